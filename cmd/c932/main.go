@@ -0,0 +1,408 @@
+// The c932 command loads a program into an emulated Censor 932 and
+// runs it.
+//
+// The machine is either described by a configuration file (see the
+// config package), or is a single CPU with local memory, into which
+// an image is loaded (see the memimage package). A raw image of
+// big-endian half-words is loaded at -load, while .hex and .lst
+// images hold their own addresses. IC starts at the lowest address
+// loaded, or where a .hex image says:
+//
+//	c932 -config installation.json -limit 100000
+//	c932 -image prog.bin -load 0x100 -trace -dump
+//	c932 -image prog.hex -ic 0x100
+//
+// The run ends when every CPU has halted (jumped to itself with
+// nothing left to wait for), when a CPU takes a trap, or when the
+// instruction limit is reached, and the exit status tells which:
+// 0 for halt, 3 for a trap, 4 for the limit. Setup errors exit with
+// 1, and bad usage with 2.
+//
+// With -do or -monitor, the machine is instead handed to the SIMH
+// style command interpreter (see the monitor package), which runs a
+// script, or reads commands from standard input, or both. Without
+// -config or -image, the machine is then a single CPU with all of
+// its address space filled with memory:
+//
+//	c932 -image prog.bin -do setup.do -monitor
+//
+// With -gdb, the command instead waits for a GDB remote protocol
+// client on the given address, and lets it debug CPU 0 (see the
+// gdbstub package):
+//
+//	c932 -config installation.json -gdb localhost:1234
+//
+// With -dap, it instead waits for a Debug Adapter Protocol client,
+// such as an editor, on the given address (see the dap package). The
+// client can then attach to the machine given by -config or -image,
+// or launch one of its own:
+//
+//	c932 -dap localhost:4711
+//
+// With -history, each CPU keeps a journal of its last instructions,
+// so that the monitor and the debuggers can step backwards:
+//
+//	c932 -image prog.bin -history 100000 -gdb localhost:1234
+//
+// With -recorder, each CPU keeps its last few instructions, and
+// prints them, disassembled, to standard error when it traps.
+//
+// With -symbols, addresses are named after the symbols in a debug
+// information file, as written by c932as -g: in -trace output, in
+// recorder dumps, in the monitor and in the debuggers. -ic can then
+// be symbolic too:
+//
+//	c932 -image prog.bin -symbols prog.dbg -ic START -trace
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/dap"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/gdbstub"
+	"github.com/vatine/censor932/pkg/memimage"
+	"github.com/vatine/censor932/pkg/monitor"
+)
+
+// Exit statuses.
+const (
+	exitHalt  = 0
+	exitError = 1
+	exitUsage = 2
+	exitTrap  = 3
+	exitLimit = 4
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Parse a number in any base strconv.ParseUint understands.
+func parseNumber(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Bad number %q", s)
+	}
+	return uint32(v), nil
+}
+
+// Parse an address range, written as low-high.
+func parseRange(s string) (cpu.MemoryRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return cpu.MemoryRange{}, fmt.Errorf("Bad range %q, expected low-high", s)
+	}
+	low, err := parseNumber(parts[0])
+	if err != nil {
+		return cpu.MemoryRange{}, err
+	}
+	high, err := parseNumber(parts[1])
+	if err != nil {
+		return cpu.MemoryRange{}, err
+	}
+	if low > high {
+		return cpu.MemoryRange{}, fmt.Errorf("Bad range %q, low is above high", s)
+	}
+	return cpu.MemoryRange{Low: low, High: high}, nil
+}
+
+// Build a machine with a single CPU, with size half-words of local
+// memory, holding the image (if any). A raw image goes at address
+// load, and the others where they say.
+func imageMachine(path string, size, load uint32) (*config.Machine, error) {
+	if path == "" {
+		return config.ImageMachine(nil, size, load)
+	}
+	img, err := memimage.ReadFile(path, load)
+	if err != nil {
+		return nil, err
+	}
+	m, err := config.LoadedMachine(img, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Print the registers of a CPU.
+func dumpRegisters(w io.Writer, c *cpu.CPU) {
+	fmt.Fprintf(w, "CPU %d: IC %05x CC %d PS %016x MIR %06x cycles %d\n", c.ID, c.IC, c.CC, c.PS, c.MIR, c.Cycles)
+	for ix, g := range c.G {
+		sep := " "
+		if ix%4 == 3 {
+			sep = "\n"
+		}
+		fmt.Fprintf(w, "  G%-2d %08x%s", ix, g, sep)
+	}
+}
+
+// Print the memory of a CPU in the given range, eight half-words to a
+// line, skipping unmapped addresses. Memory is looked at the way a
+// debugger does, so that dumping it does not count as accesses, or
+// latch the real-time clock.
+func dumpMemory(w io.Writer, c *cpu.CPU, r cpu.MemoryRange) {
+	line := []string{}
+	start := r.Low
+	flush := func() {
+		if len(line) > 0 {
+			fmt.Fprintf(w, "CPU %d %05x: %s\n", c.ID, start, strings.Join(line, " "))
+		}
+		line = line[:0]
+	}
+	for addr := uint64(r.Low); addr <= uint64(r.High); addr++ {
+		a := uint32(addr)
+		v, ok := c.Peek(a)
+		if !ok {
+			flush()
+			continue
+		}
+		if len(line) == 0 {
+			start = a
+		}
+		line = append(line, fmt.Sprintf("%04x", v))
+		if len(line) == 8 {
+			flush()
+		}
+	}
+	flush()
+}
+
+// Hand the machine to the command interpreter. Interrupting the
+// process stops a running GO or STEP, rather than the process.
+func interact(m *config.Machine, debug *debuginfo.Info, script string, interactive bool, stdin io.Reader, stdout, stderr io.Writer) int {
+	mon := monitor.New(m, stdout)
+	if debug != nil {
+		mon.Symbols = &debug.SymbolTable
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			mon.Interrupt()
+		}
+	}()
+
+	if script != "" {
+		if err := mon.Do(script); err != nil {
+			fmt.Fprintln(stderr, err)
+			if !interactive {
+				return exitError
+			}
+		}
+	}
+	if interactive && !mon.Done() {
+		mon.Prompt = "sim> "
+		if err := mon.Run(stdin); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	return exitHalt
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("c932", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", "", "Machine configuration `file`")
+	imageFile := flags.String("image", "", "Image `file` to load into a single CPU, raw, .hex or .lst")
+	memory := flags.String("memory", "0x40000", "Half-words of memory, with -image")
+	load := flags.String("load", "0", "Address to load a raw image at, with -image")
+	ic := flags.String("ic", "", "Start IC of CPU 0 (defaults to the boot address, or the load address)")
+	limit := flags.Uint64("limit", 0, "Stop after this many instructions per CPU (0 for no limit)")
+	trace := flags.Bool("trace", false, "Print each instruction executed to stderr")
+	dump := flags.Bool("dump", false, "Print the registers of each CPU at the end")
+	dumpMem := flags.String("dump-memory", "", "Print memory in the `range` low-high of each CPU at the end")
+	script := flags.String("do", "", "Run the monitor commands in `file`")
+	interactive := flags.Bool("monitor", false, "Read monitor commands from standard input")
+	gdb := flags.String("gdb", "", "Serve a gdb client on `address`, such as localhost:1234")
+	dapAddr := flags.String("dap", "", "Serve a Debug Adapter Protocol client on `address`, such as localhost:4711")
+	recorder := flags.Int("recorder", 0, "Print the last `n` instructions of a CPU when it traps")
+	history := flags.Int("history", 0, "Keep this many instructions per CPU, for stepping backwards")
+	symbols := flags.String("symbols", "", "Name addresses after the symbols in debug information `file`")
+	verbose := flags.Bool("v", false, "Enable debug logging")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	monitoring := *interactive || *script != ""
+	if flags.NArg() > 0 || (*configFile != "" && *imageFile != "") || (!monitoring && *dapAddr == "" && *configFile == "" && *imageFile == "") {
+		fmt.Fprintln(stderr, "Exactly one of -config and -image is needed")
+		flags.Usage()
+		return exitUsage
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	var dumpRange *cpu.MemoryRange
+	if *dumpMem != "" {
+		r, err := parseRange(*dumpMem)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		dumpRange = &r
+	}
+
+	var debug *debuginfo.Info
+	if *symbols != "" {
+		var err error
+		if debug, err = debuginfo.Load(*symbols); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	if *dapAddr != "" && *configFile == "" && *imageFile == "" {
+		if err := dap.NewServer(nil, debug).ListenAndServe(*dapAddr); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		return exitHalt
+	}
+
+	var m *config.Machine
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if m, err = cfg.Build(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	} else {
+		size, err := parseNumber(*memory)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		at, err := parseNumber(*load)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		if size == 0 || size > 0x40000 {
+			fmt.Fprintf(stderr, "Memory size 0x%x is outside the address space\n", size)
+			return exitUsage
+		}
+		if m, err = imageMachine(*imageFile, size, at); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	s := m.System
+	defer s.Close()
+
+	if *ic != "" {
+		v, err := parseNumber(*ic)
+		if err != nil && debug != nil {
+			v, err = debug.Resolve(*ic, func(n string) (uint64, error) {
+				v, err := parseNumber(n)
+				return uint64(v), err
+			})
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		s.CPUs[0].IC = v
+	}
+
+	if *recorder > 0 {
+		for _, c := range s.CPUs {
+			c.Recorder = cpu.NewFlightRecorder(*recorder)
+			c.Recorder.Out = stderr
+			if debug != nil {
+				c.Recorder.Names = debug.Name
+			}
+		}
+	}
+	if *history > 0 {
+		for _, c := range s.CPUs {
+			c.Journal = cpu.NewJournal(*history)
+		}
+	}
+
+	if *trace {
+		var mu sync.Mutex
+		for _, c := range s.CPUs {
+			c.Trace = func(c *cpu.CPU, ic, word uint32) {
+				mu.Lock()
+				defer mu.Unlock()
+				if debug != nil {
+					text := cpu.DisassembleSymbolic(ic, word, debug.Name)
+					if name := debug.Name(ic); name != "" {
+						text = name + ": " + text
+					}
+					fmt.Fprintf(stderr, "%d %05x %08x %s cc=%d cycles=%d\n", c.ID, ic, word, text, c.CC, c.Cycles)
+					return
+				}
+				fmt.Fprintf(stderr, "%d %05x %08x cc=%d cycles=%d\n", c.ID, ic, word, c.CC, c.Cycles)
+			}
+		}
+	}
+
+	if *gdb != "" {
+		if err := gdbstub.NewServer(s, 0).ListenAndServe(*gdb); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		return exitHalt
+	}
+	if *dapAddr != "" {
+		if err := dap.NewServer(m, debug).ListenAndServe(*dapAddr); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		return exitHalt
+	}
+	if monitoring {
+		return interact(m, debug, *script, *interactive, stdin, stdout, stderr)
+	}
+
+	steps := *limit
+	if steps == 0 {
+		steps = math.MaxUint64
+	}
+	s.RunUntil(steps, func(c *cpu.CPU) bool {
+		return c.Trap != nil || c.Halted()
+	})
+
+	status := exitHalt
+	for _, c := range s.CPUs {
+		switch {
+		case c.Trap != nil:
+			fmt.Fprintf(stderr, "CPU %d trapped: %v\n", c.ID, c.Trap)
+			status = exitTrap
+		case !c.Halted() && status == exitHalt:
+			status = exitLimit
+		}
+	}
+	if status == exitLimit {
+		fmt.Fprintf(stderr, "Instruction limit of %d reached\n", *limit)
+	}
+
+	for _, c := range s.CPUs {
+		if *dump {
+			dumpRegisters(stdout, c)
+		}
+		if dumpRange != nil {
+			dumpMemory(stdout, c, *dumpRange)
+		}
+	}
+	return status
+}
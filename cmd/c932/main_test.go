@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/device"
+	"github.com/vatine/censor932/pkg/memimage"
+)
+
+// Write an image of the given words to a temporary file.
+func writeImage(t *testing.T, dir string, words ...uint32) string {
+	data := []byte{}
+	for _, w := range words {
+		data = append(data, byte(w>>24), byte(w>>16), byte(w>>8), byte(w))
+	}
+	path := filepath.Join(dir, "prog.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unexpected error writing image, %v", err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "c932")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var debug debuginfo.Info
+	debug.AddSymbol(debuginfo.Symbol{Name: "START", Kind: debuginfo.Code, Value: 0x10})
+	debug.AddSymbol(debuginfo.Symbol{Name: "DONE", Kind: debuginfo.Code, Value: 0x12})
+	symbols := filepath.Join(dir, "prog.dbg")
+	if err := debug.Save(symbols); err != nil {
+		t.Fatalf("Unexpected error writing symbols, %v", err)
+	}
+
+	cases := []struct {
+		words  []uint32
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		// LD G1, 0x1234; JS G3 to itself
+		{[]uint32{0x98101234, 0x01300000}, []string{"-dump"}, exitHalt, "G1  00001234", ""},
+		// LW G1 <- 0x100, outside memory
+		{[]uint32{0x58100100}, []string{"-memory", "0x10"}, exitTrap, "", "No memory at address 0x00100"},
+		{[]uint32{0xff000000}, nil, exitTrap, "", "Non-existent instruction"},
+		{[]uint32{0x98101234, 0xff000000}, []string{"-recorder", "4"}, exitTrap, "", "last 2 instructions:\n  00000 98101234 LD 1,0x1234              G1=00001234\n  00002 ff000000 .WORD 0xff000000\n"},
+		// NOP; NOP; ...
+		{[]uint32{0, 0, 0, 0}, []string{"-limit", "3"}, exitLimit, "", "limit of 3"},
+		{[]uint32{0x98101234, 0x50100010}, []string{"-load", "0x10", "-limit", "2", "-dump-memory", "0x20-0x23", "-trace"}, exitLimit, "CPU 0 00020: 0000 0000 0000 1234", "0 00010 98101234"},
+		{[]uint32{0x98101234, 0x01300000}, []string{"-load", "0x10", "-ic", "START", "-symbols", symbols, "-trace"}, exitHalt, "", "0 00012 01300000 DONE: JS 3,DONE cc=0"},
+	}
+
+	for ix, tc := range cases {
+		args := append([]string{"-image", writeImage(t, dir, tc.words...)}, tc.args...)
+		var stdout, stderr bytes.Buffer
+		status := run(args, nil, &stdout, &stderr)
+		if status != tc.status {
+			t.Errorf("Case #%d, exit status %d, expected %d (stderr %q)", ix, status, tc.status, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), tc.stdout) {
+			t.Errorf("Case #%d, stdout %q does not contain %q", ix, stdout.String(), tc.stdout)
+		}
+		if !strings.Contains(stderr.String(), tc.stderr) {
+			t.Errorf("Case #%d, stderr %q does not contain %q", ix, stderr.String(), tc.stderr)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "c932")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// LD G1, 0x1234; JS G3 to itself, at 0x200, in three formats.
+	img := memimage.NewImage(0x200, []uint16{0x9810, 0x1234, 0x0130, 0x0000})
+	for _, name := range []string{"prog.bin", "prog.hex", "prog.lst"} {
+		path := filepath.Join(dir, name)
+		if err := img.WriteFile(path); err != nil {
+			t.Fatalf("Unexpected error writing %s, %v", name, err)
+		}
+		var stdout, stderr bytes.Buffer
+		if status := run([]string{"-image", path, "-load", "0x200", "-dump"}, nil, &stdout, &stderr); status != exitHalt {
+			t.Errorf("%s: exit status %d, expected %d (stderr %q)", name, status, exitHalt, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "IC 00202") || !strings.Contains(stdout.String(), "G1  00001234") {
+			t.Errorf("%s: output %q", name, stdout.String())
+		}
+	}
+}
+
+// Dumping memory only looks at it, so a real-time clock in the range
+// is not latched.
+func TestDumpMemory(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 3}, cpu.NewDirectMemory(4))
+	rtc := device.NewRTC(c, 1)
+	c.RegisterMemory(cpu.MemoryRange{Low: 0x10, High: 0x13}, rtc)
+	c.StoreWord(0, 0x12345678)
+	c.Cycles = 0x42
+
+	var b bytes.Buffer
+	dumpMemory(&b, c, cpu.MemoryRange{Low: 0, High: 0x1f})
+	expected := "CPU 0 00000: 1234 5678 0000 0000\nCPU 0 00010: 0000 0000 0000 0000\n"
+	if b.String() != expected {
+		t.Errorf("Dump is %q, expected %q", b.String(), expected)
+	}
+	if v, _ := c.PeekWord(0x12); v != 0 {
+		t.Errorf("The clock was latched at 0x%x by the dump", v)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if status := run(nil, nil, &stdout, &stderr); status != exitUsage {
+		t.Errorf("Exit status %d without arguments, expected %d", status, exitUsage)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "c932")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "setup.do")
+	if err := ioutil.WriteFile(script, []byte("dep -w 0 98101234\ndep -w 2 01300000\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing script, %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"-do", script, "-monitor"}, strings.NewReader("go\nex g1\nquit\n"), &stdout, &stderr)
+	if status != exitHalt {
+		t.Errorf("Exit status %d, expected %d (stderr %q)", status, exitHalt, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "G1:\t00001234") {
+		t.Errorf("Output %q does not show G1", stdout.String())
+	}
+}
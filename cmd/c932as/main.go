@@ -0,0 +1,156 @@
+// The c932as command assembles a Censor 932 source file (see the asm
+// package) into a raw image of big-endian half-words, which c932 can
+// load:
+//
+//	c932as -o prog.bin -g prog.dbg prog.s
+//	c932 -image prog.bin -load 0x100 -symbols prog.dbg
+//
+// The image starts at the lowest address assembled, which is printed
+// along with its size, and has to be given to c932 as -load. If -o
+// ends in .hex or .lst, the image is instead written in that format
+// (see the memimage package), holding its own addresses. With -g,
+// the symbols and line numbers go to a debug information file, for
+// c932 -symbols, the monitor's SYMBOLS command and the debuggers.
+//
+// With -c, the source is instead assembled into a relocatable object
+// (see the obj package), by default the source with .o, for c932ld to
+// link with others. -g does not apply then, as the linker writes the
+// debug information:
+//
+//	c932as -c main.s
+//	c932ld -o prog.bin -g prog.dbg main.o lib.o
+//
+// With -l, a listing of the source goes to a file as well, showing
+// what each line assembled to, with macros and repeats expanded, any
+// errors in it, and a cross-reference of where each symbol is defined
+// and used. It is written even if the source does not assemble, to
+// help find out why. If the file ends in .json, the listing is
+// written as JSON (see asm.Listing), for editors and other tools.
+//
+// With -isa, c932as prints the instruction set as JSON instead (see
+// cpu.Spec), for editors and other tools that want the mnemonics.
+//
+// The exit status is 0 if the source assembled, 1 if it did not, and 2
+// for bad usage.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/asm"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/memimage"
+)
+
+// Exit statuses.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("c932as", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	out := flags.String("o", "", "Image or object `file` to write (defaults to the source, with .bin or .o)")
+	debug := flags.String("g", "", "Debug information `file` to write")
+	object := flags.Bool("c", false, "Write a relocatable object, rather than an image")
+	listing := flags.String("l", "", "Listing `file` to write")
+	isa := flags.Bool("isa", false, "Print the instruction set as JSON, and exit")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *isa {
+		if err := cpu.WriteISA(stdout); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		return exitOK
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "Exactly one source file is needed")
+		flags.Usage()
+		return exitUsage
+	}
+	source := flags.Arg(0)
+	if *object && *debug != "" {
+		fmt.Fprintln(stderr, "-g cannot be combined with -c, give it to c932ld instead")
+		return exitUsage
+	}
+	if *out == "" {
+		ext := ".bin"
+		if *object {
+			ext = ".o"
+		}
+		*out = strings.TrimSuffix(source, filepath.Ext(source)) + ext
+	}
+	if *listing != "" {
+		if err := writeListing(*listing, source, *object); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	if *object {
+		o, err := asm.AssembleObjectFile(source)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		if err := o.Save(*out); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "%s: %d sections, %d symbols\n", *out, len(o.Sections), len(o.Symbols))
+		return exitOK
+	}
+
+	p, err := asm.AssembleFile(source)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	img := memimage.NewImage(p.Origin, p.Image)
+	img.Names = p.Debug.Name
+	if err := img.WriteFile(*out); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if *debug != "" {
+		if err := p.Debug.Save(*debug); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	fmt.Fprintf(stdout, "%s: 0x%x half-words at 0x%05x\n", *out, len(p.Image), p.Origin)
+	return exitOK
+}
+
+// Write the listing of a source file. Assembly errors are left to be
+// reported when assembling for real.
+func writeListing(path, source string, object bool) error {
+	l, _ := asm.ListFile(source, object)
+	if l == nil {
+		return nil
+	}
+	var b bytes.Buffer
+	write := l.Write
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		write = l.WriteJSON
+	}
+	if err := write(&b); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/asm"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "c932as")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "prog.s")
+	if err := ioutil.WriteFile(source, []byte("  .ORG 0x10\nSTART: LD 1,0x1234\nDONE: JS 3,DONE\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing source, %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	debug := filepath.Join(dir, "prog.dbg")
+	if status := run([]string{"-g", debug, source}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	image := filepath.Join(dir, "prog.bin")
+	if !strings.Contains(stdout.String(), image+": 0x4 half-words at 0x00010") {
+		t.Errorf("Output %q does not give the origin", stdout.String())
+	}
+	data, err := config.ReadImage(image)
+	if err != nil || len(data) != 4 || data[0] != 0x9810 || data[2] != 0x0130 {
+		t.Errorf("Image is %04x (%v)", data, err)
+	}
+	info, err := debuginfo.Load(debug)
+	if err != nil {
+		t.Fatalf("Unexpected error loading debug information, %v", err)
+	}
+	if info.Name(0x13) != "DONE+1" {
+		t.Errorf("Address 00013 is %q, expected DONE+1", info.Name(0x13))
+	}
+
+	listing := filepath.Join(dir, "prog.lst")
+	if status := run([]string{"-o", listing, source}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	text, err := ioutil.ReadFile(listing)
+	if err != nil || string(text) != "00010: 9810 1234     ; LD 1,0x1234\n00012: 0130 0000     ; JS 3,DONE\n" {
+		t.Errorf("Listing is %q (%v)", text, err)
+	}
+
+	stderr.Reset()
+	if err := ioutil.WriteFile(source, []byte("  FROB\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing source, %v", err)
+	}
+	sourceListing := filepath.Join(dir, "prog.txt")
+	if status := run([]string{"-l", sourceListing, source}, &stdout, &stderr); status != exitError || !strings.Contains(stderr.String(), "prog.s:1: Unknown instruction FROB") {
+		t.Errorf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	text, err = ioutil.ReadFile(sourceListing)
+	if err != nil || !strings.HasSuffix(string(text), "     1  00000                        FROB\n*****   Unknown instruction FROB\n") {
+		t.Errorf("Source listing is %q (%v)", text, err)
+	}
+	jsonListing := filepath.Join(dir, "prog.json")
+	if status := run([]string{"-l", jsonListing, source}, &stdout, &stderr); status != exitError {
+		t.Errorf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	var l asm.Listing
+	if text, err = ioutil.ReadFile(jsonListing); err == nil {
+		err = json.Unmarshal(text, &l)
+	}
+	if err != nil || len(l.Lines) != 1 || len(l.Lines[0].Errors) != 1 {
+		t.Errorf("JSON listing is %q (%v)", text, err)
+	}
+	stdout.Reset()
+	if err := ioutil.WriteFile(source, []byte("  .EXTERN X\n  .GLOBAL START\nSTART: LW 1,X\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing source, %v", err)
+	}
+	if status := run([]string{"-c", source}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	o, err := obj.Load(filepath.Join(dir, "prog.o"))
+	if err != nil {
+		t.Fatalf("Unexpected error loading object, %v", err)
+	}
+	if len(o.Sections) != 1 || len(o.Sections[0].Relocations) != 1 || o.Sections[0].Relocations[0].Symbol != "X" {
+		t.Errorf("Object is %+v", o)
+	}
+	if status := run([]string{"-c", "-g", debug, source}, &stdout, &stderr); status != exitUsage {
+		t.Errorf("Exit status %d for -c with -g, expected %d", status, exitUsage)
+	}
+	stdout.Reset()
+	var specs []cpu.Spec
+	if status := run([]string{"-isa"}, &stdout, &stderr); status != exitOK {
+		t.Errorf("Exit status %d for -isa, stderr %q", status, stderr.String())
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &specs); err != nil || len(specs) != len(cpu.ISA()) {
+		t.Errorf("Instruction set is %q (%v)", stdout.String(), err)
+	}
+	if status := run(nil, &stdout, &stderr); status != exitUsage {
+		t.Errorf("Exit status %d without arguments, expected %d", status, exitUsage)
+	}
+}
@@ -0,0 +1,212 @@
+// The c932ld command links relocatable objects, as written by
+// c932as -c, into a raw image of big-endian half-words (see the link
+// package):
+//
+//	c932as -c main.s
+//	c932as -c lib.s
+//	c932ld -o prog.bin -g prog.dbg -map prog.map main.o lib.o
+//
+// Shared sections go into the -shared ranges, and all others into the
+// -local ones, both given as low-high pairs separated by commas. The
+// local ranges default to the whole address space, so -shared needs
+// -local as well. The ranges can instead be taken from the local and
+// shared memory of a CPU in a configuration:
+//
+//	c932ld -config installation.json -cpu 1 -o cpu1.bin main.o lib.o
+//
+// The image starts at the lowest address linked, which is printed
+// along with its size, and has to be given to c932 as -load, unless
+// -o ends in .hex or .lst for one of the formats with addresses (see
+// the memimage package). Those keep each section where it goes, and
+// leave out the memory between them. A raw image can only fill the
+// gaps with zeros, so it is refused if a gap is not all in the given
+// ranges. With -g, the symbols and line numbers of all the objects go
+// to a debug information file, and with -map, a link map saying where
+// each section and symbol went is written.
+//
+// The exit status is 0 if the objects linked, 1 if they did not, and
+// 2 for bad usage.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/link"
+	"github.com/vatine/censor932/pkg/memimage"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+// Exit statuses.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Parse ranges, such as 0x100-0xfff,0x10000-0x1ffff.
+func parseRanges(s string) ([]cpu.MemoryRange, error) {
+	var rv []cpu.MemoryRange
+	if strings.TrimSpace(s) == "" {
+		return rv, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Bad range %s, expected low-high", r)
+		}
+		low, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad range %s, %v", r, err)
+		}
+		high, err := strconv.ParseUint(strings.TrimSpace(bounds[1]), 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad range %s, %v", r, err)
+		}
+		rv = append(rv, cpu.MemoryRange{Low: uint32(low), High: uint32(high)})
+	}
+	return rv, nil
+}
+
+// Take the layout from the memory of a CPU in a configuration.
+func configLayout(path string, cix int) (link.Layout, error) {
+	var rv link.Layout
+	c, err := config.Load(path)
+	if err != nil {
+		return rv, err
+	}
+	if err := c.Validate(); err != nil {
+		return rv, fmt.Errorf("%s: %v", path, err)
+	}
+	if cix < 0 || cix >= len(c.CPUs) {
+		return rv, fmt.Errorf("%s: No CPU #%d, there are %d CPUs", path, cix, len(c.CPUs))
+	}
+	for _, l := range c.CPUs[cix].Local {
+		rv.Local = append(rv.Local, cpu.MemoryRange{Low: uint32(l.Low), High: uint32(l.High)})
+	}
+	for _, s := range c.Shared {
+		visible := len(s.CPUs) == 0
+		for _, n := range s.CPUs {
+			visible = visible || n == cix
+		}
+		if visible {
+			rv.Shared = append(rv.Shared, cpu.MemoryRange{Low: uint32(s.Low), High: uint32(s.High)})
+		}
+	}
+	return rv, nil
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("c932ld", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	out := flags.String("o", "", "Image `file` to write, raw, .hex or .lst (defaults to the first object, with .bin)")
+	debug := flags.String("g", "", "Debug information `file` to write")
+	mapFile := flags.String("map", "", "Link map `file` to write")
+	local := flags.String("local", "0-0x3ffff", "Local memory `ranges`, as low-high,...")
+	shared := flags.String("shared", "", "Shared memory `ranges`, as low-high,...")
+	configFile := flags.String("config", "", "Take the ranges from a configuration `file`")
+	cix := flags.Int("cpu", 0, "The CPU whose memory -config describes")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "At least one object is needed")
+		flags.Usage()
+		return exitUsage
+	}
+
+	var layout link.Layout
+	if *configFile != "" {
+		set := false
+		flags.Visit(func(f *flag.Flag) { set = set || f.Name == "local" || f.Name == "shared" })
+		if set {
+			fmt.Fprintln(stderr, "-config cannot be combined with -local or -shared")
+			return exitUsage
+		}
+		var err error
+		if layout, err = configLayout(*configFile, *cix); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	} else {
+		var err error
+		if layout.Local, err = parseRanges(*local); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		if layout.Shared, err = parseRanges(*shared); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if *out == "" {
+		first := flags.Arg(0)
+		*out = strings.TrimSuffix(first, filepath.Ext(first)) + ".bin"
+	}
+
+	var objects []*obj.Object
+	for _, path := range flags.Args() {
+		o, err := obj.Load(path)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		objects = append(objects, o)
+	}
+	r, err := link.Link(objects, layout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if memimage.FormatOf(*out) == memimage.Raw {
+		segments := r.Memory.Segments
+		for ix := 1; ix < len(segments); ix++ {
+			before, after := segments[ix-1], segments[ix]
+			end := before.Address + uint32(len(before.Data))
+			if !layout.Covers(end, after.Address-1) {
+				fmt.Fprintf(stderr, "Sections at 0x%05x and 0x%05x leave unmapped memory between them, which a raw image cannot hold; write .hex or .lst instead\n", before.Address, after.Address)
+				return exitError
+			}
+		}
+	}
+	img := r.Memory
+	img.Names = r.Debug.Name
+	if err := img.WriteFile(*out); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if *debug != "" {
+		if err := r.Debug.Save(*debug); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	if *mapFile != "" {
+		f, err := os.Create(*mapFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		err = r.Map.Write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	fmt.Fprintf(stdout, "%s: 0x%x half-words at 0x%05x\n", *out, len(r.Image), r.Origin)
+	return exitOK
+}
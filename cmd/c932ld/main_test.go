@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/asm"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/memimage"
+)
+
+// Assemble a source into an object in dir, returning its path.
+func object(t *testing.T, dir, name, source string) string {
+	path := filepath.Join(dir, name+".s")
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("Unexpected error writing source, %v", err)
+	}
+	o, err := asm.AssembleObjectFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error assembling %s, %v", path, err)
+	}
+	path = filepath.Join(dir, name+".o")
+	if err := o.Save(path); err != nil {
+		t.Fatalf("Unexpected error saving %s, %v", path, err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "c932ld")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	main := object(t, dir, "main", "  .EXTERN COUNT\nSTART: LW 1,COUNT\nDONE: JS 3,DONE\n")
+	lib := object(t, dir, "lib", "  .GLOBAL COUNT\n  .SECTION common,SHARED\nCOUNT: .WORD 42\n")
+
+	var stdout, stderr bytes.Buffer
+	debug := filepath.Join(dir, "prog.dbg")
+	linkMap := filepath.Join(dir, "prog.map")
+	args := []string{"-local", "0x100-0xfff", "-shared", "0x1000-0x1fff", "-g", debug, "-map", linkMap, main, lib}
+	if status := run(args, &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	image := filepath.Join(dir, "main.bin")
+	if !strings.Contains(stdout.String(), image+": 0xf02 half-words at 0x00100") {
+		t.Errorf("Output %q does not give the origin", stdout.String())
+	}
+	data, err := config.ReadImage(image)
+	if err != nil || len(data) != 0xf02 || data[0] != 0x5810 || data[1] != 0x0f00 || data[0xf01] != 42 {
+		t.Errorf("Image is %04x... (%v)", data[:4], err)
+	}
+	info, err := debuginfo.Load(debug)
+	if err != nil {
+		t.Fatalf("Unexpected error loading debug information, %v", err)
+	}
+	if info.Name(0x1001) != "COUNT+1" || info.Name(0x102) != "DONE" {
+		t.Errorf("Addresses 01001 and 00102 are %q and %q", info.Name(0x1001), info.Name(0x102))
+	}
+	text, err := ioutil.ReadFile(linkMap)
+	if err != nil || !strings.Contains(string(text), "common       shared  01000-01001  0x2") {
+		t.Errorf("Link map is %q (%v)", text, err)
+	}
+
+	// The same layout, from a configuration.
+	conf := filepath.Join(dir, "installation.json")
+	spec := `{"cpus": [{"local": [{"low": 0, "high": "0xfff"}]}, {"local": [{"low": "0x100", "high": "0xfff"}], "boot": {"ic": "0x100"}}],
+	          "shared": [{"low": "0x1000", "high": "0x1fff"}]}`
+	if err := ioutil.WriteFile(conf, []byte(spec), 0644); err != nil {
+		t.Fatalf("Unexpected error writing configuration, %v", err)
+	}
+	stdout.Reset()
+	out := filepath.Join(dir, "cpu1.bin")
+	if status := run([]string{"-config", conf, "-cpu", "1", "-o", out, main, lib}, &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), out+": 0xf02 half-words at 0x00100") {
+		t.Errorf("Output %q does not give the origin", stdout.String())
+	}
+
+	// Shared memory away from the local memory leaves a gap that a raw
+	// image would have to fill.
+	apart := []string{"-local", "0x100-0xfff", "-shared", "0x10000-0x1ffff"}
+	stderr.Reset()
+	if status := run(append(apart, main, lib), &stdout, &stderr); status != exitError || !strings.Contains(stderr.String(), "Sections at 0x00100 and 0x10000 leave unmapped memory between them") {
+		t.Errorf("Exit status %d, stderr %q, expected the raw image to be refused", status, stderr.String())
+	}
+	hex := filepath.Join(dir, "apart.hex")
+	if status := run(append(apart, "-o", hex, main, lib), &stdout, &stderr); status != exitOK {
+		t.Fatalf("Exit status %d, stderr %q", status, stderr.String())
+	}
+	img, err := memimage.ReadFile(hex, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s, %v", hex, err)
+	}
+	if s := img.Segments; len(s) != 2 || s[0].Address != 0x100 || len(s[0].Data) != 4 || s[1].Address != 0x10000 || s[1].Data[1] != 42 {
+		t.Errorf("Segments are %+v", s)
+	}
+
+	cases := []struct {
+		args     []string
+		status   int
+		expected string
+	}{
+		{[]string{main}, exitError, "Undefined symbol COUNT"},
+		{[]string{main, lib}, exitError, "Section common, of 0x2 half-words, does not fit in shared memory"},
+		{[]string{"-shared", "0x100-0x1ff", main, lib}, exitError, "Ranges 0x00000-0x3ffff and 0x00100-0x001ff overlap"},
+		{[]string{"-local", "0x100", main}, exitUsage, "Bad range 0x100, expected low-high"},
+		{[]string{"-config", conf, "-cpu", "2", main}, exitError, "No CPU #2, there are 2 CPUs"},
+		{[]string{"-config", conf, "-local", "0-0xfff", main}, exitUsage, "-config cannot be combined with -local or -shared"},
+		{nil, exitUsage, "At least one object is needed"},
+	}
+	for ix, tc := range cases {
+		stderr.Reset()
+		if status := run(tc.args, &stdout, &stderr); status != tc.status || !strings.Contains(stderr.String(), tc.expected) {
+			t.Errorf("Case #%d, exit status %d, stderr %q, expected %d and %q", ix, status, stderr.String(), tc.status, tc.expected)
+		}
+	}
+}
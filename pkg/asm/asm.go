@@ -0,0 +1,789 @@
+// The asm package assembles Censor 932 source, either into an
+// absolute image, along with debug information (see the debuginfo
+// package) naming its addresses and mapping them back to source
+// lines, or into a relocatable object (see the obj package) for the
+// linker.
+//
+// Each line holds at most one statement, which can be preceded by
+// labels, each ending in a colon. Everything after a semicolon is a
+// comment. Mnemonics and directives are case insensitive, symbols are
+// not. Instructions are written the way the disassembler shows them:
+//
+//	LOOP:   LW    1,*PTR(2)     ; type1: r,[*]address[(x)]
+//	        AS    1,2,SUM       ; type2: r1,r2[,address]
+//	        LD    1,0x1234      ; type3: r1[,r2],d
+//	        NOP
+//
+// The addresses of type1 and type2 instructions are absolute, and are
+// assembled relative to the instruction, so they can only be up to
+// 0xffff half-words after it; go further, or backwards, through an
+// indirect word. The directives are:
+//
+//	        .ORG     address    ; Continue assembling at address
+//	        .WORD    expr,...   ; 32-bit words
+//	        .HALF    expr,...   ; Half-words
+//	        .SPACE   n          ; n half-words of zeroes
+//	NAME    .EQU     expr       ; Define a constant
+//	        .SECTION name[,SHARED]
+//	        .GLOBAL  name,...   ; Let other objects use symbols
+//	        .EXTERN  name,...   ; Use symbols from other objects
+//
+// Operands are expressions (see expr.go). The operands of .ORG,
+// .SPACE and .EQU can only use symbols defined before them. There are
+// macros, conditional assembly, includes and repeats as well (see
+// macro.go), and List gives a listing of what each line assembled to.
+//
+// An absolute program can use .ORG, but not .SECTION or .EXTERN.
+// Everything assembled goes into one image, from the lowest address
+// assembled to the highest, with gaps filled with zeroes.
+//
+// An object is the other way around. Code and data go into the
+// current section, text unless .SECTION says otherwise, and the linker
+// decides where each section goes; a SHARED section goes into shared
+// memory. Type1 and type2 addresses in the same section are assembled
+// straight away, anything else that refers to an address becomes a
+// relocation.
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+const mask = 0x3ffff
+
+// The section code goes into in an object, until .SECTION.
+const defaultSection = "text"
+
+// An assembled program.
+type Program struct {
+	Origin uint32   // The address of the first half-word of Image
+	Image  []uint16 // Big-endian half-words, as config.WriteImage wants
+	Debug  *debuginfo.Info
+}
+
+// An error in a source line.
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Every error found in a source file.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := []string{}
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// A parsed source line.
+type statement struct {
+	file    string
+	line    int
+	text    string // As written, or as expanded
+	depth   int    // How deep in macro expansions and repeats
+	macro   string // The macro the statement was expanded from
+	skip    bool   // Not assembled, as in the false branch of .IF
+	labels  []string
+	name    string // What .EQU and .MACRO define
+	op      string // Mnemonic or directive, in upper case
+	args    []string
+	sect    *section // Where the statement goes, set by the first pass
+	address uint32   // Where in the section it starts
+	size    uint32
+	errs    []string // What was wrong with it, for the listing
+}
+
+// A section being assembled. An absolute program has a single
+// section, with no name, whose offsets are addresses.
+type section struct {
+	name   string
+	shared bool
+	ic     uint32 // The offset of the current statement
+	size   uint32 // The size, once the first pass is done
+	memory map[uint32]uint16
+	relocs []obj.Relocation
+}
+
+// A defined symbol.
+type symbol struct {
+	value
+	kind   debuginfo.SymbolKind
+	global bool
+	s      *statement // Where it was defined
+}
+
+type assembler struct {
+	object     bool
+	sections   []*section
+	sect       *section // The current section
+	symbols    map[string]*symbol
+	order      []string     // Symbols, in the order they were defined
+	pending    []*symbol    // Labels waiting to see what they label
+	stmts      []*statement // Everything read, after expansion
+	lines      []*statement // Instructions, in order
+	globals    []*statement
+	frames     []*frame // Where lines are being read from
+	queue      []*statement
+	conds      []*cond
+	macros     map[string]*macro
+	expansions int
+	refs       map[string][]*statement // Where each symbol is used
+	cur        *statement              // The statement being assembled
+	errs       ErrorList
+}
+
+// Assemble the source read from r into an absolute program. The file
+// name is used in errors and in the debug information.
+func Assemble(file string, r io.Reader) (*Program, error) {
+	a, err := assemble(file, r, false)
+	if err != nil {
+		return nil, err
+	}
+	return a.program(), nil
+}
+
+// Assemble the source read from r into an object.
+func AssembleObject(file string, r io.Reader) (*obj.Object, error) {
+	a, err := assemble(file, r, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.objectFile(file), nil
+}
+
+// Assemble a source file into an absolute program.
+func AssembleFile(path string) (*Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Assemble(path, f)
+}
+
+// Assemble a source file into an object.
+func AssembleObjectFile(path string) (*obj.Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return AssembleObject(path, f)
+}
+
+// Assemble, returning the assembler, with what it got done, even if
+// there are errors.
+func assemble(file string, r io.Reader, object bool) (*assembler, error) {
+	lines, err := readLines(file, r)
+	if err != nil {
+		return nil, err
+	}
+	a := &assembler{object: object, symbols: map[string]*symbol{}, macros: map[string]*macro{}, refs: map[string][]*statement{}}
+	if object {
+		a.enter(defaultSection)
+	} else {
+		a.enter("")
+	}
+	a.frames = []*frame{{lines: lines}}
+	for s := a.next(); s != nil; s = a.next() {
+		a.stmts = append(a.stmts, s)
+		if !s.skip {
+			a.cur = s
+			a.define(s)
+		}
+	}
+	a.finish()
+	a.emit()
+	if len(a.errs) > 0 {
+		return a, a.errs
+	}
+	return a, nil
+}
+
+// Read the lines of a source file.
+func readLines(file string, r io.Reader) ([]sourceLine, error) {
+	lines := []sourceLine{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		lines = append(lines, sourceLine{file: file, line: n, text: scanner.Text()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func parseLine(text string) (*statement, error) {
+	if ix := strings.Index(text, ";"); ix >= 0 {
+		text = text[:ix]
+	}
+	s := &statement{}
+	text = strings.TrimSpace(text)
+	for {
+		fields := strings.Fields(text)
+		if len(fields) == 0 || !strings.HasSuffix(fields[0], ":") {
+			break
+		}
+		name := strings.TrimSuffix(fields[0], ":")
+		if !validName(name) {
+			return nil, fmt.Errorf("Bad label %s", name)
+		}
+		s.labels = append(s.labels, name)
+		text = strings.TrimSpace(text[len(fields[0]):])
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return s, nil
+	}
+	rest := strings.TrimSpace(text[len(fields[0]):])
+	if len(fields) > 1 && (strings.EqualFold(fields[1], ".EQU") || strings.EqualFold(fields[1], ".MACRO")) {
+		if !validName(fields[0]) {
+			return nil, fmt.Errorf("Bad symbol %s", fields[0])
+		}
+		s.name = fields[0]
+		fields = fields[1:]
+		rest = strings.TrimSpace(rest[len(fields[0]):])
+	}
+	s.op = strings.ToUpper(fields[0])
+	if rest != "" {
+		for _, arg := range strings.Split(rest, ",") {
+			s.args = append(s.args, strings.TrimSpace(arg))
+		}
+	}
+	return s, nil
+}
+
+// Note an error in a statement.
+func (a *assembler) fail(s *statement, err error) {
+	if s.macro != "" {
+		err = fmt.Errorf("%v, in macro %s", err, s.macro)
+	}
+	s.errs = append(s.errs, err.Error())
+	a.errs = append(a.errs, &Error{File: s.file, Line: s.line, Err: err})
+}
+
+// Note that a statement uses a symbol.
+func (a *assembler) refer(s *statement, name string) {
+	a.refs[name] = append(a.refs[name], s)
+}
+
+// Make a section current, creating it if need be. Return whether it
+// is new.
+func (a *assembler) enter(name string) bool {
+	for _, sect := range a.sections {
+		if sect.name == name {
+			a.sect = sect
+			return false
+		}
+	}
+	a.sect = &section{name: name, memory: map[uint32]uint16{}}
+	a.sections = append(a.sections, a.sect)
+	return true
+}
+
+// Define a symbol, with the given value.
+func (a *assembler) symbol(s *statement, name string, kind debuginfo.SymbolKind, v value) *symbol {
+	if _, ok := a.symbols[name]; ok {
+		a.fail(s, fmt.Errorf("Symbol %s defined twice", name))
+		return nil
+	}
+	sym := &symbol{value: v, kind: kind, s: s}
+	a.symbols[name] = sym
+	a.order = append(a.order, name)
+	return sym
+}
+
+// Give the labels waiting for a statement their kind, now that it is
+// known what they label.
+func (a *assembler) settle(kind debuginfo.SymbolKind) {
+	for _, sym := range a.pending {
+		sym.kind = kind
+	}
+	a.pending = nil
+}
+
+// Is the directive one that reserves data?
+func isData(op string) bool {
+	return op == ".WORD" || op == ".HALF" || op == ".SPACE"
+}
+
+// The first pass: work out where a statement goes, and define its
+// labels. A label on a statement that reserves nothing labels the
+// next one that does.
+func (a *assembler) define(s *statement) {
+	s.sect, s.address = a.sect, a.sect.ic
+	size, err := a.size(s)
+	if err != nil {
+		a.fail(s, err)
+		return
+	}
+	// .ORG and .SECTION move the labels along with them.
+	s.sect, s.address = a.sect, a.sect.ic
+	for _, name := range s.labels {
+		v := value{n: int64(a.sect.ic), base: base{section: a.sect.name}}
+		if sym := a.symbol(s, name, debuginfo.Code, v); sym != nil {
+			a.pending = append(a.pending, sym)
+		}
+	}
+	if size > 0 {
+		kind := debuginfo.Code
+		if isData(s.op) {
+			kind = debuginfo.Data
+		}
+		a.settle(kind)
+	}
+	if uint64(a.sect.ic)+uint64(size) > mask+1 {
+		a.fail(s, fmt.Errorf("Assembling past the end of memory"))
+		return
+	}
+	s.size = size
+	a.sect.ic += size
+}
+
+// Finish the first pass, once every statement has been seen.
+func (a *assembler) finish() {
+	a.settle(debuginfo.Code)
+	for _, sect := range a.sections {
+		sect.size = sect.ic
+	}
+	for _, s := range a.globals {
+		for _, name := range s.args {
+			a.refer(s, name)
+			sym, ok := a.symbols[name]
+			switch {
+			case !ok:
+				a.fail(s, fmt.Errorf("Global symbol %s is not defined", name))
+			case sym.base.extern != "":
+				a.fail(s, fmt.Errorf("Symbol %s is external, and cannot be global", name))
+			default:
+				sym.global = true
+			}
+		}
+	}
+}
+
+// Return the number of half-words a statement takes, handling the
+// directives that take none.
+func (a *assembler) size(s *statement) (uint32, error) {
+	switch s.op {
+	case "":
+		return 0, nil
+	case ".EQU":
+		if s.name == "" {
+			return 0, fmt.Errorf(".EQU needs a name")
+		}
+		if len(s.args) != 1 {
+			return 0, fmt.Errorf(".EQU needs exactly one operand")
+		}
+		v, err := a.eval(s.args[0])
+		if err != nil {
+			return 0, err
+		}
+		kind := debuginfo.Constant
+		switch {
+		case v.base.extern != "":
+			return 0, fmt.Errorf("%s cannot be defined from an external symbol", s.name)
+		case !v.absolute():
+			kind = debuginfo.Data
+		}
+		a.symbol(s, s.name, kind, v)
+		return 0, nil
+	case ".ORG":
+		if a.object {
+			return 0, fmt.Errorf(".ORG cannot be used in an object, the linker places sections")
+		}
+		v, err := a.single(s)
+		if err != nil {
+			return 0, err
+		}
+		if v < 0 || v > mask {
+			return 0, fmt.Errorf("Origin 0x%x is outside the address space", v)
+		}
+		a.sect.ic = uint32(v)
+		return 0, nil
+	case ".SECTION":
+		if !a.object {
+			return 0, fmt.Errorf(".SECTION can only be used in an object")
+		}
+		if len(s.args) < 1 || len(s.args) > 2 || !validName(s.args[0]) {
+			return 0, fmt.Errorf(".SECTION needs a name, and optionally SHARED")
+		}
+		shared := len(s.args) == 2
+		if shared && !strings.EqualFold(s.args[1], "SHARED") {
+			return 0, fmt.Errorf("Unknown section flag %s", s.args[1])
+		}
+		if a.enter(s.args[0]) {
+			a.sect.shared = shared
+		} else if shared && !a.sect.shared {
+			return 0, fmt.Errorf("Section %s was not shared before", a.sect.name)
+		}
+		return 0, nil
+	case ".GLOBAL":
+		if err := a.names(s); err != nil {
+			return 0, err
+		}
+		a.globals = append(a.globals, s)
+		return 0, nil
+	case ".EXTERN":
+		if !a.object {
+			return 0, fmt.Errorf(".EXTERN can only be used in an object")
+		}
+		if err := a.names(s); err != nil {
+			return 0, err
+		}
+		for _, name := range s.args {
+			a.symbol(s, name, debuginfo.Code, value{base: base{extern: name}})
+		}
+		return 0, nil
+	case ".WORD":
+		if len(s.args) == 0 {
+			return 0, fmt.Errorf(".WORD needs at least one value")
+		}
+		return 2 * uint32(len(s.args)), nil
+	case ".HALF":
+		if len(s.args) == 0 {
+			return 0, fmt.Errorf(".HALF needs at least one value")
+		}
+		return uint32(len(s.args)), nil
+	case ".SPACE":
+		v, err := a.single(s)
+		if err != nil {
+			return 0, err
+		}
+		if v < 0 || v > mask+1 {
+			return 0, fmt.Errorf("Bad size %d", v)
+		}
+		return uint32(v), nil
+	}
+	if _, _, ok := cpu.LookupMnemonic(s.op); !ok {
+		return 0, fmt.Errorf("Unknown instruction %s", s.op)
+	}
+	return 2, nil
+}
+
+// Evaluate the single, absolute, operand of a directive.
+func (a *assembler) single(s *statement) (int64, error) {
+	if len(s.args) != 1 {
+		return 0, fmt.Errorf("%s needs exactly one operand", s.op)
+	}
+	return a.number(s.args[0])
+}
+
+// Check that the operands of a directive are symbol names.
+func (a *assembler) names(s *statement) error {
+	if len(s.args) == 0 {
+		return fmt.Errorf("%s needs at least one symbol", s.op)
+	}
+	for _, name := range s.args {
+		if !validName(name) {
+			return fmt.Errorf("Bad symbol %s", name)
+		}
+	}
+	return nil
+}
+
+// The second pass: assemble each statement.
+func (a *assembler) emit() {
+	for _, s := range a.stmts {
+		if s.skip || len(s.errs) > 0 {
+			// Whatever failed in the first pass stays unassembled,
+			// rather than fail again.
+			continue
+		}
+		a.sect = s.sect
+		a.sect.ic = s.address
+		a.cur = s
+		var err error
+		switch s.op {
+		case "", ".EQU", ".ORG", ".SECTION", ".GLOBAL", ".EXTERN":
+		case ".WORD":
+			err = a.data(s, 32)
+		case ".HALF":
+			err = a.data(s, 16)
+		case ".SPACE":
+			v, _ := a.number(s.args[0])
+			for ix := int64(0); ix < v && err == nil; ix++ {
+				err = a.store(s.address+uint32(ix), 0)
+			}
+		default:
+			var word uint32
+			if word, err = a.instruction(s); err == nil {
+				if err = a.store(s.address, uint16(word>>16)); err == nil {
+					err = a.store(s.address+1, uint16(word))
+				}
+				a.lines = append(a.lines, s)
+			}
+		}
+		if err != nil {
+			a.fail(s, err)
+		}
+	}
+}
+
+// Put a half-word in the current section, unless something is there
+// already.
+func (a *assembler) store(offset uint32, v uint16) error {
+	if _, ok := a.sect.memory[offset]; ok {
+		return fmt.Errorf("Address 0x%05x assembled twice", offset)
+	}
+	a.sect.memory[offset] = v
+	return nil
+}
+
+// Leave a value to the linker.
+func (a *assembler) relocate(offset uint32, kind obj.RelocationKind, v value) {
+	a.sect.relocs = append(a.sect.relocs, obj.Relocation{
+		Offset:  offset,
+		Kind:    kind,
+		Section: v.base.section,
+		Symbol:  v.base.extern,
+		Addend:  v.n,
+	})
+}
+
+// Evaluate a value to be stored at an offset of the current section,
+// leaving it to the linker if it is an address in an object.
+func (a *assembler) value(arg string, offset uint32, bits uint) (uint32, error) {
+	v, err := a.eval(arg)
+	if err != nil {
+		return 0, err
+	}
+	if !v.absolute() {
+		kind := obj.Absolute16
+		if bits == 32 {
+			kind = obj.Absolute32
+		}
+		a.relocate(offset, kind, v)
+		return 0, nil
+	}
+	if v.n < -(1<<(bits-1)) || v.n >= 1<<bits {
+		return 0, fmt.Errorf("Value %s does not fit in %d bits", arg, bits)
+	}
+	return uint32(v.n) & (1<<bits - 1), nil
+}
+
+// Evaluate the address field of a type1 or type2 instruction.
+func (a *assembler) relative(s *statement, arg string) (uint32, error) {
+	v, err := a.eval(arg)
+	if err != nil {
+		return 0, err
+	}
+	var as int64
+	switch {
+	case !a.object:
+		if v.n < 0 || v.n > mask {
+			return 0, fmt.Errorf("Address %s is outside the address space", arg)
+		}
+		as = (v.n - int64(s.address)) & mask
+	case v.base.section == s.sect.name:
+		as = v.n - int64(s.address)
+	default:
+		a.relocate(s.address+1, obj.Relative16, v)
+		return 0, nil
+	}
+	if as < 0 || as > 0xffff {
+		return 0, fmt.Errorf("Address %s is out of reach, it has to be at most 0xffff half-words after the instruction", arg)
+	}
+	return uint32(as), nil
+}
+
+// Assemble the values of a .WORD or .HALF.
+func (a *assembler) data(s *statement, bits uint) error {
+	offset := s.address
+	for _, arg := range s.args {
+		v, err := a.value(arg, offset, bits)
+		if err != nil {
+			return err
+		}
+		if bits == 32 {
+			if err := a.store(offset, uint16(v>>16)); err != nil {
+				return err
+			}
+			offset++
+		}
+		if err := a.store(offset, uint16(v)); err != nil {
+			return err
+		}
+		offset++
+	}
+	return nil
+}
+
+// Evaluate a register operand, which has to be below limit.
+func (a *assembler) register(arg string, limit int64) (uint32, error) {
+	v, err := a.number(arg)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v >= limit {
+		return 0, fmt.Errorf("Register %s out of range", arg)
+	}
+	return uint32(v), nil
+}
+
+// Assemble an instruction.
+func (a *assembler) instruction(s *statement) (uint32, error) {
+	op, format, _ := cpu.LookupMnemonic(s.op)
+	switch format {
+	case cpu.NoOperands:
+		if len(s.args) != 0 {
+			return 0, fmt.Errorf("%s takes no operands", s.op)
+		}
+		return cpu.EncodeNoOperands(op)
+	case cpu.Type1:
+		if len(s.args) != 2 {
+			return 0, fmt.Errorf("%s needs a register and an address", s.op)
+		}
+		r, err := a.register(s.args[0], 16)
+		if err != nil {
+			return 0, err
+		}
+		target := s.args[1]
+		i := strings.HasPrefix(target, "*")
+		target = strings.TrimPrefix(target, "*")
+		var x uint32
+		if strings.HasSuffix(target, ")") {
+			open := strings.LastIndex(target, "(")
+			if open < 0 {
+				return 0, fmt.Errorf("Bad address %s", s.args[1])
+			}
+			if x, err = a.register(target[open+1:len(target)-1], 8); err != nil {
+				return 0, err
+			}
+			target = target[:open]
+		}
+		as, err := a.relative(s, target)
+		if err != nil {
+			return 0, err
+		}
+		return cpu.EncodeType1(op, uint8(r), i, uint8(x), uint16(as))
+	case cpu.Type2:
+		if len(s.args) != 2 && len(s.args) != 3 {
+			return 0, fmt.Errorf("%s needs two registers, and optionally an address", s.op)
+		}
+		r1, err := a.register(s.args[0], 16)
+		if err != nil {
+			return 0, err
+		}
+		r2, err := a.register(s.args[1], 16)
+		if err != nil {
+			return 0, err
+		}
+		var as uint32
+		if len(s.args) == 3 {
+			if as, err = a.relative(s, s.args[2]); err != nil {
+				return 0, err
+			}
+		}
+		return cpu.EncodeType2(op, uint8(r1), uint8(r2), uint16(as))
+	default:
+		if len(s.args) != 2 && len(s.args) != 3 {
+			return 0, fmt.Errorf("%s needs a register, optionally another, and a value", s.op)
+		}
+		r1, err := a.register(s.args[0], 16)
+		if err != nil {
+			return 0, err
+		}
+		var r2 uint32
+		if len(s.args) == 3 {
+			if r2, err = a.register(s.args[1], 16); err != nil {
+				return 0, err
+			}
+		}
+		d, err := a.value(s.args[len(s.args)-1], s.address+1, 16)
+		if err != nil {
+			return 0, err
+		}
+		return cpu.EncodeType3(op, uint8(r1), uint8(r2), uint16(d))
+	}
+}
+
+// Collect what has been assembled into an absolute program.
+func (a *assembler) program() *Program {
+	debug := &debuginfo.Info{}
+	for _, name := range a.order {
+		sym := a.symbols[name]
+		debug.AddSymbol(debuginfo.Symbol{Name: name, Kind: sym.kind, Value: uint32(sym.n), File: sym.s.file, Line: sym.s.line})
+	}
+	for _, s := range a.lines {
+		debug.Add(s.file, s.line, s.address)
+	}
+
+	p := &Program{Debug: debug}
+	memory := a.sections[0].memory
+	if len(memory) == 0 {
+		return p
+	}
+	low, high := uint32(mask), uint32(0)
+	for address := range memory {
+		if address < low {
+			low = address
+		}
+		if address > high {
+			high = address
+		}
+	}
+	p.Origin = low
+	p.Image = make([]uint16, high-low+1)
+	for address, v := range memory {
+		p.Image[address-low] = v
+	}
+	return p
+}
+
+// Collect what has been assembled into an object. Empty sections
+// are left out, unless they are labelled.
+func (a *assembler) objectFile(file string) *obj.Object {
+	o := &obj.Object{Source: file, Sections: []obj.Section{}, Symbols: []obj.Symbol{}}
+	labelled := map[string]bool{}
+	for _, sym := range a.symbols {
+		labelled[sym.base.section] = true
+	}
+	for _, sect := range a.sections {
+		if sect.size == 0 && !labelled[sect.name] {
+			continue
+		}
+		data := make([]uint16, sect.size)
+		for offset, v := range sect.memory {
+			data[offset] = v
+		}
+		relocs := append([]obj.Relocation{}, sect.relocs...)
+		sort.SliceStable(relocs, func(i, j int) bool { return relocs[i].Offset < relocs[j].Offset })
+		o.Sections = append(o.Sections, obj.Section{Name: sect.name, Shared: sect.shared, Data: data, Relocations: relocs})
+	}
+	for _, name := range a.order {
+		sym := a.symbols[name]
+		if sym.base.extern != "" {
+			continue
+		}
+		o.Symbols = append(o.Symbols, obj.Symbol{
+			Name:    name,
+			Kind:    sym.kind,
+			Section: sym.base.section,
+			Value:   uint32(sym.n),
+			Global:  sym.global,
+			Line:    sym.s.line,
+		})
+	}
+	for _, s := range a.lines {
+		o.Lines = append(o.Lines, obj.Line{File: s.file, Line: s.line, Section: s.sect.name, Offset: s.address})
+	}
+	return o
+}
@@ -0,0 +1,230 @@
+package asm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+const sum = `; Add two words
+        .ORG  0x100
+START:  LW    1,A
+        AW    1,B           ; G1 = A + B
+        STW   1,*PTR(2)
+DONE:   JS    3,DONE
+A:      .WORD 40
+B:      .WORD 2
+PTR:    .WORD RESULT
+        .HALF -1,COUNT
+RESULT:
+        .SPACE 2
+COUNT   .EQU  RESULT-A
+`
+
+func TestAssemble(t *testing.T) {
+	p, err := Assemble("sum.s", strings.NewReader(sum))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := []uint16{
+		0x5810, 0x0008, // LW 1,A
+		0x5a10, 0x0008, // AW 1,B
+		0x501a, 0x0008, // STW 1,*PTR(2)
+		0x0130, 0x0000, // JS 3,DONE
+		0x0000, 0x0028, 0x0000, 0x0002, 0x0000, 0x0110,
+		0xffff, 0x0008,
+		0x0000, 0x0000,
+	}
+	if p.Origin != 0x100 || len(p.Image) != len(expected) {
+		t.Fatalf("Assembled %d half-words at %05x, expected %d at 00100", len(p.Image), p.Origin, len(expected))
+	}
+	for ix, w := range expected {
+		if p.Image[ix] != w {
+			t.Errorf("Half-word %d is %04x, expected %04x", ix, p.Image[ix], w)
+		}
+	}
+
+	symbols := []debuginfo.Symbol{
+		{Name: "START", Kind: debuginfo.Code, Value: 0x100, File: "sum.s", Line: 3},
+		{Name: "DONE", Kind: debuginfo.Code, Value: 0x106, File: "sum.s", Line: 6},
+		{Name: "PTR", Kind: debuginfo.Data, Value: 0x10c, File: "sum.s", Line: 9},
+		{Name: "COUNT", Kind: debuginfo.Constant, Value: 8, File: "sum.s", Line: 13},
+		{Name: "RESULT", Kind: debuginfo.Data, Value: 0x110, File: "sum.s", Line: 11},
+	}
+	for _, s := range symbols {
+		if seen, ok := p.Debug.Symbol(s.Name); !ok || seen != s {
+			t.Errorf("Symbol %s is %+v, expected %+v", s.Name, seen, s)
+		}
+	}
+	if l, ok := p.Debug.Lookup(0x105); !ok || l.Line != 5 {
+		t.Errorf("Address 00105 is at %+v, expected line 5", l)
+	}
+
+	// The disassembler gives back the source.
+	lines := strings.Split(sum, "\n")
+	for ix := 0; ix < 8; ix += 2 {
+		address := p.Origin + uint32(ix)
+		text := cpu.DisassembleSymbolic(address, uint32(p.Image[ix])<<16|uint32(p.Image[ix+1]), p.Debug.Name)
+		l, _ := p.Debug.Lookup(address)
+		source := strings.Fields(strings.Split(lines[l.Line-1], ";")[0])
+		if source[len(source)-2]+" "+source[len(source)-1] != text {
+			t.Errorf("Address %05x disassembles to %q, source is %q", address, text, lines[l.Line-1])
+		}
+	}
+
+	m, err := config.ImageMachine(p.Image, 0x200, p.Origin)
+	if err != nil {
+		t.Fatalf("Unexpected error building machine, %v", err)
+	}
+	defer m.Close()
+	m.System.Run(100)
+	if c := m.CPUs[0]; c.Trap != nil || c.IC != 0x106 || c.FetchWord(0x110) != 42 {
+		t.Errorf("Ran to %05x with trap %v, RESULT is %d", c.IC, c.Trap, c.FetchWord(0x110))
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"  FROB 1,2", "x.s:1: Unknown instruction FROB"},
+		{"  LW 1,NOWHERE", "x.s:1: Undefined symbol NOWHERE"},
+		{"A: NOP\nA: NOP", "x.s:2: Symbol A defined twice"},
+		{"A: NOP\n  LW 1,A", "x.s:2: Address A is out of reach"},
+		{"  LD 16,0", "x.s:1: Register 16 out of range"},
+		{"  LW 1,*A(8)\nA: .WORD 0", "x.s:1: Register 8 out of range"},
+		{"  LD 1,0x10000", "x.s:1: Value 0x10000 does not fit in 16 bits"},
+		{"  .HALF 1,2\n  .ORG 1\n  .HALF 3", "x.s:3: Address 0x00001 assembled twice"},
+		{"  NOP 1", "x.s:1: NOP takes no operands"},
+		{"  .ORG 0x3ffff\n  NOP", "x.s:2: Assembling past the end of memory"},
+		{"1A: NOP", "x.s:1: Bad label 1A"},
+		{"N .EQU M\nM .EQU 1", "x.s:1: Undefined symbol M"},
+		{"  .WORD 1 2", "x.s:1: Expected + or - in 1 2"},
+	}
+	for ix, tc := range cases {
+		_, err := Assemble("x.s", strings.NewReader(tc.source))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
+
+const module = `; Count in shared memory
+        .EXTERN LIMIT
+        .GLOBAL START,COUNT
+START:  LW    1,COUNT
+        AW    1,*PTR
+        AS    1,2,LIMIT
+DONE:   JS    3,DONE
+PTR:    .WORD LIMIT+2
+        .SECTION common,SHARED
+COUNT:  .WORD 0
+SIZE    .EQU  $-COUNT
+        .SECTION text
+        LD    1,SIZE
+        LD    2,COUNT
+`
+
+func TestAssembleObject(t *testing.T) {
+	o, err := AssembleObject("count.s", strings.NewReader(module))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if err := o.Check(); err != nil {
+		t.Fatalf("Unexpected error checking, %v", err)
+	}
+	expected := []obj.Section{
+		{Name: "text", Data: []uint16{
+			0x5810, 0x0000, // LW 1,COUNT
+			0x5a18, 0x0006, // AW 1,*PTR
+			0x1a12, 0x0000, // AS 1,2,LIMIT
+			0x0130, 0x0000, // JS 3,DONE
+			0x0000, 0x0000, // PTR
+			0x9810, 0x0002, // LD 1,SIZE
+			0x9820, 0x0000, // LD 2,COUNT
+		}, Relocations: []obj.Relocation{
+			{Offset: 1, Kind: obj.Relative16, Section: "common"},
+			{Offset: 5, Kind: obj.Relative16, Symbol: "LIMIT"},
+			{Offset: 8, Kind: obj.Absolute32, Symbol: "LIMIT", Addend: 2},
+			{Offset: 13, Kind: obj.Absolute16, Section: "common"},
+		}},
+		{Name: "common", Shared: true, Data: []uint16{0, 0}, Relocations: []obj.Relocation{}},
+	}
+	if !reflect.DeepEqual(o.Sections, expected) {
+		t.Errorf("Sections are %+v, expected %+v", o.Sections, expected)
+	}
+	symbols := []obj.Symbol{
+		{Name: "START", Kind: debuginfo.Code, Section: "text", Global: true, Line: 4},
+		{Name: "DONE", Kind: debuginfo.Code, Section: "text", Value: 6, Line: 7},
+		{Name: "PTR", Kind: debuginfo.Data, Section: "text", Value: 8, Line: 8},
+		{Name: "COUNT", Kind: debuginfo.Data, Section: "common", Global: true, Line: 10},
+		{Name: "SIZE", Kind: debuginfo.Constant, Value: 2, Line: 11},
+	}
+	if !reflect.DeepEqual(o.Symbols, symbols) {
+		t.Errorf("Symbols are %+v, expected %+v", o.Symbols, symbols)
+	}
+	if len(o.Lines) != 6 || o.Lines[4] != (obj.Line{File: "count.s", Line: 13, Section: "text", Offset: 10}) {
+		t.Errorf("Lines are %+v", o.Lines)
+	}
+
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"  .ORG 0x100", "x.s:1: .ORG cannot be used in an object"},
+		{"  .EXTERN X\nY .EQU X+1", "x.s:2: Y cannot be defined from an external symbol"},
+		{"  .GLOBAL X", "x.s:1: Global symbol X is not defined"},
+		{"  .EXTERN X\n  .GLOBAL X", "x.s:2: Symbol X is external"},
+		{"  .SECTION data\n  .SECTION data,SHARED", "x.s:2: Section data was not shared before"},
+		{"  .SECTION data,RO", "x.s:1: Unknown section flag RO"},
+		{"A: .SPACE 1\n  .SPACE A", "x.s:2: The value of A is not known until link time"},
+	}
+	for ix, tc := range cases {
+		_, err := AssembleObject("x.s", strings.NewReader(tc.source))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+	for _, source := range []string{"  .SECTION text", "  .EXTERN X"} {
+		if _, err := Assemble("x.s", strings.NewReader(source)); err == nil {
+			t.Errorf("Expected an error assembling %q as a program", source)
+		}
+	}
+}
+
+// Every instruction in the instruction set assembles from what the
+// disassembler makes of it.
+func TestAssembleISA(t *testing.T) {
+	for _, s := range cpu.ISA() {
+		var word uint32
+		var err error
+		switch s.Format {
+		case cpu.NoOperands:
+			word, err = cpu.EncodeNoOperands(s.Opcode)
+		case cpu.Type1:
+			word, err = cpu.EncodeType1(s.Opcode, 2, true, 3, 4)
+		case cpu.Type2:
+			word, err = cpu.EncodeType2(s.Opcode, 2, 3, 4)
+		case cpu.Type3:
+			word, err = cpu.EncodeType3(s.Opcode, 2, 3, 4)
+		}
+		if err != nil {
+			t.Fatalf("%s, unexpected error encoding, %v", s.Mnemonic, err)
+		}
+		text := cpu.Disassemble(0x100, word)
+		p, err := Assemble("isa.s", strings.NewReader("  .ORG 0x100\n  "+text+"\n"))
+		if err != nil {
+			t.Errorf("%s, unexpected error assembling %s, %v", s.Mnemonic, text, err)
+			continue
+		}
+		if seen := uint32(p.Image[0])<<16 | uint32(p.Image[1]); seen != word {
+			t.Errorf("%s assembled to %08x, expected %08x", text, seen, word)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package asm
+
+// Expressions.
+//
+// An expression is a sum of terms, each of which is a number (in Go
+// syntax, so 0x1f, 0o17 and 0b101 all work), a symbol, or $ for the
+// address of the current statement. Terms are added or subtracted,
+// and can be negated, as in -1 or LOOP-$.
+//
+// In an object, addresses are not known until link time, so the
+// value of an expression is an offset from a base: the start of a
+// section, or an external symbol. Bases have to cancel out, as in
+// END-START within a section, or leave a single one added, as in
+// TABLE+4.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// What a value is relative to. The zero base is an absolute value.
+type base struct {
+	section string
+	extern  string
+}
+
+// The value of an expression or a symbol.
+type value struct {
+	n    int64
+	base base
+}
+
+func (v value) absolute() bool {
+	return v.base == base{}
+}
+
+// Is the byte part of a term?
+func termByte(c byte) bool {
+	return c == '_' || c == '.' || c == '$' ||
+		(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Is the string a valid symbol name?
+func validName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for ix := 0; ix < len(s); ix++ {
+		if !termByte(s[ix]) || s[ix] == '$' || s[ix] == '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// Work out the value of an expression.
+func (a *assembler) eval(expr string) (value, error) {
+	s := strings.TrimSpace(expr)
+	if s == "" {
+		return value{}, fmt.Errorf("Missing expression")
+	}
+	var total int64
+	bases := map[base]int{}
+	sign := int64(1)
+	wantTerm := true
+	for ix := 0; ix < len(s); {
+		c := s[ix]
+		switch {
+		case c == ' ' || c == '\t':
+			ix++
+		case c == '+' || c == '-':
+			if !wantTerm {
+				sign = 1
+				wantTerm = true
+			}
+			if c == '-' {
+				sign = -sign
+			}
+			ix++
+		case termByte(c):
+			if !wantTerm {
+				return value{}, fmt.Errorf("Expected + or - in %s", s)
+			}
+			end := ix
+			for end < len(s) && termByte(s[end]) {
+				end++
+			}
+			v, err := a.term(s[ix:end])
+			if err != nil {
+				return value{}, err
+			}
+			total += sign * v.n
+			if !v.absolute() {
+				bases[v.base] += int(sign)
+			}
+			wantTerm = false
+			ix = end
+		default:
+			return value{}, fmt.Errorf("Unexpected %q in %s", c, s)
+		}
+	}
+	if wantTerm {
+		return value{}, fmt.Errorf("Expression %s ends with an operator", s)
+	}
+	rv := value{n: total}
+	for b, count := range bases {
+		switch {
+		case count == 0:
+		case count == 1 && rv.absolute():
+			rv.base = b
+		default:
+			return value{}, fmt.Errorf("Expression %s is neither an address nor a number", s)
+		}
+	}
+	return rv, nil
+}
+
+// Work out the value of an expression that has to be absolute.
+func (a *assembler) number(expr string) (int64, error) {
+	v, err := a.eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	if !v.absolute() {
+		return 0, fmt.Errorf("The value of %s is not known until link time", expr)
+	}
+	return v.n, nil
+}
+
+// Work out the value of a single term.
+func (a *assembler) term(t string) (value, error) {
+	switch {
+	case t == "$":
+		return value{n: int64(a.sect.ic), base: base{section: a.sect.name}}, nil
+	case t[0] >= '0' && t[0] <= '9':
+		v, err := strconv.ParseInt(t, 0, 64)
+		if err != nil {
+			return value{}, fmt.Errorf("Bad number %s", t)
+		}
+		return value{n: v}, nil
+	}
+	if a.cur != nil {
+		a.refer(a.cur, t)
+	}
+	sym, ok := a.symbols[t]
+	if !ok {
+		return value{}, fmt.Errorf("Undefined symbol %s", t)
+	}
+	return sym.value, nil
+}
@@ -0,0 +1,45 @@
+package asm
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	a := &assembler{symbols: map[string]*symbol{
+		"LOOP": {value: value{n: 0x100}},
+		"N":    {value: value{n: 4}},
+		"DATA": {value: value{n: 0x10, base: base{section: "data"}}},
+		"END":  {value: value{n: 0x18, base: base{section: "data"}}},
+		"EXT":  {value: value{base: base{extern: "EXT"}}},
+	}}
+	a.enter("")
+	a.sect.ic = 0x120
+	cases := []struct {
+		expr     string
+		expected value
+	}{
+		{"0x10", value{n: 0x10}},
+		{"LOOP+N", value{n: 0x104}},
+		{"LOOP - 2 + 0b11", value{n: 0x101}},
+		{"-1", value{n: -1}},
+		{"$-LOOP", value{n: 0x20}},
+		{"N--N", value{n: 8}},
+		{"END-DATA", value{n: 8}},
+		{"DATA+N", value{n: 0x14, base: base{section: "data"}}},
+		{"EXT+2", value{n: 2, base: base{extern: "EXT"}}},
+	}
+	for _, tc := range cases {
+		v, err := a.eval(tc.expr)
+		if err != nil || v != tc.expected {
+			t.Errorf("%s is %+v (%v), expected %+v", tc.expr, v, err, tc.expected)
+		}
+	}
+	for _, expr := range []string{"", "LOOP+", "loop", "1 2", "2*N", "0xg", "DATA+END", "-DATA", "EXT-DATA"} {
+		if _, err := a.eval(expr); err == nil {
+			t.Errorf("Expected an error from %q", expr)
+		}
+	}
+	if _, err := a.number("DATA"); err == nil {
+		t.Errorf("Expected an error from number(DATA)")
+	}
+}
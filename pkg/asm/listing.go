@@ -0,0 +1,248 @@
+package asm
+
+// Listings.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/debuginfo"
+)
+
+// Half-words shown on each line of a listing.
+const listingWidth = 4
+
+// A line of a listing: a source line, what it assembled to, and what
+// was wrong with it.
+type ListingLine struct {
+	File    string   `json:"file"`
+	Line    int      `json:"line"`
+	Depth   int      `json:"depth,omitempty"` // How deep in macro expansions and repeats
+	Skipped bool     `json:"skipped,omitempty"`
+	Section string   `json:"section,omitempty"`
+	Address uint32   `json:"address"` // In the section, for an object
+	Data    []uint16 `json:"data,omitempty"`
+	Text    string   `json:"text"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// A place in the source.
+type Place struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// A symbol in the cross-reference: where it is defined, if it is, and
+// every line that uses it.
+type CrossReference struct {
+	Name       string               `json:"name"`
+	Kind       debuginfo.SymbolKind `json:"kind,omitempty"`
+	Section    string               `json:"section,omitempty"`
+	Value      uint32               `json:"value"`
+	External   bool                 `json:"external,omitempty"`
+	Global     bool                 `json:"global,omitempty"`
+	Defined    *Place               `json:"defined,omitempty"`
+	References []Place              `json:"references"`
+}
+
+// What a source file assembled to, line by line, after expanding
+// macros, repeats and includes, and its symbols, by name.
+type Listing struct {
+	Lines   []ListingLine    `json:"lines"`
+	Symbols []CrossReference `json:"symbols"`
+}
+
+// Assemble source, and return its listing. The listing is returned
+// even if there are errors, as long as the source could be read.
+func List(file string, r io.Reader, object bool) (*Listing, error) {
+	a, err := assemble(file, r, object)
+	if a == nil {
+		return nil, err
+	}
+	return a.listing(), err
+}
+
+// Assemble a source file, and return its listing.
+func ListFile(path string, object bool) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return List(path, f, object)
+}
+
+func (a *assembler) listing() *Listing {
+	l := &Listing{Lines: []ListingLine{}, Symbols: []CrossReference{}}
+	for _, s := range a.stmts {
+		line := ListingLine{File: s.file, Line: s.line, Depth: s.depth, Skipped: s.skip, Text: s.text, Errors: s.errs}
+		if s.sect != nil {
+			line.Section, line.Address = s.sect.name, s.address
+			if s.op != ".SPACE" {
+				for ix := uint32(0); ix < s.size; ix++ {
+					v, ok := s.sect.memory[s.address+ix]
+					if !ok {
+						break
+					}
+					line.Data = append(line.Data, v)
+				}
+			}
+		}
+		l.Lines = append(l.Lines, line)
+	}
+
+	names := []string{}
+	for name := range a.symbols {
+		names = append(names, name)
+	}
+	for name := range a.refs {
+		if _, ok := a.symbols[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		x := CrossReference{Name: name, References: []Place{}}
+		if sym, ok := a.symbols[name]; ok {
+			x.Kind, x.Section, x.Value = sym.kind, sym.base.section, uint32(sym.n)
+			x.External, x.Global = sym.base.extern != "", sym.global
+			x.Defined = &Place{File: sym.s.file, Line: sym.s.line}
+		}
+		// Both passes, and every expansion of a macro, can use a
+		// symbol on the same line.
+		seen := map[Place]bool{}
+		for _, s := range a.refs[name] {
+			p := Place{File: s.file, Line: s.line}
+			if !seen[p] {
+				seen[p] = true
+				x.References = append(x.References, p)
+			}
+		}
+		l.Symbols = append(l.Symbols, x)
+	}
+	return l
+}
+
+// Write a listing as text. Each line has the line number, the address
+// and what was assembled there, and the source line, marked with a +
+// for each level of expansion. Skipped lines have no address, and a
+// line that assembled to more half-words than fit goes on over the
+// following lines. Errors follow the line they are in.
+//
+// The cross-reference comes last, with each symbol, its kind, its
+// value, the line defining it and the lines using it. Lines in the
+// first file listed are given by number alone.
+func (l *Listing) Write(w io.Writer) error {
+	file := ""
+	for ix, line := range l.Lines {
+		if line.File != file {
+			file = line.File
+			sep := "\n"
+			if ix == 0 {
+				sep = ""
+			}
+			if _, err := fmt.Fprintf(w, "%s%s:\n", sep, file); err != nil {
+				return err
+			}
+		}
+		if err := line.write(w); err != nil {
+			return err
+		}
+	}
+	if len(l.Symbols) == 0 {
+		return nil
+	}
+
+	main := ""
+	if len(l.Lines) > 0 {
+		main = l.Lines[0].File
+	}
+	place := func(p Place) string {
+		if p.File == main {
+			return strconv.Itoa(p.Line)
+		}
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	if _, err := fmt.Fprintf(w, "\nSymbols:\n"); err != nil {
+		return err
+	}
+	for _, x := range l.Symbols {
+		kind, value, defined := string(x.Kind), fmt.Sprintf("%05x", x.Value), "-"
+		switch {
+		case x.Defined == nil:
+			kind, value = "undefined", ""
+		case x.External:
+			value = "extern"
+		case x.Section != "":
+			value = x.Section + "+" + value
+		}
+		if x.Defined != nil {
+			defined = place(*x.Defined)
+		}
+		if x.Global {
+			kind += ",global"
+		}
+		refs := []string{}
+		for _, p := range x.References {
+			refs = append(refs, place(p))
+		}
+		row := fmt.Sprintf("%-12s %-15s %-12s %-6s %s", x.Name, kind, value, defined, strings.Join(refs, " "))
+		if _, err := fmt.Fprintln(w, strings.TrimRight(row, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a line of a listing, with its errors.
+func (line ListingLine) write(w io.Writer) error {
+	address := "     "
+	if !line.Skipped {
+		address = fmt.Sprintf("%05x", line.Address)
+	}
+	text := line.Text
+	if line.Depth > 0 {
+		text = strings.Repeat("+", line.Depth) + " " + text
+	}
+	data := line.Data
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > listingWidth {
+			n = listingWidth
+		}
+		words := []string{}
+		for _, h := range data[:n] {
+			words = append(words, fmt.Sprintf("%04x", h))
+		}
+		row := fmt.Sprintf("%6d  %s  %-19s %s", line.Line, address, strings.Join(words, " "), text)
+		if !first {
+			offset := line.Address + uint32(len(line.Data)-len(data))
+			row = fmt.Sprintf("        %05x  %s", offset, strings.Join(words, " "))
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(row, " ")); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	for _, e := range line.Errors {
+		if _, err := fmt.Fprintf(w, "*****   %s\n", e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a listing as JSON, for editors and other tools.
+func (l *Listing) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
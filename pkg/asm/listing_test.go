@@ -0,0 +1,166 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	source := `        .ORG  0x100
+TWICE   .MACRO v
+        .HALF \v,\v
+        .ENDM
+        .IF   0
+        LD    1,1
+        .ENDIF
+        TWICE 7
+        .HALF 1,2,3,4,5
+`
+	l, err := List("l.s", strings.NewReader(source), false)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	var b bytes.Buffer
+	if err := l.Write(&b); err != nil {
+		t.Fatalf("Unexpected error writing, %v", err)
+	}
+	expected := `l.s:
+     1  00100                              .ORG  0x100
+     2  00100                      TWICE   .MACRO v
+     3                                     .HALF \v,\v
+     4                                     .ENDM
+     5                                     .IF   0
+     6                                     LD    1,1
+     7                                     .ENDIF
+     8  00100                              TWICE 7
+     8  00100  0007 0007           +         .HALF 7,7
+     9  00102  0001 0002 0003 0004         .HALF 1,2,3,4,5
+        00106  0005
+`
+	if b.String() != expected {
+		t.Errorf("Got listing\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+func TestListingErrors(t *testing.T) {
+	l, err := List("l.s", strings.NewReader("  .HALF 1\n  FROB\n"), false)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+	// The lines are still listed, with the addresses they would have had.
+	if l == nil || len(l.Lines) != 2 || l.Lines[1].Address != 1 {
+		t.Fatalf("Expected a listing of two lines, got %+v", l)
+	}
+	if !reflect.DeepEqual(l.Lines[1].Errors, []string{"Unknown instruction FROB"}) {
+		t.Errorf("Line 2 has errors %q", l.Lines[1].Errors)
+	}
+	var b bytes.Buffer
+	if err := l.Write(&b); err != nil {
+		t.Fatalf("Unexpected error writing, %v", err)
+	}
+	if !strings.HasSuffix(b.String(), "FROB\n*****   Unknown instruction FROB\n") {
+		t.Errorf("Listing %q does not show the error", b.String())
+	}
+}
+
+// Errors in the first pass do not stop the second one, so the lines
+// that do assemble show what they assembled to, and the errors of both
+// passes, and the uses of every symbol, are listed.
+func TestListingErrorsBothPasses(t *testing.T) {
+	source := `START:  LW    1,COUNT
+        FROB  2
+        STW   1,NOWHERE
+COUNT:  .WORD 42
+`
+	l, err := List("l.s", strings.NewReader(source), false)
+	if err == nil || err.Error() != "l.s:2: Unknown instruction FROB\nl.s:3: Undefined symbol NOWHERE" {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	var b bytes.Buffer
+	if err := l.Write(&b); err != nil {
+		t.Fatalf("Unexpected error writing, %v", err)
+	}
+	expected := `l.s:
+     1  00000  5810 0004           START:  LW    1,COUNT
+     2  00002                              FROB  2
+*****   Unknown instruction FROB
+     3  00002                              STW   1,NOWHERE
+*****   Undefined symbol NOWHERE
+     4  00004  0000 002a           COUNT:  .WORD 42
+
+Symbols:
+COUNT        data            00004        4      1
+NOWHERE      undefined                    -      3
+START        code            00000        1
+`
+	if b.String() != expected {
+		t.Errorf("Got listing\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+const xref = `        .ORG  0x100
+START:  LW    1,COUNT
+        AW    1,COUNT
+        STW   1,RESULT
+DONE:   JS    3,DONE
+COUNT:  .WORD 1
+N       .EQU  2
+        .IFDEF N
+        .HALF N,N
+        .ENDIF
+`
+
+func TestCrossReference(t *testing.T) {
+	l, err := List("x.s", strings.NewReader(xref), false)
+	if err == nil || err.Error() != "x.s:4: Undefined symbol RESULT" {
+		t.Errorf("Unexpected error, %v", err)
+	}
+	var b bytes.Buffer
+	if err := l.Write(&b); err != nil {
+		t.Fatalf("Unexpected error writing, %v", err)
+	}
+	expected := `
+Symbols:
+COUNT        data            00108        6      2 3
+DONE         code            00106        5      5
+N            constant        00002        7      8 9
+RESULT       undefined                    -      4
+START        code            00100        2
+`
+	if !strings.HasSuffix(b.String(), expected) {
+		t.Errorf("Got listing\n%s\nexpected it to end with\n%s", b.String(), expected)
+	}
+
+	b.Reset()
+	if err := l.WriteJSON(&b); err != nil {
+		t.Fatalf("Unexpected error writing JSON, %v", err)
+	}
+	var read Listing
+	if err := json.Unmarshal(b.Bytes(), &read); err != nil {
+		t.Fatalf("Unexpected error reading JSON, %v", err)
+	}
+	if !reflect.DeepEqual(&read, l) {
+		t.Errorf("Read back %+v, expected %+v", read, *l)
+	}
+	if x := read.Symbols[0]; x.Name != "COUNT" || *x.Defined != (Place{"x.s", 6}) || len(x.References) != 2 {
+		t.Errorf("COUNT is %+v", x)
+	}
+}
+
+func TestCrossReferenceObject(t *testing.T) {
+	source := "  .EXTERN PRINT\n  .GLOBAL MAIN\nMAIN: LW 1,PRINT\n"
+	l, err := List("o.s", strings.NewReader(source), true)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := []CrossReference{
+		{Name: "MAIN", Kind: "code", Section: "text", Global: true, Defined: &Place{"o.s", 3}, References: []Place{{"o.s", 2}}},
+		{Name: "PRINT", Kind: "code", External: true, Defined: &Place{"o.s", 1}, References: []Place{{"o.s", 3}}},
+	}
+	if !reflect.DeepEqual(l.Symbols, expected) {
+		t.Errorf("Got symbols %+v, expected %+v", l.Symbols, expected)
+	}
+}
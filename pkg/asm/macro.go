@@ -0,0 +1,467 @@
+package asm
+
+// Macros, conditional assembly, include files and repeats.
+//
+// These are dealt with as the first pass reads the source, so .IF can
+// test anything defined before it:
+//
+//	NAME    .MACRO   a,b        ; Define a macro, up to .ENDM
+//	        .ENDM
+//	        .IF      expr       ; Assemble what follows if expr is not 0,
+//	        .ELSE               ; and otherwise this
+//	        .ENDIF
+//	        .IFDEF   name       ; Or if a symbol is defined
+//	        .IFNDEF  name       ; Or if it is not
+//	        .INCLUDE file       ; Relative to the including file
+//	        .REPT    n          ; Repeat the lines up to .ENDR n times
+//	        .ENDR
+//
+// A macro is used like an instruction, as in NAME x,y. In its body,
+// \a and \b stand for the arguments, and \@ for a number unique to each
+// expansion, so that labels like LOOP\@ do not clash. \@ works in the
+// body of a repeat too. Expanded lines are marked with a + in the
+// listing, one for each level.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// How deep includes and expansions can go, and how many expansions
+// there can be in all, to catch ones that never end. There is no need
+// for more expansions than there are half-words to fill.
+const (
+	maxIncludes   = 16
+	maxDepth      = 64
+	maxExpansions = 0x40000
+)
+
+// A line of source, as read or as expanded.
+type sourceLine struct {
+	file  string
+	line  int
+	text  string
+	depth int    // How deep in macro expansions and repeats
+	macro string // The macro it was expanded from
+}
+
+// Lines being read: a file, or an expansion. A repeat is a single
+// frame, expanding its body again each time it gets to the end.
+type frame struct {
+	lines   []sourceLine
+	pos     int
+	conds   int // How many .IF were open when the frame started
+	include bool
+	repeat  *statement   // The .REPT, for a repeat
+	body    []sourceLine // What it repeats
+	left    int64        // How many more times
+}
+
+// An open .IF.
+type cond struct {
+	s      *statement
+	active bool // Assembling the current branch
+	taken  bool // A branch has been assembled, or none can be
+	seen   bool // Seen the .ELSE
+}
+
+// A macro definition.
+type macro struct {
+	name   string
+	params []string
+	body   []sourceLine
+}
+
+// Are statements being assembled, rather than skipped by .IF?
+func (a *assembler) active() bool {
+	return len(a.conds) == 0 || a.conds[len(a.conds)-1].active
+}
+
+// Return the next statement, or nil at the end of the source. Every
+// line read is returned, but those that are not to be assembled, such
+// as the false branch of an .IF, or the body of a macro definition,
+// are marked to be skipped. The directives of this file are dealt
+// with here, and turned into empty statements, to leave their labels
+// to whatever comes next.
+func (a *assembler) next() *statement {
+	for {
+		if len(a.queue) > 0 {
+			s := a.queue[0]
+			a.queue = a.queue[1:]
+			return s
+		}
+		if len(a.frames) == 0 {
+			return nil
+		}
+		f := a.frames[len(a.frames)-1]
+		if f.pos == len(f.lines) && f.left > 0 {
+			a.again(f)
+			continue
+		}
+		if f.pos == len(f.lines) {
+			a.pop()
+			continue
+		}
+		l := f.lines[f.pos]
+		f.pos++
+		s := a.statement(l)
+		if s.skip {
+			return s
+		}
+		a.directive(s, f)
+		return s
+	}
+}
+
+// Parse a line. Lines that do not parse are skipped, with an error
+// unless .IF skips them anyway.
+func (a *assembler) statement(l sourceLine) *statement {
+	s, err := parseLine(l.text)
+	if err != nil {
+		s = &statement{skip: true}
+	}
+	s.file, s.line, s.text, s.depth, s.macro = l.file, l.line, l.text, l.depth, l.macro
+	switch {
+	case s.op == ".IF" || s.op == ".IFDEF" || s.op == ".IFNDEF" || s.op == ".ELSE" || s.op == ".ENDIF":
+		// These are needed to know whether to skip.
+	case !a.active():
+		s.skip = true
+	case err != nil:
+		a.fail(s, err)
+	}
+	return s
+}
+
+// Deal with the directives of this file.
+func (a *assembler) directive(s *statement, f *frame) {
+	a.cur = s
+	var err error
+	switch s.op {
+	case ".IF", ".IFDEF", ".IFNDEF", ".ELSE", ".ENDIF":
+		// These assemble nothing, whether skipping or not.
+		s.skip = true
+		if len(s.labels) > 0 && a.active() {
+			a.fail(s, fmt.Errorf("%s cannot be labelled", s.op))
+		}
+	}
+	switch s.op {
+	case ".IF", ".IFDEF", ".IFNDEF":
+		err = a.startIf(s)
+	case ".ELSE":
+		err = a.elseIf(s, f)
+	case ".ENDIF":
+		if len(a.conds) == f.conds {
+			err = fmt.Errorf(".ENDIF without .IF")
+		} else {
+			a.conds = a.conds[:len(a.conds)-1]
+		}
+	case ".MACRO":
+		err = a.defineMacro(s, f)
+	case ".REPT":
+		err = a.repeat(s, f)
+	case ".INCLUDE":
+		err = a.include(s)
+	case ".ENDM", ".ENDR":
+		err = fmt.Errorf("%s without %s", s.op, map[string]string{".ENDM": ".MACRO", ".ENDR": ".REPT"}[s.op])
+	default:
+		m, ok := a.macros[s.op]
+		if !ok {
+			return
+		}
+		err = a.expand(s, m)
+	}
+	if err != nil {
+		a.fail(s, err)
+	}
+	s.op, s.args = "", nil
+}
+
+// Stop reading from a frame, checking that its .IF are finished.
+func (a *assembler) pop() {
+	f := a.frames[len(a.frames)-1]
+	a.frames = a.frames[:len(a.frames)-1]
+	a.endConds(f)
+}
+
+// Check that the .IF started in a frame are finished.
+func (a *assembler) endConds(f *frame) {
+	for len(a.conds) > f.conds {
+		a.fail(a.conds[len(a.conds)-1].s, fmt.Errorf(".IF without .ENDIF"))
+		a.conds = a.conds[:len(a.conds)-1]
+	}
+}
+
+// Start a conditional.
+func (a *assembler) startIf(s *statement) error {
+	c := &cond{s: s}
+	a.conds = append(a.conds, c)
+	if len(a.conds) > 1 && !a.conds[len(a.conds)-2].active {
+		// The whole .IF is skipped, else and all.
+		c.taken = true
+		return nil
+	}
+	if len(s.args) != 1 {
+		c.taken = true
+		return fmt.Errorf("%s needs exactly one operand", s.op)
+	}
+	switch s.op {
+	case ".IF":
+		v, err := a.number(s.args[0])
+		if err != nil {
+			c.taken = true
+			return err
+		}
+		c.active = v != 0
+	case ".IFDEF", ".IFNDEF":
+		a.refer(s, s.args[0])
+		_, ok := a.symbols[s.args[0]]
+		c.active = ok == (s.op == ".IFDEF")
+	}
+	c.taken = c.active
+	return nil
+}
+
+// Switch to the other branch of a conditional.
+func (a *assembler) elseIf(s *statement, f *frame) error {
+	if len(a.conds) == f.conds {
+		return fmt.Errorf(".ELSE without .IF")
+	}
+	c := a.conds[len(a.conds)-1]
+	if c.seen {
+		return fmt.Errorf(".ELSE after .ELSE")
+	}
+	c.seen = true
+	c.active = !c.taken
+	c.taken = true
+	return nil
+}
+
+// Read the lines of a frame up to the end of a block, started by
+// begin and ended by end, such as .MACRO and .ENDM. The lines are
+// listed, but skipped. Return the lines in between.
+func (a *assembler) block(s *statement, f *frame, begin, end string) ([]sourceLine, error) {
+	depth := 0
+	for ix := f.pos; ix < len(f.lines); ix++ {
+		// Just the op is needed, so labels and operands can be bad.
+		fields := strings.Fields(strings.SplitN(f.lines[ix].text, ";", 2)[0])
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+			fields = fields[1:]
+		}
+		op := ""
+		switch {
+		case len(fields) > 1 && strings.EqualFold(fields[1], begin):
+			op = begin
+		case len(fields) > 0:
+			op = strings.ToUpper(fields[0])
+		}
+		switch op {
+		case begin:
+			depth++
+		case end:
+			if depth > 0 {
+				depth--
+				continue
+			}
+			body := f.lines[f.pos:ix]
+			for _, l := range f.lines[f.pos : ix+1] {
+				listed := &statement{file: l.file, line: l.line, text: l.text, depth: l.depth, macro: l.macro, skip: true}
+				a.queue = append(a.queue, listed)
+			}
+			f.pos = ix + 1
+			return body, nil
+		}
+	}
+	f.pos = len(f.lines)
+	return nil, fmt.Errorf("%s without %s", s.op, end)
+}
+
+// Define a macro.
+func (a *assembler) defineMacro(s *statement, f *frame) error {
+	body, err := a.block(s, f, ".MACRO", ".ENDM")
+	if err != nil {
+		return err
+	}
+	name := strings.ToUpper(s.name)
+	switch _, _, ok := cpu.LookupMnemonic(name); {
+	case s.name == "":
+		return fmt.Errorf(".MACRO needs a name")
+	case ok || strings.HasPrefix(name, "."):
+		return fmt.Errorf("Macro %s would hide an instruction", s.name)
+	case a.macros[name] != nil:
+		return fmt.Errorf("Macro %s defined twice", s.name)
+	}
+	for _, p := range s.args {
+		if !validName(p) {
+			return fmt.Errorf("Bad macro parameter %s", p)
+		}
+	}
+	a.macros[name] = &macro{name: s.name, params: s.args, body: body}
+	return nil
+}
+
+// Replace the parameters in a line of a macro body with the arguments,
+// and \@ with a number unique to the expansion.
+func (a *assembler) substitute(text string, params, args []string) (string, error) {
+	var b strings.Builder
+	for ix := 0; ix < len(text); ix++ {
+		if text[ix] != '\\' {
+			b.WriteByte(text[ix])
+			continue
+		}
+		if ix+1 < len(text) && text[ix+1] == '@' {
+			b.WriteString(strconv.Itoa(a.expansions))
+			ix++
+			continue
+		}
+		end := ix + 1
+		for end < len(text) && termByte(text[end]) && text[end] != '.' && text[end] != '$' {
+			end++
+		}
+		name := text[ix+1 : end]
+		found := false
+		for px, p := range params {
+			if p == name {
+				b.WriteString(args[px])
+				found = true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("Unknown macro parameter \\%s", name)
+		}
+		ix = end - 1
+	}
+	return b.String(), nil
+}
+
+// Expand a body. Once there have been too many expansions, whatever
+// is being expanded is abandoned, rather than have every expansion
+// still to come fail on its own.
+func (a *assembler) expansion(s *statement, body []sourceLine, params, args []string, name string) ([]sourceLine, error) {
+	if s.depth >= maxDepth {
+		return nil, fmt.Errorf("Macros and repeats nested too deeply")
+	}
+	if a.expansions >= maxExpansions {
+		a.abandon()
+		return nil, fmt.Errorf("More than %d expansions of macros and repeats", maxExpansions)
+	}
+	a.expansions++
+	lines := []sourceLine{}
+	for _, l := range body {
+		text, err := a.substitute(l.text, params, args)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, sourceLine{file: s.file, line: s.line, text: text, depth: s.depth + 1, macro: name})
+	}
+	return lines, nil
+}
+
+// Read lines expanded from a body.
+func (a *assembler) push(s *statement, body []sourceLine, params, args []string, name string) error {
+	lines, err := a.expansion(s, body, params, args, name)
+	if err != nil {
+		return err
+	}
+	a.frames = append(a.frames, &frame{lines: lines, conds: len(a.conds)})
+	return nil
+}
+
+// Go through the body of a repeat again.
+func (a *assembler) again(f *frame) {
+	a.endConds(f)
+	lines, err := a.expansion(f.repeat, f.body, nil, nil, f.repeat.macro)
+	if err != nil {
+		a.fail(f.repeat, err)
+		f.left = 0
+		return
+	}
+	f.lines, f.pos = lines, 0
+	f.left--
+}
+
+// Stop reading from the expansions being read, back to the file they
+// are in, dropping their .IF.
+func (a *assembler) abandon() {
+	for len(a.frames) > 1 {
+		f := a.frames[len(a.frames)-1]
+		if f.include {
+			return
+		}
+		a.frames = a.frames[:len(a.frames)-1]
+		if len(a.conds) > f.conds {
+			a.conds = a.conds[:f.conds]
+		}
+	}
+}
+
+// Expand a macro.
+func (a *assembler) expand(s *statement, m *macro) error {
+	if len(s.args) != len(m.params) {
+		return fmt.Errorf("Macro %s takes %d arguments, not %d", m.name, len(m.params), len(s.args))
+	}
+	return a.push(s, m.body, m.params, s.args, m.name)
+}
+
+// Repeat the lines up to .ENDR.
+func (a *assembler) repeat(s *statement, f *frame) error {
+	body, err := a.block(s, f, ".REPT", ".ENDR")
+	if err != nil {
+		return err
+	}
+	n, err := a.single(s)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("Cannot repeat %d times", n)
+	}
+	if n == 0 {
+		return nil
+	}
+	if n > maxExpansions-int64(a.expansions) {
+		a.abandon()
+		return fmt.Errorf("Cannot repeat %d times, more than %d expansions of macros and repeats", n, maxExpansions)
+	}
+	lines, err := a.expansion(s, body, nil, nil, s.macro)
+	if err != nil {
+		return err
+	}
+	a.frames = append(a.frames, &frame{lines: lines, conds: len(a.conds), repeat: s, body: body, left: n - 1})
+	return nil
+}
+
+// Read the lines of another file.
+func (a *assembler) include(s *statement) error {
+	if len(s.args) != 1 {
+		return fmt.Errorf(".INCLUDE needs exactly one file")
+	}
+	includes := 0
+	for _, f := range a.frames {
+		if f.include {
+			includes++
+		}
+	}
+	if includes >= maxIncludes {
+		return fmt.Errorf("Includes nested too deeply")
+	}
+	path := strings.Trim(s.args[0], `"`)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(s.file), path)
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	lines, err := readLines(path, r)
+	if err != nil {
+		return err
+	}
+	a.frames = append(a.frames, &frame{lines: lines, conds: len(a.conds), include: true})
+	return nil
+}
@@ -0,0 +1,178 @@
+package asm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const macros = `; Macros
+        .ORG    0x100
+SET     .MACRO  r,v
+        LD      \r,\v
+L\@:    JS      3,L\@
+        .ENDM
+DEBUG   .EQU    1
+START:  SET     1,0x12
+        .IF     DEBUG
+        LD      2,1
+        .ELSE
+        LD      2,2
+        .ENDIF
+        .IFNDEF DEBUG
+        FROB    1,      ; Skipped, so not an error
+        .ENDIF
+        .REPT   2
+        .HALF   \@
+        .ENDR
+`
+
+func TestMacros(t *testing.T) {
+	p, err := Assemble("m.s", strings.NewReader(macros))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := []uint16{
+		0x9810, 0x0012, // LD 1,0x12
+		0x0130, 0x0000, // JS 3,L1
+		0x9820, 0x0001, // LD 2,1
+		0x0002, 0x0003,
+	}
+	if p.Origin != 0x100 || len(p.Image) != len(expected) {
+		t.Fatalf("Assembled %04x at %05x, expected %04x at 00100", p.Image, p.Origin, expected)
+	}
+	for ix, w := range expected {
+		if p.Image[ix] != w {
+			t.Errorf("Half-word %d is %04x, expected %04x", ix, p.Image[ix], w)
+		}
+	}
+	if s, ok := p.Debug.Symbol("START"); !ok || s.Value != 0x100 {
+		t.Errorf("START is %+v", s)
+	}
+	if s, ok := p.Debug.Symbol("L1"); !ok || s.Value != 0x102 || s.Line != 8 {
+		t.Errorf("L1 is %+v", s)
+	}
+	if l, ok := p.Debug.Lookup(0x102); !ok || l.Line != 8 {
+		t.Errorf("Address 00102 is at %+v, expected line 8", l)
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	source := `A .EQU 2
+  .IF A-2
+  .HALF 1
+  .IF 1
+  .HALF 2
+  .ELSE
+  .HALF 3
+  .ENDIF
+  .ELSE
+  .IFDEF A
+  .HALF 4
+  .ENDIF
+  .ENDIF
+`
+	p, err := Assemble("c.s", strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if len(p.Image) != 1 || p.Image[0] != 4 {
+		t.Errorf("Assembled %04x, expected 0004", p.Image)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asm")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.s":      "  .INCLUDE \"defs/defs.s\"\n  TWICE WIDTH\n",
+		"defs/defs.s": "WIDTH .EQU 4\n  .INCLUDE more.s\n",
+		"defs/more.s": "TWICE .MACRO n\n  .HALF \\n,\\n\n  .ENDM\n",
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+	}
+	p, err := AssembleFile(filepath.Join(dir, "main.s"))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if len(p.Image) != 2 || p.Image[0] != 4 || p.Image[1] != 4 {
+		t.Errorf("Assembled %04x, expected 0004 0004", p.Image)
+	}
+	if s, ok := p.Debug.Symbol("WIDTH"); !ok || s.File != filepath.Join(dir, "defs/defs.s") || s.Line != 1 {
+		t.Errorf("WIDTH is %+v", s)
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"  .ENDIF", "x.s:1: .ENDIF without .IF"},
+		{"  .IF 1", "x.s:1: .IF without .ENDIF"},
+		{"  .IF 1\n  .ELSE\n  .ELSE\n  .ENDIF", "x.s:3: .ELSE after .ELSE"},
+		{"  .IF X\n  .ENDIF\nX .EQU 1", "x.s:1: Undefined symbol X"},
+		{"A: .IF 1\n  .ENDIF", "x.s:1: .IF cannot be labelled"},
+		{"M .MACRO\n  NOP", "x.s:1: .MACRO without .ENDM"},
+		{"  .ENDM", "x.s:1: .ENDM without .MACRO"},
+		{"M .MACRO a\n  LD 1,\\b\n  .ENDM\n  M 1", "x.s:4: Unknown macro parameter \\b"},
+		{"M .MACRO a\n  .ENDM\n  M 1,2", "x.s:3: Macro M takes 1 arguments, not 2"},
+		{"M .MACRO\n  LD 1,Q\n  .ENDM\n  M", "x.s:4: Undefined symbol Q, in macro M"},
+		{"LW .MACRO\n  .ENDM", "x.s:1: Macro LW would hide an instruction"},
+		{"M .MACRO\n  .ENDM\nm .MACRO\n  .ENDM", "x.s:3: Macro m defined twice"},
+		{"M .MACRO\n  M\n  .ENDM\n  M", "x.s:4: Macros and repeats nested too deeply, in macro M"},
+		{"  .REPT -1\n  .ENDR", "x.s:1: Cannot repeat -1 times"},
+		{"  .REPT 2\n  .HALF 1", "x.s:1: .REPT without .ENDR"},
+		{"  .INCLUDE nothere.s", "x.s:1: open nothere.s"},
+	}
+	for ix, tc := range cases {
+		_, err := Assemble("x.s", strings.NewReader(tc.source))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
+
+// Repeats and expansions that would go on for ever stop, with a
+// single error, once there have been too many.
+func TestExpansionLimit(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{"  .REPT 0x7fffffffffffffff\n  .HALF 1\n  .ENDR", "x.s:1: Cannot repeat 9223372036854775807 times"},
+		{"  .REPT 0x20000\n  .REPT 0x20000\n  .ENDR\n  .ENDR", "x.s:1: Cannot repeat 131072 times"},
+		{"M .MACRO n\n  .IF \\n\n  M \\n-1\n  M \\n-1\n  .ENDIF\n  .ENDM\n  M 40", "x.s:7: More than 262144 expansions of macros and repeats, in macro M"},
+	}
+	for ix, tc := range cases {
+		_, err := Assemble("x.s", strings.NewReader(tc.source+"\n  .IF Q\n  .ENDIF"))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+			continue
+		}
+		if n := strings.Count(err.Error(), "x.s:"); n != 2 || !strings.Contains(err.Error(), "Undefined symbol Q") {
+			t.Errorf("Case #%d, error %v, expected it and an undefined Q after it", ix, err)
+		}
+	}
+
+	// Up to the limit is fine, without a frame for each repeat.
+	a, err := Assemble("x.s", strings.NewReader("  .REPT 0x100\n  .REPT 0x3ff\n  .ENDR\n  .WORD \\@\n  .ENDR"))
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if n := len(a.Image); n != 0x200 || a.Image[1] != 1 || a.Image[3] != 0x401 {
+		t.Errorf("Image of 0x%x half-words, %v...", n, a.Image[:4])
+	}
+}
@@ -0,0 +1,525 @@
+// The config package describes a complete Censor 932 installation
+// in a JSON file, and builds a system.System from it.
+//
+// A configuration lists the CPUs, each with its local memory, ROM
+// images, memory-mapped devices and boot settings, and the shared
+// memory modules connecting them. Addresses and sizes can be given
+// either as JSON numbers or as strings, so that "0x1000" and
+// "0o777" work as well as 4096. An example:
+//
+//	{
+//	  "scheduling": "lockstep",
+//	  "cpus": [
+//	    {
+//	      "local": [{"name": "ram0", "low": 0, "high": "0x0fff"}],
+//	      "roms": [{"name": "boot", "low": "0x1000", "image": "boot.bin"}],
+//	      "devices": [{"type": "timer", "low": "0x2000", "level": 3}],
+//	      "boot": {"ic": "0x1000"}
+//	    }
+//	  ],
+//	  "shared": [{"name": "common", "low": "0x10000", "high": "0x1ffff"}]
+//	}
+//
+// The loader checks that no two backends overlap in the address
+// space of any CPU, that every CPU has memory at its boot address,
+// and that all references to CPUs, device types and images can be
+// resolved, before anything is built.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/device"
+	"github.com/vatine/censor932/pkg/memimage"
+	"github.com/vatine/censor932/pkg/shared"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// The number of half-words taken by each kind of device.
+var deviceSizes = map[string]uint32{
+	"rtc":   4,
+	"timer": 4,
+}
+
+// An address, size or other unsigned number. In JSON, it is either a
+// number or a string in any base strconv.ParseUint understands.
+type Number uint32
+
+func (n *Number) UnmarshalJSON(data []byte) error {
+	var s string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(data)
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return fmt.Errorf("Bad number %s, %v", string(data), err)
+	}
+	*n = Number(v)
+	return nil
+}
+
+// A complete installation.
+type Config struct {
+	// One of "lockstep" (the default), "random" or "free".
+	Scheduling string       `json:"scheduling"`
+	Seed       int64        `json:"seed"`
+	Pacing     Pacing       `json:"pacing"`
+	CPUs       []CPU        `json:"cpus"`
+	Shared     []SharedSpec `json:"shared"`
+
+	dir string // Images are relative to this
+}
+
+// How fast to run, see system.Pacing.
+type Pacing struct {
+	Rate uint64 `json:"rate"`
+	// Either "instructions" (the default) or "cycles".
+	Unit string `json:"unit"`
+}
+
+// A CPU and everything only it can see.
+type CPU struct {
+	Local   []LocalSpec  `json:"local"`
+	ROMs    []ROMSpec    `json:"roms"`
+	Devices []DeviceSpec `json:"devices"`
+	Boot    Boot         `json:"boot"`
+}
+
+// The state of a CPU when the system starts.
+type Boot struct {
+	IC            Number `json:"ic"`
+	InterruptBase Number `json:"interruptBase"`
+}
+
+// A local memory module, mapped from Low to High inclusive.
+type LocalSpec struct {
+	Name string `json:"name"`
+	Low  Number `json:"low"`
+	High Number `json:"high"`
+}
+
+// A ROM, holding an image of raw big-endian half-words. If High is
+// not given, the ROM is exactly as large as the image.
+type ROMSpec struct {
+	Name  string  `json:"name"`
+	Low   Number  `json:"low"`
+	High  *Number `json:"high"`
+	Image string  `json:"image"`
+}
+
+// A memory-mapped device, of type "rtc" or "timer", driven by the
+// clock of the CPU it is attached to. Level is the interrupt level
+// of a timer.
+type DeviceSpec struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Low     Number `json:"low"`
+	Divisor uint64 `json:"divisor"`
+	Level   uint8  `json:"level"`
+}
+
+// A shared memory module, mapped from Low to High inclusive in the
+// address space of the listed CPUs, or all of them if none are
+// listed. A non-zero Latency enables the timing model, which needs
+// lockstep or random scheduling.
+type SharedSpec struct {
+	Name    string `json:"name"`
+	Low     Number `json:"low"`
+	High    Number `json:"high"`
+	CPUs    []int  `json:"cpus"`
+	Latency uint64 `json:"latency"`
+}
+
+// A backend mapped into the address space of a CPU.
+type Module struct {
+	Name    string
+	Kind    string // "local", "rom", "shared", or the device type
+	CPU     int
+	Range   cpu.MemoryRange
+	Backend cpu.MemoryBackend
+}
+
+// A system built from a configuration, with the backends mapped into
+// each CPU.
+type Machine struct {
+	*system.System
+	Modules []Module
+}
+
+// Parse a configuration. Unknown fields are an error, to catch typos.
+func Parse(data []byte) (*Config, error) {
+	var rv Config
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&rv); err != nil {
+		return nil, fmt.Errorf("Bad configuration, %v", err)
+	}
+	return &rv, nil
+}
+
+// Read a configuration from a file. ROM images are looked up
+// relative to the directory the file is in.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	rv.dir = filepath.Dir(path)
+	return rv, nil
+}
+
+// Read an image of raw big-endian half-words.
+func ReadImage(path string) ([]uint16, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("Image %s has an odd number of bytes", path)
+	}
+	rv := make([]uint16, len(data)/2)
+	for ix := range rv {
+		rv[ix] = uint16(data[2*ix])<<8 | uint16(data[2*ix+1])
+	}
+	return rv, nil
+}
+
+// Write an image of raw big-endian half-words.
+func WriteImage(path string, contents []uint16) error {
+	data := make([]byte, 2*len(contents))
+	for ix, h := range contents {
+		data[2*ix] = byte(h >> 8)
+		data[2*ix+1] = byte(h)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Read a ROM image, relative to the directory of the configuration.
+func (c *Config) readImage(name string) ([]uint16, error) {
+	path := name
+	if !filepath.IsAbs(path) && c.dir != "" {
+		path = filepath.Join(c.dir, path)
+	}
+	return ReadImage(path)
+}
+
+func parseScheduling(s string) (system.Scheduling, error) {
+	for _, sch := range []system.Scheduling{system.Lockstep, system.Random, system.Free} {
+		if s == sch.String() {
+			return sch, nil
+		}
+	}
+	if s == "" {
+		return system.Lockstep, nil
+	}
+	return 0, fmt.Errorf("Unknown scheduling %q", s)
+}
+
+func parseUnit(s string) (system.PaceUnit, error) {
+	switch s {
+	case "", "instructions":
+		return system.Instructions, nil
+	case "cycles":
+		return system.Cycles, nil
+	}
+	return 0, fmt.Errorf("Unknown pacing unit %q", s)
+}
+
+// A planned mapping, before anything is built.
+type mapping struct {
+	name  string
+	kind  string
+	r     cpu.MemoryRange
+	image []uint16   // For ROMs
+	spec  DeviceSpec // For devices
+	ix    int        // Index into Config.Shared, for shared modules
+}
+
+// Work out what goes where in the address space of every CPU,
+// checking the configuration as we go. The mappings of each CPU are
+// sorted by address.
+func (c *Config) plan() ([][]mapping, error) {
+	if _, err := parseScheduling(c.Scheduling); err != nil {
+		return nil, err
+	}
+	if _, err := parseUnit(c.Pacing.Unit); err != nil {
+		return nil, err
+	}
+	if len(c.CPUs) == 0 {
+		return nil, fmt.Errorf("No CPUs configured")
+	}
+
+	names := map[string]bool{}
+	name := func(given, fallback string) (string, error) {
+		if given == "" {
+			given = fallback
+		}
+		if names[given] {
+			return "", fmt.Errorf("Duplicate module name %q", given)
+		}
+		names[given] = true
+		return given, nil
+	}
+	checkRange := func(name string, low, high Number) (cpu.MemoryRange, error) {
+		if low > high {
+			return cpu.MemoryRange{}, fmt.Errorf("Module %s has low address 0x%x above high address 0x%x", name, low, high)
+		}
+		if high > 0x3ffff {
+			return cpu.MemoryRange{}, fmt.Errorf("Module %s ends at 0x%x, outside the address space", name, high)
+		}
+		return cpu.MemoryRange{Low: uint32(low), High: uint32(high)}, nil
+	}
+
+	rv := make([][]mapping, len(c.CPUs))
+	for cix, spec := range c.CPUs {
+		for ix, l := range spec.Local {
+			n, err := name(l.Name, fmt.Sprintf("cpu%d.local%d", cix, ix))
+			if err != nil {
+				return nil, err
+			}
+			r, err := checkRange(n, l.Low, l.High)
+			if err != nil {
+				return nil, err
+			}
+			rv[cix] = append(rv[cix], mapping{name: n, kind: "local", r: r})
+		}
+		for ix, rom := range spec.ROMs {
+			n, err := name(rom.Name, fmt.Sprintf("cpu%d.rom%d", cix, ix))
+			if err != nil {
+				return nil, err
+			}
+			if rom.Image == "" {
+				return nil, fmt.Errorf("ROM %s has no image", n)
+			}
+			image, err := c.readImage(rom.Image)
+			if err != nil {
+				return nil, fmt.Errorf("ROM %s: %v", n, err)
+			}
+			if len(image) == 0 {
+				return nil, fmt.Errorf("ROM %s has an empty image", n)
+			}
+			high := rom.Low + Number(len(image)) - 1
+			if rom.High != nil {
+				if *rom.High < rom.Low || uint64(*rom.High-rom.Low)+1 < uint64(len(image)) {
+					return nil, fmt.Errorf("ROM %s is too small for its %d half-word image", n, len(image))
+				}
+				high = *rom.High
+			}
+			r, err := checkRange(n, rom.Low, high)
+			if err != nil {
+				return nil, err
+			}
+			rv[cix] = append(rv[cix], mapping{name: n, kind: "rom", r: r, image: image})
+		}
+		for ix, d := range spec.Devices {
+			size, ok := deviceSizes[d.Type]
+			if !ok {
+				return nil, fmt.Errorf("Unknown device type %q on CPU #%d", d.Type, cix)
+			}
+			n, err := name(d.Name, fmt.Sprintf("cpu%d.%s%d", cix, d.Type, ix))
+			if err != nil {
+				return nil, err
+			}
+			if d.Type == "timer" && d.Level > 15 {
+				return nil, fmt.Errorf("Device %s has interrupt level %d, expected 0-15", n, d.Level)
+			}
+			r, err := checkRange(n, d.Low, d.Low+Number(size)-1)
+			if err != nil {
+				return nil, err
+			}
+			rv[cix] = append(rv[cix], mapping{name: n, kind: d.Type, r: r, spec: d})
+		}
+	}
+
+	for ix, s := range c.Shared {
+		n, err := name(s.Name, fmt.Sprintf("shared%d", ix))
+		if err != nil {
+			return nil, err
+		}
+		if s.Latency > 0 && c.Scheduling == system.Free.String() {
+			return nil, fmt.Errorf("Shared module %s has a latency, which needs lockstep or random scheduling", n)
+		}
+		r, err := checkRange(n, s.Low, s.High)
+		if err != nil {
+			return nil, err
+		}
+		cpus := s.CPUs
+		if len(cpus) == 0 {
+			for cix := range c.CPUs {
+				cpus = append(cpus, cix)
+			}
+		}
+		for _, cix := range cpus {
+			if cix < 0 || cix >= len(c.CPUs) {
+				return nil, fmt.Errorf("Shared module %s refers to CPU #%d, but there are %d CPUs", n, cix, len(c.CPUs))
+			}
+			rv[cix] = append(rv[cix], mapping{name: n, kind: "shared", r: r, ix: ix})
+		}
+	}
+
+	for cix, ms := range rv {
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].r.Low < ms[j].r.Low })
+		for ix := 1; ix < len(ms); ix++ {
+			if ms[ix].r.Low <= ms[ix-1].r.High {
+				return nil, fmt.Errorf("Modules %s and %s overlap on CPU #%d", ms[ix-1].name, ms[ix].name, cix)
+			}
+		}
+		ic := uint32(c.CPUs[cix].Boot.IC)
+		if !covered(ms, ic) || !covered(ms, ic+1) {
+			return nil, fmt.Errorf("CPU #%d has no memory at its boot address 0x%x", cix, ic)
+		}
+	}
+	return rv, nil
+}
+
+// Is the address mapped by any of ms?
+func covered(ms []mapping, addr uint32) bool {
+	for _, m := range ms {
+		if m.r.Low <= addr && addr <= m.r.High {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the configuration, without building anything.
+func (c *Config) Validate() error {
+	_, err := c.plan()
+	return err
+}
+
+// Build the system described by the configuration. The caller is
+// responsible for closing it.
+func (c *Config) Build() (*Machine, error) {
+	plan, err := c.plan()
+	if err != nil {
+		return nil, err
+	}
+	scheduling, _ := parseScheduling(c.Scheduling)
+	unit, _ := parseUnit(c.Pacing.Unit)
+
+	s := system.NewSystem(scheduling, c.Seed)
+	s.Pacing = system.Pacing{Rate: c.Pacing.Rate, Unit: unit}
+	rv := &Machine{System: s}
+
+	for _, spec := range c.CPUs {
+		cp := cpu.NewCPU()
+		cp.IC = uint32(spec.Boot.IC)
+		cp.InterruptBase = uint32(spec.Boot.InterruptBase)
+		s.AddCPU(cp)
+	}
+
+	modules := make([]shared.SharedMemory, len(c.Shared))
+	for ix, spec := range c.Shared {
+		modules[ix] = shared.NewSharedMemory(uint32(spec.High-spec.Low) + 1)
+		s.Modules = append(s.Modules, modules[ix])
+		if spec.Latency > 0 {
+			if err := modules[ix].SetTiming(shared.Timing{Latency: spec.Latency, Stall: s.Stall}); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+
+	for cix, ms := range plan {
+		cp := s.CPUs[cix]
+		for _, m := range ms {
+			size := m.r.High - m.r.Low + 1
+			var b cpu.MemoryBackend
+			switch m.kind {
+			case "local":
+				b = cpu.NewDirectMemory(size)
+			case "rom":
+				b = cpu.NewReadOnlyMemory(size, m.image)
+			case "shared":
+				b = modules[m.ix].Port(cix)
+			case "rtc":
+				b = device.NewRTC(cp, m.spec.Divisor)
+			case "timer":
+				b = device.NewIntervalTimer(cp, cp, m.spec.Level, m.spec.Divisor)
+			}
+			if err := cp.RegisterMemory(m.r, b); err != nil {
+				s.Close()
+				return nil, err
+			}
+			rv.Modules = append(rv.Modules, Module{Name: m.name, Kind: m.kind, CPU: cix, Range: m.r, Backend: b})
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"cpus":    len(s.CPUs),
+		"shared":  len(s.Modules),
+		"modules": len(rv.Modules),
+	}).Debug("Built system from configuration")
+	return rv, nil
+}
+
+// Return the module with the given name mapped into the given CPU.
+func (m *Machine) Module(cix int, name string) (Module, bool) {
+	for _, mod := range m.Modules {
+		if mod.CPU == cix && mod.Name == name {
+			return mod, true
+		}
+	}
+	return Module{}, false
+}
+
+// Build a machine with a single CPU, with size half-words of local
+// memory, holding the image at address load, and with IC set to
+// load. The memory module is called "memory".
+func ImageMachine(image []uint16, size, load uint32) (*Machine, error) {
+	if size == 0 || size > 0x40000 {
+		return nil, fmt.Errorf("Memory size 0x%x is outside the address space", size)
+	}
+	if uint64(load)+uint64(len(image)) > uint64(size) {
+		return nil, fmt.Errorf("Image does not fit in %d half-words at 0x%x", size, load)
+	}
+	c := cpu.NewCPU()
+	r := cpu.MemoryRange{Low: 0, High: size - 1}
+	mem := cpu.NewDirectMemory(size)
+	if err := c.RegisterMemory(r, mem); err != nil {
+		return nil, err
+	}
+	for ix, h := range image {
+		c.StoreHalfWord(load+uint32(ix), h)
+	}
+	c.IC = load
+	s := system.NewSystem(system.Lockstep, 0)
+	s.AddCPU(c)
+	return &Machine{
+		System:  s,
+		Modules: []Module{{Name: "memory", Kind: "local", CPU: 0, Range: r, Backend: mem}},
+	}, nil
+}
+
+// Build a machine with a single CPU, with size half-words of local
+// memory, holding an image in any of the formats of the memimage
+// package, and with IC set to where the image starts.
+func LoadedMachine(img *memimage.Image, size uint32) (*Machine, error) {
+	m, err := ImageMachine(nil, size, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.Load(m.CPUs[0]); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("Image does not fit in %d half-words, %v", size, err)
+	}
+	m.CPUs[0].IC = img.Start()
+	return m, nil
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/device"
+	"github.com/vatine/censor932/pkg/memimage"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// Write files into a fresh directory, returning its name.
+func writeFiles(t *testing.T, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Unexpected error writing %s, %v", name, err)
+		}
+	}
+	return dir
+}
+
+const twoCPUs = `{
+  "scheduling": "lockstep",
+  "cpus": [
+    {
+      "local": [{"name": "ram0", "low": 0, "high": "0xff"}],
+      "roms": [{"name": "boot", "low": "0x100", "image": "boot.bin"}],
+      "devices": [{"name": "rtc0", "type": "rtc", "low": "0x200"}],
+      "boot": {"ic": "0x100"}
+    },
+    {
+      "local": [{"name": "ram1", "low": 0, "high": "0xff"}]
+    }
+  ],
+  "shared": [{"name": "common", "low": "0x1000", "high": "0x100f"}]
+}`
+
+func TestBuild(t *testing.T) {
+	// LD G1, 0x1234; STW G1 -> 0x1000
+	boot := []byte{0x98, 0x10, 0x12, 0x34, 0x50, 0x10, 0x0e, 0xfe}
+	dir := writeFiles(t, map[string][]byte{"932.json": []byte(twoCPUs), "boot.bin": boot})
+	defer os.RemoveAll(dir)
+
+	cfg, err := Load(filepath.Join(dir, "932.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error loading, %v", err)
+	}
+	m, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error building, %v", err)
+	}
+	defer m.Close()
+
+	if m.Scheduling != system.Lockstep {
+		t.Errorf("Scheduling is %v, expected lockstep", m.Scheduling)
+	}
+	if len(m.CPUs) != 2 || len(m.System.Modules) != 1 {
+		t.Fatalf("Built %d CPUs and %d shared modules, expected 2 and 1", len(m.CPUs), len(m.System.Modules))
+	}
+	if mod, ok := m.Module(0, "rtc0"); !ok {
+		t.Errorf("No rtc0 on CPU 0")
+	} else if _, ok := mod.Backend.(*device.RTC); !ok {
+		t.Errorf("rtc0 is a %T, expected *device.RTC", mod.Backend)
+	}
+	if mod, ok := m.Module(0, "boot"); !ok || mod.Range.High != 0x103 {
+		t.Errorf("ROM boot is %v, expected it to end at 0x103", mod.Range)
+	}
+
+	m.Run(2)
+	if w := m.CPUs[1].FetchWord(0x1000); w != 0x1234 {
+		t.Errorf("CPU 1 sees 0x%08x in shared memory, expected 0x00001234", w)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	cfg, err := Parse([]byte(`{"cpus": [{"local": [{"low": "0o10", "high": 4096}], "boot": {"ic": "0x10"}}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing, %v", err)
+	}
+	l := cfg.CPUs[0].Local[0]
+	if l.Low != 8 || l.High != 4096 || cfg.CPUs[0].Boot.IC != 16 {
+		t.Errorf("Parsed %d-%d, IC %d, expected 8-4096, IC 16", l.Low, l.High, cfg.CPUs[0].Boot.IC)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{`{"cpus": []}`, "No CPUs"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}]}], "scheduling": "often"}`, "Unknown scheduling"},
+		{`{"cpus": [{"local": [{"name": "a", "low": 0, "high": 15}, {"name": "b", "low": 8, "high": 31}]}]}`, "Modules a and b overlap on CPU #0"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}]}], "shared": [{"name": "s", "low": 10, "high": 20}]}`, "overlap"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}]}], "shared": [{"low": 16, "high": 20, "cpus": [1]}]}`, "refers to CPU #1"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}], "boot": {"ic": 16}}]}`, "no memory at its boot address"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}], "devices": [{"type": "printer", "low": 16}]}]}`, "Unknown device type"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}], "roms": [{"low": 16, "image": "missing.bin"}]}]}`, "missing.bin"},
+		{`{"cpus": [{"local": [{"low": 15, "high": 0}]}]}`, "above high address"},
+		{`{"cpus": [{"local": [{"name": "a", "low": 0, "high": 15}, {"name": "a", "low": 16, "high": 31}]}]}`, "Duplicate module name"},
+		{`{"cpus": [{"local": [{"low": 0, "high": 15}]}], "shared": [{"name": "s", "low": 16, "high": 31, "latency": 2}], "scheduling": "free"}`, "Shared module s has a latency"},
+	}
+
+	for ix, tc := range cases {
+		cfg, err := Parse([]byte(tc.config))
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error parsing, %v", ix, err)
+			continue
+		}
+		err = cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Case #%d, error was %v, expected it to mention %q", ix, err, tc.err)
+		}
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	if _, err := Parse([]byte(`{"cpu": []}`)); err == nil {
+		t.Errorf("Expected an error for an unknown field")
+	}
+}
+
+func TestImageMachine(t *testing.T) {
+	m, err := ImageMachine([]uint16{0x1234, 0x5678}, 0x1000, 0x100)
+	if err != nil {
+		t.Fatalf("Unexpected error building machine, %v", err)
+	}
+	defer m.Close()
+	c := m.CPUs[0]
+	if c.IC != 0x100 || c.FetchWord(0x100) != 0x12345678 {
+		t.Errorf("IC %05x, word %08x, expected 00100 and 12345678", c.IC, c.FetchWord(0x100))
+	}
+	if c.Mapped(0x1000) {
+		t.Errorf("Expected 0x1000 to be unmapped")
+	}
+	if _, ok := m.Module(0, "memory"); !ok {
+		t.Errorf("Expected a module called memory")
+	}
+
+	if _, err := ImageMachine([]uint16{1, 2}, 0x1000, 0xfff); err == nil {
+		t.Errorf("Expected an error for an image that does not fit")
+	}
+}
+
+func TestLoadedMachine(t *testing.T) {
+	img := memimage.NewImage(0x100, []uint16{0x1234, 0x5678})
+	img.Add(0x200, 0x9abc)
+	entry := uint32(0x200)
+	img.Entry = &entry
+	m, err := LoadedMachine(img, 0x1000)
+	if err != nil {
+		t.Fatalf("Unexpected error building machine, %v", err)
+	}
+	defer m.Close()
+	c := m.CPUs[0]
+	if c.IC != 0x200 || c.FetchWord(0x100) != 0x12345678 || c.FetchHalfWord(0x200) != 0x9abc {
+		t.Errorf("IC %05x, words %08x and %04x", c.IC, c.FetchWord(0x100), c.FetchHalfWord(0x200))
+	}
+
+	if _, err := LoadedMachine(memimage.NewImage(0xfff, []uint16{1, 2}), 0x1000); err == nil || err.Error() != "Image does not fit in 4096 half-words, Address 0x01000 is not mapped" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -10,6 +10,7 @@ package cpu
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -37,6 +38,68 @@ type MemoryBackend interface {
 	WriteWord(uint32, uint32) uint32
 }
 
+// What a memory access is made for.
+type AccessKind int
+
+const (
+	// Fetching an instruction to execute.
+	InstructionFetch AccessKind = iota
+	// Reading an operand.
+	DataRead
+	// Writing an operand.
+	DataWrite
+	// Fetching an indirect address, in computeEffective.
+	IndirectFetch
+	// Exchanging a register and memory, as one indivisible
+	// operation, by IW or IH.
+	Interchange
+)
+
+func (k AccessKind) String() string {
+	switch k {
+	case InstructionFetch:
+		return "InstructionFetch"
+	case DataRead:
+		return "DataRead"
+	case DataWrite:
+		return "DataWrite"
+	case IndirectFetch:
+		return "IndirectFetch"
+	case Interchange:
+		return "Interchange"
+	}
+	return fmt.Sprintf("AccessKind(%d)", int(k))
+}
+
+// Who is making a memory access, and why.
+type Access struct {
+	Requester int // The ID of the requesting CPU
+	Kind      AccessKind
+	IC        uint32 // The IC of the instruction making the access
+	Word      uint32 // The instruction making the access
+}
+
+// A MemoryBackend that wants to know who is accessing it, and
+// why. When a backend implements this, the CPU calls these methods
+// instead of the plain MemoryBackend ones.
+type TaggedMemoryBackend interface {
+	MemoryBackend
+	FetchHalfWordFor(Access, uint32) uint16
+	WriteHalfWordFor(Access, uint32, uint16) uint16
+	FetchWordFor(Access, uint32) uint32
+	WriteWordFor(Access, uint32, uint32) uint32
+}
+
+// A MemoryBackend that debuggers can look at and change without it
+// being an access: nothing watching the accesses is told, nothing is
+// buffered or timed, and devices do not react to it. Backends without
+// these are looked at through their MemoryBackend methods.
+type DebugMemoryBackend interface {
+	MemoryBackend
+	PeekHalfWord(uint32) uint16
+	PokeHalfWord(uint32, uint16)
+}
+
 // Rgeister a given MemoryBackend as the storage backend starting at
 // Range.Low, ending at Range.High.
 type MemoryPlugin struct {
@@ -46,12 +109,44 @@ type MemoryPlugin struct {
 
 // Basic CPU data structure
 type CPU struct {
+	ID     int // Identifies the CPU to TaggedMemoryBackends
 	G      [16]uint32
 	IC     uint32 // This is technically an 18-bit entity
 	PS     uint64
 	MIR    uint32 // Actually a 24-bit entity
 	Memory []MemoryPlugin
 	CC     uint8
+	word   uint32 // The instruction currently executing
+	stalls uint64 // Cycles spent waiting for memory, accessed atomically
+
+	Cycles         uint64           // Elapsed virtual time
+	CycleCosts     map[uint8]uint64 // Per-opcode overrides of the default costs
+	MemoryCycles   uint64           // Extra cost of each memory access
+	IndirectCycles uint64           // Extra cost of indirect addressing
+	stallsSeen     uint64           // Stalls already counted in Cycles
+	accesses       uint64           // Memory accesses made
+	indirections   uint64           // Indirect addresses computed
+	devices        []Device
+
+	InterruptBase   uint32 // Start of the interrupt vectors
+	InterruptMasked uint16 // A set bit masks the interrupt level
+	pending         uint16 // Pending interrupt levels
+	inService       uint16 // Levels whose handlers have not returned
+
+	Events     EventQueue // Device events, on the virtual clock
+	IdleCycles uint64     // Cycles skipped while waiting for events
+	idle       bool       // The last instruction jumped to itself
+
+	Trap    *Trap                         // The first trap taken, if any
+	Trace   func(c *CPU, ic, word uint32) // If set, called after each instruction
+	Journal *Journal                      // If set, records how to undo each instruction
+	Watch   func(c *CPU, address uint32)  // If set, called for each half-word written
+
+	Recorder *FlightRecorder // If set, keeps the last few instructions
+	ea       uint32          // The last effective address computed
+	eaValid  bool            // An effective address was computed this Step
+	via      uint32          // Where the last indirect address was fetched from
+	indirect bool            // The effective address this Step was indirect
 }
 
 // Pull the upper 32 bits out of a 64-bit entity
@@ -80,100 +175,157 @@ func registerFunction(opcode uint8, builder InstructionBuilder) {
 	instructionTable[opcode] = builder
 }
 
+// The opcode and cycle tables are filled in from the instruction set,
+// see isa.go.
 func init() {
-	instructionTable = map[uint8]InstructionBuilder{}
-
-	registerFunction(0x4e, BuildIHFunc)
-	registerFunction(0x5e, BuildIWFunc)
-	registerFunction(0xcd, BuildLDFunc)
-	registerFunction(0x98, BuildLDFunc)
-	registerFunction(0x68, BuildLDWFunc)
-	registerFunction(0x48, BuildLHFunc)
-	registerFunction(0xcb, BuildLNFunc)
-	registerFunction(0xca, BuildLPFunc)
-	registerFunction(0xb8, BuildLRSFunc)
-	registerFunction(0xcc, BuildLTFunc)
-	registerFunction(0x58, BuildLWFunc)
-	registerFunction(0x4f, BuildRZHFunc)
-	registerFunction(0x5f, BuildRZWFunc)
-	registerFunction(0xb0, BuildSRSFunc)
-	registerFunction(0x60, BuildSTDWFunc)
-	registerFunction(0x40, BuildSTHFunc)
-	registerFunction(0x50, BuildSTWFunc)
-	registerFunction(0x9a, BuildADFunc)
-	registerFunction(0x6a, BuildADWFunc)
-	registerFunction(0x4a, BuildAHFunc)
-	registerFunction(0x1a, BuildASFunc)
-	registerFunction(0x2a, BuildATSFunc)
-	registerFunction(0x5a, BuildAWFunc)
-	registerFunction(0x99, BuildCDFunc)
-	registerFunction(0x49, BuildCHFunc)
-	registerFunction(0x59, BuildCWFunc)
-	registerFunction(0x9d, BuildDHFunc)
-	registerFunction(0x4d, BuildDHFunc)
-	registerFunction(0x1d, BuildDSFunc)
-	registerFunction(0x5d, BuildDWFunc)
-	registerFunction(0x9c, BuildMDFunc)
-	registerFunction(0x4c, BuildMHFunc)
-	registerFunction(0x1c, BuildMSFunc)
-	registerFunction(0x5c, BuildMWFunc)
-	registerFunction(0x9b, BuildSDFunc)
-	registerFunction(0x6b, BuildSDWFunc)
-	registerFunction(0x2b, BuildSFSFunc)
-	registerFunction(0x4b, BuildSHFunc)
-	registerFunction(0x1b, BuildSSFunc)
-	registerFunction(0x5b, BuildSWFunc)
-	registerFunction(0x97, BuildCLDFunc)
-	registerFunction(0x47, BuildCLHFunc)
-	registerFunction(0x57, BuildCLWFunc)
-	registerFunction(0x94, BuildNDFunc)
-	registerFunction(0x44, BuildNHFunc)
-	registerFunction(0x14, BuildNSFunc)
-	registerFunction(0x24, BuildNTSFunc)
-	registerFunction(0x54, BuildNWFunc)
-	registerFunction(0x95, BuildNDFunc)
-	registerFunction(0x45, BuildNHFunc)
-	registerFunction(0x15, BuildOSFunc)
-	registerFunction(0x25, BuildOTSFunc)
-	registerFunction(0x55, BuildOWFunc)
-	registerFunction(0x96, BuildXDFunc)
-	registerFunction(0x46, BuildXHFunc)
-	registerFunction(0x16, BuildXSFunc)
-	registerFunction(0x26, BuildXTSFunc)
-	registerFunction(0x56, BuildXWFunc)
-	registerFunction(0x85, BuildRLSFunc)
-	registerFunction(0x87, BuildRLDFunc)
-	registerFunction(0x84, BuildRRSFunc)
-	registerFunction(0x86, BuildRRDFunc)
-	registerFunction(0x89, BuildSLAFunc)
-	registerFunction(0x8b, BuildSLDAFunc)
-	registerFunction(0x8d, BuildSLLFunc)
-	registerFunction(0x8f, BuildSLDLFunc)
-	registerFunction(0x88, BuildSRAFunc)
-	registerFunction(0x8a, BuildSRDAFunc)
-	registerFunction(0x8c, BuildSRLFunc)
-	registerFunction(0x8e, BuildSRDLFunc)
-	// registerFunction(0xc0, BuildCPFunc)a
-	registerFunction(0xc1, BuildEXFunc)
-	registerFunction(0x05, BuildJCFunc)
-	registerFunction(0x02, BuildJOSFunc)
-	registerFunction(0x03, BuildJTSFunc)
-	registerFunction(0x04, BuildJOAFunc)
-	registerFunction(0x01, BuildJSFunc)
-	// registerFunction(0x06, BuildJSPFunc)
-	// registerFunction(0c3, BuildLSKFunc)
-	// registerFunction(0c2, BuildLSPFunc)
-	registerFunction(0x00, BuildNOPFunc)
-	// registerFunction(0x08, BuildSTSRFunc)
+	loadISA()
+}
+
+// The cost, in cycles, of executing an instruction, not counting
+// memory accesses and indirect addressing, from the instruction set.
+// Anything not in the table takes defaultCycles.
+var cycleTable map[uint8]uint64
+
+const defaultCycles = 1
+
+func registerCycles(cycles uint64, opcodes ...uint8) {
+	for _, op := range opcodes {
+		cycleTable[op] = cycles
+	}
+}
+
+// Return the cost of an instruction, on this CPU.
+func (c *CPU) cycleCost(op uint8) uint64 {
+	if n, ok := c.CycleCosts[op]; ok {
+		return n
+	}
+	if n, ok := cycleTable[op]; ok {
+		return n
+	}
+	return defaultCycles
 }
 
 func NewCPU() *CPU {
 	var rv CPU
 	rv.Memory = []MemoryPlugin{}
+	rv.CycleCosts = map[uint8]uint64{}
+	rv.MemoryCycles = 1
+	rv.IndirectCycles = 1
 
 	return &rv
 }
 
+// A Clock is a source of virtual time, counted in cycles.
+type Clock interface {
+	Now() uint64
+}
+
+// A Device is told about the passing of virtual time, after every
+// instruction the CPU it is attached to executes.
+type Device interface {
+	Tick(now uint64)
+}
+
+// Return the virtual time of the CPU, that is the number of cycles it
+// has executed (including stalls).
+func (c *CPU) Now() uint64 {
+	return c.Cycles
+}
+
+// Attach a device to the CPU's virtual clock.
+func (c *CPU) AttachDevice(d Device) {
+	c.devices = append(c.devices, d)
+}
+
+// Put the CPU back as it was when it was created, apart from its
+// registers and memory: the clock and stall counts start from zero,
+// no interrupts are pending or in service, the event queue is empty
+// and there is no trap.
+func (c *CPU) Reset() {
+	c.Cycles, c.IdleCycles = 0, 0
+	atomic.StoreUint64(&c.stalls, 0)
+	c.stallsSeen, c.accesses, c.indirections = 0, 0, 0
+	c.pending, c.inService = 0, 0
+	c.Events = EventQueue{}
+	c.idle = false
+	c.Trap = nil
+}
+
+// Note that the CPU has had to wait the given number of cycles for
+// memory. Safe to call from other goroutines.
+func (c *CPU) Stall(cycles uint64) {
+	atomic.AddUint64(&c.stalls, cycles)
+}
+
+// Return the number of cycles the CPU has spent waiting for memory.
+func (c *CPU) Stalls() uint64 {
+	return atomic.LoadUint64(&c.stalls)
+}
+
+// Interrupts
+//
+// The machine description does not say how interrupts are taken, so
+// this is a guess. There are 16 interrupt levels, level 0 having the
+// highest priority. Each level has a two-word vector, at
+// InterruptBase + 4 * level. When an unmasked interrupt is pending,
+// before the next instruction is fetched, the CPU stores the IC in
+// the first word of the vector and continues at the address in the
+// second word. The handler can return with an indirect jump through
+// the first word.
+//
+// From the time it is taken until its handler returns, a level is in
+// service, and neither it nor any level of lower priority is taken, so
+// the saved IC is not overwritten by the handler being re-entered.
+
+// Raise an interrupt at the given level. This is intended to be
+// called by devices, from the CPU's own goroutine.
+func (c *CPU) Interrupt(level uint8) {
+	c.pending |= 1 << (level & 0x0f)
+}
+
+// Return the highest-priority pending, unmasked, interrupt, if it has
+// a higher priority than any level in service.
+func (c *CPU) pendingInterrupt() (uint8, bool) {
+	active := c.pending &^ c.InterruptMasked
+	for level := uint8(0); level < 16; level++ {
+		if c.inService&(1<<level) != 0 {
+			return 0, false
+		}
+		if active&(1<<level) != 0 {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// Save the IC in the vector of the given level, and continue at the
+// handler address.
+func (c *CPU) takeInterrupt(level uint8) {
+	log.WithFields(log.Fields{
+		"IC":    c.IC,
+		"level": level,
+	}).Debug("interrupt")
+	c.pending &^= 1 << level
+	c.inService |= 1 << level
+	vector := (c.InterruptBase + 4*uint32(level)) & mask
+	c.storeWord(DataWrite, vector, c.IC)
+	c.IC = c.fetchWord(IndirectFetch, vector+2) & mask
+}
+
+// If the instruction just executed jumped indirectly through the
+// first word of the vector of a level in service, the handler of that
+// level has returned.
+func (c *CPU) endService() {
+	if c.inService == 0 || !c.indirect || c.IC != c.ea {
+		return
+	}
+	for level := uint8(0); level < 16; level++ {
+		if c.inService&(1<<level) != 0 && (c.InterruptBase+4*uint32(level))&mask == c.via {
+			c.inService &^= 1 << level
+		}
+	}
+}
+
 // Set correct values for condition code, depending on value and type of operation.
 func (c *CPU) setCC(opType int, value uint32) {
 	switch {
@@ -221,7 +373,9 @@ func (c *CPU) computeEffective(addr uint16, indirect bool, ixReg uint8) uint32 {
 	rv = rv & mask
 
 	if indirect {
-		rv = c.FetchWord(rv)
+		c.indirections++
+		c.via, c.indirect = rv, true
+		rv = c.fetchWord(IndirectFetch, rv)
 		rv = rv & mask
 	}
 
@@ -236,6 +390,7 @@ func (c *CPU) computeEffective(addr uint16, indirect bool, ixReg uint8) uint32 {
 		"indirect": indirect,
 		"ixReg":    ixReg,
 	}).Debug("computeEffective outputs")
+	c.ea, c.eaValid = rv, true
 
 	return rv
 }
@@ -264,9 +419,57 @@ func (c *CPU) Step() {
 		"IC": c.IC,
 	}
 	log.WithFields(fields).Debug("CPU Step")
-	word := c.FetchWord(c.IC)
+	if c.Journal != nil {
+		c.Journal.begin(c)
+		defer c.Journal.end()
+	}
+	accesses, indirections := c.accesses, c.indirections
+	trapped := c.Trap != nil
+	if c.Recorder != nil {
+		defer c.Recorder.catch(c)
+	}
+	if level, ok := c.pendingInterrupt(); ok {
+		c.takeInterrupt(level)
+	}
+	ic := c.IC
+	g, cc := c.G, c.CC
+	c.eaValid, c.indirect = false, false
+	c.word = 0
+	word := c.fetchWord(InstructionFetch, c.IC)
+	c.word = word
+	if _, ok := instructionTable[uint8(word>>24)]; !ok {
+		c.trap(IllegalInstruction, 0)
+	}
 
 	c.IC = decodeWord(word).Execute(c)
+	c.endService()
+	if c.Recorder != nil {
+		c.Recorder.record(c, ic, word, g, cc)
+	}
+	c.Cycles += c.cycleCost(uint8(word >> 24))
+	c.Cycles += (c.accesses - accesses) * c.MemoryCycles
+	c.Cycles += (c.indirections - indirections) * c.IndirectCycles
+
+	stalls := c.Stalls()
+	c.Cycles += stalls - c.stallsSeen
+	c.stallsSeen = stalls
+
+	for _, d := range c.devices {
+		d.Tick(c.Cycles)
+	}
+
+	c.idle = c.IC == ic
+	if c.idle {
+		c.fastForward()
+	}
+	c.Events.RunUntil(c.Cycles)
+
+	if c.Trace != nil {
+		c.Trace(c, ic, word)
+	}
+	if c.Recorder != nil && !trapped && c.Trap != nil {
+		c.Recorder.Dump(c.Recorder.out(), fmt.Sprintf("CPU %d trapped: %v", c.ID, c.Trap))
+	}
 }
 
 // Return the memoryPluging that corresponds to a specific address
@@ -279,6 +482,12 @@ func (c *CPU) findMemory(address uint32) (MemoryBackend, uint32) {
 	return nil, 0
 }
 
+// Is there a memory backend at the address?
+func (c *CPU) Mapped(address uint32) bool {
+	mp, _ := c.findMemory(address)
+	return mp != nil
+}
+
 // Register a memory backend with a specific memory range. Return an
 // error if the memory plugin is colliding with an alread-registered
 // plugin.
@@ -295,28 +504,167 @@ func (c *CPU) RegisterMemory(r MemoryRange, m MemoryBackend) error {
 
 // Fetch a 32-bit word from a specific address
 func (c *CPU) FetchWord(address uint32) uint32 {
+	return c.fetchWord(DataRead, address)
+}
+
+// Fetch a 16-bit word from a specific address
+func (c *CPU) FetchHalfWord(address uint32) uint16 {
+	return c.fetchHalfWord(DataRead, address)
+}
+
+func (c *CPU) StoreWord(address, word uint32) uint32 {
+	return c.storeWord(DataWrite, address, word)
+}
+
+func (c *CPU) StoreHalfWord(address uint32, word uint16) uint16 {
+	return c.storeHalfWord(DataWrite, address, word)
+}
+
+// Read a half-word for a debugger. Unlike FetchHalfWord, this is not
+// an access by the CPU: it is not counted, does not trap, and goes
+// around anything watching or buffering the accesses of the CPU (see
+// DebugMemoryBackend). Return false if there is no memory there.
+func (c *CPU) Peek(address uint32) (uint16, bool) {
+	mp, offset := c.findMemory(address & mask)
+	if mp == nil {
+		return 0, false
+	}
+	if d, ok := mp.(DebugMemoryBackend); ok {
+		return d.PeekHalfWord(offset), true
+	}
+	return mp.FetchHalfWord(offset), true
+}
+
+// Read a word for a debugger, the way Peek reads a half-word.
+func (c *CPU) PeekWord(address uint32) (uint32, bool) {
+	if mp, offset, ok := c.wordBackend(address); ok {
+		return mp.FetchWord(offset), true
+	}
+	h0, ok0 := c.Peek(address)
+	h1, ok1 := c.Peek(address + 1)
+	return uint32(h0)<<16 | uint32(h1), ok0 && ok1
+}
+
+// Return the backend holding both half-words of the word at address,
+// if it has no debugger access of its own, so that it sees a single
+// word access, as it would from the CPU.
+func (c *CPU) wordBackend(address uint32) (MemoryBackend, uint32, bool) {
+	address &= mask
+	for _, mp := range c.Memory {
+		if mp.Range.Low <= address && address < mp.Range.High {
+			_, debug := mp.Backend.(DebugMemoryBackend)
+			return mp.Backend, address - mp.Range.Low, !debug
+		}
+	}
+	return nil, 0, false
+}
+
+// Change a half-word for a debugger, the way Peek reads one. The
+// journal and any watchpoints do not see the change. Return false if
+// there is no memory there.
+func (c *CPU) Poke(address uint32, value uint16) bool {
+	mp, offset := c.findMemory(address & mask)
+	if mp == nil {
+		return false
+	}
+	if d, ok := mp.(DebugMemoryBackend); ok {
+		d.PokeHalfWord(offset, value)
+	} else {
+		mp.WriteHalfWord(offset, value)
+	}
+	return true
+}
+
+// Change a word for a debugger, the way Poke changes a half-word.
+func (c *CPU) PokeWord(address, value uint32) bool {
+	if mp, offset, ok := c.wordBackend(address); ok {
+		mp.WriteWord(offset, value)
+		return true
+	}
+	ok0 := c.Poke(address, uint16(value>>16))
+	ok1 := c.Poke(address+1, uint16(value))
+	return ok0 && ok1
+}
+
+// Describe an access of the given kind, made by the current instruction.
+func (c *CPU) access(kind AccessKind) Access {
+	return Access{Requester: c.ID, Kind: kind, IC: c.IC, Word: c.word}
+}
+
+func (c *CPU) fetchWord(kind AccessKind, address uint32) uint32 {
 	mp, offset := c.findMemory(address)
+	c.accesses++
+	if mp == nil {
+		c.trap(UnmappedAddress, address)
+		return 0
+	}
 
+	if t, ok := mp.(TaggedMemoryBackend); ok {
+		return t.FetchWordFor(c.access(kind), offset)
+	}
 	return mp.FetchWord(offset)
 }
 
-// Fetch a 16-bit word from a specific address
-func (c *CPU) FetchHalfWord(address uint32) uint16 {
+func (c *CPU) fetchHalfWord(kind AccessKind, address uint32) uint16 {
 	mp, offset := c.findMemory(address)
+	c.accesses++
+	if mp == nil {
+		c.trap(UnmappedAddress, address)
+		return 0
+	}
 
+	if t, ok := mp.(TaggedMemoryBackend); ok {
+		return t.FetchHalfWordFor(c.access(kind), offset)
+	}
 	return mp.FetchHalfWord(offset)
 }
 
-func (c *CPU) StoreWord(address, word uint32) uint32 {
+func (c *CPU) storeWord(kind AccessKind, address, word uint32) uint32 {
 	mp, offset := c.findMemory(address)
+	c.accesses++
+	if mp == nil {
+		c.trap(UnmappedAddress, address)
+		return 0
+	}
 
-	return mp.WriteWord(offset, word)
+	var old uint32
+	if t, ok := mp.(TaggedMemoryBackend); ok {
+		old = t.WriteWordFor(c.access(kind), offset, word)
+	} else {
+		old = mp.WriteWord(offset, word)
+	}
+	if c.Journal != nil && c.Journal.recording {
+		c.Journal.wrote(address, uint16(old>>16))
+		c.Journal.wrote(address+1, uint16(old))
+	}
+	if c.Watch != nil {
+		c.Watch(c, address&mask)
+		c.Watch(c, (address+1)&mask)
+	}
+	return old
 }
 
-func (c *CPU) StoreHalfWord(address uint32, word uint16) uint16 {
+func (c *CPU) storeHalfWord(kind AccessKind, address uint32, word uint16) uint16 {
 	mp, offset := c.findMemory(address)
+	c.accesses++
+	if mp == nil {
+		c.trap(UnmappedAddress, address)
+		return 0
+	}
 
-	return mp.WriteHalfWord(offset, word)
+	var old uint16
+	if t, ok := mp.(TaggedMemoryBackend); ok {
+		old = t.WriteHalfWordFor(c.access(kind), offset, word)
+	} else {
+		old = mp.WriteHalfWord(offset, word)
+	}
+	if c.Journal != nil && c.Journal.recording {
+		c.Journal.wrote(address, old)
+	}
+	if c.Watch != nil {
+		c.Watch(c, address&mask)
+	}
+	return old
 }
 
 // Various stuff for implementing "local" memory
@@ -347,6 +695,14 @@ func (m *DirectMemory) WriteWord(address, data uint32) uint32 {
 	return old
 }
 
+func (m *DirectMemory) PeekHalfWord(address uint32) uint16 {
+	return m.memory[address]
+}
+
+func (m *DirectMemory) PokeHalfWord(address uint32, data uint16) {
+	m.memory[address] = data
+}
+
 func NewDirectMemory(size uint32) *DirectMemory {
 	var rv DirectMemory
 
@@ -355,6 +711,49 @@ func NewDirectMemory(size uint32) *DirectMemory {
 	return &rv
 }
 
+// Read-only memory, for ROM images. Writes are ignored, and return
+// the current contents.
+type ReadOnlyMemory struct {
+	memory []uint16
+}
+
+func (m *ReadOnlyMemory) FetchWord(address uint32) uint32 {
+	w1 := uint32(m.memory[address])
+	w2 := uint32(m.memory[address+1])
+	return (w1 << 16) | w2
+}
+
+func (m *ReadOnlyMemory) FetchHalfWord(address uint32) uint16 {
+	return m.memory[address]
+}
+
+func (m *ReadOnlyMemory) WriteHalfWord(address uint32, data uint16) uint16 {
+	log.WithFields(log.Fields{"address": address, "data": data}).Debug("Write to read-only memory ignored")
+	return m.memory[address]
+}
+
+func (m *ReadOnlyMemory) WriteWord(address, data uint32) uint32 {
+	log.WithFields(log.Fields{"address": address, "data": data}).Debug("Write to read-only memory ignored")
+	return m.FetchWord(address)
+}
+
+// Replace the contents of the memory with a copy of contents. Any
+// half-words past the end of contents become zero.
+func (m *ReadOnlyMemory) Load(contents []uint16) {
+	n := copy(m.memory, contents)
+	for ix := n; ix < len(m.memory); ix++ {
+		m.memory[ix] = 0
+	}
+}
+
+// Create a read-only memory of the given size, holding a copy of
+// contents. Any half-words past the end of contents are zero.
+func NewReadOnlyMemory(size uint32, contents []uint16) *ReadOnlyMemory {
+	rv := ReadOnlyMemory{memory: make([]uint16, size)}
+	copy(rv.memory, contents)
+	return &rv
+}
+
 // Type1 instructions all have a index register reference. However,
 // the CPu description document has no reference to how the index
 // registers work, nor how to set them. One of the later models does
@@ -413,7 +812,7 @@ type IW type1
 func (i IW) Execute(c *CPU) uint32 {
 	target := c.computeEffective(i.as, i.i, i.x)
 
-	c.G[i.r] = c.StoreWord(target, c.G[i.r])
+	c.G[i.r] = c.storeWord(Interchange, target, c.G[i.r])
 
 	return c.IC + 2
 }
@@ -427,7 +826,7 @@ type IH type1
 func (i IH) Execute(c *CPU) uint32 {
 	target := c.computeEffective(i.as, i.i, i.x)
 
-	c.G[i.r] = uint32(c.StoreHalfWord(target, uint16(c.G[i.r]&0x0000ffff)))
+	c.G[i.r] = uint32(c.storeHalfWord(Interchange, target, uint16(c.G[i.r]&0x0000ffff)))
 
 	return c.IC + 2
 }
@@ -846,7 +1245,7 @@ func BuildDSFunc(op, r1, r2 uint8, as uint16) Instruction {
 type DW type1
 
 func (i DW) Execute(c *CPU) uint32 {
-	value := uint64(c.G[i.r] << 32)
+	value := uint64(c.G[i.r]) << 32
 	value = value + uint64(c.G[i.r+1])
 	source := c.computeEffective(i.as, i.i, i.x)
 	dividend := uint64(c.FetchWord(source))
@@ -934,9 +1333,9 @@ func BuildSDFunc(op, r1, r2 uint8, d uint16) Instruction {
 type SDW type1
 
 func (i SDW) Execute(c *CPU) uint32 {
-	v1 := uint64(c.G[i.r]<<32) + uint64(c.G[i.r+1])
+	v1 := uint64(c.G[i.r])<<32 + uint64(c.G[i.r+1])
 	source := c.computeEffective(i.as, i.i, i.x)
-	v2 := uint64(c.FetchWord(source) << 32)
+	v2 := uint64(c.FetchWord(source)) << 32
 	source = c.computeEffective(i.as+2, i.i, i.x)
 	v2 += uint64(c.FetchWord(source))
 
@@ -1445,7 +1844,7 @@ type EX type1
 
 func (i EX) Execute(c *CPU) uint32 {
 	source := c.computeEffective(i.as, i.i, i.x)
-	value := c.FetchWord(source)
+	value := c.fetchWord(InstructionFetch, source)
 	return decodeWord(value).Execute(c)
 }
 func BuildEXFunc(op, r, ix uint8, as uint16) Instruction {
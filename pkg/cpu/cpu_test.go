@@ -75,6 +75,21 @@ func TestDirectMemory(t *testing.T) {
 
 }
 
+func TestReadOnlyMemory(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{Low: 0, High: 3}, NewReadOnlyMemory(4, []uint16{0x1234, 0x5678}))
+
+	if old := c.StoreWord(0, 0xdeadbeef); old != 0x12345678 {
+		t.Errorf("Store returned 0x%08x, expected 0x12345678", old)
+	}
+	if w := c.FetchWord(0); w != 0x12345678 {
+		t.Errorf("ROM holds 0x%08x after a store, expected 0x12345678", w)
+	}
+	if w := c.FetchWord(2); w != 0 {
+		t.Errorf("ROM past the image holds 0x%08x, expected 0", w)
+	}
+}
+
 func TestBasicInstructions(t *testing.T) {
 	var dm *DirectMemory
 	dm = NewDirectMemory(16)
@@ -92,3 +107,175 @@ func TestBasicInstructions(t *testing.T) {
 		t.Errorf("c.IC is %d, expected 2", c.IC)
 	}
 }
+
+// A TaggedMemoryBackend remembering every Access made to it.
+type taggedMemory struct {
+	*DirectMemory
+	seen []Access
+}
+
+func (m *taggedMemory) FetchHalfWordFor(a Access, address uint32) uint16 {
+	m.seen = append(m.seen, a)
+	return m.FetchHalfWord(address)
+}
+
+func (m *taggedMemory) WriteHalfWordFor(a Access, address uint32, data uint16) uint16 {
+	m.seen = append(m.seen, a)
+	return m.WriteHalfWord(address, data)
+}
+
+func (m *taggedMemory) FetchWordFor(a Access, address uint32) uint32 {
+	m.seen = append(m.seen, a)
+	return m.FetchWord(address)
+}
+
+func (m *taggedMemory) WriteWordFor(a Access, address, data uint32) uint32 {
+	m.seen = append(m.seen, a)
+	return m.WriteWord(address, data)
+}
+
+func TestTaggedAccess(t *testing.T) {
+	dm := &taggedMemory{DirectMemory: NewDirectMemory(16)}
+	c := NewCPU()
+	c.ID = 3
+	c.RegisterMemory(MemoryRange{0, 15}, dm)
+
+	// LW G1, *8 ; STW G1, 10
+	dm.memory[0] = 0x5818
+	dm.memory[1] = 0x0008
+	dm.memory[2] = 0x5010
+	dm.memory[3] = 0x0008
+	dm.memory[8] = 0x0000
+	dm.memory[9] = 0x000c
+	c.Step()
+	c.Step()
+
+	expected := []Access{
+		{Requester: 3, Kind: InstructionFetch},
+		{Requester: 3, Kind: IndirectFetch},
+		{Requester: 3, Kind: DataRead},
+		{Requester: 3, Kind: InstructionFetch},
+		{Requester: 3, Kind: DataWrite},
+	}
+	if len(dm.seen) != len(expected) {
+		t.Fatalf("Saw %d accesses, expected %d", len(dm.seen), len(expected))
+	}
+	for ix, a := range expected {
+		a.IC = dm.seen[ix].IC
+		a.Word = dm.seen[ix].Word
+		if dm.seen[ix] != a {
+			t.Errorf("Access #%d was %v, expected %v", ix, dm.seen[ix], a)
+		}
+	}
+}
+
+// A Device remembering when it was ticked.
+type tickRecorder struct {
+	ticks []uint64
+}
+
+func (d *tickRecorder) Tick(now uint64) {
+	d.ticks = append(d.ticks, now)
+}
+
+func TestCycles(t *testing.T) {
+	dm := NewDirectMemory(16)
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{0, 15}, dm)
+	d := &tickRecorder{}
+	c.AttachDevice(d)
+
+	c.StoreWord(0, 0x98101234) // LD G1, 0x1234
+	c.StoreWord(2, 0x5818000a) // LW G1, *12
+	c.StoreWord(4, 0x5c100008) // MW G1, 12
+	c.StoreWord(12, 0x0000000e)
+	c.CycleCosts[0x98] = 3
+
+	c.Step() // 3 + 1 fetch
+	c.Step() // 1 + 3 accesses + 1 indirect
+	c.Stall(2)
+	c.Step() // 4 + 2 accesses + 2 stalled
+
+	expected := []uint64{4, 9, 17}
+	for ix, e := range expected {
+		if d.ticks[ix] != e {
+			t.Errorf("Tick #%d at %d, expected %d", ix, d.ticks[ix], e)
+		}
+	}
+	if c.Now() != 17 {
+		t.Errorf("Now is %d, expected 17", c.Now())
+	}
+}
+
+// A level raised again while its handler runs is held until the
+// handler returns, rather than overwriting the saved IC.
+func TestInterruptInService(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{0, 0xff}, NewDirectMemory(0x100))
+	c.InterruptBase = 0x80
+	c.StoreWord(0x82, 0x60)       // Vector for level 0
+	c.StoreWord(0x86, 0x40)       // Vector for level 1
+	c.StoreWord(0x40, 0x00000000) // NOP
+	c.StoreWord(0x42, 0x05f80042) // JC 15, *0x84
+	c.StoreWord(0x60, 0x00000000) // NOP
+	c.StoreWord(0x62, 0x05f8001e) // JC 15, *0x80
+	// The rest is NOPs
+	c.CC = 2
+
+	c.Interrupt(1)
+	c.Step()
+	c.Interrupt(1)
+	c.Step()
+	if c.IC != 0 {
+		t.Errorf("IC is 0x%x after returning, expected 0x0", c.IC)
+	}
+	if saved := c.FetchWord(0x84); saved != 0 {
+		t.Errorf("Saved IC is 0x%x, expected 0x0", saved)
+	}
+
+	// The second one is taken once the first has returned, and
+	// a higher priority level can interrupt it.
+	c.Step()
+	if c.IC != 0x42 {
+		t.Errorf("IC is 0x%x, expected 0x42", c.IC)
+	}
+	c.Interrupt(0)
+	c.Step()
+	if c.IC != 0x62 {
+		t.Errorf("IC is 0x%x, expected 0x62", c.IC)
+	}
+	if saved := c.FetchWord(0x80); saved != 0x42 {
+		t.Errorf("Saved IC for level 0 is 0x%x, expected 0x42", saved)
+	}
+	c.Step()
+	c.Step()
+	if c.IC != 0 {
+		t.Errorf("IC is 0x%x after both handlers returned, expected 0x0", c.IC)
+	}
+}
+
+func TestPeekPoke(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{0, 15}, NewDirectMemory(16))
+	watched := 0
+	c.Watch = func(*CPU, uint32) { watched++ }
+
+	if !c.PokeWord(2, 0x12345678) || !c.Poke(4, 0x9abc) {
+		t.Errorf("Poking mapped memory failed")
+	}
+	if w, ok := c.PeekWord(2); !ok || w != 0x12345678 {
+		t.Errorf("Peeked 0x%08x, %v, expected 0x12345678", w, ok)
+	}
+	if h, ok := c.Peek(4); !ok || h != 0x9abc {
+		t.Errorf("Peeked 0x%04x, %v, expected 0x9abc", h, ok)
+	}
+	if _, ok := c.Peek(16); ok || c.Poke(16, 1) {
+		t.Errorf("Expected peeking and poking unmapped memory to fail")
+	}
+	if _, ok := c.PeekWord(15); ok {
+		t.Errorf("Expected peeking a word running off the end of memory to fail")
+	}
+	if watched != 0 || c.Trap != nil {
+		t.Errorf("Peeks and pokes were watched %d times, trap %v", watched, c.Trap)
+	}
+}
@@ -0,0 +1,119 @@
+package cpu
+
+// Turning instruction words back into text.
+//
+// The mnemonic and format of an instruction come from the instruction
+// set (see isa.go), and the operands are laid out by format:
+//
+//	type1: OP r,*address(x) where address is the absolute target
+//	       (the instruction's as field is relative to its IC), * marks
+//	       indirection, and (x) is left out for x = 0
+//	type2: OP r1,r2 with ,address added when as is non-zero, again
+//	       as an absolute target
+//	type3: OP r1,d or OP r1,r2,d when r2 is non-zero
+//
+// Words that are not instructions come out as .WORD. This is also
+// the syntax the assembler reads.
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The operand layout of an instruction.
+type Format int
+
+const (
+	NoOperands Format = iota
+	Type1
+	Type2
+	Type3
+)
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+var (
+	type1Type = reflect.TypeOf(type1{})
+	type2Type = reflect.TypeOf(type2{})
+	type3Type = reflect.TypeOf(type3{})
+)
+
+// Return the mnemonic and format of an opcode, and false if there is
+// no such instruction.
+func OpcodeInfo(op uint8) (string, Format, bool) {
+	s, ok := specs[op]
+	if !ok {
+		return "", NoOperands, false
+	}
+	return s.Mnemonic, s.Format, true
+}
+
+// Return the opcode and format of a mnemonic, in any case.
+func LookupMnemonic(name string) (uint8, Format, bool) {
+	s, ok := mnemonics[strings.ToUpper(name)]
+	if !ok {
+		return 0, NoOperands, false
+	}
+	return s.Opcode, s.Format, true
+}
+
+// Return the text of the instruction word at address.
+func Disassemble(address, word uint32) string {
+	return DisassembleSymbolic(address, word, nil)
+}
+
+// Return the text of the instruction word at address, showing the
+// targets of type1 and type2 instructions by name where name (if not
+// nil) returns one.
+func DisassembleSymbolic(address, word uint32, name func(uint32) string) string {
+	op := uint8(word >> 24)
+	builder, ok := instructionTable[op]
+	if !ok {
+		return fmt.Sprintf(".WORD 0x%08x", word)
+	}
+	v := reflect.ValueOf(builder(op, uint8(word>>20)&0xf, uint8(word>>16)&0xf, uint16(word)))
+	mnemonic, format, _ := OpcodeInfo(op)
+	target := func(as uint16) string {
+		t := (uint32(as) + address) & mask
+		if name != nil {
+			if n := name(t); n != "" {
+				return n
+			}
+		}
+		return fmt.Sprintf("0x%05x", t)
+	}
+
+	switch format {
+	case NoOperands:
+		return mnemonic
+	case Type1:
+		i := v.Convert(type1Type).Interface().(type1)
+		ind := ""
+		if i.i {
+			ind = "*"
+		}
+		ix := ""
+		if i.x != 0 {
+			ix = fmt.Sprintf("(%d)", i.x)
+		}
+		return fmt.Sprintf("%s %d,%s%s%s", mnemonic, i.r, ind, target(i.as), ix)
+	case Type2:
+		i := v.Convert(type2Type).Interface().(type2)
+		if i.as != 0 {
+			return fmt.Sprintf("%s %d,%d,%s", mnemonic, i.r1, i.r2, target(i.as))
+		}
+		return fmt.Sprintf("%s %d,%d", mnemonic, i.r1, i.r2)
+	default:
+		i := v.Convert(type3Type).Interface().(type3)
+		if i.r2 != 0 {
+			return fmt.Sprintf("%s %d,%d,0x%04x", mnemonic, i.r1, i.r2, i.d)
+		}
+		return fmt.Sprintf("%s %d,0x%04x", mnemonic, i.r1, i.d)
+	}
+}
@@ -0,0 +1,71 @@
+package cpu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	cases := []struct {
+		address  uint32
+		word     uint32
+		expected string
+	}{
+		{0, 0x00000000, "NOP"},
+		{0x100, 0x58100010, "LW 1,0x00110"},
+		{0x100, 0x501a0010, "STW 1,*0x00110(2)"},
+		{0, 0x98201234, "LD 2,0x1234"},
+		{0, 0x1a120000, "AS 1,2"},
+		{0x100, 0x1a120020, "AS 1,2,0x00120"},
+		{0, 0xff000000, ".WORD 0xff000000"},
+	}
+
+	for ix, tc := range cases {
+		if seen := Disassemble(tc.address, tc.word); seen != tc.expected {
+			t.Errorf("Case #%d, saw %q, expected %q", ix, seen, tc.expected)
+		}
+	}
+}
+
+func TestDisassembleSymbolic(t *testing.T) {
+	names := func(address uint32) string {
+		if address == 0x110 {
+			return "TABLE"
+		}
+		return ""
+	}
+	if seen := DisassembleSymbolic(0x100, 0x501a0010, names); seen != "STW 1,*TABLE(2)" {
+		t.Errorf("Saw %q, expected %q", seen, "STW 1,*TABLE(2)")
+	}
+	if seen := DisassembleSymbolic(0x100, 0x58100020, names); seen != "LW 1,0x00120" {
+		t.Errorf("Saw %q, expected %q", seen, "LW 1,0x00120")
+	}
+}
+
+func TestMnemonics(t *testing.T) {
+	cases := []struct {
+		name   string
+		op     uint8
+		format Format
+	}{
+		{"NOP", 0x00, NoOperands},
+		{"lw", 0x58, Type1},
+		{"AS", 0x1a, Type2},
+		{"LD", 0x98, Type3},
+	}
+	for _, tc := range cases {
+		op, format, ok := LookupMnemonic(tc.name)
+		if !ok || op != tc.op || format != tc.format {
+			t.Errorf("%s is %02x/%v/%v, expected %02x/%v", tc.name, op, format, ok, tc.op, tc.format)
+		}
+		if name, f, _ := OpcodeInfo(tc.op); !strings.EqualFold(name, tc.name) || f != tc.format {
+			t.Errorf("Opcode %02x is %s/%v, expected %s/%v", tc.op, name, f, tc.name, tc.format)
+		}
+	}
+	if _, _, ok := LookupMnemonic("FROB"); ok {
+		t.Errorf("Found a FROB instruction")
+	}
+	if _, _, ok := OpcodeInfo(0xff); ok {
+		t.Errorf("Found an instruction at 0xff")
+	}
+}
@@ -0,0 +1,100 @@
+package cpu
+
+// Building instruction words from their fields, the other way around
+// from decodeWord. Every instruction has the opcode in the top byte,
+// then two four-bit register fields and a 16-bit field:
+//
+//	type1: op, r, i and x (indirection is the top bit of the second
+//	       register field, the index register the other three), as
+//	type2: op, r1, r2, as
+//	type3: op, r1, r2, d
+//
+// The as fields are relative to the instruction, as the CPU sees them,
+// not absolute addresses as the disassembler shows them.
+
+import (
+	"fmt"
+)
+
+// Return the opcode of a mnemonic, in any case.
+func Opcode(mnemonic string) (uint8, error) {
+	op, _, ok := LookupMnemonic(mnemonic)
+	if !ok {
+		return 0, fmt.Errorf("Unknown instruction %s", mnemonic)
+	}
+	return op, nil
+}
+
+// Check that an opcode is an instruction of the given format.
+func checkFormat(op uint8, want Format) error {
+	name, format, ok := OpcodeInfo(op)
+	if !ok {
+		return fmt.Errorf("No instruction has opcode 0x%02x", op)
+	}
+	if format != want {
+		return fmt.Errorf("%s (0x%02x) is %s, not %s", name, op, format, want)
+	}
+	return nil
+}
+
+// Check that a register field fits.
+func checkRegister(what string, r, limit uint8) error {
+	if r >= limit {
+		return fmt.Errorf("%s %d out of range, it has to be below %d", what, r, limit)
+	}
+	return nil
+}
+
+// Encode an instruction without operands.
+func EncodeNoOperands(op uint8) (uint32, error) {
+	if err := checkFormat(op, NoOperands); err != nil {
+		return 0, err
+	}
+	return uint32(op) << 24, nil
+}
+
+// Encode a type1 instruction: register r, indirect if i, indexed by x
+// (0 for none), at as half-words after the instruction.
+func EncodeType1(op, r uint8, i bool, x uint8, as uint16) (uint32, error) {
+	if err := checkFormat(op, Type1); err != nil {
+		return 0, err
+	}
+	if err := checkRegister("Register", r, 16); err != nil {
+		return 0, err
+	}
+	if err := checkRegister("Index register", x, 8); err != nil {
+		return 0, err
+	}
+	r2 := uint32(x)
+	if i {
+		r2 |= 0x08
+	}
+	return uint32(op)<<24 | uint32(r)<<20 | r2<<16 | uint32(as), nil
+}
+
+// Encode a type2 instruction: registers r1 and r2, and as half-words
+// after the instruction (0 if there is no address).
+func EncodeType2(op, r1, r2 uint8, as uint16) (uint32, error) {
+	if err := checkFormat(op, Type2); err != nil {
+		return 0, err
+	}
+	return encodeRegisters(op, r1, r2, as)
+}
+
+// Encode a type3 instruction: registers r1 and r2, and the value d.
+func EncodeType3(op, r1, r2 uint8, d uint16) (uint32, error) {
+	if err := checkFormat(op, Type3); err != nil {
+		return 0, err
+	}
+	return encodeRegisters(op, r1, r2, d)
+}
+
+func encodeRegisters(op, r1, r2 uint8, rest uint16) (uint32, error) {
+	if err := checkRegister("Register", r1, 16); err != nil {
+		return 0, err
+	}
+	if err := checkRegister("Register", r2, 16); err != nil {
+		return 0, err
+	}
+	return uint32(op)<<24 | uint32(r1)<<20 | uint32(r2)<<16 | uint32(rest), nil
+}
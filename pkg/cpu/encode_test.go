@@ -0,0 +1,142 @@
+package cpu
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// Every opcode of a format.
+func opcodes(f Format) []uint8 {
+	rv := []uint8{}
+	for op := 0; op < 256; op++ {
+		if _, format, ok := OpcodeInfo(uint8(op)); ok && format == f {
+			rv = append(rv, uint8(op))
+		}
+	}
+	return rv
+}
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		word     uint32
+		expected uint32
+	}{
+		{must(EncodeType3(0x98, 1, 0, 0x1234)), 0x98101234},     // LD 1,0x1234
+		{must(EncodeType1(0x58, 1, true, 2, 0x20)), 0x581a0020}, // LW 1,*address(2)
+		{must(EncodeType1(0x01, 3, false, 0, 0)), 0x01300000},   // JS 3,$
+		{must(EncodeType2(0x1a, 1, 2, 0x10)), 0x1a120010},       // AS 1,2,address
+		{must(EncodeNoOperands(0x00)), 0x00000000},
+	}
+	for ix, tc := range cases {
+		if tc.word != tc.expected {
+			t.Errorf("Case #%d, encoded %08x, expected %08x", ix, tc.word, tc.expected)
+		}
+	}
+	if op, err := Opcode("stw"); err != nil || op != 0x50 {
+		t.Errorf("STW is %02x (%v), expected 50", op, err)
+	}
+}
+
+func must(word uint32, err error) uint32 {
+	if err != nil {
+		panic(err)
+	}
+	return word
+}
+
+func TestEncodeErrors(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{second(EncodeType1(0xff, 0, false, 0, 0)), "No instruction has opcode 0xff"},
+		{second(EncodeType1(0x98, 0, false, 0, 0)), "LD (0x98) is type3, not type1"},
+		{second(EncodeType2(0x58, 0, 0, 0)), "LW (0x58) is type1, not type2"},
+		{second(EncodeType3(0x1a, 0, 0, 0)), "AS (0x1a) is type2, not type3"},
+		{second(EncodeNoOperands(0x58)), "LW (0x58) is type1, not operandless"},
+		{second(EncodeType1(0x58, 16, false, 0, 0)), "Register 16 out of range, it has to be below 16"},
+		{second(EncodeType1(0x58, 0, false, 8, 0)), "Index register 8 out of range, it has to be below 8"},
+		{second(EncodeType2(0x1a, 0, 16, 0)), "Register 16 out of range, it has to be below 16"},
+		{second(EncodeType3(0x98, 16, 0, 0)), "Register 16 out of range, it has to be below 16"},
+		{second(Opcode("FROB")), "Unknown instruction FROB"},
+	}
+	for ix, tc := range cases {
+		if tc.err == nil || tc.err.Error() != tc.expected {
+			t.Errorf("Case #%d, error %v, expected %q", ix, tc.err, tc.expected)
+		}
+	}
+}
+
+func second(_ interface{}, err error) error {
+	return err
+}
+
+// Decoding an encoded word gives back the fields, for every opcode
+// of each format.
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, op := range opcodes(Type1) {
+		op := op
+		f := func(r, x uint8, i bool, as uint16) bool {
+			r, x = r%16, x%8
+			word, err := EncodeType1(op, r, i, x, as)
+			if err != nil {
+				t.Errorf("Unexpected error encoding %02x, %v", op, err)
+				return false
+			}
+			seen := reflect.ValueOf(decodeWord(word)).Convert(type1Type).Interface().(type1)
+			return seen == type1{op: op, r: r, i: i, x: x, as: as}
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("Opcode %02x, %v", op, err)
+		}
+	}
+	for _, format := range []Format{Type2, Type3} {
+		for _, op := range opcodes(format) {
+			op, format := op, format
+			f := func(r1, r2 uint8, rest uint16) bool {
+				r1, r2 = r1%16, r2%16
+				encode, decoded := EncodeType2, type2Type
+				if format == Type3 {
+					encode, decoded = EncodeType3, type3Type
+				}
+				word, err := encode(op, r1, r2, rest)
+				if err != nil {
+					return false
+				}
+				seen := reflect.ValueOf(decodeWord(word)).Convert(decoded).Interface()
+				if format == Type3 {
+					return seen == type3{op: op, r1: r1, r2: r2, d: rest}
+				}
+				return seen == type2{op: op, r1: r1, r2: r2, as: rest}
+			}
+			if err := quick.Check(f, nil); err != nil {
+				t.Errorf("Opcode %02x, %v", op, err)
+			}
+		}
+	}
+}
+
+// Disassembling an encoded word gives the mnemonic it was encoded
+// from.
+func TestEncodeMnemonics(t *testing.T) {
+	for _, name := range []string{"LW", "STW", "AS", "LD"} {
+		op, err := Opcode(name)
+		if err != nil {
+			t.Fatalf("Unexpected error, %v", err)
+		}
+		var word uint32
+		switch _, format, _ := OpcodeInfo(op); format {
+		case Type1:
+			word, err = EncodeType1(op, 1, false, 0, 2)
+		case Type2:
+			word, err = EncodeType2(op, 1, 2, 0)
+		case Type3:
+			word, err = EncodeType3(op, 1, 0, 2)
+		}
+		if err != nil || !strings.HasPrefix(Disassemble(0, word), name+" ") {
+			t.Errorf("%s encoded as %08x, %s (%v)", name, word, Disassemble(0, word), err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package cpu
+
+// A discrete-event queue on the virtual clock of a CPU.
+//
+// Devices that need to do something after a delay (a timer expiring,
+// a tape reaching the next block) post a callback to the CPU's event
+// queue, in the style of SIMH's sim_activate/sim_cancel. The queue is
+// run between instructions, so callbacks see the CPU in a consistent
+// state, and can raise interrupts or change device registers.
+//
+// When the CPU is idle in a wait loop (an instruction jumping to
+// itself), there is no point in executing the loop over and over
+// until the next event is due, so the virtual clock is moved forward
+// to the next event instead.
+
+import (
+	"container/heap"
+)
+
+// A callback scheduled for a specific virtual time.
+type Event struct {
+	when  uint64
+	seq   uint64
+	index int // Position in the heap, -1 when not queued
+	fn    func(now uint64)
+}
+
+// Return the virtual time the event is scheduled for.
+func (e *Event) When() uint64 {
+	return e.when
+}
+
+type eventHeap []*Event
+
+func (h eventHeap) Len() int { return len(h) }
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].when != h[j].when {
+		return h[i].when < h[j].when
+	}
+	return h[i].seq < h[j].seq
+}
+func (h eventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *eventHeap) Push(x interface{}) {
+	e := x.(*Event)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// A queue of events, ordered by time. Events scheduled for the same
+// time run in the order they were scheduled. The zero value is an
+// empty queue.
+type EventQueue struct {
+	events eventHeap
+	seq    uint64
+}
+
+// Schedule fn to be called once the virtual time reaches at.
+func (q *EventQueue) Schedule(at uint64, fn func(now uint64)) *Event {
+	e := &Event{when: at, seq: q.seq, fn: fn}
+	q.seq++
+	heap.Push(&q.events, e)
+	return e
+}
+
+// Remove an event from the queue. Return false if it was not queued
+// (it has already run, or has already been cancelled).
+func (q *EventQueue) Cancel(e *Event) bool {
+	if e == nil || e.index < 0 || e.index >= len(q.events) || q.events[e.index] != e {
+		return false
+	}
+	heap.Remove(&q.events, e.index)
+	return true
+}
+
+// Return the time of the next event, if there is one.
+func (q *EventQueue) Next() (uint64, bool) {
+	if len(q.events) == 0 {
+		return 0, false
+	}
+	return q.events[0].when, true
+}
+
+// Return the number of queued events.
+func (q *EventQueue) Len() int {
+	return len(q.events)
+}
+
+// Run, in order, all events due at or before now. Events scheduled
+// by the callbacks run too, if they are due.
+func (q *EventQueue) RunUntil(now uint64) {
+	for len(q.events) > 0 && q.events[0].when <= now {
+		e := heap.Pop(&q.events).(*Event)
+		e.fn(now)
+	}
+}
+
+// Anything devices can schedule events against, usually a *CPU.
+type Scheduler interface {
+	Clock
+	Activate(delay uint64, fn func(now uint64)) *Event
+	Cancel(e *Event) bool
+}
+
+// Schedule fn to be called delay cycles from now.
+func (c *CPU) Activate(delay uint64, fn func(now uint64)) *Event {
+	return c.Events.Schedule(c.Cycles+delay, fn)
+}
+
+// Cancel a scheduled event.
+func (c *CPU) Cancel(e *Event) bool {
+	return c.Events.Cancel(e)
+}
+
+// Move the virtual clock forward to the next event, counting the
+// skipped cycles as idle.
+func (c *CPU) fastForward() {
+	next, ok := c.Events.Next()
+	if !ok || next <= c.Cycles {
+		return
+	}
+	c.IdleCycles += next - c.Cycles
+	c.Cycles = next
+}
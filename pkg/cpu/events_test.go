@@ -0,0 +1,62 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestEventQueue(t *testing.T) {
+	var q EventQueue
+	seen := []int{}
+	record := func(n int) func(uint64) {
+		return func(uint64) { seen = append(seen, n) }
+	}
+
+	q.Schedule(20, record(3))
+	q.Schedule(10, record(1))
+	e := q.Schedule(15, record(-1))
+	q.Schedule(10, record(2))
+
+	if !q.Cancel(e) {
+		t.Errorf("Cancel of a queued event failed")
+	}
+	if q.Cancel(e) {
+		t.Errorf("Cancel of a cancelled event succeeded")
+	}
+	if next, _ := q.Next(); next != 10 {
+		t.Errorf("Next event at %d, expected 10", next)
+	}
+
+	q.RunUntil(15)
+	q.Schedule(18, record(4))
+	q.RunUntil(25)
+
+	expected := []int{1, 2, 4, 3}
+	if len(seen) != len(expected) {
+		t.Fatalf("Saw %v, expected %v", seen, expected)
+	}
+	for ix := range expected {
+		if seen[ix] != expected[ix] {
+			t.Errorf("Event #%d was %d, expected %d", ix, seen[ix], expected[ix])
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d events left in queue, expected 0", q.Len())
+	}
+}
+
+func TestActivate(t *testing.T) {
+	dm := NewDirectMemory(16)
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{0, 15}, dm)
+
+	var when uint64
+	c.Activate(3, func(now uint64) { when = now })
+	c.Step()
+	if when != 0 {
+		t.Errorf("Event ran early, at %d", when)
+	}
+	c.Step()
+	if when != 4 {
+		t.Errorf("Event ran at %d, expected 4", when)
+	}
+}
@@ -0,0 +1,258 @@
+package cpu
+
+// The instruction set.
+//
+// Every instruction is described once, in isa, and the opcode table,
+// the cycle costs, the mnemonics the disassembler and assembler use,
+// and the conformance tests all come from there. The table is checked
+// when the package starts, so an opcode given twice, a mnemonic used
+// twice, or an entry whose implementation is some other instruction,
+// stops everything rather than quietly running the wrong thing.
+//
+// Operations are written with r, r1 and r2 for the registers named by
+// an instruction, r+1 for the one after r, ea for the effective
+// address (see computeEffective), as for the address type2
+// instructions give, d for the value in a type3 instruction, (a) for
+// the word at a and h(a) for the half-word at a.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// How an instruction sets the condition code. The values are the
+// kinds setCC takes.
+type CCEffect int
+
+const (
+	CCUnchanged  CCEffect = 0 // Left alone
+	CCArithmetic CCEffect = 1 // 1 if negative, 0 if zero, 2 if positive
+	CCLogical    CCEffect = 2 // 0 if zero, 1 if not
+	CCCompare    CCEffect = 3 // 0 if zero, 2 if the top four bits are clear, 3 if not
+)
+
+var ccNames = map[CCEffect]string{
+	CCUnchanged:  "unchanged",
+	CCArithmetic: "arithmetic",
+	CCLogical:    "logical",
+	CCCompare:    "compare",
+}
+
+var formatNames = map[Format]string{
+	NoOperands: "operandless",
+	Type1:      "type1",
+	Type2:      "type2",
+	Type3:      "type3",
+}
+
+func (e CCEffect) String() string {
+	if name, ok := ccNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("CCEffect(%d)", int(e))
+}
+
+func (e CCEffect) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *CCEffect) UnmarshalText(text []byte) error {
+	for k, name := range ccNames {
+		if name == string(text) {
+			*e = k
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown condition code effect %q", text)
+}
+
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *Format) UnmarshalText(text []byte) error {
+	for k, name := range formatNames {
+		if name == string(text) {
+			*f = k
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown instruction format %q", text)
+}
+
+// A description of an instruction.
+type Spec struct {
+	Mnemonic  string   `json:"mnemonic"`
+	Opcode    uint8    `json:"opcode"`
+	Format    Format   `json:"format"`
+	Operation string   `json:"operation"`
+	CC        CCEffect `json:"cc"`
+	Cycles    uint64   `json:"cycles"` // Not counting memory accesses and indirection
+	build     InstructionBuilder
+}
+
+// The instructions. The machine description has no timings, so the
+// cycles are guesses: multiplication and division take longer, as do
+// instructions working on two words.
+var isa = []Spec{
+	{"IH", 0x4e, Type1, "r, h(ea) := h(ea), r", CCUnchanged, 1, BuildIHFunc},
+	{"IW", 0x5e, Type1, "r, (ea) := (ea), r", CCUnchanged, 1, BuildIWFunc},
+	{"LC", 0xcd, Type1, "r := -(ea)", CCArithmetic, 1, BuildLCFunc},
+	{"LD", 0x98, Type3, "r1 := d", CCUnchanged, 1, BuildLDFunc},
+	{"LDW", 0x68, Type1, "r, r+1 := (ea), (ea+2)", CCUnchanged, 2, BuildLDWFunc},
+	{"LH", 0x48, Type1, "r := h(ea)", CCUnchanged, 1, BuildLHFunc},
+	{"LN", 0xcb, Type1, "r := -|(ea)|", CCArithmetic, 1, BuildLNFunc},
+	{"LP", 0xca, Type1, "r := |(ea)|", CCArithmetic, 1, BuildLPFunc},
+	{"LRS", 0xb8, Type2, "r1, r2 := (as), (as+2)", CCUnchanged, 2, BuildLRSFunc},
+	{"LT", 0xcc, Type1, "r := (ea)", CCArithmetic, 1, BuildLTFunc},
+	{"LW", 0x58, Type1, "r := (ea)", CCUnchanged, 1, BuildLWFunc},
+	{"RZH", 0x4f, Type1, "h(ea) := 0", CCUnchanged, 1, BuildRZHFunc},
+	{"RZW", 0x5f, Type1, "(ea) := 0", CCUnchanged, 1, BuildRZWFunc},
+	{"SRS", 0xb0, Type2, "(as), (as+2), ... := r1 ... r2", CCUnchanged, 1, BuildSRSFunc},
+	{"STDW", 0x60, Type1, "(ea), (ea+2) := r, r+1", CCUnchanged, 2, BuildSTDWFunc},
+	{"STH", 0x40, Type1, "h(ea) := r", CCUnchanged, 1, BuildSTHFunc},
+	{"STW", 0x50, Type1, "(ea) := r", CCUnchanged, 1, BuildSTWFunc},
+	{"AD", 0x9a, Type3, "r1 := r2 + d", CCArithmetic, 1, BuildADFunc},
+	{"ADW", 0x6a, Type1, "r, r+1 := r, r+1 + (ea), (ea+2)", CCArithmetic, 2, BuildADWFunc},
+	{"AH", 0x4a, Type1, "r := r + h(ea)", CCArithmetic, 1, BuildAHFunc},
+	{"AS", 0x1a, Type2, "(as) := r1 + r2", CCLogical, 1, BuildASFunc},
+	{"ATS", 0x2a, Type1, "(ea) := (ea) + r", CCArithmetic, 1, BuildATSFunc},
+	{"AW", 0x5a, Type1, "r := r + (ea)", CCArithmetic, 1, BuildAWFunc},
+	{"CD", 0x99, Type3, "compare r2 - d", CCCompare, 1, BuildCDFunc},
+	{"CH", 0x49, Type1, "compare r - h(ea)", CCLogical, 1, BuildCHFunc},
+	{"CW", 0x59, Type1, "compare r - (ea)", CCLogical, 1, BuildCWFunc},
+	{"DD", 0x9d, Type3, "r1 := r2 / d", CCUnchanged, 8, BuildDDFunc},
+	{"DH", 0x4d, Type1, "r := r / h(ea)", CCUnchanged, 8, BuildDHFunc},
+	{"DS", 0x1d, Type2, "(as), (as+2) := r1, r1+1 / r2", CCUnchanged, 8, BuildDSFunc},
+	{"DW", 0x5d, Type1, "r, r+1 := r, r+1 / (ea)", CCUnchanged, 8, BuildDWFunc},
+	{"MD", 0x9c, Type3, "r1 := r2 * d", CCUnchanged, 4, BuildMDFunc},
+	{"MH", 0x4c, Type1, "r := r * h(ea)", CCUnchanged, 4, BuildMHFunc},
+	{"MS", 0x1c, Type2, "(as), (as+2) := r1 * r2", CCUnchanged, 4, BuildMSFunc},
+	{"MW", 0x5c, Type1, "r, r+1 := r * (ea)", CCUnchanged, 4, BuildMWFunc},
+	{"SD", 0x9b, Type3, "r1 := r2 - d", CCArithmetic, 1, BuildSDFunc},
+	{"SDW", 0x6b, Type1, "r, r+1 := r, r+1 - (ea), (ea+2)", CCArithmetic, 2, BuildSDWFunc},
+	{"SFS", 0x2b, Type1, "(ea) := (ea) - r", CCArithmetic, 1, BuildSFSFunc},
+	{"SH", 0x4b, Type1, "r := r - h(ea)", CCArithmetic, 1, BuildSHFunc},
+	{"SS", 0x1b, Type2, "(as) := r1 - r2", CCArithmetic, 1, BuildSSFunc},
+	{"SW", 0x5b, Type1, "r := r - (ea)", CCArithmetic, 1, BuildSWFunc},
+	{"CLD", 0x97, Type3, "compare r2 - d, logically", CCLogical, 1, BuildCLDFunc},
+	{"CLH", 0x47, Type1, "compare r - h(ea), logically", CCLogical, 1, BuildCLHFunc},
+	{"CLW", 0x57, Type1, "compare r - (ea), logically", CCLogical, 1, BuildCLWFunc},
+	{"ND", 0x94, Type3, "r1 := r2 and d", CCCompare, 1, BuildNDFunc},
+	{"NH", 0x44, Type1, "r := r and h(ea)", CCCompare, 1, BuildNHFunc},
+	{"NS", 0x14, Type2, "(as) := r1 and r2", CCCompare, 1, BuildNSFunc},
+	{"NTS", 0x24, Type1, "(ea) := (ea) and r", CCCompare, 1, BuildNTSFunc},
+	{"NW", 0x54, Type1, "r := r and (ea)", CCCompare, 1, BuildNWFunc},
+	{"OD", 0x95, Type3, "r1 := r2 or d", CCCompare, 1, BuildODFunc},
+	{"OH", 0x45, Type1, "r := r or h(ea)", CCCompare, 1, BuildOHFunc},
+	{"OS", 0x15, Type2, "(as) := r1 or r2", CCCompare, 1, BuildOSFunc},
+	{"OTS", 0x25, Type1, "(ea) := (ea) or r", CCCompare, 1, BuildOTSFunc},
+	{"OW", 0x55, Type1, "r := r or (ea)", CCCompare, 1, BuildOWFunc},
+	{"XD", 0x96, Type3, "r1 := r2 xor d", CCCompare, 1, BuildXDFunc},
+	{"XH", 0x46, Type1, "r := r xor h(ea)", CCCompare, 1, BuildXHFunc},
+	{"XS", 0x16, Type2, "(as) := r1 xor r2", CCCompare, 1, BuildXSFunc},
+	{"XTS", 0x26, Type1, "(ea) := (ea) xor r", CCCompare, 1, BuildXTSFunc},
+	{"XW", 0x56, Type1, "r := r xor (ea)", CCCompare, 1, BuildXWFunc},
+	{"RLS", 0x85, Type1, "rotate r left one bit", CCUnchanged, 1, BuildRLSFunc},
+	{"RLD", 0x87, Type1, "rotate r, r+1 left one bit", CCUnchanged, 1, BuildRLDFunc},
+	{"RRS", 0x84, Type1, "rotate r right one bit", CCUnchanged, 1, BuildRRSFunc},
+	{"RRD", 0x86, Type1, "rotate r, r+1 right one bit", CCUnchanged, 1, BuildRRDFunc},
+	{"SLA", 0x89, Type1, "shift r left one bit, arithmetically", CCArithmetic, 1, BuildSLAFunc},
+	{"SLDA", 0x8b, Type1, "shift r, r+1 left one bit, arithmetically", CCArithmetic, 1, BuildSLDAFunc},
+	{"SLL", 0x8d, Type1, "shift r left one bit, logically", CCUnchanged, 1, BuildSLLFunc},
+	{"SLDL", 0x8f, Type1, "shift r, r+1 left one bit, logically", CCUnchanged, 1, BuildSLDLFunc},
+	{"SRA", 0x88, Type1, "shift r right one bit, arithmetically", CCUnchanged, 1, BuildSRAFunc},
+	{"SRDA", 0x8a, Type1, "shift r, r+1 right one bit, arithmetically", CCUnchanged, 1, BuildSRDAFunc},
+	{"SRL", 0x8c, Type1, "shift r right one bit, logically", CCUnchanged, 1, BuildSRLFunc},
+	{"SRDL", 0x8e, Type1, "shift r, r+1 right one bit, logically", CCUnchanged, 1, BuildSRDLFunc},
+	{"EX", 0xc1, Type1, "execute the instruction at ea", CCUnchanged, 1, BuildEXFunc},
+	{"JC", 0x05, Type1, "jump to ea if CC and r are not 0", CCUnchanged, 1, BuildJCFunc},
+	{"JOS", 0x02, Type1, "r := r - 1, jump to ea unless r is 0", CCUnchanged, 1, BuildJOSFunc},
+	{"JTS", 0x03, Type1, "r := r - 2, jump to ea unless r is 0", CCUnchanged, 1, BuildJTSFunc},
+	{"JOA", 0x04, Type1, "r := r + 1, jump to ea unless r is 0", CCUnchanged, 1, BuildJOAFunc},
+	{"JS", 0x01, Type1, "r := IC + 2, jump to ea", CCUnchanged, 1, BuildJSFunc},
+	{"NOP", 0x00, NoOperands, "nothing", CCUnchanged, 1, BuildNOPFunc},
+	// Not implemented yet: CP (0xc0), JSP (0x06), LSK (0xc3), LSP
+	// (0xc2) and STSR (0x08).
+}
+
+// The instructions, by opcode and by mnemonic.
+var (
+	specs     map[uint8]*Spec
+	mnemonics map[string]*Spec
+)
+
+// Fill in the opcode and cycle tables from the instruction set.
+func loadISA() {
+	if err := checkISA(isa); err != nil {
+		panic(err)
+	}
+	instructionTable = map[uint8]InstructionBuilder{}
+	cycleTable = map[uint8]uint64{}
+	specs = map[uint8]*Spec{}
+	mnemonics = map[string]*Spec{}
+	for ix := range isa {
+		s := &isa[ix]
+		registerFunction(s.Opcode, s.build)
+		registerCycles(s.Cycles, s.Opcode)
+		specs[s.Opcode] = s
+		mnemonics[s.Mnemonic] = s
+	}
+}
+
+// Check a description of an instruction set: that each opcode and
+// mnemonic is only used once, and that each instruction is
+// implemented, by something of its name and format.
+func checkISA(specs []Spec) error {
+	opcodes := map[uint8]string{}
+	names := map[string]uint8{}
+	for _, s := range specs {
+		if s.Mnemonic == "" || s.Mnemonic != strings.ToUpper(s.Mnemonic) {
+			return fmt.Errorf("Opcode 0x%02x has a bad mnemonic %q", s.Opcode, s.Mnemonic)
+		}
+		if other, ok := opcodes[s.Opcode]; ok {
+			return fmt.Errorf("Opcode 0x%02x is both %s and %s", s.Opcode, other, s.Mnemonic)
+		}
+		opcodes[s.Opcode] = s.Mnemonic
+		if other, ok := names[s.Mnemonic]; ok {
+			return fmt.Errorf("%s is both 0x%02x and 0x%02x", s.Mnemonic, other, s.Opcode)
+		}
+		names[s.Mnemonic] = s.Opcode
+		if s.build == nil {
+			return fmt.Errorf("%s (0x%02x) is not implemented", s.Mnemonic, s.Opcode)
+		}
+		if s.Cycles == 0 {
+			return fmt.Errorf("%s (0x%02x) takes no time", s.Mnemonic, s.Opcode)
+		}
+		t := reflect.TypeOf(s.build(s.Opcode, 0, 0, 0))
+		if t.Name() != s.Mnemonic {
+			return fmt.Errorf("%s (0x%02x) is implemented by %s", s.Mnemonic, s.Opcode, t.Name())
+		}
+		formats := map[Format]reflect.Type{Type1: type1Type, Type2: type2Type, Type3: type3Type}
+		if want, ok := formats[s.Format]; ok && !t.ConvertibleTo(want) {
+			return fmt.Errorf("%s (0x%02x) is %s, but not implemented as one", s.Mnemonic, s.Opcode, s.Format)
+		}
+	}
+	return nil
+}
+
+// Return the description of every instruction, by opcode.
+func ISA() []Spec {
+	rv := append([]Spec{}, isa...)
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Opcode < rv[j].Opcode })
+	return rv
+}
+
+// Write the description of every instruction as JSON.
+func WriteISA(w io.Writer) error {
+	data, err := json.MarshalIndent(ISA(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
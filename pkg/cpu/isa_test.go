@@ -0,0 +1,265 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Every builder in the package is in the instruction set, so that
+// none is left unregistered.
+func TestISAComplete(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", nil, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing the package, %v", err)
+	}
+	used := map[string]bool{}
+	for _, s := range isa {
+		name := reflect.TypeOf(s.build(s.Opcode, 0, 0, 0)).Name()
+		used["Build"+name+"Func"] = true
+	}
+	builders := 0
+	for _, f := range pkgs["cpu"].Files {
+		for _, d := range f.Decls {
+			fn, ok := d.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Build") || !strings.HasSuffix(fn.Name.Name, "Func") {
+				continue
+			}
+			builders++
+			if !used[fn.Name.Name] {
+				t.Errorf("%s is not in the instruction set", fn.Name.Name)
+			}
+		}
+	}
+	if builders != len(isa) {
+		t.Errorf("%d builders, for %d instructions", builders, len(isa))
+	}
+}
+
+func TestCheckISA(t *testing.T) {
+	if err := checkISA(isa); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	lw := Spec{"LW", 0x58, Type1, "r := (ea)", CCUnchanged, 1, BuildLWFunc}
+	cases := []struct {
+		specs    []Spec
+		expected string
+	}{
+		{[]Spec{lw, {"ND", 0x58, Type3, "", CCCompare, 1, BuildNDFunc}}, "Opcode 0x58 is both LW and ND"},
+		{[]Spec{lw, {"LW", 0x59, Type1, "", CCUnchanged, 1, BuildLWFunc}}, "LW is both 0x58 and 0x59"},
+		{[]Spec{{"OD", 0x95, Type3, "", CCCompare, 1, BuildNDFunc}}, "OD (0x95) is implemented by ND"},
+		{[]Spec{{"LC", 0xcd, Type1, "", CCArithmetic, 1, nil}}, "LC (0xcd) is not implemented"},
+		{[]Spec{{"LW", 0x58, Type3, "", CCUnchanged, 1, BuildLWFunc}}, "LW (0x58) is type3, but not implemented as one"},
+		{[]Spec{{"LW", 0x58, Type1, "", CCUnchanged, 0, BuildLWFunc}}, "LW (0x58) takes no time"},
+		{[]Spec{{"lw", 0x58, Type1, "", CCUnchanged, 1, BuildLWFunc}}, `Opcode 0x58 has a bad mnemonic "lw"`},
+	}
+	for ix, tc := range cases {
+		if err := checkISA(tc.specs); err == nil || err.Error() != tc.expected {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
+
+// Encode every instruction, and check that it decodes, disassembles
+// and costs what the instruction set says.
+func TestISAConformance(t *testing.T) {
+	for _, s := range ISA() {
+		var word uint32
+		var err error
+		switch s.Format {
+		case NoOperands:
+			word, err = EncodeNoOperands(s.Opcode)
+		case Type1:
+			word, err = EncodeType1(s.Opcode, 2, false, 0, 4)
+		case Type2:
+			word, err = EncodeType2(s.Opcode, 2, 3, 4)
+		case Type3:
+			word, err = EncodeType3(s.Opcode, 2, 3, 4)
+		}
+		if err != nil {
+			t.Errorf("%s, unexpected error encoding, %v", s.Mnemonic, err)
+			continue
+		}
+		if name := reflect.TypeOf(decodeWord(word)).Name(); name != s.Mnemonic {
+			t.Errorf("%s (0x%02x) decodes as %s", s.Mnemonic, s.Opcode, name)
+		}
+		if text := Disassemble(0x100, word); strings.Fields(text)[0] != s.Mnemonic {
+			t.Errorf("%s (0x%02x) disassembles as %s", s.Mnemonic, s.Opcode, text)
+		}
+		if op, format, ok := LookupMnemonic(s.Mnemonic); !ok || op != s.Opcode || format != s.Format {
+			t.Errorf("%s looks up as 0x%02x/%v/%v", s.Mnemonic, op, format, ok)
+		}
+		if n := NewCPU().cycleCost(s.Opcode); n != s.Cycles {
+			t.Errorf("%s costs %d cycles, expected %d", s.Mnemonic, n, s.Cycles)
+		}
+	}
+}
+
+// The condition code an effect gives a value, as the CCEffect
+// constants describe it.
+func expectedCC(e CCEffect, v uint32) uint8 {
+	switch e {
+	case CCArithmetic:
+		switch {
+		case v&0x80000000 != 0:
+			return 1
+		case v == 0:
+			return 0
+		}
+		return 2
+	case CCLogical:
+		if v == 0 {
+			return 0
+		}
+		return 1
+	case CCCompare:
+		switch {
+		case v == 0:
+			return 0
+		case v&0xf0000000 == 0:
+			return 2
+		}
+		return 3
+	}
+	return 0
+}
+
+// The value an instruction sets the condition code from, worked out
+// from its operation: what it compares, or where its result goes. The
+// instructions are run with r (or r1) as G2, r2 as G3, ea and as at
+// 0x104, and d as 4. Double-word results count by their first word,
+// unless it is zero.
+func ccValue(t *testing.T, s Spec, before, after *CPU) uint32 {
+	operand := func(name string, c *CPU) uint32 {
+		switch name {
+		case "r", "r1":
+			return c.G[2]
+		case "r2":
+			return c.G[3]
+		case "d":
+			return 4
+		case "(ea)", "(as)":
+			return c.FetchWord(0x104)
+		case "h(ea)":
+			return uint32(c.FetchHalfWord(0x104))
+		}
+		t.Fatalf("%s: unknown operand %s", s.Mnemonic, name)
+		return 0
+	}
+	op := s.Operation
+	if strings.HasPrefix(op, "compare ") {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(op, "compare "), ", logically"))
+		return operand(fields[0], before) - operand(fields[2], before)
+	}
+	op = strings.TrimPrefix(op, "shift ")
+	if strings.HasPrefix(op, "r, r+1") {
+		if after.G[2] != 0 {
+			return after.G[2]
+		}
+		return after.G[3]
+	}
+	return operand(strings.Fields(op)[0], after)
+}
+
+// A CPU for TestISACC, with registers counting from reg in steps of
+// step, and memory full of half.
+func ccCPU(reg, step uint32, half uint16) *CPU {
+	c := NewCPU()
+	dm := NewDirectMemory(0x400)
+	for ix := range dm.memory {
+		dm.memory[ix] = half
+	}
+	c.RegisterMemory(MemoryRange{0, 0x3ff}, dm)
+	for ix := range c.G {
+		c.G[ix] = reg + step*uint32(ix)
+	}
+	c.IC = 0x100
+	c.CC = 0xf // Not a condition code any instruction sets
+	return c
+}
+
+// Execute every instruction, with operands giving small and large,
+// positive and negative results, and check that it leaves the
+// condition code alone, or sets it from its result the way the
+// instruction set says.
+func TestISACC(t *testing.T) {
+	// Registers and half-words of memory: non-zero, so nothing
+	// divides by zero, and an EX finds a NOP.
+	setups := []struct {
+		reg  uint32 // G0, with each register step more than the last
+		step uint32
+		half uint16
+	}{
+		{0x00000001, 1, 0x0001},
+		{0x00000001, 1, 0x8001},
+		{0x80000001, 1, 0x0001},
+		{0x80000001, 1, 0x8001},
+		{0x00010001, 1, 0x0001},
+		{0x70000001, 1, 0x0001},
+		{0x7ffffffd, 1, 0x0001}, // G2 positive, G3 negative
+		{0x00000010, 0xffffffff, 0x0001},
+	}
+	for _, s := range ISA() {
+		for _, setup := range setups {
+			if setup.half != 1 && s.CC == CCUnchanged {
+				continue
+			}
+			// One to run, and one to look at the operands in.
+			c, before := ccCPU(setup.reg, setup.step, setup.half), ccCPU(setup.reg, setup.step, setup.half)
+			var word uint32
+			switch s.Format {
+			case NoOperands:
+				word, _ = EncodeNoOperands(s.Opcode)
+			case Type1:
+				word, _ = EncodeType1(s.Opcode, 2, false, 0, 4)
+			case Type2:
+				word, _ = EncodeType2(s.Opcode, 2, 3, 4)
+			case Type3:
+				word, _ = EncodeType3(s.Opcode, 2, 3, 4)
+			}
+			decodeWord(word).Execute(c)
+			if s.CC == CCUnchanged {
+				if c.CC != 0xf {
+					t.Errorf("%s (0x%02x) set the condition code to %d", s.Mnemonic, s.Opcode, c.CC)
+				}
+				continue
+			}
+			v := ccValue(t, s, before, c)
+			if cc := expectedCC(s.CC, v); c.CC != cc {
+				t.Errorf("%s (0x%02x) set the condition code to %d from 0x%08x, expected %d, as %v", s.Mnemonic, s.Opcode, c.CC, v, cc, s.CC)
+			}
+		}
+	}
+}
+
+func TestWriteISA(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteISA(&b); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if !strings.Contains(b.String(), `"mnemonic": "LW",
+    "opcode": 88,
+    "format": "type1",
+    "operation": "r := (ea)",
+    "cc": "unchanged",
+    "cycles": 1`) {
+		t.Errorf("LW is missing from %s", b.String())
+	}
+	var read []Spec
+	if err := json.Unmarshal(b.Bytes(), &read); err != nil {
+		t.Fatalf("Unexpected error reading back, %v", err)
+	}
+	expected := ISA()
+	for ix := range expected {
+		expected[ix].build = nil
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Read back %+v, expected %+v", read, expected)
+	}
+}
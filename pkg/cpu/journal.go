@@ -0,0 +1,183 @@
+package cpu
+
+// Undoing instructions.
+//
+// With a Journal attached, each Step records the registers as they
+// were before it, and the old contents of every half-word it wrote,
+// so that it can be undone. This is what a debugger needs to step
+// backwards, to go back to the instruction that last wrote an
+// address, or to any earlier point in the history.
+//
+// Only what the CPU itself did can be undone. Writes by other CPUs
+// to shared memory, the state of devices and the event queue are not
+// recorded. The old values are put back with Poke, so they are not
+// accesses by the CPU, and are neither buffered nor observed; devices
+// without a way in for debuggers see them like any other write.
+
+import (
+	"fmt"
+)
+
+// The registers, and other CPU state, an instruction can change.
+type registers struct {
+	G            [16]uint32
+	IC           uint32
+	PS           uint64
+	MIR          uint32
+	CC           uint8
+	Cycles       uint64
+	IdleCycles   uint64
+	stallsSeen   uint64
+	accesses     uint64
+	indirections uint64
+	pending      uint16
+	inService    uint16
+	idle         bool
+	Trap         *Trap
+}
+
+// A half-word, as it was before an instruction wrote it.
+type oldValue struct {
+	address uint32
+	value   uint16
+}
+
+// What is needed to undo one Step.
+type journalEntry struct {
+	count  uint64 // Instructions executed before the step
+	before registers
+	writes []oldValue // In the order they were made
+}
+
+// An undo history of the last Depth instructions executed by a CPU.
+type Journal struct {
+	Depth     int
+	entries   []journalEntry // Oldest first
+	count     uint64
+	recording bool // A Step is in progress
+}
+
+// Create a journal keeping the given number of instructions (at
+// least one).
+func NewJournal(depth int) *Journal {
+	if depth < 1 {
+		depth = 1
+	}
+	return &Journal{Depth: depth}
+}
+
+// Return the number of instructions executed since the journal was
+// attached. Stepping backwards counts down.
+func (j *Journal) Count() uint64 {
+	return j.count
+}
+
+// Return the lowest instruction count the history goes back to.
+func (j *Journal) Oldest() uint64 {
+	if len(j.entries) == 0 {
+		return j.count
+	}
+	return j.entries[0].count
+}
+
+// Start recording a Step.
+func (j *Journal) begin(c *CPU) {
+	if len(j.entries) >= j.Depth {
+		j.entries = j.entries[len(j.entries)-j.Depth+1:]
+	}
+	j.entries = append(j.entries, journalEntry{count: j.count, before: c.registers()})
+	j.count++
+	j.recording = true
+}
+
+func (j *Journal) end() {
+	j.recording = false
+}
+
+// Note the old value of a half-word about to be overwritten.
+func (j *Journal) wrote(address uint32, value uint16) {
+	e := &j.entries[len(j.entries)-1]
+	e.writes = append(e.writes, oldValue{address: address & mask, value: value})
+}
+
+func (c *CPU) registers() registers {
+	return registers{
+		G:            c.G,
+		IC:           c.IC,
+		PS:           c.PS,
+		MIR:          c.MIR,
+		CC:           c.CC,
+		Cycles:       c.Cycles,
+		IdleCycles:   c.IdleCycles,
+		stallsSeen:   c.stallsSeen,
+		accesses:     c.accesses,
+		indirections: c.indirections,
+		pending:      c.pending,
+		inService:    c.inService,
+		idle:         c.idle,
+		Trap:         c.Trap,
+	}
+}
+
+func (c *CPU) setRegisters(r registers) {
+	c.G, c.IC, c.PS, c.MIR, c.CC = r.G, r.IC, r.PS, r.MIR, r.CC
+	c.Cycles, c.IdleCycles, c.stallsSeen = r.Cycles, r.IdleCycles, r.stallsSeen
+	c.accesses, c.indirections = r.accesses, r.indirections
+	c.pending, c.inService, c.idle, c.Trap = r.pending, r.inService, r.idle, r.Trap
+}
+
+// Undo the last instruction in the journal. Return false if there is
+// no journal, or nothing left in it.
+func (c *CPU) StepBack() bool {
+	j := c.Journal
+	if j == nil || len(j.entries) == 0 {
+		return false
+	}
+	e := j.entries[len(j.entries)-1]
+	j.entries = j.entries[:len(j.entries)-1]
+	for ix := len(e.writes) - 1; ix >= 0; ix-- {
+		w := e.writes[ix]
+		c.Poke(w.address, w.value)
+	}
+	c.setRegisters(e.before)
+	j.count = e.count
+	return true
+}
+
+// Undo instructions up to and including the last one that wrote the
+// given address, leaving the CPU about to execute it again. Return
+// false if no instruction in the journal wrote it, in which case the
+// whole journal has been undone.
+func (c *CPU) StepBackToWrite(address uint32) bool {
+	address &= mask
+	for c.Journal != nil && len(c.Journal.entries) > 0 {
+		e := c.Journal.entries[len(c.Journal.entries)-1]
+		c.StepBack()
+		for _, w := range e.writes {
+			if w.address == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Go back, or forward, to the point where the given number of
+// instructions had been executed. Going back is limited by the depth
+// of the journal, and going forward re-executes instructions.
+func (c *CPU) Seek(count uint64) error {
+	j := c.Journal
+	if j == nil {
+		return fmt.Errorf("CPU %d has no history", c.ID)
+	}
+	if count < j.Oldest() {
+		return fmt.Errorf("Instruction %d is no longer in the history, which starts at %d", count, j.Oldest())
+	}
+	for j.count > count {
+		c.StepBack()
+	}
+	for j.count < count {
+		c.Step()
+	}
+	return nil
+}
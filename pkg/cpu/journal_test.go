@@ -0,0 +1,106 @@
+package cpu
+
+import (
+	"testing"
+)
+
+// A CPU running a program that stores G1 at 0x20, then 0x21, and
+// doubles G1 each time round a loop.
+func newJournalled(depth int) *CPU {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{Low: 0, High: 0x3f}, NewDirectMemory(0x40))
+	c.StoreWord(0, 0x98100001) // LD 1,1
+	c.StoreWord(2, 0x5010001e) // STW 1,0x20
+	c.StoreWord(4, 0x1a110000) // AS 1,1
+	c.StoreWord(6, 0x5010001b) // STW 1,0x21 (half-words 0x21 and 0x22)
+	c.StoreWord(8, 0x01380002) // JS 3,*0x0a, back to 2
+	c.StoreWord(10, 0x00000002)
+	c.Journal = NewJournal(depth)
+	return c
+}
+
+func TestStepBack(t *testing.T) {
+	c := newJournalled(100)
+	if c.StepBack() {
+		t.Errorf("Stepped back with an empty journal")
+	}
+	for ix := 0; ix < 10; ix++ {
+		c.Step()
+	}
+	g1, ic, cycles := c.G[1], c.IC, c.Cycles
+	mem := []uint16{c.FetchHalfWord(0x20), c.FetchHalfWord(0x21), c.FetchHalfWord(0x22)}
+
+	c.Step()
+	c.Step()
+	if !c.StepBack() || !c.StepBack() {
+		t.Fatalf("Could not step back")
+	}
+	if c.G[1] != g1 || c.IC != ic || c.Cycles != cycles {
+		t.Errorf("After stepping back G1 %x, IC %x, cycles %d, expected %x, %x, %d", c.G[1], c.IC, c.Cycles, g1, ic, cycles)
+	}
+	for ix, h := range mem {
+		if got := c.FetchHalfWord(0x20 + uint32(ix)); got != h {
+			t.Errorf("Half-word %x is %04x, expected %04x", 0x20+ix, got, h)
+		}
+	}
+	if c.Journal.Count() != 10 {
+		t.Errorf("Count is %d, expected 10", c.Journal.Count())
+	}
+
+	for c.StepBack() {
+	}
+	if c.IC != 0 || c.G[1] != 0 || c.FetchWord(0x20) != 0 || c.Journal.Count() != 0 {
+		t.Errorf("Undoing everything left IC %x, G1 %x, memory %08x", c.IC, c.G[1], c.FetchWord(0x20))
+	}
+}
+
+func TestStepBackToWrite(t *testing.T) {
+	c := newJournalled(100)
+	for ix := 0; ix < 12; ix++ {
+		c.Step()
+	}
+	if !c.StepBackToWrite(0x20) {
+		t.Fatalf("Found no write to 0x20")
+	}
+	if c.IC != 2 || c.Journal.Count() != 9 {
+		t.Errorf("Stopped at IC %x, count %d, expected the STW at 2, count 9", c.IC, c.Journal.Count())
+	}
+	c.Step()
+	if c.FetchWord(0x20) != c.G[1] {
+		t.Errorf("Re-executing the write stored %08x, expected %08x", c.FetchWord(0x20), c.G[1])
+	}
+	if c.StepBackToWrite(0x30) {
+		t.Errorf("Found a write to 0x30")
+	}
+	if c.Journal.Count() != 0 {
+		t.Errorf("Expected the whole journal to be undone")
+	}
+}
+
+func TestSeek(t *testing.T) {
+	c := newJournalled(5)
+	for ix := 0; ix < 10; ix++ {
+		c.Step()
+	}
+	if c.Journal.Oldest() != 5 {
+		t.Errorf("Oldest is %d, expected 5", c.Journal.Oldest())
+	}
+	if err := c.Seek(4); err == nil {
+		t.Errorf("Expected an error seeking past the depth")
+	}
+	if err := c.Seek(8); err != nil {
+		t.Fatalf("Unexpected error seeking, %v", err)
+	}
+	ic, g1 := c.IC, c.G[1]
+	if err := c.Seek(12); err != nil || c.Journal.Count() != 12 {
+		t.Fatalf("Seeking forward gave %v, count %d", err, c.Journal.Count())
+	}
+	if err := c.Seek(8); err != nil || c.IC != ic || c.G[1] != g1 {
+		t.Errorf("Seeking back again gave %v, IC %x, G1 %x, expected %x and %x", err, c.IC, c.G[1], ic, g1)
+	}
+
+	c.Journal = nil
+	if err := c.Seek(0); err == nil {
+		t.Errorf("Expected an error seeking without a journal")
+	}
+}
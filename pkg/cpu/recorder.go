@@ -0,0 +1,123 @@
+package cpu
+
+// A flight recorder, keeping the last few instructions a CPU
+// executed, so that there is some context when something goes
+// wrong.
+//
+// Each Step fills in the next slot of a fixed-size ring, without
+// allocating: the IC and instruction word, the effective address
+// (for instructions that compute one), and the general registers and
+// CC that the instruction changed. When the Step takes a trap, or
+// panics, the recorder is dumped, disassembled, to its Out.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// One executed instruction.
+type Record struct {
+	IC         uint32
+	Word       uint32
+	Address    uint32 // Effective address, if HasAddress
+	HasAddress bool
+	Changed    uint16     // Bit n is set if Gn changed
+	G          [16]uint32 // The registers after the instruction
+	CC         uint8      // CC after the instruction
+	CCChanged  bool
+}
+
+// A ring of the most recently executed instructions.
+type FlightRecorder struct {
+	Out     io.Writer           // Where dumps go, os.Stderr if nil
+	Names   func(uint32) string // Symbolic addresses for dumps, if set
+	records []Record
+	next    int  // The slot to fill next
+	full    bool // Every slot has been filled
+}
+
+// Create a recorder keeping the given number of instructions (at
+// least one).
+func NewFlightRecorder(size int) *FlightRecorder {
+	if size < 1 {
+		size = 1
+	}
+	return &FlightRecorder{records: make([]Record, size)}
+}
+
+// Return the recorded instructions, oldest first.
+func (f *FlightRecorder) Records() []Record {
+	if !f.full {
+		return append([]Record{}, f.records[:f.next]...)
+	}
+	return append(append([]Record{}, f.records[f.next:]...), f.records[:f.next]...)
+}
+
+// Record an instruction, given the registers and CC from before it.
+func (f *FlightRecorder) record(c *CPU, ic, word uint32, g [16]uint32, cc uint8) {
+	r := &f.records[f.next]
+	r.IC, r.Word = ic, word
+	r.Address, r.HasAddress = c.ea, c.eaValid
+	r.G, r.CC = c.G, c.CC
+	r.CCChanged = cc != c.CC
+	r.Changed = 0
+	for ix := range g {
+		if g[ix] != c.G[ix] {
+			r.Changed |= 1 << uint(ix)
+		}
+	}
+	f.next++
+	if f.next == len(f.records) {
+		f.next = 0
+		f.full = true
+	}
+}
+
+// Format a record, disassembled, with what it changed.
+func (r Record) String() string {
+	return r.format(nil)
+}
+
+func (r Record) format(names func(uint32) string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%05x %08x %-24s", r.IC, r.Word, DisassembleSymbolic(r.IC, r.Word, names))
+	if r.HasAddress {
+		fmt.Fprintf(&b, " @%05x", r.Address)
+	}
+	for ix := range r.G {
+		if r.Changed&(1<<uint(ix)) != 0 {
+			fmt.Fprintf(&b, " G%d=%08x", ix, r.G[ix])
+		}
+	}
+	if r.CCChanged {
+		fmt.Fprintf(&b, " CC=%d", r.CC)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// Write the recorded instructions, oldest first, after a heading
+// saying why.
+func (f *FlightRecorder) Dump(w io.Writer, why string) {
+	records := f.Records()
+	fmt.Fprintf(w, "%s, last %d instructions:\n", why, len(records))
+	for _, r := range records {
+		fmt.Fprintf(w, "  %s\n", r.format(f.Names))
+	}
+}
+
+func (f *FlightRecorder) out() io.Writer {
+	if f.Out == nil {
+		return os.Stderr
+	}
+	return f.Out
+}
+
+// Dump the recorder if Step panics, then carry on panicking.
+func (f *FlightRecorder) catch(c *CPU) {
+	if r := recover(); r != nil {
+		f.Dump(f.out(), fmt.Sprintf("CPU %d panicked at IC 0x%05x: %v", c.ID, c.IC, r))
+		panic(r)
+	}
+}
@@ -0,0 +1,61 @@
+package cpu
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A memory backend that fails loudly.
+type brokenMemory struct{}
+
+func (brokenMemory) FetchHalfWord(uint32) uint16         { panic("broken memory") }
+func (brokenMemory) WriteHalfWord(uint32, uint16) uint16 { panic("broken memory") }
+func (brokenMemory) FetchWord(uint32) uint32             { panic("broken memory") }
+func (brokenMemory) WriteWord(uint32, uint32) uint32     { panic("broken memory") }
+
+func TestFlightRecorder(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{Low: 0, High: 0x3f}, NewDirectMemory(0x40))
+	c.RegisterMemory(MemoryRange{Low: 0x40, High: 0x4f}, brokenMemory{})
+	c.StoreWord(0, 0x98101234) // LD 1,0x1234
+	c.StoreWord(2, 0x98200000) // LD 2,0
+	c.StoreWord(4, 0x5010001c) // STW 1,0x20
+	c.StoreWord(6, 0x5820007a) // LW 2,0x80
+	c.StoreWord(8, 0x5820003e) // LW 2,0x46
+	var out bytes.Buffer
+	c.Recorder = NewFlightRecorder(3)
+	c.Recorder.Out = &out
+
+	c.Step()
+	if rs := c.Recorder.Records(); len(rs) != 1 || rs[0].Changed != 1<<1 || rs[0].HasAddress {
+		t.Errorf("Records after one step are %+v", rs)
+	}
+	c.Step()
+	c.Step()
+	if out.Len() != 0 {
+		t.Errorf("Dumped %q without a trap", out.String())
+	}
+	c.Step()
+	expected := `CPU 0 trapped: No memory at address 0x00080, IC 0x00006, last 3 instructions:
+  00002 98200000 LD 2,0x0000
+  00004 5010001c STW 1,0x00020            @00020
+  00006 5820007a LW 2,0x00080             @00080
+`
+	if out.String() != expected {
+		t.Errorf("Dump is\n%s\nexpected\n%s", out.String(), expected)
+	}
+
+	out.Reset()
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected the panic to carry on")
+			}
+		}()
+		c.Step()
+	}()
+	if !strings.HasPrefix(out.String(), "CPU 0 panicked at IC 0x00008: broken memory, last 3 instructions:\n") {
+		t.Errorf("Dump after panic is %q", out.String())
+	}
+}
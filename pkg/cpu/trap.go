@@ -0,0 +1,71 @@
+package cpu
+
+// Traps, and telling when a CPU has stopped for good.
+//
+// The machine description does not say what happens on an opcode
+// that does not exist, or on an access to an address no memory
+// module answers to. The CPU treats the former as a NOP, and reads
+// zero from (and ignores writes to) the latter, as before, but also
+// records a Trap, so whoever is running it can stop and report it.
+//
+// There is no halt instruction either. A program ends by jumping to
+// itself, and once it does so with no events queued and no
+// interrupts that can be taken, nothing can ever change, so the CPU
+// counts as halted.
+
+import (
+	"fmt"
+)
+
+// What caused a trap.
+type TrapKind int
+
+const (
+	// An opcode that does not exist.
+	IllegalInstruction TrapKind = iota
+	// An access to an address not covered by any memory backend.
+	UnmappedAddress
+)
+
+func (k TrapKind) String() string {
+	switch k {
+	case IllegalInstruction:
+		return "illegal instruction"
+	case UnmappedAddress:
+		return "unmapped address"
+	}
+	return fmt.Sprintf("TrapKind(%d)", int(k))
+}
+
+// A trap, taken while executing the instruction at IC.
+type Trap struct {
+	Kind    TrapKind
+	IC      uint32
+	Word    uint32 // The instruction
+	Address uint32 // For UnmappedAddress
+}
+
+func (t *Trap) Error() string {
+	if t.Kind == UnmappedAddress {
+		return fmt.Sprintf("No memory at address 0x%05x, IC 0x%05x", t.Address, t.IC)
+	}
+	return fmt.Sprintf("Non-existent instruction 0x%08x at IC 0x%05x", t.Word, t.IC)
+}
+
+// Record a trap, unless one is already recorded.
+func (c *CPU) trap(kind TrapKind, address uint32) {
+	if c.Trap != nil {
+		return
+	}
+	c.Trap = &Trap{Kind: kind, IC: c.IC, Word: c.word, Address: address}
+}
+
+// Has the CPU halted? That is, did the last instruction jump to
+// itself, with no events queued and no interrupt able to be taken.
+func (c *CPU) Halted() bool {
+	if !c.idle || c.Events.Len() > 0 {
+		return false
+	}
+	_, ok := c.pendingInterrupt()
+	return !ok
+}
@@ -0,0 +1,47 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestTraps(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{Low: 0, High: 15}, NewDirectMemory(16))
+	c.StoreWord(0, 0x58100100) // LW G1 <- 0x100
+	c.StoreWord(2, 0xff000000)
+
+	c.Step()
+	if c.Trap == nil || c.Trap.Kind != UnmappedAddress || c.Trap.Address != 0x100 || c.Trap.IC != 0 {
+		t.Fatalf("Trap is %v, expected an unmapped address 0x100 at IC 0", c.Trap)
+	}
+
+	c.Trap = nil
+	c.Step()
+	if c.Trap == nil || c.Trap.Kind != IllegalInstruction || c.Trap.Word != 0xff000000 || c.Trap.IC != 2 {
+		t.Errorf("Trap is %v, expected an illegal instruction at IC 2", c.Trap)
+	}
+	if c.IC != 4 {
+		t.Errorf("IC is %d, expected the illegal instruction to act as a NOP", c.IC)
+	}
+}
+
+func TestHalted(t *testing.T) {
+	c := NewCPU()
+	c.RegisterMemory(MemoryRange{Low: 0, High: 15}, NewDirectMemory(16))
+	c.StoreWord(2, 0x05f00000) // JC 15, to itself
+	c.CC = 2
+
+	c.Step()
+	if c.Halted() {
+		t.Errorf("Halted after a NOP")
+	}
+	c.Step()
+	if !c.Halted() {
+		t.Errorf("Not halted in a loop with nothing to wait for")
+	}
+
+	c.Activate(10, func(uint64) {})
+	if c.Halted() {
+		t.Errorf("Halted while waiting for an event")
+	}
+}
@@ -0,0 +1,834 @@
+// The dap package lets editors, such as VS Code, debug a Censor 932
+// program through the Debug Adapter Protocol.
+//
+// A session either launches a machine, from a configuration file or
+// an image, or attaches to the machine the server was created
+// with. Each CPU is a thread, with a single stack frame. If debug
+// information (see the debuginfo package) is given, frames carry
+// source positions and are named by symbol, disassembly shows
+// symbolic targets, breakpoints can be set on source lines, and
+// stepping goes by line; otherwise stepping goes by instruction.
+//
+// The launch and attach arguments are:
+//
+//	config       machine configuration file
+//	image        image file, raw, .hex or .lst (see the memimage
+//	             package), loaded into a single CPU
+//	memory       half-words of memory, with image (default 0x40000)
+//	load         address to load a raw image at (default 0)
+//	ic           start IC of CPU 0
+//	debug        debug information file, as written by c932as -g
+//	stopOnEntry  stop before the first instruction
+//	history      instructions each CPU keeps in its journal, so
+//	             that they can be stepped back over
+//
+// Only debug, stopOnEntry and history apply to attach. Memory references,
+// and the addresses of instructions, are half-word addresses, and
+// refer to the memory of the CPU most recently stopped or inspected.
+// Offsets and counts in readMemory are in bytes, as the protocol
+// wants, with the high byte of each half-word first.
+//
+// Continuing and stepping run the whole system. Breakpoints apply to
+// every CPU, and the first CPU to hit one, or to trap, stops them
+// all. Stepping back and reverse continuing only move the thread
+// asked for, through its journal (see cpu.Journal), and fail if it
+// has none.
+package dap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/memimage"
+)
+
+// How far a resumed CPU should go.
+type stepping int
+
+const (
+	runFree stepping = iota
+	stepInstruction
+	stepLine
+)
+
+// The number of half-words shown in the Memory scope.
+const memoryWindow = 16
+
+// A debugging session for a machine.
+type Server struct {
+	Machine *config.Machine // Nil until launched, if not attaching
+	Debug   *debuginfo.Info
+
+	conn        *conn
+	owned       bool // The machine was launched, and is closed at the end
+	stopOnEntry bool
+	current     int // Index of the CPU memory references refer to
+
+	sourceBreaks map[string][]uint32 // By source path
+	instrBreaks  []uint32
+	breaks       atomic.Value // map[uint32]bool, read while running
+
+	running  int32 // Accessed atomically
+	pause    int32 // Accessed atomically
+	finished chan struct{}
+
+	after func() error // Run once the response to a request is sent
+}
+
+// Create a server, for the given machine and debug information. Both
+// may be nil, if the client is going to launch.
+func NewServer(m *config.Machine, debug *debuginfo.Info) *Server {
+	s := &Server{Machine: m, Debug: debug, sourceBreaks: map[string][]uint32{}}
+	s.breaks.Store(map[uint32]bool{})
+	return s
+}
+
+// Wait for a client on a TCP address, such as localhost:4711, and
+// serve it until it disconnects.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"address": l.Addr()}).Info("Waiting for a DAP client")
+	c, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return s.Serve(c)
+}
+
+// Serve a client until it disconnects.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	s.conn = newConn(rw)
+	defer s.halt()
+	for {
+		req, err := s.conn.receive()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if req.Command == "disconnect" {
+			s.halt()
+			return s.conn.respond(req, nil)
+		}
+		body, err := s.handle(req)
+		if err != nil {
+			err = s.conn.fail(req, err)
+		} else {
+			err = s.conn.respond(req, body)
+		}
+		if err != nil {
+			return err
+		}
+		if s.after != nil {
+			after := s.after
+			s.after = nil
+			if err := after(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Stop the machine if it is running, and close it if the session
+// launched it.
+func (s *Server) halt() {
+	if s.isRunning() {
+		atomic.StoreInt32(&s.pause, 1)
+		<-s.finished
+	}
+	if s.owned && s.Machine != nil {
+		s.Machine.Close()
+		s.Machine = nil
+		s.owned = false
+	}
+}
+
+func (s *Server) isRunning() bool {
+	return atomic.LoadInt32(&s.running) != 0
+}
+
+var errRunning = fmt.Errorf("The machine is running")
+
+// Commands that need the machine to be stopped.
+var needsStop = map[string]bool{
+	"stackTrace":      true,
+	"scopes":          true,
+	"variables":       true,
+	"setVariable":     true,
+	"readMemory":      true,
+	"disassemble":     true,
+	"continue":        true,
+	"next":            true,
+	"stepIn":          true,
+	"stepOut":         true,
+	"stepBack":        true,
+	"reverseContinue": true,
+}
+
+// Handle a request, returning the body of the response.
+func (s *Server) handle(req *request) (interface{}, error) {
+	if s.Machine == nil && req.Command != "initialize" && req.Command != "launch" {
+		return nil, fmt.Errorf("Nothing has been launched")
+	}
+	if needsStop[req.Command] && s.isRunning() {
+		return nil, errRunning
+	}
+	var args struct {
+		ThreadID          int    `json:"threadId"`
+		FrameID           int    `json:"frameId"`
+		Granularity       string `json:"granularity"`
+		VariablesRef      int    `json:"variablesReference"`
+		Name              string `json:"name"`
+		Value             string `json:"value"`
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int64  `json:"offset"`
+		Count             int    `json:"count"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if len(req.Arguments) > 0 && req.Command != "launch" && req.Command != "attach" {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, fmt.Errorf("Bad arguments to %s, %v", req.Command, err)
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsSetVariable":              true,
+			"supportsReadMemoryRequest":        true,
+			"supportsDisassembleRequest":       true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsSteppingGranularity":      true,
+			"supportsStepBack":                 true,
+		}, nil
+	case "launch", "attach":
+		var err error
+		if req.Command == "launch" {
+			err = s.launch(req.Arguments)
+		} else {
+			err = s.attach(req.Arguments)
+		}
+		if err == nil {
+			s.after = func() error { return s.conn.event("initialized", nil) }
+		}
+		return nil, err
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.current = 0
+			s.after = func() error {
+				return s.conn.event("stopped", stoppedBody{Reason: "entry", ThreadID: 1, AllThreadsStopped: true})
+			}
+			return nil, nil
+		}
+		s.resume(0, runFree)
+		return nil, nil
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "setInstructionBreakpoints":
+		return s.setInstructionBreakpoints(req.Arguments)
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{}, nil
+	case "threads":
+		threads := []map[string]interface{}{}
+		for ix := range s.Machine.CPUs {
+			threads = append(threads, map[string]interface{}{"id": ix + 1, "name": fmt.Sprintf("CPU %d", ix)})
+		}
+		return map[string]interface{}{"threads": threads}, nil
+	case "stackTrace":
+		return s.stackTrace(args.ThreadID)
+	case "scopes":
+		return s.scopes(args.FrameID)
+	case "variables":
+		return s.variables(args.VariablesRef)
+	case "setVariable":
+		return s.setVariable(args.VariablesRef, args.Name, args.Value)
+	case "readMemory":
+		return s.readMemory(args.MemoryReference, args.Offset, args.Count)
+	case "disassemble":
+		return s.disassemble(args.MemoryReference, args.Offset, args.InstructionOffset, args.InstructionCount)
+	case "continue":
+		if _, err := s.cpu(args.ThreadID); err != nil {
+			return nil, err
+		}
+		s.resume(args.ThreadID-1, runFree)
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		c, err := s.cpu(args.ThreadID)
+		if err != nil {
+			return nil, err
+		}
+		step := stepLine
+		if _, ok := s.line(c.IC); !ok || args.Granularity == "instruction" {
+			step = stepInstruction
+		}
+		s.resume(args.ThreadID-1, step)
+		return nil, nil
+	case "stepBack", "reverseContinue":
+		c, err := s.cpu(args.ThreadID)
+		if err != nil {
+			return nil, err
+		}
+		if c.Journal == nil {
+			return nil, fmt.Errorf("CPU %d has no history to go back through", c.ID)
+		}
+		body := s.reverse(c, req.Command == "reverseContinue")
+		s.current = c.ID
+		s.after = func() error { return s.conn.event("stopped", body) }
+		return nil, nil
+	case "pause":
+		atomic.StoreInt32(&s.pause, 1)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unsupported request %s", req.Command)
+}
+
+type launchArguments struct {
+	Config      string         `json:"config"`
+	Image       string         `json:"image"`
+	Memory      *config.Number `json:"memory"`
+	Load        config.Number  `json:"load"`
+	IC          *config.Number `json:"ic"`
+	Debug       string         `json:"debug"`
+	StopOnEntry bool           `json:"stopOnEntry"`
+	History     int            `json:"history"`
+}
+
+func (s *Server) launch(raw json.RawMessage) error {
+	var args launchArguments
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return fmt.Errorf("Bad launch arguments, %v", err)
+		}
+	}
+	var m *config.Machine
+	switch {
+	case args.Config != "" && args.Image != "":
+		return fmt.Errorf("Only one of config and image can be launched")
+	case args.Config != "":
+		cfg, err := config.Load(args.Config)
+		if err != nil {
+			return err
+		}
+		if m, err = cfg.Build(); err != nil {
+			return err
+		}
+	case args.Image != "":
+		img, err := memimage.ReadFile(args.Image, uint32(args.Load))
+		if err != nil {
+			return err
+		}
+		size := uint32(0x40000)
+		if args.Memory != nil {
+			size = uint32(*args.Memory)
+		}
+		if m, err = config.LoadedMachine(img, size); err != nil {
+			return fmt.Errorf("%s: %v", args.Image, err)
+		}
+	case s.Machine == nil:
+		return fmt.Errorf("Nothing to launch, give a config or an image")
+	}
+	if m != nil {
+		s.halt()
+		s.Machine = m
+		s.owned = true
+	}
+	if args.IC != nil {
+		s.Machine.CPUs[0].IC = uint32(*args.IC) & 0x3ffff
+	}
+	return s.setup(args)
+}
+
+func (s *Server) attach(raw json.RawMessage) error {
+	var args launchArguments
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return fmt.Errorf("Bad attach arguments, %v", err)
+		}
+	}
+	return s.setup(args)
+}
+
+// Settings shared by launch and attach.
+func (s *Server) setup(args launchArguments) error {
+	if args.Debug != "" {
+		debug, err := debuginfo.Load(args.Debug)
+		if err != nil {
+			return err
+		}
+		s.Debug = debug
+	}
+	s.stopOnEntry = args.StopOnEntry
+	if args.History > 0 {
+		for _, c := range s.Machine.CPUs {
+			c.Journal = cpu.NewJournal(args.History)
+		}
+	}
+	return nil
+}
+
+// Return the CPU of a thread.
+func (s *Server) cpu(thread int) (*cpu.CPU, error) {
+	if thread < 1 || thread > len(s.Machine.CPUs) {
+		return nil, fmt.Errorf("No thread %d", thread)
+	}
+	return s.Machine.CPUs[thread-1], nil
+}
+
+// Return the source line of an address, if there is debug
+// information.
+func (s *Server) line(address uint32) (debuginfo.LineEntry, bool) {
+	if s.Debug == nil {
+		return debuginfo.LineEntry{}, false
+	}
+	return s.Debug.Lookup(address)
+}
+
+// Return the symbolic form of an address, or "" without symbols.
+func (s *Server) name(address uint32) string {
+	if s.Debug == nil {
+		return ""
+	}
+	return s.Debug.Name(address)
+}
+
+type stoppedBody struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	ThreadID          int    `json:"threadId"`
+	Text              string `json:"text,omitempty"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+}
+
+// Once the response is sent, start running the system in the
+// background, until the CPU with the given index has stepped as
+// asked, any CPU hits a breakpoint or traps, the client pauses, or
+// every CPU has halted. A stopped event is sent at the end.
+func (s *Server) resume(cix int, step stepping) {
+	for _, c := range s.Machine.CPUs {
+		c.Trap = nil
+	}
+	s.after = func() error {
+		atomic.StoreInt32(&s.pause, 0)
+		atomic.StoreInt32(&s.running, 1)
+		finished := make(chan struct{})
+		s.finished = finished
+		go func() {
+			defer close(finished)
+			body := s.run(cix, step)
+			s.current = body.ThreadID - 1
+			atomic.StoreInt32(&s.running, 0)
+			if err := s.conn.event("stopped", body); err != nil {
+				log.WithFields(log.Fields{"error": err}).Warn("Failed to send stopped event")
+			}
+		}()
+		return nil
+	}
+}
+
+func (s *Server) run(cix int, step stepping) stoppedBody {
+	target := s.Machine.CPUs[cix]
+	start, _ := s.line(target.IC)
+
+	var once sync.Once
+	var stopped int32
+	rv := stoppedBody{Reason: "halt", Description: "Halted", ThreadID: cix + 1, AllThreadsStopped: true}
+	stopAll := func(c *cpu.CPU, reason, text string) {
+		once.Do(func() {
+			rv = stoppedBody{Reason: reason, Text: text, ThreadID: c.ID + 1, AllThreadsStopped: true}
+			atomic.StoreInt32(&stopped, 1)
+		})
+	}
+
+	s.Machine.RunUntil(math.MaxUint64, func(c *cpu.CPU) bool {
+		if atomic.LoadInt32(&stopped) != 0 {
+			return true
+		}
+		breaks := s.breaks.Load().(map[uint32]bool)
+		switch {
+		case c.Trap != nil:
+			stopAll(c, "exception", c.Trap.Error())
+		case breaks[c.IC]:
+			stopAll(c, "breakpoint", "")
+		case c == target && step == stepInstruction:
+			stopAll(c, "step", "")
+		case c == target && step == stepLine:
+			if l, ok := s.line(c.IC); !ok || l.Line != start.Line || l.File != start.File || c.Halted() {
+				stopAll(c, "step", "")
+			}
+		case c.Halted():
+			return true
+		case atomic.LoadInt32(&s.pause) != 0:
+			stopAll(target, "pause", "")
+		}
+		return atomic.LoadInt32(&stopped) != 0
+	})
+	return rv
+}
+
+// Undo one instruction of a CPU, or keep undoing them until
+// reaching a breakpoint, returning why it stopped.
+func (s *Server) reverse(c *cpu.CPU, cont bool) stoppedBody {
+	breaks := s.breaks.Load().(map[uint32]bool)
+	rv := stoppedBody{Reason: "step", ThreadID: c.ID + 1, AllThreadsStopped: true}
+	for {
+		if !c.StepBack() {
+			rv.Description = "Start of history"
+			return rv
+		}
+		if !cont {
+			return rv
+		}
+		if breaks[c.IC] {
+			rv.Reason = "breakpoint"
+			return rv
+		}
+	}
+}
+
+type breakpoint struct {
+	Verified             bool   `json:"verified"`
+	Line                 int    `json:"line,omitempty"`
+	Message              string `json:"message,omitempty"`
+	InstructionReference string `json:"instructionReference,omitempty"`
+}
+
+func (s *Server) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("Bad arguments to setBreakpoints, %v", err)
+	}
+	rv := []breakpoint{}
+	addresses := []uint32{}
+	for _, b := range args.Breakpoints {
+		var found []uint32
+		if s.Debug != nil {
+			found = s.Debug.Addresses(args.Source.Path, b.Line)
+		}
+		if len(found) == 0 {
+			rv = append(rv, breakpoint{Line: b.Line, Message: "No code at this line"})
+			continue
+		}
+		addresses = append(addresses, found...)
+		rv = append(rv, breakpoint{Verified: true, Line: b.Line, InstructionReference: reference(found[0])})
+	}
+	s.sourceBreaks[args.Source.Path] = addresses
+	s.updateBreaks()
+	return map[string]interface{}{"breakpoints": rv}, nil
+}
+
+func (s *Server) setInstructionBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			InstructionReference string `json:"instructionReference"`
+			Offset               int64  `json:"offset"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("Bad arguments to setInstructionBreakpoints, %v", err)
+	}
+	rv := []breakpoint{}
+	s.instrBreaks = nil
+	for _, b := range args.Breakpoints {
+		address, err := s.parseReference(b.InstructionReference, b.Offset)
+		if err != nil {
+			rv = append(rv, breakpoint{Message: err.Error()})
+			continue
+		}
+		s.instrBreaks = append(s.instrBreaks, address)
+		rv = append(rv, breakpoint{Verified: true, InstructionReference: reference(address)})
+	}
+	s.updateBreaks()
+	return map[string]interface{}{"breakpoints": rv}, nil
+}
+
+// Publish the combined breakpoints to a running machine.
+func (s *Server) updateBreaks() {
+	breaks := map[uint32]bool{}
+	for _, addresses := range s.sourceBreaks {
+		for _, a := range addresses {
+			breaks[a] = true
+		}
+	}
+	for _, a := range s.instrBreaks {
+		breaks[a] = true
+	}
+	s.breaks.Store(breaks)
+}
+
+// Return the memory reference of a half-word address.
+func reference(address uint32) string {
+	return fmt.Sprintf("0x%05x", address)
+}
+
+// Parse a memory reference, adding a byte offset to it. With debug
+// information, a reference can be symbolic, such as LOOP+4.
+func (s *Server) parseReference(ref string, offset int64) (uint32, error) {
+	v, err := strconv.ParseUint(ref, 0, 32)
+	if err != nil && s.Debug != nil {
+		var a uint32
+		a, err = s.Debug.Resolve(ref, func(n string) (uint64, error) {
+			return strconv.ParseUint(n, 0, 32)
+		})
+		v = uint64(a)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Bad memory reference %q", ref)
+	}
+	address := int64(v) + offset/2
+	if address < 0 || address > 0x3ffff {
+		return 0, fmt.Errorf("Address 0x%x is outside the address space", address)
+	}
+	return uint32(address), nil
+}
+
+type source struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func (s *Server) stackTrace(thread int) (interface{}, error) {
+	c, err := s.cpu(thread)
+	if err != nil {
+		return nil, err
+	}
+	s.current = thread - 1
+	name := s.disassembleAt(c, c.IC)
+	if n := s.name(c.IC); n != "" {
+		name = n + ": " + name
+	}
+	frame := map[string]interface{}{
+		"id":                          thread,
+		"name":                        name,
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": reference(c.IC),
+	}
+	if l, ok := s.line(c.IC); ok {
+		frame["source"] = source{Name: filepath.Base(l.File), Path: l.File}
+		frame["line"] = l.Line
+		frame["column"] = 1
+	}
+	return map[string]interface{}{"stackFrames": []interface{}{frame}, "totalFrames": 1}, nil
+}
+
+// Return the text of the instruction at an address, for a CPU.
+func (s *Server) disassembleAt(c *cpu.CPU, address uint32) string {
+	word, ok := c.PeekWord(address)
+	if !ok {
+		return "??"
+	}
+	return cpu.DisassembleSymbolic(address, word, s.name)
+}
+
+// Variables references. Each CPU has two scopes.
+const (
+	scopeRegisters = iota
+	scopeMemory
+	nScopes
+)
+
+func (s *Server) scopes(frame int) (interface{}, error) {
+	if _, err := s.cpu(frame); err != nil {
+		return nil, err
+	}
+	base := (frame-1)*nScopes + 1
+	return map[string]interface{}{"scopes": []map[string]interface{}{
+		{"name": "Registers", "presentationHint": "registers", "variablesReference": base + scopeRegisters, "expensive": false},
+		{"name": "Memory", "variablesReference": base + scopeMemory, "expensive": false},
+	}}, nil
+}
+
+// Return the CPU and scope of a variables reference.
+func (s *Server) scope(ref int) (*cpu.CPU, int, error) {
+	c, err := s.cpu((ref-1)/nScopes + 1)
+	if err != nil || ref < 1 {
+		return nil, 0, fmt.Errorf("No variables reference %d", ref)
+	}
+	return c, (ref - 1) % nScopes, nil
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+func (s *Server) variables(ref int) (interface{}, error) {
+	c, scope, err := s.scope(ref)
+	if err != nil {
+		return nil, err
+	}
+	rv := []variable{}
+	if scope == scopeRegisters {
+		for ix, g := range c.G {
+			rv = append(rv, variable{Name: fmt.Sprintf("G%d", ix), Value: fmt.Sprintf("0x%08x", g)})
+		}
+		rv = append(rv,
+			variable{Name: "IC", Value: fmt.Sprintf("0x%05x", c.IC), MemoryReference: reference(c.IC)},
+			variable{Name: "CC", Value: fmt.Sprintf("%d", c.CC)},
+			variable{Name: "PS", Value: fmt.Sprintf("0x%016x", c.PS)})
+	} else {
+		for ix := uint32(0); ix < memoryWindow; ix++ {
+			a := (c.IC + ix) & 0x3ffff
+			if h, ok := c.Peek(a); ok {
+				rv = append(rv, variable{Name: reference(a), Value: fmt.Sprintf("0x%04x", h), MemoryReference: reference(a)})
+			}
+		}
+	}
+	return map[string]interface{}{"variables": rv}, nil
+}
+
+func (s *Server) setVariable(ref int, name, value string) (interface{}, error) {
+	c, scope, err := s.scope(ref)
+	if err != nil {
+		return nil, err
+	}
+	v, err := strconv.ParseUint(value, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad value %q", value)
+	}
+	var rv string
+	if scope == scopeMemory {
+		a, err := s.parseReference(name, 0)
+		if err != nil || !c.Poke(a, uint16(v)) {
+			return nil, fmt.Errorf("No memory at %s", name)
+		}
+		h, _ := c.Peek(a)
+		rv = fmt.Sprintf("0x%04x", h)
+	} else {
+		switch name {
+		case "IC":
+			c.IC = uint32(v) & 0x3ffff
+			rv = fmt.Sprintf("0x%05x", c.IC)
+		case "CC":
+			c.CC = uint8(v & 0xf)
+			rv = fmt.Sprintf("%d", c.CC)
+		case "PS":
+			c.PS = v
+			rv = fmt.Sprintf("0x%016x", c.PS)
+		default:
+			var n int
+			if _, err := fmt.Sscanf(name, "G%d", &n); err != nil || n < 0 || n > 15 || name != fmt.Sprintf("G%d", n) {
+				return nil, fmt.Errorf("No register %s", name)
+			}
+			c.G[n] = uint32(v)
+			rv = fmt.Sprintf("0x%08x", c.G[n])
+		}
+	}
+	return map[string]string{"value": rv}, nil
+}
+
+// Read bytes of memory. A read that runs into unmapped memory
+// returns what could be read, and says how much was left.
+func (s *Server) readMemory(ref string, offset int64, count int) (interface{}, error) {
+	v, err := s.parseReference(ref, 0)
+	if err != nil {
+		return nil, err
+	}
+	start := 2*int64(v) + offset
+	if start < 0 {
+		return nil, fmt.Errorf("Address %s%+d is outside the address space", ref, offset)
+	}
+	c := s.Machine.CPUs[s.current]
+	data := []byte{}
+	for b := start; b < start+int64(count); b++ {
+		hw := b / 2
+		if hw > 0x3ffff {
+			break
+		}
+		h, ok := c.Peek(uint32(hw))
+		if !ok {
+			break
+		}
+		if b%2 == 0 {
+			h >>= 8
+		}
+		data = append(data, byte(h))
+	}
+	return map[string]interface{}{
+		"address":         reference(uint32(start / 2)),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": count - len(data),
+	}, nil
+}
+
+// Disassemble count instructions, starting instructionOffset
+// instructions (two half-words each) from the reference.
+func (s *Server) disassemble(ref string, offset int64, instructionOffset, count int) (interface{}, error) {
+	v, err := s.parseReference(ref, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := s.Machine.CPUs[s.current]
+	first := int64(v) + offset/2 + 2*int64(instructionOffset)
+	rv := []map[string]interface{}{}
+	for ix := 0; ix < count; ix++ {
+		a := first + 2*int64(ix)
+		if a < 0 || a > 0x3ffff {
+			rv = append(rv, map[string]interface{}{
+				"address":          fmt.Sprintf("0x%05x", a&0xfffff),
+				"instruction":      "??",
+				"presentationHint": "invalid",
+			})
+			continue
+		}
+		address := uint32(a)
+		i := map[string]interface{}{
+			"address":     reference(address),
+			"instruction": s.disassembleAt(c, address),
+		}
+		if sym, ok := s.symbolAt(address); ok {
+			i["symbol"] = sym
+		}
+		if word, ok := c.PeekWord(address); ok {
+			i["instructionBytes"] = fmt.Sprintf("%08x", word)
+		}
+		if l, ok := s.line(address); ok {
+			i["location"] = source{Name: filepath.Base(l.File), Path: l.File}
+			i["line"] = l.Line
+		}
+		rv = append(rv, i)
+	}
+	return map[string]interface{}{"instructions": rv}, nil
+}
+
+// Return the name of the code or data symbol at exactly an address.
+func (s *Server) symbolAt(address uint32) (string, bool) {
+	n := s.name(address)
+	if n == "" || strings.ContainsAny(n, "+") {
+		return "", false
+	}
+	return n, true
+}
@@ -0,0 +1,462 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/shared"
+)
+
+// A message from the server, response or event.
+type message struct {
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// The client end of a session.
+type client struct {
+	t        *testing.T
+	conn     net.Conn
+	seq      int
+	messages chan message
+}
+
+func newClient(t *testing.T, conn net.Conn) *client {
+	c := &client{t: t, conn: conn, messages: make(chan message, 100)}
+	go func() {
+		defer close(c.messages)
+		r := textproto.NewReader(bufio.NewReader(conn))
+		for {
+			header, err := r.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			length, _ := strconv.Atoi(header.Get("Content-Length"))
+			data := make([]byte, length)
+			if _, err := r.R.Read(data); err != nil {
+				return
+			}
+			var m message
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Errorf("Bad message %s, %v", data, err)
+				return
+			}
+			c.messages <- m
+		}
+	}()
+	return c
+}
+
+// Wait for the next message.
+func (c *client) next() message {
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("Connection closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("Timed out waiting for a message")
+	}
+	return message{}
+}
+
+// Send a request, and return the body of the response, decoded into
+// body (if not nil).
+func (c *client) call(command string, args interface{}, body interface{}) message {
+	c.seq++
+	data, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	m := c.next()
+	if m.Type != "response" || m.RequestSeq != c.seq {
+		c.t.Fatalf("Expected the response to %s, got %+v", command, m)
+	}
+	if body != nil && m.Success {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatalf("Bad body %s, %v", m.Body, err)
+		}
+	}
+	return m
+}
+
+// Wait for an event, and decode its body.
+func (c *client) expect(event string, body interface{}) {
+	m := c.next()
+	if m.Type != "event" || m.Event != event {
+		c.t.Fatalf("Expected a %s event, got %+v", event, m)
+	}
+	if body != nil {
+		if err := json.Unmarshal(m.Body, body); err != nil {
+			c.t.Fatalf("Bad body %s, %v", m.Body, err)
+		}
+	}
+}
+
+// Wait for a stopped event, checking its reason.
+func (c *client) stopped(reason string) stoppedBody {
+	var b stoppedBody
+	c.expect("stopped", &b)
+	if b.Reason != reason {
+		c.t.Fatalf("Stopped for %q (%s), expected %q", b.Reason, b.Text, reason)
+	}
+	return b
+}
+
+type frame struct {
+	Name   string `json:"name"`
+	Line   int    `json:"line"`
+	Source struct {
+		Path string `json:"path"`
+	} `json:"source"`
+	InstructionPointerReference string `json:"instructionPointerReference"`
+}
+
+func (c *client) frame(thread int) frame {
+	var body struct {
+		StackFrames []frame `json:"stackFrames"`
+	}
+	if m := c.call("stackTrace", map[string]int{"threadId": thread}, &body); !m.Success || len(body.StackFrames) != 1 {
+		c.t.Fatalf("Bad stack trace %+v", m)
+	}
+	return body.StackFrames[0]
+}
+
+// Write a program and its debug information, returning their paths.
+// The first word is labelled START, and the last DONE.
+func writeProgram(t *testing.T, dir string, words ...uint32) (string, string) {
+	image := []uint16{}
+	var debug debuginfo.Info
+	for ix, w := range words {
+		image = append(image, uint16(w>>16), uint16(w))
+		debug.Add(filepath.Join(dir, "test.s"), ix+1, uint32(2*ix))
+	}
+	debug.AddSymbol(debuginfo.Symbol{Name: "START", Kind: debuginfo.Code})
+	debug.AddSymbol(debuginfo.Symbol{Name: "DONE", Kind: debuginfo.Code, Value: uint32(2*len(words) - 2)})
+	imagePath := filepath.Join(dir, "test.bin")
+	if err := config.WriteImage(imagePath, image); err != nil {
+		t.Fatalf("Unexpected error writing image, %v", err)
+	}
+	debugPath := filepath.Join(dir, "test.dbg")
+	if err := debug.Save(debugPath); err != nil {
+		t.Fatalf("Unexpected error writing debug information, %v", err)
+	}
+	return imagePath, debugPath
+}
+
+func startSession(t *testing.T, s *Server) (*client, chan error) {
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(server)
+		server.Close()
+	}()
+	c := newClient(t, conn)
+	if m := c.call("initialize", map[string]string{"adapterID": "c932"}, nil); !m.Success {
+		t.Fatalf("Initialize failed, %s", m.Message)
+	}
+	return c, done
+}
+
+func TestSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image, debug := writeProgram(t, dir,
+		0x98101234, // LD 1,0x1234
+		0x98202222, // LD 2,0x2222
+		0x01300000, // JS 3, to itself
+	)
+
+	s := NewServer(nil, nil)
+	c, done := startSession(t, s)
+	if m := c.call("threads", nil, nil); m.Success {
+		t.Errorf("Expected threads to fail before launching")
+	}
+	launch := map[string]interface{}{"image": image, "memory": "0x100", "debug": debug, "stopOnEntry": true}
+	if m := c.call("launch", launch, nil); !m.Success {
+		t.Fatalf("Launch failed, %s", m.Message)
+	}
+	c.expect("initialized", nil)
+
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	args := map[string]interface{}{
+		"source":      map[string]string{"path": "/elsewhere/test.s"},
+		"breakpoints": []map[string]int{{"line": 2}, {"line": 9}},
+	}
+	c.call("setBreakpoints", args, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Verified {
+		t.Errorf("Breakpoints %+v, expected only the first verified", bps.Breakpoints)
+	}
+
+	c.call("configurationDone", nil, nil)
+	c.stopped("entry")
+	if f := c.frame(1); f.Name != "START: LD 1,0x1234" || f.Line != 1 || f.Source.Path != filepath.Join(dir, "test.s") {
+		t.Errorf("Entry frame %+v", f)
+	}
+
+	c.call("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint")
+	if f := c.frame(1); f.Line != 2 || f.InstructionPointerReference != "0x00002" {
+		t.Errorf("Breakpoint frame %+v", f)
+	}
+
+	c.call("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step")
+	if f := c.frame(1); f.Line != 3 || f.Name != "DONE: JS 3,DONE" {
+		t.Errorf("Stepped to %+v, expected line 3", f)
+	}
+
+	var scopes struct {
+		Scopes []struct {
+			Name               string `json:"name"`
+			VariablesReference int    `json:"variablesReference"`
+		} `json:"scopes"`
+	}
+	c.call("scopes", map[string]int{"frameId": 1}, &scopes)
+	if len(scopes.Scopes) != 2 || scopes.Scopes[0].Name != "Registers" {
+		t.Fatalf("Scopes %+v", scopes)
+	}
+	registers := scopes.Scopes[0].VariablesReference
+	if m := c.call("setVariable", map[string]interface{}{"variablesReference": registers, "name": "G5", "value": "0x42"}, nil); !m.Success {
+		t.Errorf("Setting G5 failed, %s", m.Message)
+	}
+	if m := c.call("setVariable", map[string]interface{}{"variablesReference": registers, "name": "G16", "value": "1"}, nil); m.Success {
+		t.Errorf("Expected setting G16 to fail")
+	}
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	c.call("variables", map[string]int{"variablesReference": registers}, &vars)
+	values := map[string]string{}
+	for _, v := range vars.Variables {
+		values[v.Name] = v.Value
+	}
+	if values["G1"] != "0x00001234" || values["G2"] != "0x00002222" || values["G5"] != "0x00000042" || values["IC"] != "0x00004" {
+		t.Errorf("Registers %v", values)
+	}
+	c.call("variables", map[string]int{"variablesReference": scopes.Scopes[1].VariablesReference}, &vars)
+	if len(vars.Variables) != memoryWindow || vars.Variables[0].Name != "0x00004" || vars.Variables[0].Value != "0x0130" {
+		t.Errorf("Memory %+v", vars.Variables)
+	}
+
+	var mem struct {
+		Address         string `json:"address"`
+		Data            string `json:"data"`
+		UnreadableBytes int    `json:"unreadableBytes"`
+	}
+	c.call("readMemory", map[string]interface{}{"memoryReference": "0xfe", "offset": 1, "count": 6}, &mem)
+	if mem.Address != "0x000fe" || mem.Data != "AAAA" || mem.UnreadableBytes != 3 {
+		t.Errorf("Read %+v, expected 3 bytes and 3 unreadable", mem)
+	}
+	c.call("readMemory", map[string]interface{}{"memoryReference": "0x00000", "count": 4}, &mem)
+	if mem.Data != "mBASNA==" {
+		t.Errorf("Read %+v, expected mBASNA==", mem)
+	}
+	c.call("readMemory", map[string]interface{}{"memoryReference": "DONE-4", "count": 4}, &mem)
+	if mem.Address != "0x00000" || mem.Data != "mBASNA==" {
+		t.Errorf("Read %+v at DONE-4, expected mBASNA==", mem)
+	}
+
+	var dis struct {
+		Instructions []struct {
+			Address     string `json:"address"`
+			Instruction string `json:"instruction"`
+			Line        int    `json:"line"`
+			Symbol      string `json:"symbol"`
+		} `json:"instructions"`
+	}
+	c.call("disassemble", map[string]interface{}{"memoryReference": "0x00002", "instructionOffset": -1, "instructionCount": 3}, &dis)
+	want := []string{"LD 1,0x1234", "LD 2,0x2222", "JS 3,DONE"}
+	symbols := []string{"START", "", "DONE"}
+	for ix, i := range dis.Instructions {
+		if i.Instruction != want[ix] || i.Line != ix+1 || i.Address != fmt.Sprintf("0x%05x", 2*ix) || i.Symbol != symbols[ix] {
+			t.Errorf("Instruction #%d is %+v, expected %s", ix, i, want[ix])
+		}
+	}
+
+	c.call("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("halt")
+
+	c.call("disconnect", nil, nil)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+	if s.Machine != nil {
+		t.Errorf("Expected the launched machine to be closed")
+	}
+}
+
+func TestPauseAndTrap(t *testing.T) {
+	m, err := config.ImageMachine([]uint16{
+		0x0000, 0x0000, // NOP
+		0x0138, 0x0002, // JS 3,*4, back to 0
+		0x0000, 0x0000,
+	}, 0x100, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error building machine, %v", err)
+	}
+	defer m.Close()
+
+	c, done := startSession(t, NewServer(m, nil))
+	if msg := c.call("attach", nil, nil); !msg.Success {
+		t.Fatalf("Attach failed, %s", msg.Message)
+	}
+	c.expect("initialized", nil)
+	c.call("configurationDone", nil, nil)
+	if msg := c.call("stackTrace", map[string]int{"threadId": 1}, nil); msg.Success {
+		t.Errorf("Expected stackTrace to fail while running")
+	}
+	c.call("pause", map[string]int{"threadId": 1}, nil)
+	c.stopped("pause")
+
+	m.CPUs[0].IC = 0x200
+	c.call("stepIn", map[string]interface{}{"threadId": 1, "granularity": "instruction"}, nil)
+	if b := c.stopped("exception"); b.Text != "No memory at address 0x00200, IC 0x00200" {
+		t.Errorf("Trap text %q", b.Text)
+	}
+	if f := c.frame(1); f.Name != "??" {
+		t.Errorf("Frame at unmapped IC is %+v", f)
+	}
+
+	c.conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image, debug := writeProgram(t, dir,
+		0x98101234, // LD 1,0x1234
+		0x98202222, // LD 2,0x2222
+		0x98303333, // LD 3,0x3333
+		0x01300000, // JS 3, to itself
+	)
+
+	c, done := startSession(t, NewServer(nil, nil))
+	launch := map[string]interface{}{"image": image, "memory": 256, "debug": debug, "stopOnEntry": true}
+	c.call("launch", launch, nil)
+	c.expect("initialized", nil)
+	c.call("configurationDone", nil, nil)
+	c.stopped("entry")
+	if m := c.call("stepBack", map[string]int{"threadId": 1}, nil); m.Success {
+		t.Errorf("Expected stepping back without history to fail")
+	}
+	c.call("disconnect", nil, nil)
+	<-done
+
+	c, done = startSession(t, NewServer(nil, nil))
+	launch["history"] = 100
+	c.call("launch", launch, nil)
+	c.expect("initialized", nil)
+	c.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "test.s"},
+		"breakpoints": []map[string]int{{"line": 2}},
+	}, nil)
+	c.call("configurationDone", nil, nil)
+	c.stopped("entry")
+	c.call("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint")
+	c.call("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("halt")
+
+	c.call("stepBack", map[string]int{"threadId": 1}, nil)
+	c.stopped("step")
+	c.call("stepBack", map[string]int{"threadId": 1}, nil)
+	c.stopped("step")
+	if f := c.frame(1); f.Line != 3 {
+		t.Errorf("Stepped back to line %d, expected 3", f.Line)
+	}
+	c.call("reverseContinue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint")
+	if f := c.frame(1); f.Line != 2 {
+		t.Errorf("Reverse continued to line %d, expected 2", f.Line)
+	}
+	c.call("reverseContinue", map[string]int{"threadId": 1}, nil)
+	if b := c.stopped("step"); b.Description != "Start of history" {
+		t.Errorf("Stopped with %+v, expected the start of history", b)
+	}
+	if f := c.frame(1); f.Line != 1 {
+		t.Errorf("Reverse continued to line %d, expected 1", f.Line)
+	}
+	c.call("disconnect", nil, nil)
+	<-done
+}
+
+// Looking at and changing memory is not an access by the CPU, so
+// observers of shared memory do not see it.
+func TestSharedMemory(t *testing.T) {
+	cfg, err := config.Parse([]byte(`{
+	  "cpus": [{"local": [{"low": 0, "high": "0xff"}], "boot": {"ic": "0x100"}}],
+	  "shared": [{"low": "0x100", "high": "0x10f"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing, %v", err)
+	}
+	m, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error building, %v", err)
+	}
+	defer m.Close()
+	module := m.System.Modules[0]
+	module.TryWriteWord(0, 0x98101234) // LD 1,0x1234
+	module.SetConsistency(shared.Consistency{Ordering: shared.TotalStoreOrder, DrainDelay: 100})
+	r := shared.NewRecorder()
+	module.Observe(r)
+
+	c, done := startSession(t, NewServer(m, nil))
+	c.call("launch", map[string]interface{}{"stopOnEntry": true}, nil)
+	c.expect("initialized", nil)
+	c.call("configurationDone", nil, nil)
+	c.stopped("entry")
+
+	var scopes struct {
+		Scopes []struct {
+			VariablesReference int `json:"variablesReference"`
+		} `json:"scopes"`
+	}
+	c.call("scopes", map[string]int{"frameId": 1}, &scopes)
+	memory := scopes.Scopes[1].VariablesReference
+	c.call("variables", map[string]int{"variablesReference": memory}, nil)
+	if m := c.call("setVariable", map[string]interface{}{"variablesReference": memory, "name": "0x00102", "value": "0xabcd"}, nil); !m.Success {
+		t.Errorf("Setting 0x00102 failed, %s", m.Message)
+	}
+	var mem struct {
+		Data string `json:"data"`
+	}
+	c.call("readMemory", map[string]interface{}{"memoryReference": "0x00100", "count": 6}, &mem)
+	if mem.Data != "mBASNKvN" {
+		t.Errorf("Read %q, expected mBASNKvN", mem.Data)
+	}
+	c.call("disassemble", map[string]interface{}{"memoryReference": "0x00100", "instructionCount": 1}, nil)
+
+	if n := len(r.Events()); n != 0 {
+		t.Errorf("Observers saw %d events, expected none", n)
+	}
+	c.call("disconnect", nil, nil)
+	<-done
+}
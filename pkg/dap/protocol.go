@@ -0,0 +1,120 @@
+package dap
+
+// Framing of Debug Adapter Protocol messages.
+//
+// Each message is a JSON object, preceded by a Content-Length header
+// giving its length in bytes and an empty line:
+//
+//	Content-Length: 59\r\n
+//	\r\n
+//	{"seq":1,"type":"request","command":"threads","arguments":{}}
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A request from the client.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// A response to a request.
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// An event, sent whenever something happens.
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// A connection to a DAP client.
+type conn struct {
+	r   *textproto.Reader
+	w   io.Writer
+	mu  sync.Mutex // Serialises writes, and protects seq
+	seq int
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{r: textproto.NewReader(bufio.NewReader(rw)), w: rw}
+}
+
+// Read the next request.
+func (c *conn) receive() (*request, error) {
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header.Get("Content-Length")))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("Bad Content-Length %q", header.Get("Content-Length"))
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r.R, data); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"message": string(data)}).Debug("DAP receive")
+	var rv request
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("Bad message, %v", err)
+	}
+	return &rv, nil
+}
+
+// Send a message, filling in its sequence number.
+func (c *conn) send(setSeq func(int), msg interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	setSeq(c.seq)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"message": string(data)}).Debug("DAP send")
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(data)
+	return err
+}
+
+// Send a successful response, with the given body.
+func (c *conn) respond(req *request, body interface{}) error {
+	r := &response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body}
+	return c.send(func(seq int) { r.Seq = seq }, r)
+}
+
+// Send a failure response.
+func (c *conn) fail(req *request, err error) error {
+	r := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: err.Error()}
+	return c.send(func(seq int) { r.Seq = seq }, r)
+}
+
+// Send an event.
+func (c *conn) event(name string, body interface{}) error {
+	e := &event{Type: "event", Event: name, Body: body}
+	return c.send(func(seq int) { e.Seq = seq }, e)
+}
@@ -0,0 +1,61 @@
+package dap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A buffer standing in for both ends of a connection.
+type loopback struct {
+	in  *strings.Reader
+	out bytes.Buffer
+}
+
+func (l *loopback) Read(p []byte) (int, error)  { return l.in.Read(p) }
+func (l *loopback) Write(p []byte) (int, error) { return l.out.Write(p) }
+
+func TestReceive(t *testing.T) {
+	first := `{"seq":1,"type":"request","command":"initialize","arguments":{"adapterID":"c932"}}`
+	second := `{"seq":2,"type":"request","command":"threads"}`
+	in := fmt.Sprintf("Content-Length: %d\r\n\r\n%scontent-length:%d\r\n\r\n%s", len(first), first, len(second), second)
+	c := newConn(&loopback{in: strings.NewReader(in)})
+
+	req, err := c.receive()
+	if err != nil {
+		t.Fatalf("Unexpected error receiving, %v", err)
+	}
+	if req.Seq != 1 || req.Command != "initialize" || string(req.Arguments) != `{"adapterID":"c932"}` {
+		t.Errorf("Received %+v", req)
+	}
+	if req, err = c.receive(); err != nil || req.Seq != 2 || req.Command != "threads" {
+		t.Errorf("Received %+v, %v", req, err)
+	}
+	if _, err := c.receive(); err == nil {
+		t.Errorf("Expected an error at the end of the input")
+	}
+
+	c = newConn(&loopback{in: strings.NewReader("Content-Length: x\r\n\r\n{}")})
+	if _, err := c.receive(); err == nil {
+		t.Errorf("Expected an error for a bad Content-Length")
+	}
+}
+
+func TestSend(t *testing.T) {
+	l := &loopback{in: strings.NewReader("")}
+	c := newConn(l)
+	req := &request{Seq: 7, Type: "request", Command: "pause"}
+	if err := c.respond(req, nil); err != nil {
+		t.Fatalf("Unexpected error responding, %v", err)
+	}
+	if err := c.event("stopped", stoppedBody{Reason: "pause", ThreadID: 1}); err != nil {
+		t.Fatalf("Unexpected error sending event, %v", err)
+	}
+	response := `{"seq":1,"type":"response","request_seq":7,"success":true,"command":"pause"}`
+	event := `{"seq":2,"type":"event","event":"stopped","body":{"reason":"pause","threadId":1,"allThreadsStopped":false}}`
+	want := fmt.Sprintf("Content-Length: %d\r\n\r\n%sContent-Length: %d\r\n\r\n%s", len(response), response, len(event), event)
+	if got := l.out.String(); got != want {
+		t.Errorf("Sent %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+// The debuginfo package holds what a debugger needs to relate a
+// running program to its source: the names of addresses, and which
+// source line each address was assembled from.
+//
+// Debug information is stored as JSON, as written by the assembler:
+//
+//	{
+//	  "symbols": [{"name": "LOOP", "kind": "code", "value": 258, "file": "boot.s", "line": 4}, ...],
+//	  "lines": [{"file": "boot.s", "line": 3, "address": 256}, ...]
+//	}
+package debuginfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// The debug information of a program.
+type Info struct {
+	SymbolTable
+	LineTable
+}
+
+// Read debug information from a file.
+func Load(path string) (*Info, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rv Info
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("Bad debug information %s, %v", path, err)
+	}
+	rv.LineTable.sort()
+	if err := rv.SymbolTable.index(); err != nil {
+		return nil, fmt.Errorf("Bad debug information %s, %v", path, err)
+	}
+	return &rv, nil
+}
+
+// Write the debug information to a file.
+func (i *Info) Save(path string) error {
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// The first address assembled from a source line.
+type LineEntry struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Address uint32 `json:"address"` // Half-word address
+}
+
+// A mapping between source lines and addresses.
+type LineTable struct {
+	Entries []LineEntry `json:"lines"`
+}
+
+// Add an entry.
+func (t *LineTable) Add(file string, line int, address uint32) {
+	t.Entries = append(t.Entries, LineEntry{File: file, Line: line, Address: address})
+	t.sort()
+}
+
+func (t *LineTable) sort() {
+	sort.SliceStable(t.Entries, func(i, j int) bool {
+		return t.Entries[i].Address < t.Entries[j].Address
+	})
+}
+
+// Do two file names refer to the same file? Debuggers tend to use
+// absolute paths, and assemblers whatever they were given, so base
+// names are compared if the names differ.
+func sameFile(a, b string) bool {
+	return a == b || filepath.Base(a) == filepath.Base(b)
+}
+
+// Return the addresses assembled from a source line.
+func (t *LineTable) Addresses(file string, line int) []uint32 {
+	rv := []uint32{}
+	for _, e := range t.Entries {
+		if e.Line == line && sameFile(e.File, file) {
+			rv = append(rv, e.Address)
+		}
+	}
+	return rv
+}
+
+// Return the source line an address was assembled from, that is, the
+// entry with the highest address not above it.
+func (t *LineTable) Lookup(address uint32) (LineEntry, bool) {
+	ix := sort.Search(len(t.Entries), func(i int) bool {
+		return t.Entries[i].Address > address
+	})
+	if ix == 0 {
+		return LineEntry{}, false
+	}
+	return t.Entries[ix-1], true
+}
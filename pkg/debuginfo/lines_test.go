@@ -0,0 +1,70 @@
+package debuginfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLineTable(t *testing.T) {
+	var lt LineTable
+	lt.Add("boot.s", 5, 0x104)
+	lt.Add("boot.s", 3, 0x100)
+	lt.Add("boot.s", 4, 0x102)
+	lt.Add("lib.s", 10, 0x200)
+
+	if a := lt.Addresses("/home/user/src/boot.s", 4); !reflect.DeepEqual(a, []uint32{0x102}) {
+		t.Errorf("Addresses of line 4 are %v, expected [0x102]", a)
+	}
+	cases := []struct {
+		address uint32
+		file    string
+		line    int
+		ok      bool
+	}{
+		{0x0ff, "", 0, false},
+		{0x100, "boot.s", 3, true},
+		{0x103, "boot.s", 4, true},
+		{0x1ff, "boot.s", 5, true},
+		{0x200, "lib.s", 10, true},
+	}
+	for ix, tc := range cases {
+		e, ok := lt.Lookup(tc.address)
+		if ok != tc.ok || e.File != tc.file || e.Line != tc.line {
+			t.Errorf("Case #%d, looked up %v, %v, expected %s:%d", ix, e, ok, tc.file, tc.line)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "debuginfo")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "boot.dbg")
+	info := Info{LineTable: lt}
+	if err := info.AddSymbol(Symbol{Name: "START", Kind: Code, Value: 0x100}); err != nil {
+		t.Fatalf("Unexpected error adding symbol, %v", err)
+	}
+	if err := info.Save(path); err != nil {
+		t.Fatalf("Unexpected error saving, %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading, %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Entries, lt.Entries) {
+		t.Errorf("Loaded %v, expected %v", loaded.Entries, lt.Entries)
+	}
+	if loaded.Name(0x102) != "START+2" {
+		t.Errorf("Loaded symbols name 0x102 %q, expected START+2", loaded.Name(0x102))
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"symbols": [{"name": "A"}, {"name": "A"}]}`), 0644); err != nil {
+		t.Fatalf("Unexpected error writing, %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Expected an error loading duplicate symbols")
+	}
+}
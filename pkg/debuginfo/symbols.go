@@ -0,0 +1,191 @@
+package debuginfo
+
+// Symbols, and symbolic addresses.
+//
+// A symbolic address is a symbol, optionally followed by offsets
+// added to or subtracted from it, such as LOOP+4 or TABLE-0x10. A
+// plain number works too. How numbers are written is up to the
+// caller, so that the monitor can keep to hexadecimal; offsets are
+// shown as decimal up to 9, and with a 0x prefix above that, which
+// reads the same either way.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// What a symbol names.
+type SymbolKind string
+
+const (
+	// A label on an instruction.
+	Code SymbolKind = "code"
+	// A label on data.
+	Data SymbolKind = "data"
+	// A value that is not an address, from .EQU.
+	Constant SymbolKind = "constant"
+)
+
+// A named value, and where it was defined.
+type Symbol struct {
+	Name  string     `json:"name"`
+	Kind  SymbolKind `json:"kind"`
+	Value uint32     `json:"value"` // A half-word address, unless Constant
+	File  string     `json:"file,omitempty"`
+	Line  int        `json:"line,omitempty"`
+}
+
+// A set of symbols, with unique names. The lookup methods index the
+// symbols on first use, so a table that is shared between goroutines
+// should be filled with AddSymbol, or come from Load.
+type SymbolTable struct {
+	Symbols   []Symbol `json:"symbols"`
+	byName    map[string]int
+	byAddress []int // Indices of address symbols, by value
+}
+
+// Build the lookup structures, checking for duplicate names.
+func (t *SymbolTable) index() error {
+	t.byName = map[string]int{}
+	t.byAddress = nil
+	for ix, s := range t.Symbols {
+		if _, ok := t.byName[s.Name]; ok {
+			return fmt.Errorf("Symbol %s defined twice", s.Name)
+		}
+		t.byName[s.Name] = ix
+		if s.Kind != Constant {
+			t.byAddress = append(t.byAddress, ix)
+		}
+	}
+	sort.SliceStable(t.byAddress, func(i, j int) bool {
+		return t.Symbols[t.byAddress[i]].Value < t.Symbols[t.byAddress[j]].Value
+	})
+	return nil
+}
+
+// Add a symbol. Return an error if the name is taken.
+func (t *SymbolTable) AddSymbol(s Symbol) error {
+	if t.byName == nil {
+		if err := t.index(); err != nil {
+			return err
+		}
+	}
+	if _, ok := t.byName[s.Name]; ok {
+		return fmt.Errorf("Symbol %s defined twice", s.Name)
+	}
+	ix := len(t.Symbols)
+	t.Symbols = append(t.Symbols, s)
+	t.byName[s.Name] = ix
+	if s.Kind != Constant {
+		at := sort.Search(len(t.byAddress), func(i int) bool {
+			return t.Symbols[t.byAddress[i]].Value > s.Value
+		})
+		t.byAddress = append(t.byAddress, 0)
+		copy(t.byAddress[at+1:], t.byAddress[at:])
+		t.byAddress[at] = ix
+	}
+	return nil
+}
+
+// Look up a symbol by name. A nil table has no symbols.
+func (t *SymbolTable) Symbol(name string) (Symbol, bool) {
+	if t == nil {
+		return Symbol{}, false
+	}
+	if t.byName == nil {
+		t.index()
+	}
+	ix, ok := t.byName[name]
+	if !ok {
+		return Symbol{}, false
+	}
+	return t.Symbols[ix], true
+}
+
+// Return the symbolic form of an address: the closest code or data
+// symbol at or below it, plus an offset. Return the empty string if
+// there is no such symbol.
+func (t *SymbolTable) Name(address uint32) string {
+	if t == nil {
+		return ""
+	}
+	if t.byName == nil {
+		t.index()
+	}
+	ix := sort.Search(len(t.byAddress), func(i int) bool {
+		return t.Symbols[t.byAddress[i]].Value > address
+	})
+	if ix == 0 {
+		return ""
+	}
+	s := t.Symbols[t.byAddress[ix-1]]
+	switch offset := address - s.Value; {
+	case offset == 0:
+		return s.Name
+	case offset < 10:
+		return fmt.Sprintf("%s+%d", s.Name, offset)
+	default:
+		return fmt.Sprintf("%s+0x%x", s.Name, offset)
+	}
+}
+
+// Look up a symbol by name, ignoring case if there is no exact match.
+func (t *SymbolTable) symbolFold(name string) (Symbol, bool) {
+	if s, ok := t.Symbol(name); ok || t == nil {
+		return s, ok
+	}
+	for _, s := range t.Symbols {
+		if strings.EqualFold(s.Name, name) {
+			return s, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// Work out a symbolic address, such as LOOP+4. Numbers are parsed
+// with the number function; a symbol hides a number spelt the same
+// way. Symbols are matched ignoring case, if they do not match
+// exactly.
+func (t *SymbolTable) Resolve(expr string, number func(string) (uint64, error)) (uint32, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return 0, fmt.Errorf("Empty address")
+	}
+	var total int64
+	sign := int64(1)
+	for {
+		end := strings.IndexAny(expr, "+-")
+		if end == 0 {
+			return 0, fmt.Errorf("Bad address %s", expr)
+		}
+		term := expr
+		if end > 0 {
+			term = expr[:end]
+		}
+		term = strings.TrimSpace(term)
+		var v int64
+		if s, ok := t.symbolFold(term); ok {
+			v = int64(s.Value)
+		} else {
+			n, err := number(term)
+			if err != nil {
+				return 0, fmt.Errorf("Unknown symbol or bad number %s", term)
+			}
+			v = int64(n)
+		}
+		total += sign * v
+		if end < 0 {
+			break
+		}
+		sign = 1
+		if expr[end] == '-' {
+			sign = -1
+		}
+		expr = expr[end+1:]
+	}
+	if total < 0 || total > 0x3ffff {
+		return 0, fmt.Errorf("Address 0x%x is outside the address space", total)
+	}
+	return uint32(total), nil
+}
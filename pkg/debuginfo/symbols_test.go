@@ -0,0 +1,74 @@
+package debuginfo
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func hex(s string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+func TestSymbols(t *testing.T) {
+	var st SymbolTable
+	for _, s := range []Symbol{
+		{Name: "LOOP", Kind: Code, Value: 0x110},
+		{Name: "START", Kind: Code, Value: 0x100},
+		{Name: "COUNT", Kind: Data, Value: 0x140},
+		{Name: "SIZE", Kind: Constant, Value: 0x120},
+		{Name: "ABC", Kind: Data, Value: 0x200},
+	} {
+		if err := st.AddSymbol(s); err != nil {
+			t.Fatalf("Unexpected error adding %s, %v", s.Name, err)
+		}
+	}
+	if err := st.AddSymbol(Symbol{Name: "LOOP"}); err == nil {
+		t.Errorf("Expected an error adding LOOP twice")
+	}
+
+	names := []struct {
+		address uint32
+		name    string
+	}{
+		{0x0ff, ""},
+		{0x100, "START"},
+		{0x109, "START+9"},
+		{0x120, "LOOP+0x10"},
+		{0x141, "COUNT+1"},
+	}
+	for _, tc := range names {
+		if n := st.Name(tc.address); n != tc.name {
+			t.Errorf("Name of %05x is %q, expected %q", tc.address, n, tc.name)
+		}
+	}
+
+	addresses := []struct {
+		expr    string
+		address uint32
+		ok      bool
+	}{
+		{"LOOP", 0x110, true},
+		{"LOOP+4", 0x114, true},
+		{"LOOP + 0x10", 0x120, true},
+		{"COUNT-SIZE+10", 0x30, true},
+		{"ABC", 0x200, true},
+		{"ABD", 0xabd, true},
+		{"200", 0x200, true},
+		{"NOWHERE", 0, false},
+		{"START-200", 0, false},
+		{"", 0, false},
+		{"LOOP+", 0, false},
+	}
+	for _, tc := range addresses {
+		a, err := st.Resolve(tc.expr, hex)
+		if (err == nil) != tc.ok || a != tc.address {
+			t.Errorf("Resolving %q gave %05x, %v, expected %05x", tc.expr, a, err, tc.address)
+		}
+	}
+
+	var none *SymbolTable
+	if a, err := none.Resolve("10", hex); err != nil || a != 0x10 || none.Name(0x10) != "" {
+		t.Errorf("A nil table resolved 10 to %x, %v", a, err)
+	}
+}
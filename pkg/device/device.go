@@ -0,0 +1,24 @@
+// The device package provides memory-mapped peripherals for the
+// Censor 932.
+//
+// The machine description gives no information about the I/O
+// instructions, so devices are instead accessed through memory: each
+// device is a cpu.MemoryBackend, registered at some range of the
+// CPU's address space, and its registers are read and written with
+// the ordinary load and store instructions. Devices that need to
+// keep track of time are driven by the virtual clock of the CPU they
+// are attached to, never by host wall time, so runs are
+// deterministic.
+package device
+
+// Anything that can take an interrupt, usually a *cpu.CPU.
+type Interrupter interface {
+	Interrupt(level uint8)
+}
+
+// A device that can be put back in its power-on state. This does not
+// cancel anything the device has scheduled, as resetting the CPU
+// empties its event queue anyway.
+type Resetter interface {
+	Reset()
+}
@@ -0,0 +1,72 @@
+package device
+
+import (
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// A real-time clock, counting ticks of the virtual clock of a CPU.
+//
+// The clock occupies four half-words, holding a 64-bit count, high
+// half-words first. Reading half-word 0 (or the word at 0) latches
+// the current count, so that the remaining half-words can be read
+// without the count changing underneath. Writes are ignored.
+type RTC struct {
+	clock   cpu.Clock
+	divisor uint64
+	latched uint64
+}
+
+// Create a real-time clock, ticking once every divisor cycles of the
+// given clock.
+func NewRTC(clock cpu.Clock, divisor uint64) *RTC {
+	if divisor == 0 {
+		divisor = 1
+	}
+	return &RTC{clock: clock, divisor: divisor}
+}
+
+// Return the current count.
+func (r *RTC) Count() uint64 {
+	return r.clock.Now() / r.divisor
+}
+
+// Clear the latched count. The count itself follows the clock.
+func (r *RTC) Reset() {
+	r.latched = 0
+}
+
+func (r *RTC) FetchHalfWord(address uint32) uint16 {
+	if address == 0 {
+		r.latched = r.Count()
+	}
+	if address > 3 {
+		return 0
+	}
+	shift := 16 * (3 - address)
+	return uint16(r.latched >> shift)
+}
+
+func (r *RTC) FetchWord(address uint32) uint32 {
+	h0 := uint32(r.FetchHalfWord(address))
+	h1 := uint32(r.FetchHalfWord(address + 1))
+	return (h0 << 16) | h1
+}
+
+// Return what a read would, without latching the count, so that
+// looking at the clock from a debugger does not change it.
+func (r *RTC) PeekHalfWord(address uint32) uint16 {
+	if address > 3 {
+		return 0
+	}
+	return uint16(r.latched >> (16 * (3 - address)))
+}
+
+func (r *RTC) PokeHalfWord(address uint32, data uint16) {}
+
+func (r *RTC) WriteHalfWord(address uint32, data uint16) uint16 {
+	return r.FetchHalfWord(address)
+}
+
+func (r *RTC) WriteWord(address, data uint32) uint32 {
+	return r.FetchWord(address)
+}
@@ -0,0 +1,55 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+func TestRTC(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0xff}, cpu.NewDirectMemory(0x100))
+	c.RegisterMemory(cpu.MemoryRange{Low: 0x100, High: 0x103}, NewRTC(c, 1))
+
+	c.StoreWord(0, 0x58100100) // LW G1 <- 0x100
+	c.StoreWord(2, 0x58200100) // LW G2 <- 0x102
+	c.Cycles = 0x123456789
+
+	c.Step()
+	c.Step()
+
+	if c.G[1] != 0x00000001 {
+		t.Errorf("G[1] is 0x%08x, expected 0x00000001", c.G[1])
+	}
+	// The low word was latched by the first read.
+	if c.G[2] != 0x23456789 {
+		t.Errorf("G[2] is 0x%08x, expected 0x23456789", c.G[2])
+	}
+}
+
+func TestRTCDivisor(t *testing.T) {
+	c := cpu.NewCPU()
+	r := NewRTC(c, 10)
+	c.Cycles = 1234
+
+	if r.Count() != 123 {
+		t.Errorf("Count is %d, expected 123", r.Count())
+	}
+}
+
+// A debugger looking at the clock does not latch it.
+func TestRTCPeek(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0x100, High: 0x103}, NewRTC(c, 1))
+	c.Cycles = 0x1234
+	c.FetchHalfWord(0x100)
+	c.Cycles = 0x5678
+
+	if w, _ := c.PeekWord(0x102); w != 0x1234 {
+		t.Errorf("Peeked 0x%08x, expected the latched 0x00001234", w)
+	}
+	c.Peek(0x100)
+	if h := c.FetchHalfWord(0x103); h != 0x1234 {
+		t.Errorf("Read 0x%04x after a peek, expected the latched 0x1234", h)
+	}
+}
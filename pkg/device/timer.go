@@ -0,0 +1,134 @@
+package device
+
+import (
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// An interval timer, raising an interrupt after a programmed number
+// of ticks of the virtual clock of a CPU.
+//
+// The timer occupies four half-words:
+//
+//	0-1: the count, as a word. Writing a non-zero count arms the
+//	     timer, writing zero disarms it. Reading gives the number of
+//	     ticks left until it fires (zero when disarmed).
+//	2:   control. If bit 0 is set, the timer is periodic, and re-arms
+//	     itself with the last written count each time it fires.
+//	3:   unused, reads as zero.
+//
+// Expiry is an event on the scheduler's event queue, so a CPU idling
+// in a wait loop skips straight to it.
+type IntervalTimer struct {
+	sched    cpu.Scheduler
+	irq      Interrupter
+	level    uint8
+	divisor  uint64
+	count    uint32
+	control  uint16
+	event    *cpu.Event
+	deadline uint64 // In cycles
+}
+
+// Create an interval timer, ticking once every divisor cycles of the
+// scheduler's clock, raising interrupts at the given level.
+func NewIntervalTimer(sched cpu.Scheduler, irq Interrupter, level uint8, divisor uint64) *IntervalTimer {
+	if divisor == 0 {
+		divisor = 1
+	}
+	return &IntervalTimer{sched: sched, irq: irq, level: level, divisor: divisor}
+}
+
+// Schedule the expiry at the given time, in cycles.
+func (t *IntervalTimer) schedule(deadline uint64) {
+	now := t.sched.Now()
+	delay := uint64(0)
+	if deadline > now {
+		delay = deadline - now
+	}
+	t.deadline = deadline
+	t.event = t.sched.Activate(delay, t.fire)
+}
+
+// Arm (or, for a zero count, disarm) the timer.
+func (t *IntervalTimer) arm(count uint32) {
+	t.sched.Cancel(t.event)
+	t.event = nil
+	t.count = count
+	if count == 0 {
+		return
+	}
+	start := t.sched.Now() / t.divisor
+	t.schedule((start + uint64(count)) * t.divisor)
+}
+
+// Return the number of ticks left until the timer fires.
+func (t *IntervalTimer) remaining() uint32 {
+	if t.event == nil {
+		return 0
+	}
+	now := t.sched.Now() / t.divisor
+	deadline := t.deadline / t.divisor
+	if now >= deadline {
+		return 0
+	}
+	return uint32(deadline - now)
+}
+
+// Disarm the timer, and clear its count and control.
+func (t *IntervalTimer) Reset() {
+	t.count, t.control = 0, 0
+	t.event, t.deadline = nil, 0
+}
+
+// Raise the interrupt, and re-arm if periodic.
+func (t *IntervalTimer) fire(now uint64) {
+	t.event = nil
+	t.irq.Interrupt(t.level)
+	if t.control&1 != 0 {
+		t.schedule(t.deadline + uint64(t.count)*t.divisor)
+	}
+}
+
+func (t *IntervalTimer) FetchHalfWord(address uint32) uint16 {
+	switch address {
+	case 0:
+		return uint16(t.remaining() >> 16)
+	case 1:
+		return uint16(t.remaining())
+	case 2:
+		return t.control
+	}
+	return 0
+}
+
+func (t *IntervalTimer) FetchWord(address uint32) uint32 {
+	h0 := uint32(t.FetchHalfWord(address))
+	h1 := uint32(t.FetchHalfWord(address + 1))
+	return (h0 << 16) | h1
+}
+
+// Writing the high half of the count only stages it, writing the low
+// half arms the timer.
+func (t *IntervalTimer) WriteHalfWord(address uint32, data uint16) uint16 {
+	old := t.FetchHalfWord(address)
+	switch address {
+	case 0:
+		t.count = (t.count & 0xffff) | uint32(data)<<16
+	case 1:
+		t.arm((t.count & 0xffff0000) | uint32(data))
+	case 2:
+		t.control = data
+	}
+	return old
+}
+
+func (t *IntervalTimer) WriteWord(address, data uint32) uint32 {
+	old := t.FetchWord(address)
+	if address == 0 {
+		t.arm(data)
+		return old
+	}
+	t.WriteHalfWord(address, uint16(data>>16))
+	t.WriteHalfWord(address+1, uint16(data))
+	return old
+}
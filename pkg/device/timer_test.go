@@ -0,0 +1,114 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+func TestIntervalTimer(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0xff}, cpu.NewDirectMemory(0x100))
+	timer := NewIntervalTimer(c, c, 3, 1)
+	c.RegisterMemory(cpu.MemoryRange{Low: 0x100, High: 0x103}, timer)
+
+	c.InterruptBase = 0x34
+	c.StoreWord(0x42, 0x20)    // Vector for level 3
+	c.StoreWord(0, 0x98100005) // LD G1, 5
+	c.StoreWord(2, 0x501000fe) // STW G1 -> 0x100
+	// The rest is NOPs, taking two cycles each
+
+	c.Step()
+	c.Step()
+	if r := c.FetchWord(0x100); r != 2 {
+		t.Errorf("Timer has %d ticks left, expected 2", r)
+	}
+	c.Step() // The timer fires at the end of this
+	if c.IC != 6 {
+		t.Errorf("IC is 0x%x before the interrupt, expected 0x6", c.IC)
+	}
+	c.Step()
+
+	if c.IC != 0x22 {
+		t.Errorf("IC is 0x%x, expected 0x22", c.IC)
+	}
+	if saved := c.FetchWord(0x40); saved != 6 {
+		t.Errorf("Saved IC is 0x%x, expected 0x6", saved)
+	}
+	if r := c.FetchWord(0x100); r != 0 {
+		t.Errorf("Timer has %d ticks left after firing, expected 0", r)
+	}
+}
+
+func TestPeriodicTimer(t *testing.T) {
+	c := cpu.NewCPU()
+	fired := &countingInterrupter{}
+	timer := NewIntervalTimer(c, fired, 0, 1)
+	timer.WriteHalfWord(2, 1)
+	timer.WriteWord(0, 10)
+
+	for now := uint64(1); now <= 35; now++ {
+		c.Cycles = now
+		c.Events.RunUntil(now)
+	}
+	if fired.n != 3 {
+		t.Errorf("Timer fired %d times, expected 3", fired.n)
+	}
+}
+
+type countingInterrupter struct {
+	n int
+}
+
+func (i *countingInterrupter) Interrupt(level uint8) {
+	i.n++
+}
+
+func TestIdleFastForward(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0xff}, cpu.NewDirectMemory(0x100))
+	timer := NewIntervalTimer(c, c, 0, 100)
+	c.RegisterMemory(cpu.MemoryRange{Low: 0x100, High: 0x103}, timer)
+
+	c.StoreWord(0x02, 0x10)       // Vector for level 0
+	c.StoreWord(0x10, 0x05f00000) // JC 15, 0x10 (wait here)
+	c.IC = 0x10
+	c.CC = 2
+	timer.WriteWord(0, 50)
+
+	c.Step()
+	if c.Cycles != 5000 {
+		t.Errorf("Cycles is %d after idling, expected 5000", c.Cycles)
+	}
+	if c.IdleCycles == 0 {
+		t.Errorf("No idle cycles counted")
+	}
+	c.Step()
+	if saved := c.FetchWord(0); saved != 0x10 {
+		t.Errorf("Saved IC is 0x%x, expected 0x10", saved)
+	}
+}
+
+func TestTimerReset(t *testing.T) {
+	c := cpu.NewCPU()
+	fired := &countingInterrupter{}
+	timer := NewIntervalTimer(c, fired, 0, 1)
+	timer.WriteHalfWord(2, 1)
+	timer.WriteWord(0, 10)
+
+	c.Reset()
+	timer.Reset()
+	if r := timer.FetchWord(0); r != 0 {
+		t.Errorf("Timer has %d ticks left after a reset, expected 0", r)
+	}
+	if control := timer.FetchHalfWord(2); control != 0 {
+		t.Errorf("Control is %d after a reset, expected 0", control)
+	}
+	for now := uint64(1); now <= 35; now++ {
+		c.Cycles = now
+		c.Events.RunUntil(now)
+	}
+	if fired.n != 0 {
+		t.Errorf("Timer fired %d times after a reset, expected none", fired.n)
+	}
+}
@@ -0,0 +1,500 @@
+// The gdbstub package lets gdb, or any other front end speaking the
+// GDB remote serial protocol, debug a CPU in a running system.
+//
+// The registers are G0 to G15 (numbers 0-15, 32 bits each), IC (16,
+// 32 bits), CC (17, 32 bits) and PS (18, 64 bits), all big-endian,
+// and are described to the client in a target description. As gdb
+// thinks of memory as bytes, and the Censor 932 addresses
+// half-words, the addresses the client sees are byte addresses,
+// twice the half-word address. This includes IC, so that the pc and
+// the addresses of breakpoints agree. The high byte of a half-word is
+// at the lower address.
+//
+// Continuing and stepping run the whole system, so the other CPUs
+// keep going while the one being debugged is. Software and hardware
+// breakpoints work the same way, by checking the IC of the debugged
+// CPU after each instruction; memory is never patched.
+//
+// If the CPU has a journal (see cpu.Journal), the client can also
+// step (bs) and continue (bc) backwards, through the debugged CPU's
+// history only. Reverse execution stops at breakpoints, and at the
+// start of the history.
+package gdbstub
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// Register numbers.
+const (
+	regIC = 16
+	regCC = 17
+	regPS = 18
+	nRegs = 19
+)
+
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.censor932.core">
+` + "%s" + `  </feature>
+</target>
+`
+
+// Return the target description.
+func targetDescription() string {
+	regs := ""
+	for n := 0; n < 16; n++ {
+		regs += fmt.Sprintf("    <reg name=\"g%d\" bitsize=\"32\" type=\"uint32\" regnum=\"%d\"/>\n", n, n)
+	}
+	regs += "    <reg name=\"ic\" bitsize=\"32\" type=\"code_ptr\" regnum=\"16\"/>\n"
+	regs += "    <reg name=\"cc\" bitsize=\"32\" type=\"uint32\" regnum=\"17\"/>\n"
+	regs += "    <reg name=\"ps\" bitsize=\"64\" type=\"uint64\" regnum=\"18\"/>\n"
+	return fmt.Sprintf(targetXML, regs)
+}
+
+// A debugging session for one CPU of a system.
+type Server struct {
+	System *system.System
+	CPU    int // Index of the CPU being debugged
+
+	swBreaks map[uint32]bool // By half-word address
+	hwBreaks map[uint32]bool
+}
+
+func NewServer(s *system.System, cpu int) *Server {
+	return &Server{
+		System:   s,
+		CPU:      cpu,
+		swBreaks: map[uint32]bool{},
+		hwBreaks: map[uint32]bool{},
+	}
+}
+
+func (s *Server) cpu() *cpu.CPU {
+	return s.System.CPUs[s.CPU]
+}
+
+// Wait for a client on a TCP address, such as localhost:1234, and
+// serve it until it detaches or disconnects.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"address": l.Addr()}).Info("Waiting for gdb")
+	c, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return s.Serve(c)
+}
+
+// Serve a client until it detaches, kills the target or disconnects.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	c := newConn(rw)
+	packets := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	var readErr error
+	go func() {
+		defer close(packets)
+		for {
+			p, err := c.receive()
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case packets <- p:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for p := range packets {
+		var reply string
+		switch {
+		case p == "":
+		case p == interruptPacket:
+			reply = "S02"
+		case p == "D":
+			return c.send("OK")
+		case p == "k":
+			return nil
+		case p[0] == 'c' || p[0] == 's':
+			if len(p) > 1 {
+				addr, err := strconv.ParseUint(p[1:], 16, 32)
+				if err != nil {
+					reply = "E01"
+					break
+				}
+				s.cpu().IC = uint32(addr/2) & 0x3ffff
+			}
+			rounds := uint64(1)
+			if p[0] == 'c' {
+				rounds = math.MaxUint64
+			}
+			var ok bool
+			if reply, ok = s.resume(rounds, packets); !ok {
+				return readErr
+			}
+		case p == "bs" || p == "bc":
+			reply = s.reverse(p == "bc")
+		case p == "QStartNoAckMode":
+			if err := c.send("OK"); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&c.noAck, 1)
+			continue
+		default:
+			reply = s.handle(p)
+		}
+		if err := c.send(reply); err != nil {
+			return err
+		}
+	}
+	if readErr == io.EOF {
+		return nil
+	}
+	return readErr
+}
+
+// Run the system for up to the given number of rounds, until the
+// debugged CPU hits a breakpoint, traps or halts, or the client
+// interrupts. Return the stop reply, and false if the client went
+// away.
+func (s *Server) resume(rounds uint64, packets <-chan string) (string, bool) {
+	target := s.cpu()
+	target.Trap = nil
+	var interrupted, stopped int32
+	reply := "S05"
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.System.RunUntil(rounds, func(c *cpu.CPU) bool {
+			if c == target {
+				switch {
+				case c.Trap != nil && c.Trap.Kind == cpu.IllegalInstruction:
+					reply = "S04"
+				case c.Trap != nil:
+					reply = "S0b"
+				case s.swBreaks[c.IC]:
+					reply = "T05swbreak:;"
+				case s.hwBreaks[c.IC]:
+					reply = "T05hwbreak:;"
+				case c.Halted():
+				default:
+					return atomic.LoadInt32(&interrupted) != 0 || atomic.LoadInt32(&stopped) != 0
+				}
+				atomic.StoreInt32(&stopped, 1)
+				return true
+			}
+			return atomic.LoadInt32(&interrupted) != 0 || atomic.LoadInt32(&stopped) != 0
+		})
+	}()
+
+	alive := true
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		case p, ok := <-packets:
+			if !ok {
+				alive = false
+				packets = nil
+				atomic.StoreInt32(&interrupted, 1)
+			} else if p == interruptPacket {
+				atomic.StoreInt32(&interrupted, 1)
+			} else {
+				log.WithFields(log.Fields{"packet": p}).Warn("RSP packet ignored while running")
+			}
+		}
+	}
+	if atomic.LoadInt32(&interrupted) != 0 && atomic.LoadInt32(&stopped) == 0 {
+		reply = "S02"
+	}
+	return reply, alive
+}
+
+// Undo one instruction of the debugged CPU, or keep undoing them
+// until reaching a breakpoint. Return the stop reply.
+func (s *Server) reverse(cont bool) string {
+	c := s.cpu()
+	if c.Journal == nil {
+		return "E01"
+	}
+	for {
+		if !c.StepBack() {
+			return "T05replaylog:begin;"
+		}
+		switch {
+		case !cont:
+			return "S05"
+		case s.swBreaks[c.IC]:
+			return "T05swbreak:;"
+		case s.hwBreaks[c.IC]:
+			return "T05hwbreak:;"
+		}
+	}
+}
+
+// Handle a packet that does not resume the target, returning the
+// reply. Unsupported packets get an empty reply.
+func (s *Server) handle(p string) string {
+	switch p[0] {
+	case '?':
+		return "S05"
+	case 'g':
+		return s.registers()
+	case 'G':
+		return s.setRegisters(p[1:])
+	case 'p':
+		n, err := strconv.ParseUint(p[1:], 16, 8)
+		if err != nil || n >= nRegs {
+			return "E01"
+		}
+		return s.register(int(n))
+	case 'P':
+		parts := strings.SplitN(p[1:], "=", 2)
+		n, err := strconv.ParseUint(parts[0], 16, 8)
+		if err != nil || n >= nRegs || len(parts) != 2 {
+			return "E01"
+		}
+		return s.setRegister(int(n), parts[1])
+	case 'm':
+		addr, length, _, err := parseAddressLength(p[1:])
+		if err != nil {
+			return "E01"
+		}
+		return s.readMemory(addr, length)
+	case 'M':
+		addr, length, data, err := parseAddressLength(p[1:])
+		if err != nil {
+			return "E01"
+		}
+		bytes, err := hex.DecodeString(data)
+		if err != nil || uint64(len(bytes)) != length {
+			return "E01"
+		}
+		return s.writeMemory(addr, bytes)
+	case 'Z', 'z':
+		return s.breakpoint(p)
+	case 'H', 'T':
+		return "OK"
+	case 'q':
+		return s.query(p)
+	}
+	return ""
+}
+
+// Parse addr,length, optionally followed by :data.
+func parseAddressLength(s string) (uint64, uint64, string, error) {
+	data := ""
+	if ix := strings.Index(s, ":"); ix >= 0 {
+		s, data = s[:ix], s[ix+1:]
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, "", fmt.Errorf("Bad address and length %s", s)
+	}
+	addr, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return addr, length, data, nil
+}
+
+const xferPrefix = "qXfer:features:read:target.xml:"
+
+func (s *Server) query(p string) string {
+	switch {
+	case strings.HasPrefix(p, "qSupported"):
+		supported := "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+"
+		if s.cpu().Journal != nil {
+			supported += ";ReverseStep+;ReverseContinue+"
+		}
+		return supported
+	case strings.HasPrefix(p, xferPrefix):
+		offset, length, _, err := parseAddressLength(strings.TrimPrefix(p, xferPrefix))
+		if err != nil {
+			return "E01"
+		}
+		xml := targetDescription()
+		if offset >= uint64(len(xml)) {
+			return "l"
+		}
+		if offset+length >= uint64(len(xml)) {
+			return "l" + escape(xml[offset:])
+		}
+		return "m" + escape(xml[offset:offset+length])
+	case p == "qAttached":
+		return "1"
+	case p == "qC":
+		return "QC1"
+	case p == "qfThreadInfo":
+		return "m1"
+	case p == "qsThreadInfo":
+		return "l"
+	}
+	return ""
+}
+
+// Return a register as big-endian hex.
+func (s *Server) register(n int) string {
+	c := s.cpu()
+	switch n {
+	case regIC:
+		return fmt.Sprintf("%08x", c.IC*2)
+	case regCC:
+		return fmt.Sprintf("%08x", c.CC)
+	case regPS:
+		return fmt.Sprintf("%016x", c.PS)
+	}
+	return fmt.Sprintf("%08x", c.G[n])
+}
+
+func (s *Server) registers() string {
+	rv := ""
+	for n := 0; n < nRegs; n++ {
+		rv += s.register(n)
+	}
+	return rv
+}
+
+func (s *Server) setRegister(n int, value string) string {
+	width := 8
+	if n == regPS {
+		width = 16
+	}
+	if len(value) != width {
+		return "E01"
+	}
+	v, err := strconv.ParseUint(value, 16, 64)
+	if err != nil {
+		return "E01"
+	}
+	c := s.cpu()
+	switch n {
+	case regIC:
+		c.IC = uint32(v/2) & 0x3ffff
+	case regCC:
+		c.CC = uint8(v & 0xf)
+	case regPS:
+		c.PS = v
+	default:
+		c.G[n] = uint32(v)
+	}
+	return "OK"
+}
+
+func (s *Server) setRegisters(data string) string {
+	if len(data) != 16*8+8+8+16 {
+		return "E01"
+	}
+	for n := 0; n < nRegs; n++ {
+		width := 8
+		if n == regPS {
+			width = 16
+		}
+		if reply := s.setRegister(n, data[:width]); reply != "OK" {
+			return reply
+		}
+		data = data[width:]
+	}
+	return "OK"
+}
+
+// Read bytes of memory, at byte addresses. A read that runs into
+// unmapped memory returns what could be read.
+func (s *Server) readMemory(addr, length uint64) string {
+	c := s.cpu()
+	rv := ""
+	for b := addr; b < addr+length; b++ {
+		hw := b / 2
+		if hw > 0x3ffff {
+			break
+		}
+		h, ok := c.Peek(uint32(hw))
+		if !ok {
+			break
+		}
+		if b%2 == 0 {
+			h >>= 8
+		}
+		rv += fmt.Sprintf("%02x", byte(h))
+	}
+	if rv == "" && length > 0 {
+		return "E14"
+	}
+	return rv
+}
+
+// Write bytes of memory, at byte addresses.
+func (s *Server) writeMemory(addr uint64, data []byte) string {
+	c := s.cpu()
+	for ix, d := range data {
+		b := addr + uint64(ix)
+		hw := b / 2
+		if hw > 0x3ffff {
+			return "E14"
+		}
+		h, ok := c.Peek(uint32(hw))
+		if !ok {
+			return "E14"
+		}
+		if b%2 == 0 {
+			h = h&0x00ff | uint16(d)<<8
+		} else {
+			h = h&0xff00 | uint16(d)
+		}
+		c.Poke(uint32(hw), h)
+	}
+	return "OK"
+}
+
+// Insert (Z) or remove (z) a software (0) or hardware (1) breakpoint.
+func (s *Server) breakpoint(p string) string {
+	parts := strings.Split(p[1:], ",")
+	if len(parts) < 2 {
+		return "E01"
+	}
+	var breaks map[uint32]bool
+	switch parts[0] {
+	case "0":
+		breaks = s.swBreaks
+	case "1":
+		breaks = s.hwBreaks
+	default:
+		return ""
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil || addr/2 > 0x3ffff {
+		return "E01"
+	}
+	if p[0] == 'Z' {
+		breaks[uint32(addr/2)] = true
+	} else {
+		delete(breaks, uint32(addr/2))
+	}
+	return "OK"
+}
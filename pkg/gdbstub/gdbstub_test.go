@@ -0,0 +1,252 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/shared"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// The client end of a session.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Send a packet, and return the reply.
+func (c *client) call(data string) string {
+	fmt.Fprintf(c.conn, "$%s#%02x", data, checksum(data))
+	return c.reply()
+}
+
+// Read a reply, skipping acknowledgements, and acknowledge it.
+func (c *client) reply() string {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Fatalf("Unexpected error reading reply, %v", err)
+		}
+		if b != '$' {
+			continue
+		}
+		data, err := c.r.ReadString('#')
+		if err != nil {
+			c.t.Fatalf("Unexpected error reading reply, %v", err)
+		}
+		io.ReadFull(c.r, make([]byte, 2))
+		c.conn.Write([]byte("+"))
+		return data[:len(data)-1]
+	}
+}
+
+// Start a session on a CPU with 256 half-words of memory, holding
+// the given program, returning the client end and a channel that
+// gets the result of Serve.
+func session(t *testing.T, program ...uint32) (*client, *cpu.CPU, chan error) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0xff}, cpu.NewDirectMemory(0x100))
+	for ix, w := range program {
+		c.StoreWord(uint32(2*ix), w)
+	}
+	s := system.NewSystem(system.Lockstep, 0)
+	s.AddCPU(c)
+
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(s, 0).Serve(server)
+		server.Close()
+	}()
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}, c, done
+}
+
+func TestSession(t *testing.T) {
+	cl, c, done := session(t,
+		0x98101234, // LD G1, 0x1234
+		0x5010001e, // STW G1 -> 0x20
+		0x01300000, // JS G3, to itself
+	)
+
+	cases := []struct {
+		packet string
+		reply  string
+	}{
+		{"qSupported:swbreak+", "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+"},
+		{"?", "S05"},
+		{"Z0,4,4", "OK"},
+		{"c", "T05swbreak:;"},
+		{"p10", "00000004"},
+		{"p1", "00001234"},
+		{"m40,4", "00000000"},
+		{"s", "S05"},
+		{"m40,4", "00001234"},
+		{"m41,2", "0012"},
+		{"z0,4,4", "OK"},
+		{"Z1,4,4", "OK"},
+		{"c0", "T05hwbreak:;"},
+		{"z1,4,4", "OK"},
+		{"c", "S05"},
+		{"p10", "00000008"},
+		{"M0,2:ff00", "OK"},
+		{"m0,4", "ff001234"},
+		{"P10=00000000", "OK"},
+		{"c", "S04"},
+		{"P3=deadbeef", "OK"},
+		{"m1000,2", "E14"},
+		{"vMustReplyEmpty", ""},
+	}
+	for ix, tc := range cases {
+		if reply := cl.call(tc.packet); reply != tc.reply {
+			t.Errorf("Case #%d, %s got %q, expected %q", ix, tc.packet, reply, tc.reply)
+		}
+	}
+	if c.G[3] != 0xdeadbeef {
+		t.Errorf("G3 is 0x%08x, expected 0xdeadbeef", c.G[3])
+	}
+
+	regs := cl.call("g")
+	if len(regs) != 2*(16*4+4+4+8) || !strings.HasPrefix(regs[8:], "0000123400000000deadbeef") {
+		t.Errorf("Registers are %q", regs)
+	}
+	if xml := cl.call("qXfer:features:read:target.xml:0,1000"); !strings.HasPrefix(xml, "l<?xml") || !strings.Contains(xml, "name=\"ic\"") {
+		t.Errorf("Target description is %q", xml)
+	}
+
+	if reply := cl.call("D"); reply != "OK" {
+		t.Errorf("Detach got %q", reply)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	cl, _, done := session(t,
+		0x01300002, // JS G3, to the next instruction
+		0x01380002, // JS G3, indirectly through the next word
+		0x00000000, // back to 0
+	)
+
+	fmt.Fprintf(cl.conn, "$c#%02x", checksum("c"))
+	if b, _ := cl.r.ReadByte(); b != '+' {
+		t.Fatalf("Continue acknowledged with %q", b)
+	}
+	cl.conn.Write([]byte{0x03})
+	if reply := cl.reply(); reply != "S02" {
+		t.Errorf("Interrupt got %q, expected S02", reply)
+	}
+
+	cl.conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	cl, c, done := session(t,
+		0x98101234, // LD G1, 0x1234
+		0x5010001e, // STW G1 -> 0x20
+		0x98105678, // LD G1, 0x5678
+		0x01300000, // JS G3, to itself
+	)
+	c.Journal = cpu.NewJournal(10)
+
+	cases := []struct {
+		packet string
+		reply  string
+	}{
+		{"qSupported", "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+;ReverseStep+;ReverseContinue+"},
+		{"bs", "T05replaylog:begin;"},
+		{"Z0,4,4", "OK"},
+		{"c", "T05swbreak:;"},
+		{"z0,4,4", "OK"},
+		{"c", "S05"},
+		{"p1", "00005678"},
+		{"bs", "S05"},
+		{"bs", "S05"},
+		{"p10", "00000008"},
+		{"p1", "00001234"},
+		{"m40,4", "00001234"},
+		{"bs", "S05"},
+		{"m40,4", "00000000"},
+		{"Z0,0,4", "OK"},
+		{"bc", "T05swbreak:;"},
+		{"p10", "00000000"},
+		{"bc", "T05replaylog:begin;"},
+	}
+	for ix, tc := range cases {
+		if reply := cl.call(tc.packet); reply != tc.reply {
+			t.Errorf("Case #%d, %s got %q, expected %q", ix, tc.packet, reply, tc.reply)
+		}
+	}
+
+	cl.conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+}
+
+// Looking at and changing memory from the debugger is not an access
+// by the CPU, so observers of shared memory do not see it, and it
+// does not go through the store buffer of the CPU.
+func TestSharedMemory(t *testing.T) {
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0xff}, cpu.NewDirectMemory(0x100))
+	c.StoreWord(0, 0x98101234) // LD G1, 0x1234
+	c.StoreWord(2, 0x501000fe) // STW G1 -> 0x100
+	s := system.NewSystem(system.Lockstep, 0)
+	defer s.Close()
+	s.AddCPU(c)
+	m := shared.NewSharedMemory(16)
+	m.SetConsistency(shared.Consistency{Ordering: shared.TotalStoreOrder, DrainDelay: 100})
+	if err := s.AddSharedMemory(m, cpu.MemoryRange{Low: 0x100, High: 0x10f}); err != nil {
+		t.Fatalf("Unexpected error adding shared memory, %v", err)
+	}
+	r := shared.NewRecorder()
+	m.Observe(r)
+
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(s, 0).Serve(server)
+		server.Close()
+	}()
+	cl := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	cases := []struct {
+		packet string
+		reply  string
+	}{
+		{"s", "S05"},
+		{"s", "S05"},
+		{"m200,4", "00001234"}, // The CPU sees its buffered write
+		{"M204,2:abcd", "OK"},
+		{"m204,2", "abcd"},
+	}
+	for ix, tc := range cases {
+		if reply := cl.call(tc.packet); reply != tc.reply {
+			t.Errorf("Case #%d, %s got %q, expected %q", ix, tc.packet, reply, tc.reply)
+		}
+	}
+	if n := len(r.Events()); n != 1 {
+		t.Errorf("Observers saw %d events, expected only the STW", n)
+	}
+	if h, _ := m.TryFetchHalfWord(1); h != 0 {
+		t.Errorf("Buffered write reached memory early, half-word 1 is 0x%04x", h)
+	}
+	if h, _ := m.TryFetchHalfWord(2); h != 0xabcd {
+		t.Errorf("Half-word 2 is 0x%04x, expected 0xabcd", h)
+	}
+
+	cl.conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error from Serve, %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package gdbstub
+
+// Framing of remote serial protocol packets.
+//
+// A packet is $data#cs, where cs is the modulo 256 sum of the data
+// bytes, in hex. Each packet is acknowledged with + (or - if it was
+// garbled), unless acknowledgements have been turned off. A lone
+// 0x03 byte, outside any packet, asks the target to stop.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// What is sent on the channel when the client asks the target to
+// stop.
+const interruptPacket = "\x03"
+
+// A connection to an RSP client.
+type conn struct {
+	r     *bufio.Reader
+	w     io.Writer
+	mu    sync.Mutex // Serialises writes
+	noAck int32      // Accessed atomically
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{r: bufio.NewReader(rw), w: rw}
+}
+
+func checksum(data string) byte {
+	sum := byte(0)
+	for ix := 0; ix < len(data); ix++ {
+		sum += data[ix]
+	}
+	return sum
+}
+
+// Escape the bytes that cannot appear as-is in a packet.
+func escape(data string) string {
+	rv := make([]byte, 0, len(data))
+	for ix := 0; ix < len(data); ix++ {
+		b := data[ix]
+		switch b {
+		case '#', '$', '}', '*':
+			rv = append(rv, '}', b^0x20)
+		default:
+			rv = append(rv, b)
+		}
+	}
+	return string(rv)
+}
+
+func (c *conn) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(data)
+	return err
+}
+
+// Send a packet.
+func (c *conn) send(data string) error {
+	log.WithFields(log.Fields{"packet": data}).Debug("RSP send")
+	return c.write([]byte(fmt.Sprintf("$%s#%02x", data, checksum(data))))
+}
+
+// Read the next packet, or an interruptPacket, acknowledging it as
+// needed.
+func (c *conn) receive() (string, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case 0x03:
+			return interruptPacket, nil
+		case '$':
+		default:
+			// Acknowledgements, and noise between packets.
+			continue
+		}
+
+		data, err := c.r.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+		data = data[:len(data)-1]
+		cs := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, cs); err != nil {
+			return "", err
+		}
+		sum, err := strconv.ParseUint(string(cs), 16, 8)
+		if atomic.LoadInt32(&c.noAck) == 0 {
+			if err != nil || byte(sum) != checksum(data) {
+				log.WithFields(log.Fields{"packet": data}).Warn("RSP packet with bad checksum")
+				if err := c.write([]byte("-")); err != nil {
+					return "", err
+				}
+				continue
+			}
+			if err := c.write([]byte("+")); err != nil {
+				return "", err
+			}
+		}
+		log.WithFields(log.Fields{"packet": data}).Debug("RSP receive")
+		return data, nil
+	}
+}
@@ -0,0 +1,43 @@
+package gdbstub
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A reader and writer pair, for feeding a conn.
+type pipe struct {
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (p *pipe) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p *pipe) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+func TestReceive(t *testing.T) {
+	p := &pipe{in: bytes.NewBufferString("+$g#00$g#67\x03")}
+	c := newConn(p)
+
+	data, err := c.receive()
+	if err != nil || data != "g" {
+		t.Errorf("Received %q, %v, expected \"g\"", data, err)
+	}
+	if p.out.String() != "-+" {
+		t.Errorf("Acknowledged with %q, expected \"-+\"", p.out.String())
+	}
+	if data, err := c.receive(); err != nil || data != interruptPacket {
+		t.Errorf("Received %q, %v, expected an interrupt", data, err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	p := &pipe{in: &bytes.Buffer{}}
+	c := newConn(p)
+	c.send("OK")
+	if p.out.String() != "$OK#9a" {
+		t.Errorf("Sent %q, expected \"$OK#9a\"", p.out.String())
+	}
+	if e := escape("a#b}c"); e != "a}\x03b}]c" {
+		t.Errorf("Escaped to %q", e)
+	}
+}
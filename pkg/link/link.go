@@ -0,0 +1,374 @@
+// The link package combines relocatable objects (see the obj package)
+// into an absolute image.
+//
+// Sections with the same name are put together, in the order the
+// objects are given, each object's part starting at an even offset.
+// The combined sections are then placed, in the order they first
+// appear, at the first even address where they fit: shared sections
+// in the shared memory ranges of the layout, the others in the local
+// ones. Global symbols are visible to all objects, and a relocation
+// referring to a symbol its own object does not define is resolved
+// among them.
+//
+// Local symbols end up in the debug information too. One whose name
+// is also used in another object is qualified with the name of its
+// source file, so LOOP in sort.s becomes sort.LOOP.
+package link
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/memimage"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+const mask = 0x3ffff
+
+// Where sections may be placed. Ranges are inclusive, and are tried
+// in the order given.
+type Layout struct {
+	Local  []cpu.MemoryRange
+	Shared []cpu.MemoryRange
+}
+
+// Check that the ranges are inside the address space, and do not
+// overlap.
+func (l Layout) Check() error {
+	all := append(append([]cpu.MemoryRange{}, l.Local...), l.Shared...)
+	for ix, r := range all {
+		if r.Low > r.High || r.High > mask {
+			return fmt.Errorf("Bad range 0x%05x-0x%05x", r.Low, r.High)
+		}
+		for _, o := range all[:ix] {
+			if r.Low <= o.High && o.Low <= r.High {
+				return fmt.Errorf("Ranges 0x%05x-0x%05x and 0x%05x-0x%05x overlap", o.Low, o.High, r.Low, r.High)
+			}
+		}
+	}
+	return nil
+}
+
+// Is every address from low to high, inclusive, in one of the ranges?
+func (l Layout) Covers(low, high uint32) bool {
+	all := append(append([]cpu.MemoryRange{}, l.Local...), l.Shared...)
+	for address := uint64(low); address <= uint64(high); {
+		found := false
+		for _, r := range all {
+			if uint64(r.Low) <= address && address <= uint64(r.High) {
+				address = uint64(r.High) + 1
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// The part of a placed section that came from one object.
+type Part struct {
+	Object  string // The source of the object
+	Address uint32
+	Size    uint32
+}
+
+// A section, as placed in the image.
+type Placement struct {
+	Name    string
+	Shared  bool
+	Address uint32
+	Size    uint32
+	Parts   []Part
+}
+
+// A symbol, as placed in the image.
+type MapSymbol struct {
+	Name   string // Qualified, if need be
+	Kind   debuginfo.SymbolKind
+	Value  uint32
+	Global bool
+	Object string
+	Line   int
+}
+
+// Where everything went.
+type Map struct {
+	Sections []Placement
+	Symbols  []MapSymbol // By value
+}
+
+// The outcome of a link.
+type Result struct {
+	Origin uint32          // The address of the first half-word of Image
+	Image  []uint16        // Everything from Origin on, gaps filled with zeros
+	Memory *memimage.Image // A segment per section, joined where they meet
+	Debug  *debuginfo.Info
+	Map    *Map
+}
+
+// Where a section of one object went.
+type key struct {
+	object  int
+	section string
+}
+
+type linker struct {
+	objects  []*obj.Object
+	parts    map[key]uint32 // Addresses
+	globals  map[string]uint32
+	memory   map[uint32]uint16
+	sections []Placement
+}
+
+// Link objects into an image.
+func Link(objects []*obj.Object, layout Layout) (*Result, error) {
+	if err := layout.Check(); err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		if err := o.Check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", o.Source, err)
+		}
+	}
+	l := &linker{objects: objects, parts: map[key]uint32{}, globals: map[string]uint32{}, memory: map[uint32]uint16{}}
+	if err := l.place(layout); err != nil {
+		return nil, err
+	}
+	m, err := l.symbols()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.relocate(); err != nil {
+		return nil, err
+	}
+	return l.result(m)
+}
+
+// Round up to an even number.
+func even(n uint32) uint32 {
+	return (n + 1) &^ 1
+}
+
+// Put the sections together, and place them.
+func (l *linker) place(layout Layout) error {
+	index := map[string]int{}
+	owner := map[string]string{}
+	parts := map[key]int{} // Indices into the Parts of each section
+	for ox, o := range l.objects {
+		for _, s := range o.Sections {
+			ix, ok := index[s.Name]
+			if !ok {
+				ix = len(l.sections)
+				index[s.Name] = ix
+				owner[s.Name] = o.Source
+				l.sections = append(l.sections, Placement{Name: s.Name, Shared: s.Shared})
+			}
+			p := &l.sections[ix]
+			if p.Shared != s.Shared {
+				return fmt.Errorf("Section %s is shared in one of %s and %s, but not in the other", s.Name, owner[s.Name], o.Source)
+			}
+			p.Size = even(p.Size)
+			parts[key{ox, s.Name}] = len(p.Parts)
+			p.Parts = append(p.Parts, Part{Object: o.Source, Address: p.Size, Size: uint32(len(s.Data))})
+			p.Size += uint32(len(s.Data))
+		}
+	}
+
+	local := append([]cpu.MemoryRange{}, layout.Local...)
+	shared := append([]cpu.MemoryRange{}, layout.Shared...)
+	for ix := range l.sections {
+		p := &l.sections[ix]
+		free, kind := local, "local"
+		if p.Shared {
+			free, kind = shared, "shared"
+		}
+		placed := false
+		for fx := range free {
+			r := &free[fx]
+			low := even(r.Low)
+			if uint64(low)+uint64(p.Size) > uint64(r.High)+1 {
+				continue
+			}
+			p.Address = low
+			r.Low = low + p.Size
+			placed = true
+			break
+		}
+		if !placed {
+			return fmt.Errorf("Section %s, of 0x%x half-words, does not fit in %s memory", p.Name, p.Size, kind)
+		}
+		for px := range p.Parts {
+			p.Parts[px].Address += p.Address
+		}
+	}
+
+	for k, px := range parts {
+		l.parts[k] = l.sections[index[k.section]].Parts[px].Address
+	}
+	for ox, o := range l.objects {
+		for _, s := range o.Sections {
+			address := l.parts[key{ox, s.Name}]
+			for offset, v := range s.Data {
+				l.memory[address+uint32(offset)] = v
+			}
+		}
+	}
+	return nil
+}
+
+// The value of a symbol defined by an object.
+func (l *linker) value(ox int, sym obj.Symbol) uint32 {
+	if sym.Section == "" {
+		return sym.Value
+	}
+	return l.parts[key{ox, sym.Section}] + sym.Value
+}
+
+// The name of an object, for qualifying its local symbols.
+func qualifier(source string) string {
+	base := filepath.Base(source)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Collect the global symbols, checking that none is defined twice,
+// and list all of the symbols.
+func (l *linker) symbols() (*Map, error) {
+	owner := map[string]string{}
+	used := map[string]int{}
+	for ox, o := range l.objects {
+		for _, sym := range o.Symbols {
+			used[sym.Name]++
+			if !sym.Global {
+				continue
+			}
+			if other, ok := owner[sym.Name]; ok {
+				return nil, fmt.Errorf("Symbol %s is defined in both %s and %s", sym.Name, other, o.Source)
+			}
+			owner[sym.Name] = o.Source
+			l.globals[sym.Name] = l.value(ox, sym)
+		}
+	}
+
+	m := &Map{Sections: l.sections}
+	for ox, o := range l.objects {
+		for _, sym := range o.Symbols {
+			name := sym.Name
+			if !sym.Global && used[name] > 1 {
+				name = qualifier(o.Source) + "." + name
+			}
+			m.Symbols = append(m.Symbols, MapSymbol{
+				Name:   name,
+				Kind:   sym.Kind,
+				Value:  l.value(ox, sym),
+				Global: sym.Global,
+				Object: o.Source,
+				Line:   sym.Line,
+			})
+		}
+	}
+	sort.SliceStable(m.Symbols, func(i, j int) bool { return m.Symbols[i].Value < m.Symbols[j].Value })
+	return m, nil
+}
+
+// Work out the target of a relocation in an object.
+func (l *linker) target(ox int, r obj.Relocation) (int64, error) {
+	o := l.objects[ox]
+	switch {
+	case r.Section != "":
+		return int64(l.parts[key{ox, r.Section}]) + r.Addend, nil
+	case r.Symbol != "":
+		for _, sym := range o.Symbols {
+			if sym.Name == r.Symbol {
+				return int64(l.value(ox, sym)) + r.Addend, nil
+			}
+		}
+		v, ok := l.globals[r.Symbol]
+		if !ok {
+			return 0, fmt.Errorf("Undefined symbol %s", r.Symbol)
+		}
+		return int64(v) + r.Addend, nil
+	}
+	return r.Addend, nil
+}
+
+// Patch the references to addresses.
+func (l *linker) relocate() error {
+	for ox, o := range l.objects {
+		for _, s := range o.Sections {
+			base := l.parts[key{ox, s.Name}]
+			for _, r := range s.Relocations {
+				at := base + r.Offset
+				v, err := l.target(ox, r)
+				if err == nil {
+					err = l.patch(at, r.Kind, v)
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %s+0x%x: %v", o.Source, s.Name, r.Offset, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Store a relocated value.
+func (l *linker) patch(at uint32, kind obj.RelocationKind, v int64) error {
+	switch kind {
+	case obj.Relative16:
+		// Relative to the instruction, which starts the half-word before.
+		d := v - int64(at-1)
+		if d < 0 || d > 0xffff {
+			return fmt.Errorf("Address 0x%05x is out of reach of the instruction at 0x%05x", v, at-1)
+		}
+		l.memory[at] = uint16(d)
+	case obj.Absolute16:
+		if v < 0 || v > 0xffff {
+			return fmt.Errorf("Value 0x%x does not fit in 16 bits", v)
+		}
+		l.memory[at] = uint16(v)
+	case obj.Absolute32:
+		if v < 0 || v > 0xffffffff {
+			return fmt.Errorf("Value 0x%x does not fit in 32 bits", v)
+		}
+		l.memory[at] = uint16(v >> 16)
+		l.memory[at+1] = uint16(v)
+	}
+	return nil
+}
+
+// Collect the image and the debug information.
+func (l *linker) result(m *Map) (*Result, error) {
+	debug := &debuginfo.Info{}
+	for _, sym := range m.Symbols {
+		if err := debug.AddSymbol(debuginfo.Symbol{Name: sym.Name, Kind: sym.Kind, Value: sym.Value, File: sym.Object, Line: sym.Line}); err != nil {
+			return nil, err
+		}
+	}
+	for ox, o := range l.objects {
+		for _, line := range o.Lines {
+			debug.Add(line.File, line.Line, l.parts[key{ox, line.Section}]+line.Offset)
+		}
+	}
+
+	rv := &Result{Memory: &memimage.Image{}, Debug: debug, Map: m}
+	sections := append([]Placement{}, l.sections...)
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Address < sections[j].Address })
+	for _, p := range sections {
+		data := make([]uint16, p.Size)
+		for ix := range data {
+			data[ix] = l.memory[p.Address+uint32(ix)]
+		}
+		if len(data) > 0 {
+			rv.Memory.Add(p.Address, data...)
+		}
+	}
+	rv.Origin, rv.Image = rv.Memory.Flat()
+	return rv, nil
+}
@@ -0,0 +1,191 @@
+package link
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/asm"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/obj"
+)
+
+const mainSource = `; Add STEP to COUNT
+        .EXTERN COUNT,STEP
+        .GLOBAL START
+START:  LW    1,COUNT
+        AW    1,STEP
+        STW   1,COUNT
+LOOP:   JS    3,LOOP
+`
+
+const libSource = `; Data for main.s
+        .GLOBAL COUNT,STEP
+STEP:   .WORD 1
+LOOP:   .HALF 0
+        .SECTION common,SHARED
+COUNT:  .WORD 41
+`
+
+var layout = Layout{
+	Local:  []cpu.MemoryRange{{Low: 0x100, High: 0xfff}},
+	Shared: []cpu.MemoryRange{{Low: 0x10000, High: 0x1ffff}},
+}
+
+// Assemble sources, named a.s, b.s and so on unless given as
+// name=source.
+func objects(t *testing.T, sources ...string) []*obj.Object {
+	var rv []*obj.Object
+	for ix, source := range sources {
+		name := string(rune('a'+ix)) + ".s"
+		if eq := strings.Index(source, "="); eq > 0 && !strings.ContainsAny(source[:eq], " \n") {
+			name, source = source[:eq], source[eq+1:]
+		}
+		o, err := asm.AssembleObject(name, strings.NewReader(source))
+		if err != nil {
+			t.Fatalf("Unexpected error assembling %s, %v", name, err)
+		}
+		rv = append(rv, o)
+	}
+	return rv
+}
+
+func TestLink(t *testing.T) {
+	r, err := Link(objects(t, "main.s="+mainSource, "lib.s="+libSource), layout)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if r.Origin != 0x100 || len(r.Image) != 0x10000-0x100+2 {
+		t.Fatalf("Image of 0x%x half-words at %05x", len(r.Image), r.Origin)
+	}
+	text := []uint16{
+		0x5810, 0xff00, // LW 1,COUNT
+		0x5a10, 0x0006, // AW 1,STEP
+		0x5010, 0xfefc, // STW 1,COUNT
+		0x0130, 0x0000, // JS 3,LOOP
+		0x0000, 0x0001, 0x0000,
+	}
+	for ix, w := range text {
+		if r.Image[ix] != w {
+			t.Errorf("Half-word %05x is %04x, expected %04x", 0x100+ix, r.Image[ix], w)
+		}
+	}
+
+	symbols := []debuginfo.Symbol{
+		{Name: "START", Kind: debuginfo.Code, Value: 0x100, File: "main.s", Line: 4},
+		{Name: "main.LOOP", Kind: debuginfo.Code, Value: 0x106, File: "main.s", Line: 7},
+		{Name: "STEP", Kind: debuginfo.Data, Value: 0x108, File: "lib.s", Line: 3},
+		{Name: "lib.LOOP", Kind: debuginfo.Data, Value: 0x10a, File: "lib.s", Line: 4},
+		{Name: "COUNT", Kind: debuginfo.Data, Value: 0x10000, File: "lib.s", Line: 6},
+	}
+	for _, s := range symbols {
+		if seen, ok := r.Debug.Symbol(s.Name); !ok || seen != s {
+			t.Errorf("Symbol %s is %+v, expected %+v", s.Name, seen, s)
+		}
+	}
+	if l, ok := r.Debug.Lookup(0x104); !ok || l.File != "main.s" || l.Line != 6 {
+		t.Errorf("Address 00104 is at %+v, expected main.s line 6", l)
+	}
+
+	if len(r.Map.Sections) != 2 {
+		t.Fatalf("Sections are %+v", r.Map.Sections)
+	}
+	if p := r.Map.Sections[0]; p.Name != "text" || p.Address != 0x100 || p.Size != 0xb || len(p.Parts) != 2 || p.Parts[1] != (Part{Object: "lib.s", Address: 0x108, Size: 3}) {
+		t.Errorf("Section text is %+v", p)
+	}
+	if p := r.Map.Sections[1]; p.Name != "common" || !p.Shared || p.Address != 0x10000 || p.Size != 2 {
+		t.Errorf("Section common is %+v", p)
+	}
+
+	// Only the sections themselves, so the image loads where nothing
+	// is mapped between them.
+	if segments := r.Memory.Segments; len(segments) != 2 || segments[0].Address != 0x100 || len(segments[0].Data) != 0xb || segments[1].Address != 0x10000 || len(segments[1].Data) != 2 {
+		t.Errorf("Segments are %+v", segments)
+	}
+	c := cpu.NewCPU()
+	c.RegisterMemory(layout.Local[0], cpu.NewDirectMemory(0xf00))
+	c.RegisterMemory(layout.Shared[0], cpu.NewDirectMemory(0x10000))
+	if err := r.Memory.Load(c); err != nil {
+		t.Errorf("Unexpected error loading image, %v", err)
+	} else if c.FetchWord(0x100) != 0x5810ff00 || c.FetchWord(0x10000) != 41 {
+		t.Errorf("Loaded %08x and %08x", c.FetchWord(0x100), c.FetchWord(0x10000))
+	}
+
+	m, err := config.ImageMachine(r.Image, 0x10002, r.Origin)
+	if err != nil {
+		t.Fatalf("Unexpected error building machine, %v", err)
+	}
+	defer m.Close()
+	m.System.Run(100)
+	if c := m.CPUs[0]; c.Trap != nil || c.IC != 0x106 || c.FetchWord(0x10000) != 42 {
+		t.Errorf("Ran to %05x with trap %v, COUNT is %d", c.IC, c.Trap, c.FetchWord(0x10000))
+	}
+}
+
+func TestLayoutCovers(t *testing.T) {
+	l := Layout{
+		Local:  []cpu.MemoryRange{{Low: 0x100, High: 0xfff}, {Low: 0x2000, High: 0x2fff}},
+		Shared: []cpu.MemoryRange{{Low: 0x1000, High: 0x1fff}},
+	}
+	cases := []struct {
+		low, high uint32
+		expected  bool
+	}{
+		{0x100, 0x100, true},
+		{0x200, 0x2fff, true},
+		{0xff, 0x100, false},
+		{0x2000, 0x3000, false},
+		{0x0, 0x3ffff, false},
+	}
+	for _, tc := range cases {
+		if seen := l.Covers(tc.low, tc.high); seen != tc.expected {
+			t.Errorf("Covers(0x%05x, 0x%05x) is %v, expected %v", tc.low, tc.high, seen, tc.expected)
+		}
+	}
+}
+
+func TestLinkAlignment(t *testing.T) {
+	r, err := Link(objects(t, "  .HALF 1", "X: .HALF 2\n  .GLOBAL X", "  .EXTERN X\n  .WORD X"), layout)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := []uint16{1, 0, 2, 0, 0, 0x102}
+	if len(r.Image) != len(expected) {
+		t.Fatalf("Image is %04x, expected %04x", r.Image, expected)
+	}
+	for ix, w := range expected {
+		if r.Image[ix] != w {
+			t.Errorf("Image is %04x, expected %04x", r.Image, expected)
+			break
+		}
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	cases := []struct {
+		sources  []string
+		layout   Layout
+		expected string
+	}{
+		{[]string{"X: NOP\n  .GLOBAL X", "X: NOP\n  .GLOBAL X"}, layout, "Symbol X is defined in both a.s and b.s"},
+		{[]string{"  .EXTERN Y\n  LW 1,Y"}, layout, "a.s: text+0x1: Undefined symbol Y"},
+		{[]string{"  .SPACE 8"}, Layout{Local: []cpu.MemoryRange{{Low: 0, High: 6}}}, "Section text, of 0x8 half-words, does not fit in local memory"},
+		{[]string{"  .SECTION d,SHARED\n  .HALF 1"}, Layout{Local: layout.Local}, "Section d, of 0x1 half-words, does not fit in shared memory"},
+		{[]string{"  .SECTION d\n  .HALF 1", "  .SECTION d,SHARED\n  .HALF 1"}, layout, "Section d is shared in one of a.s and b.s, but not in the other"},
+		{
+			[]string{"  .EXTERN C\n  LW 1,C", "  .GLOBAL C\n  .SECTION common,SHARED\nC: .WORD 0"},
+			Layout{Local: []cpu.MemoryRange{{Low: 0x20000, High: 0x2ffff}}, Shared: layout.Shared},
+			"a.s: text+0x1: Address 0x10000 is out of reach of the instruction at 0x20000",
+		},
+		{[]string{"  .EXTERN C\n  LD 1,C", "  .GLOBAL C\n  .SECTION common,SHARED\nC: .WORD 0"}, layout, "a.s: text+0x1: Value 0x10000 does not fit in 16 bits"},
+		{nil, Layout{Local: []cpu.MemoryRange{{Low: 0, High: 0xff}}, Shared: []cpu.MemoryRange{{Low: 0x80, High: 0x1ff}}}, "Ranges 0x00000-0x000ff and 0x00080-0x001ff overlap"},
+		{nil, Layout{Local: []cpu.MemoryRange{{Low: 0, High: 0x40000}}}, "Bad range 0x00000-0x40000"},
+	}
+	for ix, tc := range cases {
+		_, err := Link(objects(t, tc.sources...), tc.layout)
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package link
+
+// The link map, in text.
+
+import (
+	"fmt"
+	"io"
+)
+
+// A range of half-words, for the map.
+func span(address, size uint32) string {
+	if size == 0 {
+		return fmt.Sprintf("%05x (empty)", address)
+	}
+	return fmt.Sprintf("%05x-%05x", address, address+size-1)
+}
+
+// Write the map: each section with where it went and what each object
+// put into it, then the symbols by value.
+//
+//	Sections:
+//	text         local   00100-0010b  0xc
+//	  main.s             00100-00107  0x8
+//	  lib.s              00108-0010b  0x4
+//
+//	Symbols:
+//	00100  START            code      main.s global
+func (m *Map) Write(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "Sections:"); err != nil {
+		return err
+	}
+	for _, p := range m.Sections {
+		kind := "local"
+		if p.Shared {
+			kind = "shared"
+		}
+		if _, err := fmt.Fprintf(w, "%-12s %-7s %-12s 0x%x\n", p.Name, kind, span(p.Address, p.Size), p.Size); err != nil {
+			return err
+		}
+		for _, part := range p.Parts {
+			if _, err := fmt.Fprintf(w, "  %-18s %-12s 0x%x\n", part.Object, span(part.Address, part.Size), part.Size); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprintln(w, "\nSymbols:"); err != nil {
+		return err
+	}
+	for _, sym := range m.Symbols {
+		scope := "local"
+		if sym.Global {
+			scope = "global"
+		}
+		if _, err := fmt.Fprintf(w, "%05x  %-16s %-9s %s %s\n", sym.Value, sym.Name, sym.Kind, sym.Object, scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
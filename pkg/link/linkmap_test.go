@@ -0,0 +1,34 @@
+package link
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteMap(t *testing.T) {
+	r, err := Link(objects(t, "main.s="+mainSource, "lib.s="+libSource, "  .SECTION bss"), layout)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	var b bytes.Buffer
+	if err := r.Map.Write(&b); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := `Sections:
+text         local   00100-0010a  0xb
+  main.s             00100-00107  0x8
+  lib.s              00108-0010a  0x3
+common       shared  10000-10001  0x2
+  lib.s              10000-10001  0x2
+
+Symbols:
+00100  START            code      main.s global
+00106  main.LOOP        code      main.s local
+00108  STEP             data      lib.s global
+0010a  lib.LOOP         data      lib.s local
+10000  COUNT            data      lib.s global
+`
+	if b.String() != expected {
+		t.Errorf("Map is\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
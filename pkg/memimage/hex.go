@@ -0,0 +1,143 @@
+package memimage
+
+// Hex images.
+//
+// Each record is a line of hexadecimal digits after a colon:
+//
+//	:NNAAAATTDDDD...CC
+//
+// NN is the number of half-words of data, AAAA the low 16 bits of the
+// half-word address, and TT the type of record. CC is a checksum: the
+// bytes of the whole record, including it, add up to zero. The types
+// are:
+//
+//	00  Data, NN half-words at AAAA
+//	01  End of the image, with no data
+//	04  The high bits of the addresses of the records that follow,
+//	    as a single half-word
+//	05  Where to start, as two half-words
+//
+// So, LD 1,0x1234 at 0x10100, and the start address, look like:
+//
+//	:010000040001FA
+//	:02010000981012340F
+//	:0200000500010100F7
+//	:00000001FF
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Record types.
+const (
+	hexData    = 0x00
+	hexEnd     = 0x01
+	hexUpper   = 0x04
+	hexStart   = 0x05
+	hexPerLine = 8 // Half-words in each data record written
+)
+
+// Write a record, with its checksum.
+func writeRecord(w io.Writer, kind uint8, address uint16, data ...uint16) error {
+	record := []byte{byte(len(data)), byte(address >> 8), byte(address), kind}
+	for _, h := range data {
+		record = append(record, byte(h>>8), byte(h))
+	}
+	sum := byte(0)
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, -sum)
+	_, err := fmt.Fprintf(w, ":%s\n", strings.ToUpper(hex.EncodeToString(record)))
+	return err
+}
+
+func (img *Image) writeHex(w io.Writer) error {
+	upper := uint32(0)
+	for _, s := range img.Segments {
+		for ix := 0; ix < len(s.Data); {
+			address := s.Address + uint32(ix)
+			if address>>16 != upper {
+				upper = address >> 16
+				if err := writeRecord(w, hexUpper, 0, uint16(upper)); err != nil {
+					return err
+				}
+			}
+			// A record cannot cross into the next 0x10000 half-words.
+			n := len(s.Data) - ix
+			if n > hexPerLine {
+				n = hexPerLine
+			}
+			if room := 0x10000 - int(address&0xffff); n > room {
+				n = room
+			}
+			if err := writeRecord(w, hexData, uint16(address), s.Data[ix:ix+n]...); err != nil {
+				return err
+			}
+			ix += n
+		}
+	}
+	if img.Entry != nil {
+		if err := writeRecord(w, hexStart, 0, uint16(*img.Entry>>16), uint16(*img.Entry)); err != nil {
+			return err
+		}
+	}
+	return writeRecord(w, hexEnd, 0)
+}
+
+func readHex(r io.Reader) (*Image, error) {
+	img := &Image{}
+	upper := uint32(0)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("Line %d: Expected a record, starting with a colon", n)
+		}
+		record, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		if len(record) < 5 || len(record) != 5+2*int(record[0]) {
+			return nil, fmt.Errorf("Line %d: Record has the wrong length", n)
+		}
+		sum := byte(0)
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("Line %d: Bad checksum", n)
+		}
+		address := uint32(record[1])<<8 | uint32(record[2])
+		data := make([]uint16, record[0])
+		for ix := range data {
+			data[ix] = uint16(record[4+2*ix])<<8 | uint16(record[5+2*ix])
+		}
+		switch kind := record[3]; {
+		case kind == hexData:
+			if len(data) > 0 {
+				img.Add(upper<<16|address, data...)
+			}
+		case kind == hexEnd:
+			return img, nil
+		case kind == hexUpper && len(data) == 1 && uint32(data[0]) <= mask>>16:
+			upper = uint32(data[0])
+		case kind == hexStart && len(data) == 2 && uint32(data[0]) <= mask>>16:
+			entry := uint32(data[0])<<16 | uint32(data[1])
+			img.Entry = &entry
+		default:
+			return nil, fmt.Errorf("Line %d: Bad record of type %02x", n, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("No end record")
+}
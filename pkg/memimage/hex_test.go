@@ -0,0 +1,65 @@
+package memimage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteHex(t *testing.T) {
+	img := NewImage(0x10100, []uint16{0x9810, 0x1234})
+	entry := uint32(0x10100)
+	img.Entry = &entry
+	var b bytes.Buffer
+	if err := img.Write(&b, Hex); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := ":010000040001FA\n:02010000981012340F\n:0200000500010100F7\n:00000001FF\n"
+	if b.String() != expected {
+		t.Errorf("Hex image is\n%s\nexpected\n%s", b.String(), expected)
+	}
+
+	// Records are split at 0x10000 half-word boundaries.
+	data := make([]uint16, 10)
+	img = NewImage(0xfffe, data)
+	b.Reset()
+	if err := img.Write(&b, Hex); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], ":02FFFE00") || lines[1] != ":010000040001FA" || !strings.HasPrefix(lines[2], ":08000000") {
+		t.Errorf("Hex image is %q", lines)
+	}
+	back, err := Read(&b, Hex, 0)
+	if err != nil || len(back.Segments) != 1 || back.Segments[0].Address != 0xfffe || len(back.Segments[0].Data) != 10 {
+		t.Errorf("Read back %+v (%v)", back, err)
+	}
+}
+
+func TestReadHex(t *testing.T) {
+	img, err := Read(strings.NewReader("\n:02010000981012340F\n:0200000500010100F7\n:00000001FF\nrubbish"), Hex, 0x300)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if len(img.Segments) != 1 || img.Segments[0].Address != 0x100 || img.Entry == nil || *img.Entry != 0x10100 {
+		t.Errorf("Image is %+v", img)
+	}
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"02010000981012340F\n", "Line 1: Expected a record, starting with a colon"},
+		{":02010000981012340E\n", "Line 1: Bad checksum"},
+		{":0201000098101234\n", "Line 1: Record has the wrong length"},
+		{":0X\n", "Line 1: encoding/hex: invalid byte: U+0058 'X'"},
+		{":010000040004F7\n", "Line 1: Bad record of type 04"},
+		{":00000003FD\n", "Line 1: Bad record of type 03"},
+		{":02010000981012340F\n", "No end record"},
+	}
+	for ix, tc := range cases {
+		if _, err := Read(strings.NewReader(tc.text), Hex, 0); err == nil || err.Error() != tc.expected {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package memimage
+
+// Listings.
+//
+// Each line holds an address, a colon and the half-words from there
+// on, all in hexadecimal. A semicolon starts a comment, and blank
+// lines are ignored:
+//
+//	; Written by c932as
+//	00100: 9810 1234     ; LD 1,0x1234
+//	00102: 0130 0000     ; JS 3,0x00102
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// Write a listing, two half-words to a line, each line annotated with
+// the disassembly of the instruction it would hold. Listings have no
+// entry, so that is left out.
+func (img *Image) writeListing(w io.Writer) error {
+	for _, s := range img.Segments {
+		for ix := 0; ix < len(s.Data); ix += 2 {
+			address := s.Address + uint32(ix)
+			var err error
+			if ix+1 < len(s.Data) {
+				word := uint32(s.Data[ix])<<16 | uint32(s.Data[ix+1])
+				_, err = fmt.Fprintf(w, "%05x: %04x %04x     ; %s\n", address, s.Data[ix], s.Data[ix+1], cpu.DisassembleSymbolic(address, word, img.Names))
+			} else {
+				_, err = fmt.Fprintf(w, "%05x: %04x\n", address, s.Data[ix])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readListing(r io.Reader) (*Image, error) {
+	img := &Image{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if ix := strings.Index(line, ";"); ix >= 0 {
+			line = line[:ix]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("Line %d: Expected an address and a colon", n)
+		}
+		address, err := strconv.ParseUint(strings.TrimSpace(line[:colon]), 16, 32)
+		if err != nil || address > mask {
+			return nil, fmt.Errorf("Line %d: Bad address %s", n, strings.TrimSpace(line[:colon]))
+		}
+		var data []uint16
+		for _, field := range strings.Fields(line[colon+1:]) {
+			h, err := strconv.ParseUint(field, 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: Bad half-word %s", n, field)
+			}
+			data = append(data, uint16(h))
+		}
+		if len(data) > 0 {
+			img.Add(uint32(address), data...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,60 @@
+package memimage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteListing(t *testing.T) {
+	var b bytes.Buffer
+	img := sample()
+	img.Names = func(address uint32) string {
+		if address == 0x204 {
+			return "FAR"
+		}
+		return ""
+	}
+	if err := img.Write(&b, Listing); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := `00100: 9810 1234     ; LD 1,0x1234
+00102: 0130 0102     ; JS 3,FAR
+00106: beef
+`
+	if b.String() != expected {
+		t.Errorf("Listing is\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+func TestReadListing(t *testing.T) {
+	text := `; Comment
+00100: 9810 1234     ; LD 1,0x1234
+
+00102: 0130          ; Split
+00103: 0000
+00200:
+`
+	img, err := Read(strings.NewReader(text), Listing, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if len(img.Segments) != 1 || img.Segments[0].Address != 0x100 || len(img.Segments[0].Data) != 4 || img.Segments[0].Data[2] != 0x130 {
+		t.Errorf("Image is %+v", img)
+	}
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"00100 9810", "Line 1: Expected an address and a colon"},
+		{"40000: 9810", "Line 1: Bad address 40000"},
+		{"00100: 19810", "Line 1: Bad half-word 19810"},
+		{"00100: 1 2\n00101: 3", "Address 0x00101 is given twice"},
+	}
+	for ix, tc := range cases {
+		if _, err := Read(strings.NewReader(tc.text), Listing, 0); err == nil || err.Error() != tc.expected {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// The memimage package reads and writes memory images, in one of
+// three formats:
+//
+// Raw images are big-endian half-words, as c932as writes them, with
+// the high half of a word first. They hold no addresses, so the
+// origin is given when reading, and gaps between segments are filled
+// with zeros when writing.
+//
+// Hex images are text, like Intel HEX but counting half-words rather
+// than bytes (see hex.go). They hold their own addresses, can have
+// gaps, and can give the address to start at.
+//
+// Listings are text too, with an address and the half-words at it on
+// each line, and anything after a semicolon ignored. When written,
+// each pair of half-words is annotated with its disassembly (see
+// listing.go).
+//
+// The format of a file is given by its extension: .hex for hex, .lst
+// for listings, and anything else is raw.
+package memimage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+const mask = 0x3ffff
+
+// The format of an image.
+type Format string
+
+const (
+	Raw     Format = "raw"
+	Hex     Format = "hex"
+	Listing Format = "listing"
+)
+
+// Work out the format of a file from its extension.
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex":
+		return Hex
+	case ".lst":
+		return Listing
+	}
+	return Raw
+}
+
+// Consecutive half-words, starting at Address.
+type Segment struct {
+	Address uint32
+	Data    []uint16
+}
+
+// A memory image.
+type Image struct {
+	Segments []Segment // By address, not overlapping
+	Entry    *uint32   // Where to start, if known
+	// If set, names addresses in the disassembly of a listing, as
+	// for cpu.DisassembleSymbolic.
+	Names func(uint32) string
+}
+
+// Make an image of data at origin.
+func NewImage(origin uint32, data []uint16) *Image {
+	img := &Image{}
+	if len(data) > 0 {
+		img.Segments = []Segment{{Address: origin, Data: data}}
+	}
+	return img
+}
+
+// Add half-words at an address, joining them to the segment before
+// if they follow on from it.
+func (img *Image) Add(address uint32, data ...uint16) {
+	if n := len(img.Segments); n > 0 {
+		last := &img.Segments[n-1]
+		if last.Address+uint32(len(last.Data)) == address {
+			last.Data = append(last.Data, data...)
+			return
+		}
+	}
+	img.Segments = append(img.Segments, Segment{Address: address, Data: append([]uint16{}, data...)})
+}
+
+// Sort the segments, and check that they neither overlap nor go past
+// the end of the address space.
+func (img *Image) Check() error {
+	sort.SliceStable(img.Segments, func(i, j int) bool { return img.Segments[i].Address < img.Segments[j].Address })
+	end := uint64(0)
+	for ix, s := range img.Segments {
+		if ix > 0 && uint64(s.Address) < end {
+			return fmt.Errorf("Address 0x%05x is given twice", s.Address)
+		}
+		end = uint64(s.Address) + uint64(len(s.Data))
+		if end > mask+1 {
+			return fmt.Errorf("Segment at 0x%05x goes past the end of memory", s.Address)
+		}
+	}
+	return nil
+}
+
+// Return the lowest address of the image, and the half-words from it
+// to the end of the image, with any gaps filled with zeros.
+func (img *Image) Flat() (uint32, []uint16) {
+	if len(img.Segments) == 0 {
+		return 0, []uint16{}
+	}
+	origin := img.Segments[0].Address
+	last := img.Segments[len(img.Segments)-1]
+	rv := make([]uint16, last.Address+uint32(len(last.Data))-origin)
+	for _, s := range img.Segments {
+		copy(rv[s.Address-origin:], s.Data)
+	}
+	return origin, rv
+}
+
+// Where a CPU loading the image should start: the entry, if there is
+// one, and otherwise the lowest address.
+func (img *Image) Start() uint32 {
+	if img.Entry != nil {
+		return *img.Entry
+	}
+	origin, _ := img.Flat()
+	return origin
+}
+
+// Store the image in the memory of a CPU. All of it has to be mapped.
+func (img *Image) Load(c *cpu.CPU) error {
+	for _, s := range img.Segments {
+		for ix := range s.Data {
+			if address := s.Address + uint32(ix); !c.Mapped(address) {
+				return fmt.Errorf("Address 0x%05x is not mapped", address)
+			}
+		}
+	}
+	for _, s := range img.Segments {
+		for ix, h := range s.Data {
+			c.StoreHalfWord(s.Address+uint32(ix), h)
+		}
+	}
+	return nil
+}
+
+// Read an image. The origin is only used for raw images.
+func Read(r io.Reader, f Format, origin uint32) (*Image, error) {
+	var img *Image
+	var err error
+	switch f {
+	case Raw:
+		img, err = readRaw(r, origin)
+	case Hex:
+		img, err = readHex(r)
+	case Listing:
+		img, err = readListing(r)
+	default:
+		return nil, fmt.Errorf("Unknown image format %q", f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := img.Check(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Write an image.
+func (img *Image) Write(w io.Writer, f Format) error {
+	switch f {
+	case Raw:
+		return img.writeRaw(w)
+	case Hex:
+		return img.writeHex(w)
+	case Listing:
+		return img.writeListing(w)
+	}
+	return fmt.Errorf("Unknown image format %q", f)
+}
+
+// Read an image from a file, in the format its extension gives.
+func ReadFile(path string, origin uint32) (*Image, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := Read(bytes.NewReader(data), FormatOf(path), origin)
+	if err != nil {
+		return nil, fmt.Errorf("Image %s: %v", path, err)
+	}
+	return img, nil
+}
+
+// Write an image to a file, in the format its extension gives.
+func (img *Image) WriteFile(path string) error {
+	var b bytes.Buffer
+	if err := img.Write(&b, FormatOf(path)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+func readRaw(r io.Reader, origin uint32) (*Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("Odd number of bytes")
+	}
+	rv := make([]uint16, len(data)/2)
+	for ix := range rv {
+		rv[ix] = uint16(data[2*ix])<<8 | uint16(data[2*ix+1])
+	}
+	return NewImage(origin, rv), nil
+}
+
+func (img *Image) writeRaw(w io.Writer) error {
+	_, contents := img.Flat()
+	data := make([]byte, 2*len(contents))
+	for ix, h := range contents {
+		data[2*ix] = byte(h >> 8)
+		data[2*ix+1] = byte(h)
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,114 @@
+package memimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// An image with a gap and an entry.
+func sample() *Image {
+	img := NewImage(0x100, []uint16{0x9810, 0x1234, 0x0130, 0x0102})
+	img.Add(0x106, 0xbeef)
+	entry := uint32(0x100)
+	img.Entry = &entry
+	return img
+}
+
+func TestFlat(t *testing.T) {
+	origin, data := sample().Flat()
+	expected := []uint16{0x9810, 0x1234, 0x0130, 0x0102, 0, 0, 0xbeef}
+	if origin != 0x100 || !reflect.DeepEqual(data, expected) {
+		t.Errorf("Flat image is %04x at %05x, expected %04x at 00100", data, origin, expected)
+	}
+	if origin, data := (&Image{}).Flat(); origin != 0 || len(data) != 0 {
+		t.Errorf("Empty image is %04x at %05x", data, origin)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	img := NewImage(0x10, []uint16{1, 2, 3})
+	img.Add(0x4, 4)
+	if err := img.Check(); err != nil || img.Segments[0].Address != 4 {
+		t.Errorf("Segments are %+v (%v)", img.Segments, err)
+	}
+	img.Add(0x11, 5)
+	if err := img.Check(); err == nil || err.Error() != "Address 0x00011 is given twice" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	img = NewImage(0x3ffff, []uint16{1, 2})
+	if err := img.Check(); err == nil || err.Error() != "Segment at 0x3ffff goes past the end of memory" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	var b bytes.Buffer
+	if err := sample().Write(&b, Raw); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	expected := []byte{0x98, 0x10, 0x12, 0x34, 0x01, 0x30, 0x01, 0x02, 0, 0, 0, 0, 0xbe, 0xef}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Raw image is % x, expected % x", b.Bytes(), expected)
+	}
+	img, err := Read(bytes.NewReader(expected), Raw, 0x200)
+	if err != nil || len(img.Segments) != 1 || img.Segments[0].Address != 0x200 || img.Segments[0].Data[6] != 0xbeef {
+		t.Errorf("Read %+v (%v)", img, err)
+	}
+	if _, err := Read(bytes.NewReader([]byte{1}), Raw, 0); err == nil {
+		t.Errorf("Expected an error reading an odd number of bytes")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memimage")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"prog.bin", "prog.hex", "prog.lst"} {
+		path := filepath.Join(dir, name)
+		if err := sample().WriteFile(path); err != nil {
+			t.Fatalf("Unexpected error writing %s, %v", name, err)
+		}
+		img, err := ReadFile(path, 0x100)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s, %v", name, err)
+		}
+		origin, data := img.Flat()
+		expectedOrigin, expected := sample().Flat()
+		if origin != expectedOrigin || !reflect.DeepEqual(data, expected) {
+			t.Errorf("%s holds %04x at %05x, expected %04x at %05x", name, data, origin, expected, expectedOrigin)
+		}
+	}
+	if FormatOf("X.HEX") != Hex || FormatOf("x.lst") != Listing || FormatOf("x.img") != Raw {
+		t.Errorf("Formats of X.HEX, x.lst and x.img are %s, %s and %s", FormatOf("X.HEX"), FormatOf("x.lst"), FormatOf("x.img"))
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c := cpu.NewCPU()
+	if err := c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 0x1ff}, cpu.NewDirectMemory(0x200)); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	img := sample()
+	if err := img.Load(c); err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if c.FetchWord(0x100) != 0x98101234 || c.FetchHalfWord(0x106) != 0xbeef || img.Start() != 0x100 {
+		t.Errorf("Loaded %08x and %04x, starting at %05x", c.FetchWord(0x100), c.FetchHalfWord(0x106), img.Start())
+	}
+
+	img = NewImage(0x1fe, []uint16{1, 2, 3})
+	if err := img.Load(c); err == nil || err.Error() != "Address 0x00200 is not mapped" {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if c.FetchHalfWord(0x1fe) != 0 || c.Trap != nil {
+		t.Errorf("Image partly loaded, or trapped (%v)", c.Trap)
+	}
+}
@@ -0,0 +1,1106 @@
+// The monitor package provides a command interpreter for a running
+// machine, in the style of the SIMH simulator control program, so
+// that habits and scripts carry over.
+//
+// Commands can be abbreviated, as in SIMH, and are case insensitive.
+// Numbers and addresses are hexadecimal, with or without a 0x
+// prefix. Once symbols are loaded, an address can also be a symbol,
+// and any address can have offsets added or subtracted, as in
+// LOOP+4. An address range is either low-high or low/count; an
+// address with a symbol in it, such as COUNT-2, is a range of one.
+// Everything after a semicolon is a comment.
+//
+//	ATTACH module file     Load a raw image into a memory module,
+//	                       and write it back on DETACH
+//	DETACH module|ALL      Write an attached module back to its file
+//	DEPOSIT [-W] what val  Set a register, or memory at an address
+//	EXAMINE [-W] what      Show a register (or STATE for all of
+//	                       them), or memory in an address range
+//	SET CPU n              Make CPU n current
+//	SET CPU param=val      Set MEMORYCYCLES, INDIRECTCYCLES,
+//	                       INTERRUPTBASE, MASK, HISTORY (the number
+//	                       of instructions that can be undone, 0 for
+//	                       none) or RECORDER (the number of
+//	                       instructions kept to show after a trap, 0
+//	                       for none) on the current CPU
+//	SET SYSTEM param=val   Set SCHEDULING, SEED or PACING (rate or
+//	                       rate,CYCLES) of the system
+//	SHOW CPU|MEMORY|DEVICES|BREAK|WATCH|SYSTEM|RECORDER|SYMBOLS
+//	BOOT                   Reset every CPU and device to its boot state, and GO
+//	GO [addr]              Run until a breakpoint, trap or halt
+//	STEP [n]               Run n (default 1) rounds
+//	BREAK addr...          Set breakpoints on the current CPU
+//	NOBREAK [addr...]      Remove breakpoints (all, if none given)
+//	WATCH range...         Stop when the current CPU writes to a
+//	                       watched address
+//	NOWATCH [range...]     Remove watchpoints (all, if none given)
+//	SYMBOLS file           Load symbols from a debug information
+//	                       file, as written by c932as -g
+//	BACKSTEP [n]           Undo n (default 1) instructions of the
+//	                       current CPU
+//	REWIND addr            Undo instructions of the current CPU back
+//	                       to the last one that wrote addr
+//	SEEK n                 Take the current CPU back, or forward, to
+//	                       the point where it had executed n
+//	                       instructions
+//	SAVE file, RESTORE file
+//	DO file                Run the commands in a file
+//	EXIT, QUIT, HELP
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/debuginfo"
+	"github.com/vatine/censor932/pkg/device"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// How deeply DO files may nest.
+const maxDepth = 10
+
+// A command interpreter for a machine.
+type Monitor struct {
+	Machine *config.Machine
+	Prompt  string                 // Printed before each line read by Run, if set
+	Symbols *debuginfo.SymbolTable // Names for addresses, if set
+
+	out      io.Writer
+	current  int               // Index of the current CPU
+	boot     []cpu.CPU         // The state of each CPU at boot
+	breaks   []map[uint32]bool // Breakpoints per CPU
+	watches  []map[uint32]bool // Watchpoints per CPU
+	attached map[string]string // Files attached to modules, by module name
+	stop     int32             // Set, atomically, to stop a run
+	depth    int               // Nesting of DO files
+	done     bool              // EXIT has been given
+}
+
+// Create a monitor for a machine, writing its output to out. The
+// state of the CPUs at this point is what BOOT returns them to.
+func New(m *config.Machine, out io.Writer) *Monitor {
+	rv := &Monitor{
+		Machine:  m,
+		out:      out,
+		attached: map[string]string{},
+	}
+	for _, c := range m.CPUs {
+		rv.boot = append(rv.boot, cpu.CPU{
+			G: c.G, IC: c.IC, PS: c.PS, MIR: c.MIR, CC: c.CC,
+			InterruptBase: c.InterruptBase, InterruptMasked: c.InterruptMasked,
+		})
+		rv.breaks = append(rv.breaks, map[uint32]bool{})
+		rv.watches = append(rv.watches, map[uint32]bool{})
+	}
+	return rv
+}
+
+// A command, with the shortest abbreviation it can be given as.
+type command struct {
+	name string
+	min  int
+	fn   func(m *Monitor, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"ATTACH", 2, (*Monitor).attach},
+		{"BACKSTEP", 2, (*Monitor).backStep},
+		{"BOOT", 1, (*Monitor).bootCmd},
+		{"BREAK", 2, (*Monitor).breakCmd},
+		{"DEPOSIT", 1, (*Monitor).deposit},
+		{"DETACH", 3, (*Monitor).detach},
+		{"DO", 2, (*Monitor).doCmd},
+		{"EXAMINE", 1, (*Monitor).examine},
+		{"EXIT", 3, (*Monitor).exit},
+		{"GO", 1, (*Monitor).goCmd},
+		{"HELP", 1, (*Monitor).help},
+		{"NOBREAK", 3, (*Monitor).noBreak},
+		{"NOWATCH", 3, (*Monitor).noWatch},
+		{"QUIT", 1, (*Monitor).exit},
+		{"RESTORE", 3, (*Monitor).restore},
+		{"REWIND", 3, (*Monitor).rewind},
+		{"SAVE", 2, (*Monitor).save},
+		{"SEEK", 3, (*Monitor).seek},
+		{"SET", 2, (*Monitor).set},
+		{"SHOW", 2, (*Monitor).show},
+		{"STEP", 1, (*Monitor).step},
+		{"SYMBOLS", 2, (*Monitor).symbols},
+		{"WATCH", 1, (*Monitor).watch},
+	}
+}
+
+// Find the command a (possibly abbreviated) name refers to.
+func lookup(name string) *command {
+	name = strings.ToUpper(name)
+	for ix := range commands {
+		c := &commands[ix]
+		if len(name) >= c.min && strings.HasPrefix(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Has EXIT been given?
+func (m *Monitor) Done() bool {
+	return m.done
+}
+
+// Stop a running GO or STEP as soon as possible. Safe to call from
+// another goroutine, such as a signal handler.
+func (m *Monitor) Interrupt() {
+	atomic.StoreInt32(&m.stop, 1)
+}
+
+// Execute a single command line.
+func (m *Monitor) Execute(line string) error {
+	if ix := strings.Index(line, ";"); ix >= 0 {
+		line = line[:ix]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	c := lookup(fields[0])
+	if c == nil {
+		return fmt.Errorf("Unknown command %s", fields[0])
+	}
+	log.WithFields(log.Fields{"command": c.name, "args": fields[1:]}).Debug("Monitor command")
+	return c.fn(m, fields[1:])
+}
+
+// Read and execute commands until EOF or EXIT. Errors are reported to
+// the output, and do not stop the loop.
+func (m *Monitor) Run(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for !m.done {
+		if m.Prompt != "" {
+			fmt.Fprint(m.out, m.Prompt)
+		}
+		if !scanner.Scan() {
+			break
+		}
+		if err := m.Execute(scanner.Text()); err != nil {
+			fmt.Fprintf(m.out, "%v\n", err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Execute the commands in a file, stopping at the first error.
+func (m *Monitor) Do(path string) error {
+	if m.depth >= maxDepth {
+		return fmt.Errorf("DO files nested too deeply")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m.depth++
+	defer func() { m.depth-- }()
+	scanner := bufio.NewScanner(f)
+	for n := 1; !m.done && scanner.Scan(); n++ {
+		if err := m.Execute(scanner.Text()); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Return the current CPU.
+func (m *Monitor) cpu() *cpu.CPU {
+	return m.Machine.CPUs[m.current]
+}
+
+// Parse a hexadecimal number.
+func parseNumber(s string) (uint64, error) {
+	t := strings.ToLower(s)
+	t = strings.TrimPrefix(t, "0x")
+	v, err := strconv.ParseUint(t, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad number %s", s)
+	}
+	return v, nil
+}
+
+// Parse an address, a hexadecimal number or a symbolic address.
+func (m *Monitor) parseAddress(s string) (uint32, error) {
+	if strings.ContainsAny(s, "+-") || m.Symbols != nil {
+		return m.Symbols.Resolve(s, parseNumber)
+	}
+	v, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	if v > 0x3ffff {
+		return 0, fmt.Errorf("Address %s is outside the address space", s)
+	}
+	return uint32(v), nil
+}
+
+// Parse an address range, low-high or low/count. A single address is
+// a range of one. As addresses can subtract, something with a symbol
+// in it that is an address on its own, such as COUNT-2, is one;
+// otherwise the first - with an address on each side of it separates
+// low and high, so that 300-100 is a bad range rather than 200.
+func (m *Monitor) parseRange(s string) (uint32, uint32, error) {
+	if ix := strings.Index(s, "/"); ix >= 0 {
+		low, err := m.parseAddress(s[:ix])
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := parseNumber(s[ix+1:])
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			return 0, 0, fmt.Errorf("Empty range %s", s)
+		}
+		high := uint64(low) + n - 1
+		if high > 0x3ffff {
+			return 0, 0, fmt.Errorf("Bad range %s", s)
+		}
+		return low, uint32(high), nil
+	}
+
+	a, err := m.parseAddress(s)
+	if err == nil && (!strings.Contains(s, "-") || m.symbolic(s)) {
+		return a, a, nil
+	}
+	for ix := 0; ix < len(s); ix++ {
+		if s[ix] != '-' {
+			continue
+		}
+		low, lerr := m.parseAddress(s[:ix])
+		high, herr := m.parseAddress(s[ix+1:])
+		if lerr != nil || herr != nil {
+			continue
+		}
+		if high < low {
+			return 0, 0, fmt.Errorf("Bad range %s", s)
+		}
+		return low, high, nil
+	}
+	return a, a, err
+}
+
+// Does an address have a symbol in it, rather than only numbers?
+func (m *Monitor) symbolic(s string) bool {
+	notNumber := func(string) (uint64, error) { return 0, fmt.Errorf("Not a symbol") }
+	for _, term := range strings.FieldsFunc(s, func(r rune) bool { return r == '+' || r == '-' }) {
+		if _, err := m.Symbols.Resolve(term, notNumber); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the symbolic form of an address, or "" if there is none.
+func (m *Monitor) name(address uint32) string {
+	return m.Symbols.Name(address)
+}
+
+// Return an address, with its symbolic form if there is one.
+func (m *Monitor) where(address uint32) string {
+	if n := m.Symbols.Name(address); n != "" {
+		return fmt.Sprintf("%05x (%s)", address, n)
+	}
+	return fmt.Sprintf("%05x", address)
+}
+
+// Split off leading switches, such as -W.
+func switches(args []string) (map[string]bool, []string) {
+	rv := map[string]bool{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, r := range strings.ToUpper(args[0][1:]) {
+			rv[string(r)] = true
+		}
+		args = args[1:]
+	}
+	return rv, args
+}
+
+// Return a pointer to a register of the current CPU, and its width in
+// hex digits. PS is handled separately, being 64 bits.
+func (m *Monitor) register(name string) (*uint32, int, bool) {
+	c := m.cpu()
+	switch strings.ToUpper(name) {
+	case "IC":
+		return &c.IC, 5, true
+	case "MIR":
+		return &c.MIR, 6, true
+	}
+	up := strings.ToUpper(name)
+	if strings.HasPrefix(up, "G") {
+		n, err := strconv.Atoi(up[1:])
+		if err == nil && n >= 0 && n < 16 {
+			return &c.G[n], 8, true
+		}
+	}
+	return nil, 0, false
+}
+
+func (m *Monitor) examineRegister(name string) bool {
+	c := m.cpu()
+	switch strings.ToUpper(name) {
+	case "CC":
+		fmt.Fprintf(m.out, "CC:\t%x\n", c.CC)
+		return true
+	case "PS":
+		fmt.Fprintf(m.out, "PS:\t%016x\n", c.PS)
+		return true
+	}
+	if r, width, ok := m.register(name); ok {
+		fmt.Fprintf(m.out, "%s:\t%0*x\n", strings.ToUpper(name), width, *r)
+		return true
+	}
+	return false
+}
+
+func (m *Monitor) examine(args []string) error {
+	sw, args := switches(args)
+	if len(args) == 0 {
+		return fmt.Errorf("EXAMINE needs something to examine")
+	}
+	c := m.cpu()
+	for _, a := range args {
+		if strings.ToUpper(a) == "STATE" {
+			fmt.Fprintf(m.out, "IC:\t%05x\nCC:\t%x\nPS:\t%016x\nMIR:\t%06x\n", c.IC, c.CC, c.PS, c.MIR)
+			for ix, g := range c.G {
+				fmt.Fprintf(m.out, "G%d:\t%08x\n", ix, g)
+			}
+			continue
+		}
+		if m.examineRegister(a) {
+			continue
+		}
+		low, high, err := m.parseRange(a)
+		if err != nil {
+			return err
+		}
+		step := uint32(1)
+		if sw["W"] {
+			step = 2
+		}
+		for addr := uint64(low); addr <= uint64(high); addr += uint64(step) {
+			ad := uint32(addr)
+			if !c.Mapped(ad) || (step == 2 && !c.Mapped(ad+1)) {
+				return fmt.Errorf("No memory at address %05x", ad)
+			}
+			if step == 2 {
+				w, _ := c.PeekWord(ad)
+				fmt.Fprintf(m.out, "%05x:\t%08x\n", ad, w)
+			} else {
+				h, _ := c.Peek(ad)
+				fmt.Fprintf(m.out, "%05x:\t%04x\n", ad, h)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) deposit(args []string) error {
+	sw, args := switches(args)
+	if len(args) != 2 {
+		return fmt.Errorf("DEPOSIT needs a register or address, and a value")
+	}
+	v, err := parseNumber(args[1])
+	if err != nil {
+		return err
+	}
+	c := m.cpu()
+	switch strings.ToUpper(args[0]) {
+	case "CC":
+		if v > 0xf {
+			return fmt.Errorf("CC value %s out of range", args[1])
+		}
+		c.CC = uint8(v)
+		return nil
+	case "PS":
+		c.PS = v
+		return nil
+	}
+	if r, _, ok := m.register(args[0]); ok {
+		if v > math.MaxUint32 {
+			return fmt.Errorf("Value %s does not fit in a register", args[1])
+		}
+		*r = uint32(v)
+		return nil
+	}
+
+	low, high, err := m.parseRange(args[0])
+	if err != nil {
+		return err
+	}
+	step := uint64(1)
+	if sw["W"] {
+		step = 2
+	}
+	if (step == 1 && v > 0xffff) || v > math.MaxUint32 {
+		return fmt.Errorf("Value %s is too large", args[1])
+	}
+	for addr := uint64(low); addr <= uint64(high); addr += step {
+		ad := uint32(addr)
+		if !c.Mapped(ad) || (step == 2 && !c.Mapped(ad+1)) {
+			return fmt.Errorf("No memory at address %05x", ad)
+		}
+		if step == 2 {
+			c.PokeWord(ad, uint32(v))
+		} else {
+			c.Poke(ad, uint16(v))
+		}
+	}
+	return nil
+}
+
+// Find a memory module or device by name, in the current CPU or, for
+// shared modules, any CPU.
+func (m *Monitor) module(name string) (config.Module, error) {
+	if mod, ok := m.Machine.Module(m.current, name); ok {
+		return mod, nil
+	}
+	for _, mod := range m.Machine.Modules {
+		if strings.EqualFold(mod.Name, name) {
+			return mod, nil
+		}
+	}
+	return config.Module{}, fmt.Errorf("No module %s", name)
+}
+
+// Is the module a memory, rather than a device?
+func isMemory(mod config.Module) bool {
+	return mod.Kind == "local" || mod.Kind == "rom" || mod.Kind == "shared"
+}
+
+// Return the contents of a memory module.
+func contents(mod config.Module) []uint16 {
+	rv := make([]uint16, mod.Range.High-mod.Range.Low+1)
+	d, debug := mod.Backend.(cpu.DebugMemoryBackend)
+	for ix := range rv {
+		if debug {
+			rv[ix] = d.PeekHalfWord(uint32(ix))
+		} else {
+			rv[ix] = mod.Backend.FetchHalfWord(uint32(ix))
+		}
+	}
+	return rv
+}
+
+// Replace the contents of a memory module. Anything past the end of
+// data is cleared.
+func (m *Monitor) load(mod config.Module, data []uint16) {
+	if rom, ok := mod.Backend.(*cpu.ReadOnlyMemory); ok {
+		rom.Load(data)
+		return
+	}
+	size := mod.Range.High - mod.Range.Low + 1
+	d, debug := mod.Backend.(cpu.DebugMemoryBackend)
+	for ix := uint32(0); ix < size; ix++ {
+		v := uint16(0)
+		if int(ix) < len(data) {
+			v = data[ix]
+		}
+		if debug {
+			d.PokeHalfWord(ix, v)
+		} else {
+			mod.Backend.WriteHalfWord(ix, v)
+		}
+	}
+}
+
+func (m *Monitor) attach(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("ATTACH needs a module and a file")
+	}
+	mod, err := m.module(args[0])
+	if err != nil {
+		return err
+	}
+	if !isMemory(mod) {
+		return fmt.Errorf("Device %s has nothing to attach", mod.Name)
+	}
+	if _, ok := m.attached[mod.Name]; ok {
+		return fmt.Errorf("Module %s is already attached", mod.Name)
+	}
+	data, err := config.ReadImage(args[1])
+	if err != nil {
+		return err
+	}
+	if uint32(len(data)) > mod.Range.High-mod.Range.Low+1 {
+		return fmt.Errorf("Image %s is larger than module %s", args[1], mod.Name)
+	}
+	m.load(mod, data)
+	m.attached[mod.Name] = args[1]
+	return nil
+}
+
+// Detach a module, writing its contents back unless it is a ROM.
+func (m *Monitor) detachModule(name string) error {
+	mod, err := m.module(name)
+	if err != nil {
+		return err
+	}
+	path, ok := m.attached[mod.Name]
+	if !ok {
+		return fmt.Errorf("Module %s is not attached", mod.Name)
+	}
+	delete(m.attached, mod.Name)
+	if mod.Kind == "rom" {
+		return nil
+	}
+	return config.WriteImage(path, contents(mod))
+}
+
+func (m *Monitor) detach(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("DETACH needs a module, or ALL")
+	}
+	if strings.ToUpper(args[0]) != "ALL" {
+		return m.detachModule(args[0])
+	}
+	names := []string{}
+	for name := range m.attached {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := m.detachModule(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split a param=value argument.
+func param(arg string) (string, string, error) {
+	ix := strings.Index(arg, "=")
+	if ix < 0 {
+		return "", "", fmt.Errorf("Expected param=value, not %s", arg)
+	}
+	return strings.ToUpper(arg[:ix]), arg[ix+1:], nil
+}
+
+func (m *Monitor) set(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("SET needs CPU or SYSTEM, and a setting")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CPU":
+		return m.setCPU(args[1])
+	case "SYSTEM":
+		return m.setSystem(args[1])
+	}
+	return fmt.Errorf("Cannot SET %s", args[0])
+}
+
+func (m *Monitor) setCPU(arg string) error {
+	if !strings.Contains(arg, "=") {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 || n >= len(m.Machine.CPUs) {
+			return fmt.Errorf("No CPU %s", arg)
+		}
+		m.current = n
+		return nil
+	}
+	p, value, err := param(arg)
+	if err != nil {
+		return err
+	}
+	v, err := parseNumber(value)
+	if err != nil {
+		return err
+	}
+	c := m.cpu()
+	switch p {
+	case "MEMORYCYCLES":
+		c.MemoryCycles = v
+	case "INDIRECTCYCLES":
+		c.IndirectCycles = v
+	case "INTERRUPTBASE":
+		if v > 0x3ffff {
+			return fmt.Errorf("Address %s is outside the address space", value)
+		}
+		c.InterruptBase = uint32(v)
+	case "MASK":
+		if v > 0xffff {
+			return fmt.Errorf("Mask %s has more than 16 bits", value)
+		}
+		c.InterruptMasked = uint16(v)
+	case "RECORDER":
+		if v == 0 {
+			c.Recorder = nil
+		} else {
+			c.Recorder = cpu.NewFlightRecorder(int(v))
+			c.Recorder.Out = m.out
+			c.Recorder.Names = m.name
+		}
+	case "HISTORY":
+		if v == 0 {
+			c.Journal = nil
+		} else {
+			c.Journal = cpu.NewJournal(int(v))
+		}
+	default:
+		return fmt.Errorf("Unknown CPU parameter %s", p)
+	}
+	return nil
+}
+
+func (m *Monitor) setSystem(arg string) error {
+	p, value, err := param(arg)
+	if err != nil {
+		return err
+	}
+	s := m.Machine.System
+	switch p {
+	case "SCHEDULING":
+		for _, sch := range []system.Scheduling{system.Lockstep, system.Random, system.Free} {
+			if strings.EqualFold(value, sch.String()) {
+				s.Scheduling = sch
+				return nil
+			}
+		}
+		return fmt.Errorf("Unknown scheduling %s", value)
+	case "SEED":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad seed %s", value)
+		}
+		s.Seed = n
+	case "PACING":
+		parts := strings.SplitN(value, ",", 2)
+		rate, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad rate %s", parts[0])
+		}
+		unit := system.Instructions
+		if len(parts) == 2 {
+			switch strings.ToUpper(parts[1]) {
+			case "INSTRUCTIONS":
+			case "CYCLES":
+				unit = system.Cycles
+			default:
+				return fmt.Errorf("Unknown pacing unit %s", parts[1])
+			}
+		}
+		s.Pacing = system.Pacing{Rate: rate, Unit: unit}
+	default:
+		return fmt.Errorf("Unknown SYSTEM parameter %s", p)
+	}
+	return nil
+}
+
+func (m *Monitor) show(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("SHOW needs CPU, MEMORY, DEVICES, BREAK, WATCH, SYSTEM, RECORDER or SYMBOLS")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CPU":
+		for ix, c := range m.Machine.CPUs {
+			mark := " "
+			if ix == m.current {
+				mark = "*"
+			}
+			fmt.Fprintf(m.out, "%sCPU %d: IC %s, %d cycles (%d idle)", mark, ix, m.where(c.IC), c.Cycles, c.IdleCycles)
+			if c.Trap != nil {
+				fmt.Fprintf(m.out, ", trapped: %v", c.Trap)
+			} else if c.Halted() {
+				fmt.Fprintf(m.out, ", halted")
+			}
+			if j := c.Journal; j != nil {
+				fmt.Fprintf(m.out, ", instruction %x (history from %x)", j.Count(), j.Oldest())
+			}
+			fmt.Fprintln(m.out)
+		}
+	case "MEMORY", "DEVICES":
+		memory := strings.ToUpper(args[0]) == "MEMORY"
+		for _, mod := range m.Machine.Modules {
+			if mod.CPU != m.current || isMemory(mod) != memory {
+				continue
+			}
+			fmt.Fprintf(m.out, "%-12s %-7s %05x-%05x", mod.Name, mod.Kind, mod.Range.Low, mod.Range.High)
+			if path, ok := m.attached[mod.Name]; ok {
+				fmt.Fprintf(m.out, ", attached to %s", path)
+			}
+			fmt.Fprintln(m.out)
+		}
+	case "BREAK":
+		for ix, bs := range m.breaks {
+			for _, addr := range sortedAddresses(bs) {
+				fmt.Fprintf(m.out, "CPU %d: %s\n", ix, m.where(addr))
+			}
+		}
+	case "WATCH":
+		for ix, ws := range m.watches {
+			for _, addr := range sortedAddresses(ws) {
+				fmt.Fprintf(m.out, "CPU %d: %s\n", ix, m.where(addr))
+			}
+		}
+	case "SYMBOLS":
+		if m.Symbols == nil {
+			return fmt.Errorf("No symbols loaded")
+		}
+		for _, sym := range m.Symbols.Symbols {
+			fmt.Fprintf(m.out, "%-16s %-8s %05x\n", sym.Name, sym.Kind, sym.Value)
+		}
+	case "RECORDER":
+		c := m.cpu()
+		if c.Recorder == nil {
+			return fmt.Errorf("CPU %d has no recorder, SET CPU RECORDER=n first", m.current)
+		}
+		c.Recorder.Names = m.name
+		c.Recorder.Dump(m.out, fmt.Sprintf("CPU %d", m.current))
+	case "SYSTEM":
+		s := m.Machine.System
+		fmt.Fprintf(m.out, "%d CPUs, %d shared modules, %v scheduling, seed %d", len(s.CPUs), len(s.Modules), s.Scheduling, s.Seed)
+		if s.Pacing.Rate > 0 {
+			unit := "instructions"
+			if s.Pacing.Unit == system.Cycles {
+				unit = "cycles"
+			}
+			fmt.Fprintf(m.out, ", paced at %d %s per second", s.Pacing.Rate, unit)
+		}
+		fmt.Fprintln(m.out)
+	default:
+		return fmt.Errorf("Cannot SHOW %s", args[0])
+	}
+	return nil
+}
+
+func sortedAddresses(bs map[uint32]bool) []uint32 {
+	rv := []uint32{}
+	for addr := range bs {
+		rv = append(rv, addr)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i] < rv[j] })
+	return rv
+}
+
+func (m *Monitor) breakCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("BREAK needs at least one address")
+	}
+	for _, a := range args {
+		addr, err := m.parseAddress(a)
+		if err != nil {
+			return err
+		}
+		m.breaks[m.current][addr] = true
+	}
+	return nil
+}
+
+func (m *Monitor) noBreak(args []string) error {
+	if len(args) == 0 {
+		m.breaks[m.current] = map[uint32]bool{}
+		return nil
+	}
+	for _, a := range args {
+		addr, err := m.parseAddress(a)
+		if err != nil {
+			return err
+		}
+		delete(m.breaks[m.current], addr)
+	}
+	return nil
+}
+
+func (m *Monitor) watch(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("WATCH needs at least one address")
+	}
+	for _, a := range args {
+		low, high, err := m.parseRange(a)
+		if err != nil {
+			return err
+		}
+		for addr := low; addr <= high; addr++ {
+			m.watches[m.current][addr] = true
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) noWatch(args []string) error {
+	if len(args) == 0 {
+		m.watches[m.current] = map[uint32]bool{}
+		return nil
+	}
+	for _, a := range args {
+		low, high, err := m.parseRange(a)
+		if err != nil {
+			return err
+		}
+		for addr := low; addr <= high; addr++ {
+			delete(m.watches[m.current], addr)
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) symbols(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("SYMBOLS needs a file")
+	}
+	info, err := debuginfo.Load(args[0])
+	if err != nil {
+		return err
+	}
+	m.Symbols = &info.SymbolTable
+	return nil
+}
+
+// Why a run stopped.
+type reason int
+
+const (
+	expired reason = iota
+	interrupted
+	breakpoint
+	watchpoint
+	trapped
+	halted
+)
+
+// Run the system for up to the given number of rounds, stopping
+// every CPU as soon as any of them reaches a breakpoint or traps, or
+// the run is interrupted. Report why the run stopped.
+func (m *Monitor) run(rounds uint64) {
+	s := m.Machine.System
+	for _, c := range s.CPUs {
+		c.Trap = nil
+	}
+	atomic.StoreInt32(&m.stop, 0)
+	var all int32 // Set once every CPU should stop
+	why := make([]reason, len(s.CPUs))
+	wrote := make([]int64, len(s.CPUs)) // The watched address written, or -1
+	for ix, c := range s.CPUs {
+		wrote[ix] = -1
+		if len(m.watches[ix]) == 0 {
+			continue
+		}
+		c.Watch = func(c *cpu.CPU, address uint32) {
+			if m.watches[c.ID][address] && wrote[c.ID] < 0 {
+				wrote[c.ID] = int64(address)
+			}
+		}
+		defer func(c *cpu.CPU) { c.Watch = nil }(c)
+	}
+	s.RunUntil(rounds, func(c *cpu.CPU) bool {
+		switch {
+		case c.Trap != nil:
+			why[c.ID] = trapped
+		case wrote[c.ID] >= 0:
+			why[c.ID] = watchpoint
+		case m.breaks[c.ID][c.IC]:
+			why[c.ID] = breakpoint
+		case atomic.LoadInt32(&m.stop) != 0:
+			why[c.ID] = interrupted
+			return true
+		case c.Halted():
+			why[c.ID] = halted
+			return true
+		default:
+			return atomic.LoadInt32(&all) != 0
+		}
+		atomic.StoreInt32(&all, 1)
+		return true
+	})
+
+	reported := false
+	for ix, c := range s.CPUs {
+		switch why[ix] {
+		case trapped:
+			fmt.Fprintf(m.out, "CPU %d trapped: %v\n", ix, c.Trap)
+		case breakpoint:
+			fmt.Fprintf(m.out, "Breakpoint, CPU %d IC: %s\n", ix, m.where(c.IC))
+		case watchpoint:
+			fmt.Fprintf(m.out, "Watchpoint, CPU %d wrote %s, IC: %s\n", ix, m.where(uint32(wrote[ix])), m.where(c.IC))
+		default:
+			continue
+		}
+		reported = true
+	}
+	if reported {
+		return
+	}
+	c := m.cpu()
+	switch why[m.current] {
+	case interrupted:
+		fmt.Fprintf(m.out, "Simulation stopped, IC: %s\n", m.where(c.IC))
+	case halted:
+		fmt.Fprintf(m.out, "Halted, IC: %s\n", m.where(c.IC))
+	default:
+		fmt.Fprintf(m.out, "Step expired, IC: %s\n", m.where(c.IC))
+	}
+}
+
+func (m *Monitor) goCmd(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("GO takes at most one address")
+	}
+	if len(args) == 1 {
+		addr, err := m.parseAddress(args[0])
+		if err != nil {
+			return err
+		}
+		m.cpu().IC = addr
+	}
+	m.run(math.MaxUint64)
+	return nil
+}
+
+func (m *Monitor) step(args []string) error {
+	n := uint64(1)
+	if len(args) > 1 {
+		return fmt.Errorf("STEP takes at most one count")
+	}
+	if len(args) == 1 {
+		v, err := parseNumber(args[0])
+		if err != nil || v == 0 {
+			return fmt.Errorf("Bad step count %s", args[0])
+		}
+		n = v
+	}
+	m.run(n)
+	return nil
+}
+
+func (m *Monitor) bootCmd(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("BOOT takes no arguments")
+	}
+	m.reset()
+	for ix, c := range m.Machine.CPUs {
+		b := m.boot[ix]
+		c.G, c.IC, c.PS, c.MIR, c.CC = b.G, b.IC, b.PS, b.MIR, b.CC
+		c.InterruptBase, c.InterruptMasked = b.InterruptBase, b.InterruptMasked
+	}
+	m.run(math.MaxUint64)
+	return nil
+}
+
+// Reset the CPUs and devices, stopping the clocks, dropping pending
+// interrupts and queued events, and forgetting the history, before
+// the registers are set again.
+func (m *Monitor) reset() {
+	for _, c := range m.Machine.CPUs {
+		c.Reset()
+		clearHistory(c)
+	}
+	for _, mod := range m.Machine.Modules {
+		if r, ok := mod.Backend.(device.Resetter); ok {
+			r.Reset()
+		}
+	}
+}
+
+// Forget what could be undone, as the CPU has been changed behind the
+// journal's back.
+func clearHistory(c *cpu.CPU) {
+	if c.Journal != nil {
+		c.Journal = cpu.NewJournal(c.Journal.Depth)
+	}
+}
+
+// Report where the current CPU is after going backwards.
+func (m *Monitor) position(what string) {
+	c := m.cpu()
+	fmt.Fprintf(m.out, "%s, IC: %s, instruction %x\n", what, m.where(c.IC), c.Journal.Count())
+}
+
+func (m *Monitor) backStep(args []string) error {
+	if m.cpu().Journal == nil {
+		return fmt.Errorf("CPU %d has no history, SET CPU HISTORY=n first", m.current)
+	}
+	n := uint64(1)
+	if len(args) > 1 {
+		return fmt.Errorf("BACKSTEP takes at most one count")
+	}
+	if len(args) == 1 {
+		v, err := parseNumber(args[0])
+		if err != nil || v == 0 {
+			return fmt.Errorf("Bad step count %s", args[0])
+		}
+		n = v
+	}
+	for ; n > 0; n-- {
+		if !m.cpu().StepBack() {
+			m.position("Start of history")
+			return nil
+		}
+	}
+	m.position("Step expired")
+	return nil
+}
+
+func (m *Monitor) rewind(args []string) error {
+	if m.cpu().Journal == nil {
+		return fmt.Errorf("CPU %d has no history, SET CPU HISTORY=n first", m.current)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("REWIND needs an address")
+	}
+	addr, err := m.parseAddress(args[0])
+	if err != nil {
+		return err
+	}
+	if m.cpu().StepBackToWrite(addr) {
+		m.position(fmt.Sprintf("Last write to %s", m.where(addr)))
+	} else {
+		m.position(fmt.Sprintf("No write to %s, start of history", m.where(addr)))
+	}
+	return nil
+}
+
+func (m *Monitor) seek(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("SEEK needs an instruction count")
+	}
+	n, err := parseNumber(args[0])
+	if err != nil {
+		return err
+	}
+	if err := m.cpu().Seek(n); err != nil {
+		return err
+	}
+	m.position("Seek complete")
+	return nil
+}
+
+func (m *Monitor) doCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("DO needs a file")
+	}
+	return m.Do(args[0])
+}
+
+func (m *Monitor) exit(args []string) error {
+	m.done = true
+	return nil
+}
+
+func (m *Monitor) help(args []string) error {
+	names := []string{}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(m.out, "Commands: %s\n", strings.Join(names, " "))
+	return nil
+}
@@ -0,0 +1,337 @@
+package monitor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/config"
+	"github.com/vatine/censor932/pkg/debuginfo"
+)
+
+// Build a monitor for two CPUs, each with 256 half-words of local
+// memory, sharing 16 half-words at 0x100.
+func newMonitor(t *testing.T) (*Monitor, *bytes.Buffer) {
+	cfg, err := config.Parse([]byte(`{
+	  "cpus": [
+	    {"local": [{"name": "ram0", "low": 0, "high": "0xff"}], "devices": [{"name": "rtc0", "type": "rtc", "low": "0x200"}]},
+	    {"local": [{"name": "ram1", "low": 0, "high": "0xff"}]}
+	  ],
+	  "shared": [{"name": "common", "low": "0x100", "high": "0x10f"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing, %v", err)
+	}
+	machine, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error building, %v", err)
+	}
+	var out bytes.Buffer
+	return New(machine, &out), &out
+}
+
+// Execute commands, failing on the first error.
+func execute(t *testing.T, m *Monitor, lines ...string) {
+	for _, l := range lines {
+		if err := m.Execute(l); err != nil {
+			t.Fatalf("Unexpected error from %q, %v", l, err)
+		}
+	}
+}
+
+func TestExamineDeposit(t *testing.T) {
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+
+	execute(t, m,
+		"dep 10 1234",
+		"d -w 12 56789abc",
+		"DEPOSIT G3 ffffffff ; a comment",
+		"dep cc 2",
+		"ex 10-13",
+		"e -w 12",
+		"exa g3 cc",
+	)
+	expected := "00010:\t1234\n00011:\t0000\n00012:\t5678\n00013:\t9abc\n00012:\t56789abc\nG3:\tffffffff\nCC:\t2\n"
+	if out.String() != expected {
+		t.Errorf("Output is %q, expected %q", out.String(), expected)
+	}
+
+	cases := []string{"dep 300 1", "dep 10 12345", "ex 10-", "frobnicate", "dep g16 0", "set cpu 2"}
+	for _, l := range cases {
+		if err := m.Execute(l); err == nil {
+			t.Errorf("Expected an error from %q", l)
+		}
+	}
+	// Without symbols, two numbers are a range, even backwards, rather
+	// than one subtracted from the other.
+	if err := m.Execute("ex 30-10"); err == nil || err.Error() != "Bad range 30-10" {
+		t.Errorf("Unexpected error from a reversed range, %v", err)
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+
+	execute(t, m,
+		"dep -w 0 98101234", // LD G1, 0x1234
+		"dep -w 2 50100100", // STW G1 -> 0x102
+		"dep -w 4 01300000", // JS G3, to itself
+		"set cpu 1",
+		"dep -w 0 01300000",
+		"set cpu 0",
+		"break 2",
+		"go",
+	)
+	if !strings.Contains(out.String(), "Breakpoint, CPU 0 IC: 00002") {
+		t.Errorf("Output %q does not report the breakpoint", out.String())
+	}
+
+	out.Reset()
+	execute(t, m, "step")
+	if !strings.Contains(out.String(), "Step expired, IC: 00004") {
+		t.Errorf("Output %q does not report the step", out.String())
+	}
+
+	out.Reset()
+	execute(t, m, "nobreak", "go", "set cpu 1", "ex -w 102")
+	if !strings.Contains(out.String(), "Halted, IC: 00004") {
+		t.Errorf("Output %q does not report the halt", out.String())
+	}
+	if !strings.Contains(out.String(), "00102:\t00001234") {
+		t.Errorf("CPU 1 does not see the store, output %q", out.String())
+	}
+
+	out.Reset()
+	execute(t, m, "set cpu 0", "boot")
+	if m.Machine.CPUs[0].IC != 4 || !strings.Contains(out.String(), "Halted") {
+		t.Errorf("BOOT left IC at %05x, output %q", m.Machine.CPUs[0].IC, out.String())
+	}
+
+	out.Reset()
+	execute(t, m, "dep -w 4 ff000000", "go 4")
+	if !strings.Contains(out.String(), "CPU 0 trapped: Non-existent instruction") {
+		t.Errorf("Output %q does not report the trap", out.String())
+	}
+}
+
+// BOOT starts the clock again, and forgets pending interrupts and
+// queued events.
+func TestBoot(t *testing.T) {
+	m, _ := newMonitor(t)
+	defer m.Machine.Close()
+
+	execute(t, m,
+		"dep -w 0 98101234", // LD G1, 0x1234
+		"dep -w 2 01300000", // JS G3, to itself
+		"dep -w e 20",       // Vector for level 3
+		"dep -w 20 01300000",
+		"set cpu 1",
+		"dep -w 0 01300000",
+		"set cpu 0",
+		"go",
+	)
+	c := m.Machine.CPUs[0]
+	cycles := c.Cycles
+
+	fired := false
+	c.Activate(1000, func(uint64) { fired = true })
+	c.Interrupt(3)
+	execute(t, m, "boot")
+	if c.Cycles != cycles {
+		t.Errorf("Cycles is %d after BOOT, expected %d", c.Cycles, cycles)
+	}
+	if fired {
+		t.Errorf("An event queued before BOOT ran after it")
+	}
+	if c.IC != 2 {
+		t.Errorf("IC is 0x%x after BOOT, expected 0x2", c.IC)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+
+	execute(t, m,
+		"dep -w 0 98101234", // LD G1, 0x1234
+		"dep -w 2 5010000e", // STW G1 -> 0x10
+		"dep -w 4 98105678", // LD G1, 0x5678
+		"dep -w 6 5010000a", // STW G1 -> 0x10
+		"dep -w 8 01300000", // JS G3, to itself
+		"set cpu 1",
+		"dep -w 0 01300000",
+	)
+	if err := m.Execute("backstep"); err == nil {
+		t.Errorf("Expected an error stepping back without history")
+	}
+	execute(t, m, "set cpu 0", "set cpu history=64", "step 5")
+
+	cases := []struct {
+		command string
+		output  string
+	}{
+		{"backstep", "Step expired, IC: 00008, instruction 4\n"},
+		{"rewind 10", "Last write to 00010, IC: 00006, instruction 3\n"},
+		{"ex -w 10", "00010:\t00001234\n"},
+		{"seek 1", "Seek complete, IC: 00002, instruction 1\n"},
+		{"seek 5", "Seek complete, IC: 00008, instruction 5\n"},
+		{"ex -w 10", "00010:\t00005678\n"},
+		{"rewind 20", "No write to 00020, start of history, IC: 00000, instruction 0\n"},
+		{"step", "Step expired, IC: 00002\n"},
+		{"ba 10", "Start of history, IC: 00000, instruction 0\n"},
+	}
+	for _, tc := range cases {
+		out.Reset()
+		execute(t, m, tc.command)
+		if out.String() != tc.output {
+			t.Errorf("Output of %q is %q, expected %q", tc.command, out.String(), tc.output)
+		}
+	}
+	if err := m.Execute("seek 10"); err != nil {
+		t.Errorf("Unexpected error seeking forward, %v", err)
+	}
+	execute(t, m, "set cpu history=2", "go 0")
+	if err := m.Execute("seek 1"); err == nil {
+		t.Errorf("Expected an error seeking past the history")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+
+	if err := m.Execute("show recorder"); err == nil {
+		t.Errorf("Expected an error showing a missing recorder")
+	}
+	execute(t, m,
+		"dep -w 0 98101234", // LD G1, 0x1234
+		"dep -w 2 ff000000",
+		"set cpu 1",
+		"dep -w 0 01300000",
+		"set cpu 0",
+		"set cpu recorder=8",
+		"go",
+	)
+	dump := "CPU 0 trapped: Non-existent instruction 0xff000000 at IC 0x00002, last 2 instructions:\n" +
+		"  00000 98101234 LD 1,0x1234              G1=00001234\n" +
+		"  00002 ff000000 .WORD 0xff000000\n"
+	if !strings.HasPrefix(out.String(), dump) {
+		t.Errorf("Output %q does not start with the recorder", out.String())
+	}
+	out.Reset()
+	execute(t, m, "show recorder")
+	if !strings.HasPrefix(out.String(), "CPU 0, last 2 instructions:\n") {
+		t.Errorf("SHOW RECORDER output %q", out.String())
+	}
+}
+
+func TestAttachAndDo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "ram.bin")
+	if err := config.WriteImage(image, []uint16{0x1111, 0x2222}); err != nil {
+		t.Fatalf("Unexpected error writing image, %v", err)
+	}
+	script := filepath.Join(dir, "script.do")
+	body := "attach ram0 " + image + "\ndep 2 3333\ndetach ram0\nshow memory\nexit\ndep 4 4444\n"
+	if err := ioutil.WriteFile(script, []byte(body), 0644); err != nil {
+		t.Fatalf("Unexpected error writing script, %v", err)
+	}
+
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+	execute(t, m, "do "+script)
+
+	if !m.Done() {
+		t.Errorf("EXIT in the script did not finish the monitor")
+	}
+	if h := m.Machine.CPUs[0].FetchHalfWord(4); h != 0 {
+		t.Errorf("Commands after EXIT were run")
+	}
+	data, err := config.ReadImage(image)
+	if err != nil {
+		t.Fatalf("Unexpected error reading image, %v", err)
+	}
+	if len(data) != 256 || data[0] != 0x1111 || data[1] != 0x2222 || data[2] != 0x3333 {
+		t.Errorf("Image after DETACH is %d half-words starting %x, expected 256 starting 1111 2222 3333", len(data), data[:3])
+	}
+	if !strings.Contains(out.String(), "ram0") || !strings.Contains(out.String(), "common") || strings.Contains(out.String(), "rtc0") {
+		t.Errorf("SHOW MEMORY output %q", out.String())
+	}
+	if err := m.Execute("attach rtc0 " + image); err == nil {
+		t.Errorf("Expected an error attaching to a device")
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	m, out := newMonitor(t)
+	defer m.Machine.Close()
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var info debuginfo.Info
+	info.AddSymbol(debuginfo.Symbol{Name: "START", Kind: debuginfo.Code})
+	info.AddSymbol(debuginfo.Symbol{Name: "DONE", Kind: debuginfo.Code, Value: 6})
+	info.AddSymbol(debuginfo.Symbol{Name: "COUNT", Kind: debuginfo.Data, Value: 0x40})
+	info.AddSymbol(debuginfo.Symbol{Name: "LIMIT", Kind: debuginfo.Data, Value: 0x42})
+	path := filepath.Join(dir, "test.dbg")
+	if err := info.Save(path); err != nil {
+		t.Fatalf("Unexpected error saving, %v", err)
+	}
+
+	execute(t, m,
+		"set cpu 1",
+		"dep -w 0 01300000",
+		"set cpu 0",
+		"symbols "+path,
+		"dep -w start 98101234",   // LD G1, 0x1234
+		"dep -w start+2 5010003e", // STW G1 -> COUNT
+		"dep -w done-2/2 0",       // NOP
+		"dep -w done 01300000",    // JS G3, to itself
+		"watch limit-1",
+		"break done",
+		"go",
+	)
+	if !strings.Contains(out.String(), "Watchpoint, CPU 0 wrote 00041 (COUNT+1), IC: 00004 (START+4)") {
+		t.Errorf("Output %q does not report the watchpoint", out.String())
+	}
+
+	out.Reset()
+	execute(t, m, "go", "show break", "ex count/2")
+	expected := "Breakpoint, CPU 0 IC: 00006 (DONE)\nCPU 0: 00006 (DONE)\n00040:\t0000\n00041:\t1234\n"
+	if out.String() != expected {
+		t.Errorf("Output is %q, expected %q", out.String(), expected)
+	}
+
+	out.Reset()
+	execute(t, m, "nowatch", "nobreak", "go start")
+	if !strings.Contains(out.String(), "Halted, IC: 00006 (DONE)") {
+		t.Errorf("Output %q does not report the halt", out.String())
+	}
+
+	// An address that subtracts is not a range.
+	out.Reset()
+	execute(t, m, "dep count-2 abcd", "ex count-2", "ex limit-4-count", "ex count-2/2")
+	expected = "0003e:\tabcd\n0003e:\tabcd\n0003f:\t0000\n00040:\t0000\n0003e:\tabcd\n0003f:\t0000\n"
+	if out.String() != expected {
+		t.Errorf("Output is %q, expected %q", out.String(), expected)
+	}
+
+	for _, l := range []string{"break nowhere", "break start-1", "ex nowhere-2", "ex 30-10", "symbols " + filepath.Join(dir, "missing")} {
+		if err := m.Execute(l); err == nil {
+			t.Errorf("Expected an error from %q", l)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package monitor
+
+// SAVE and RESTORE.
+//
+// A snapshot holds the registers and clocks of every CPU, and the
+// contents of every local and shared memory module, as JSON. ROMs
+// are not saved, as they cannot change. Nor are the internal state of
+// devices, pending interrupts or queued events. RESTORE resets the
+// CPUs and devices, as BOOT does, so a restored timer is disarmed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type cpuState struct {
+	G               [16]uint32 `json:"g"`
+	IC              uint32     `json:"ic"`
+	PS              uint64     `json:"ps"`
+	MIR             uint32     `json:"mir"`
+	CC              uint8      `json:"cc"`
+	Cycles          uint64     `json:"cycles"`
+	IdleCycles      uint64     `json:"idleCycles"`
+	InterruptBase   uint32     `json:"interruptBase"`
+	InterruptMasked uint16     `json:"interruptMasked"`
+}
+
+type snapshot struct {
+	CPUs   []cpuState          `json:"cpus"`
+	Memory map[string][]uint16 `json:"memory"` // By module name
+}
+
+// Take a snapshot of the machine.
+func (m *Monitor) snapshot() snapshot {
+	rv := snapshot{Memory: map[string][]uint16{}}
+	for _, c := range m.Machine.CPUs {
+		rv.CPUs = append(rv.CPUs, cpuState{
+			G:               c.G,
+			IC:              c.IC,
+			PS:              c.PS,
+			MIR:             c.MIR,
+			CC:              c.CC,
+			Cycles:          c.Cycles,
+			IdleCycles:      c.IdleCycles,
+			InterruptBase:   c.InterruptBase,
+			InterruptMasked: c.InterruptMasked,
+		})
+	}
+	for _, mod := range m.Machine.Modules {
+		if mod.Kind != "local" && mod.Kind != "shared" {
+			continue
+		}
+		if _, ok := rv.Memory[mod.Name]; !ok {
+			rv.Memory[mod.Name] = contents(mod)
+		}
+	}
+	return rv
+}
+
+func (m *Monitor) save(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("SAVE needs a file")
+	}
+	data, err := json.Marshal(m.snapshot())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(args[0], data, 0644)
+}
+
+func (m *Monitor) restore(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("RESTORE needs a file")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("Bad snapshot %s, %v", args[0], err)
+	}
+
+	// Check everything before changing anything.
+	if len(snap.CPUs) != len(m.Machine.CPUs) {
+		return fmt.Errorf("Snapshot %s has %d CPUs, the machine has %d", args[0], len(snap.CPUs), len(m.Machine.CPUs))
+	}
+	for name, contents := range snap.Memory {
+		mod, err := m.module(name)
+		if err != nil {
+			return fmt.Errorf("Snapshot %s: %v", args[0], err)
+		}
+		if uint32(len(contents)) != mod.Range.High-mod.Range.Low+1 {
+			return fmt.Errorf("Snapshot %s has %d half-words for module %s", args[0], len(contents), name)
+		}
+	}
+
+	m.reset()
+	for ix, c := range m.Machine.CPUs {
+		st := snap.CPUs[ix]
+		c.G, c.IC, c.PS, c.MIR, c.CC = st.G, st.IC, st.PS, st.MIR, st.CC
+		c.Cycles, c.IdleCycles = st.Cycles, st.IdleCycles
+		c.InterruptBase, c.InterruptMasked = st.InterruptBase, st.InterruptMasked
+	}
+	for name, contents := range snap.Memory {
+		mod, _ := m.module(name)
+		m.load(mod, contents)
+	}
+	return nil
+}
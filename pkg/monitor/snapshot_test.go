@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/config"
+)
+
+func TestSaveRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "932.save")
+
+	m, _ := newMonitor(t)
+	defer m.Machine.Close()
+
+	execute(t, m, "dep 10 1234", "dep 105 5678", "dep g1 42", "dep ic 20", "save "+path)
+	execute(t, m, "dep 10 0", "dep 105 0", "dep g1 0", "dep ic 0", "restore "+path)
+
+	c := m.Machine.CPUs[0]
+	if c.G[1] != 0x42 || c.IC != 0x20 {
+		t.Errorf("Restored G1 %x, IC %x, expected 42 and 20", c.G[1], c.IC)
+	}
+	if h := c.FetchHalfWord(0x10); h != 0x1234 {
+		t.Errorf("Restored local memory holds %04x, expected 1234", h)
+	}
+	if h := m.Machine.CPUs[1].FetchHalfWord(0x105); h != 0x5678 {
+		t.Errorf("Restored shared memory holds %04x, expected 5678", h)
+	}
+
+	if err := m.Execute("restore " + filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error restoring a missing file")
+	}
+}
+
+// A timer armed when the snapshot was taken, and firing after it,
+// does not fire again once the snapshot is restored.
+func TestRestoreTimer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "932.save")
+
+	cfg, err := config.Parse([]byte(`{
+	  "cpus": [{"local": [{"name": "ram", "low": 0, "high": "0xff"}], "devices": [{"name": "timer", "type": "timer", "low": "0x200", "level": 3}]}]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing, %v", err)
+	}
+	machine, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Unexpected error building, %v", err)
+	}
+	defer machine.Close()
+	m := New(machine, ioutil.Discard)
+	c := machine.CPUs[0]
+
+	execute(t, m,
+		"set cpu interruptbase=80",
+		"dep -w 0 01300000",  // JS G3, to itself
+		"dep -w 8e 20",       // Vector for level 3
+		"dep -w 20 98100001", // LD G1, 1
+		"dep -w 22 0138006a", // JS G3, *0x8c
+		"dep 202 1",          // Periodic
+		"dep -w 200 10",
+		"save "+path,
+		"step 10",
+	)
+	if c.G[1] != 1 {
+		t.Fatalf("The timer did not fire before RESTORE")
+	}
+	execute(t, m, "restore "+path, "step 100")
+	if c.G[1] != 0 {
+		t.Errorf("The timer fired after RESTORE")
+	}
+	if v, _ := c.PeekWord(0x200); v != 0 {
+		t.Errorf("The timer has 0x%x ticks left after RESTORE, expected it disarmed", v)
+	}
+}
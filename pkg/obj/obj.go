@@ -0,0 +1,195 @@
+// The obj package defines the relocatable object format, written by
+// c932as -c and combined into an image by c932ld.
+//
+// An object is a JSON file. It holds sections of half-words, each
+// placed by the linker as a whole into local memory, or into shared
+// memory for a shared section. Sections with the same name in
+// different objects are placed one after the other. Symbols are
+// offsets into a section, or absolute values, and are local to the
+// object unless they are global. Relocations say where a section
+// refers to a symbol, or to an address in one of the object's own
+// sections, whose address is not known until link time:
+//
+//	{
+//	  "source": "main.s",
+//	  "sections": [
+//	    {"name": "text", "data": [22544, 0, 304, 0],
+//	     "relocations": [{"offset": 1, "kind": "relative16", "symbol": "COUNT"}]}
+//	  ],
+//	  "symbols": [{"name": "START", "kind": "code", "section": "text", "value": 0, "global": true}],
+//	  "lines": [{"file": "main.s", "line": 3, "section": "text", "offset": 0}]
+//	}
+//
+// Here, LW 1,COUNT refers to COUNT, defined in another object.
+package obj
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/vatine/censor932/pkg/debuginfo"
+)
+
+// How a relocation patches a section.
+type RelocationKind string
+
+const (
+	// The address field of a type1 or type2 instruction, at Offset,
+	// which holds the target relative to the instruction at Offset-1.
+	Relative16 RelocationKind = "relative16"
+	// A 16-bit value at Offset, such as the d field of a type3
+	// instruction or a .HALF.
+	Absolute16 RelocationKind = "absolute16"
+	// A 32-bit value in the two half-words at Offset, such as a .WORD.
+	Absolute32 RelocationKind = "absolute32"
+)
+
+// A reference to an address, to be filled in by the linker. The
+// target is the address of Symbol, or of the start of Section, plus
+// Addend. If neither is given, Addend is an absolute address.
+type Relocation struct {
+	Offset  uint32         `json:"offset"`
+	Kind    RelocationKind `json:"kind"`
+	Section string         `json:"section,omitempty"`
+	Symbol  string         `json:"symbol,omitempty"`
+	Addend  int64          `json:"addend,omitempty"`
+}
+
+// A block of half-words, placed by the linker.
+type Section struct {
+	Name        string       `json:"name"`
+	Shared      bool         `json:"shared,omitempty"`
+	Data        []uint16     `json:"data"`
+	Relocations []Relocation `json:"relocations,omitempty"`
+}
+
+// A symbol defined by an object. Value is an offset into Section, or
+// an absolute value if Section is empty.
+type Symbol struct {
+	Name    string               `json:"name"`
+	Kind    debuginfo.SymbolKind `json:"kind"`
+	Section string               `json:"section,omitempty"`
+	Value   uint32               `json:"value"`
+	Global  bool                 `json:"global,omitempty"`
+	Line    int                  `json:"line,omitempty"`
+}
+
+// Where the code of a source line went.
+type Line struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Section string `json:"section"`
+	Offset  uint32 `json:"offset"`
+}
+
+// A relocatable object.
+type Object struct {
+	Source   string    `json:"source"`
+	Sections []Section `json:"sections"`
+	Symbols  []Symbol  `json:"symbols"`
+	Lines    []Line    `json:"lines,omitempty"`
+}
+
+// Return a section by name.
+func (o *Object) Section(name string) (*Section, bool) {
+	for ix := range o.Sections {
+		if o.Sections[ix].Name == name {
+			return &o.Sections[ix], true
+		}
+	}
+	return nil, false
+}
+
+// Check that sections and symbols are unique, and that everything
+// refers to sections that exist and stays inside them.
+func (o *Object) Check() error {
+	sizes := map[string]uint32{}
+	for _, s := range o.Sections {
+		if _, ok := sizes[s.Name]; ok {
+			return fmt.Errorf("Section %s appears twice", s.Name)
+		}
+		sizes[s.Name] = uint32(len(s.Data))
+	}
+	inside := func(section string, offset, n uint32) error {
+		size, ok := sizes[section]
+		switch {
+		case !ok:
+			return fmt.Errorf("No section %s", section)
+		case uint64(offset)+uint64(n) > uint64(size):
+			return fmt.Errorf("Offset 0x%x is outside section %s", offset, section)
+		}
+		return nil
+	}
+	names := map[string]bool{}
+	for _, sym := range o.Symbols {
+		if names[sym.Name] {
+			return fmt.Errorf("Symbol %s defined twice", sym.Name)
+		}
+		names[sym.Name] = true
+		if sym.Section != "" {
+			// A label can be at the very end of a section.
+			if err := inside(sym.Section, sym.Value, 0); err != nil {
+				return fmt.Errorf("Symbol %s: %v", sym.Name, err)
+			}
+		}
+	}
+	for _, s := range o.Sections {
+		for _, r := range s.Relocations {
+			n := uint32(1)
+			switch r.Kind {
+			case Relative16:
+				if r.Offset == 0 {
+					return fmt.Errorf("Relocation at %s+0: no instruction before it", s.Name)
+				}
+			case Absolute16:
+			case Absolute32:
+				n = 2
+			default:
+				return fmt.Errorf("Unknown relocation kind %q", r.Kind)
+			}
+			if err := inside(s.Name, r.Offset, n); err != nil {
+				return fmt.Errorf("Relocation: %v", err)
+			}
+			if r.Section != "" && r.Symbol != "" {
+				return fmt.Errorf("Relocation at %s+0x%x is relative to both a section and a symbol", s.Name, r.Offset)
+			}
+			if r.Section != "" {
+				if _, ok := sizes[r.Section]; !ok {
+					return fmt.Errorf("Relocation at %s+0x%x refers to missing section %s", s.Name, r.Offset, r.Section)
+				}
+			}
+		}
+	}
+	for _, l := range o.Lines {
+		if err := inside(l.Section, l.Offset, 0); err != nil {
+			return fmt.Errorf("Line %d: %v", l.Line, err)
+		}
+	}
+	return nil
+}
+
+// Load and check an object.
+func Load(path string) (*Object, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var o Object
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := o.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &o, nil
+}
+
+// Write an object.
+func (o *Object) Save(path string) error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
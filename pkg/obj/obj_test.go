@@ -0,0 +1,83 @@
+package obj
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/debuginfo"
+)
+
+func testObject() *Object {
+	return &Object{
+		Source: "main.s",
+		Sections: []Section{
+			{Name: "text", Data: []uint16{0x5810, 0, 0x0130, 0}, Relocations: []Relocation{
+				{Offset: 1, Kind: Relative16, Symbol: "COUNT"},
+			}},
+			{Name: "common", Shared: true, Data: []uint16{0, 0}, Relocations: []Relocation{
+				{Offset: 0, Kind: Absolute32, Section: "text", Addend: 2},
+			}},
+		},
+		Symbols: []Symbol{
+			{Name: "START", Kind: debuginfo.Code, Section: "text", Global: true, Line: 1},
+			{Name: "SIZE", Kind: debuginfo.Constant, Value: 4},
+		},
+		Lines: []Line{{File: "main.s", Line: 1, Section: "text"}},
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "obj")
+	if err != nil {
+		t.Fatalf("Unexpected error creating directory, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := testObject()
+	path := filepath.Join(dir, "main.o")
+	if err := o.Save(path); err != nil {
+		t.Fatalf("Unexpected error saving, %v", err)
+	}
+	seen, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading, %v", err)
+	}
+	if !reflect.DeepEqual(seen, o) {
+		t.Errorf("Loaded %+v, expected %+v", seen, o)
+	}
+	if s, ok := seen.Section("common"); !ok || !s.Shared {
+		t.Errorf("Section common is %+v", s)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		change   func(o *Object)
+		expected string
+	}{
+		{func(o *Object) { o.Sections[1].Name = "text" }, "Section text appears twice"},
+		{func(o *Object) { o.Symbols[1].Name = "START" }, "Symbol START defined twice"},
+		{func(o *Object) { o.Symbols[0].Value = 5 }, "Symbol START: Offset 0x5 is outside section text"},
+		{func(o *Object) { o.Symbols[0].Section = "data" }, "Symbol START: No section data"},
+		{func(o *Object) { o.Sections[0].Relocations[0].Offset = 0 }, "no instruction before it"},
+		{func(o *Object) { o.Sections[1].Relocations[0].Offset = 1 }, "Offset 0x1 is outside section common"},
+		{func(o *Object) { o.Sections[1].Relocations[0].Kind = "frob" }, "Unknown relocation kind"},
+		{func(o *Object) { o.Sections[1].Relocations[0].Symbol = "START" }, "both a section and a symbol"},
+		{func(o *Object) { o.Sections[1].Relocations[0].Section = "data" }, "missing section data"},
+		{func(o *Object) { o.Lines[0].Section = "data" }, "Line 1: No section data"},
+	}
+	if err := testObject().Check(); err != nil {
+		t.Errorf("Unexpected error checking, %v", err)
+	}
+	for ix, tc := range cases {
+		o := testObject()
+		tc.change(o)
+		if err := o.Check(); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Case #%d, error %v, expected %q", ix, err, tc.expected)
+		}
+	}
+}
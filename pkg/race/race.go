@@ -0,0 +1,210 @@
+// The race package finds data races in guest programs running on
+// several CPUs sharing memory.
+//
+// The Detector is a shared.Observer, so it sees every access to a
+// SharedMemory in the order the accesses happen. It tracks a
+// happens-before relation between the CPUs using vector clocks. The
+// only synchronisation the Censor 932 offers between CPUs is the
+// indivisible interchange of a register and memory (IW and IH), so
+// an interchange on a half-word is treated as releasing everything
+// the interchanging CPU has done so far to that half-word, and
+// acquiring everything previously released to it.
+//
+// Two accesses to the same half-word, from different CPUs, at least
+// one of which is a write, and where neither happens before the
+// other, are reported as a race. A write held in a store buffer
+// counts from when it was made, so its commit is ignored.
+package race
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/shared"
+)
+
+// A vector clock, mapping CPU IDs to logical time.
+type vectorClock map[int]uint64
+
+func (v vectorClock) copy() vectorClock {
+	rv := vectorClock{}
+	for k, t := range v {
+		rv[k] = t
+	}
+	return rv
+}
+
+// Update v to be the element-wise maximum of v and o.
+func (v vectorClock) join(o vectorClock) {
+	for k, t := range o {
+		if t > v[k] {
+			v[k] = t
+		}
+	}
+}
+
+// One side of a race.
+type Access struct {
+	CPU   int
+	IC    uint32
+	Word  uint32
+	Write bool
+	clock uint64
+}
+
+func (a Access) String() string {
+	kind := "read"
+	if a.Write {
+		kind = "write"
+	}
+	return fmt.Sprintf("CPU %d %s at IC 0x%05x (%08x)", a.CPU, kind, a.IC, a.Word)
+}
+
+// A race between two accesses to the same half-word.
+type Report struct {
+	Addr     uint32
+	Previous Access
+	Current  Access
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("Race on 0x%05x: %v and %v", r.Addr, r.Previous, r.Current)
+}
+
+// The access history of a single half-word.
+type shadow struct {
+	write *Access
+	reads map[int]Access
+}
+
+// A happens-before data race detector.
+type Detector struct {
+	lock    sync.Mutex
+	clocks  map[int]vectorClock
+	syncs   map[uint32]vectorClock
+	shadows map[uint32]*shadow
+	seen    map[[3]uint32]bool
+	reports []Report
+	// If set, called (from the memory backend goroutine) for each
+	// new race.
+	OnRace func(Report)
+}
+
+func NewDetector() *Detector {
+	return &Detector{
+		clocks:  map[int]vectorClock{},
+		syncs:   map[uint32]vectorClock{},
+		shadows: map[uint32]*shadow{},
+		seen:    map[[3]uint32]bool{},
+	}
+}
+
+// Return the vector clock of a CPU, creating it if needed.
+func (d *Detector) clock(id int) vectorClock {
+	vc, ok := d.clocks[id]
+	if !ok {
+		vc = vectorClock{id: 1}
+		d.clocks[id] = vc
+	}
+	return vc
+}
+
+func (d *Detector) Observe(e shared.Event) {
+	if e.Commit {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := uint32(1)
+	if e.Op == "FetchWord" || e.Op == "WriteWord" {
+		n = 2
+	}
+
+	vc := d.clock(e.CPU)
+	if e.Kind == cpu.Interchange {
+		for addr := e.Addr; addr < e.Addr+n; addr++ {
+			d.interchange(vc, addr)
+		}
+		vc[e.CPU]++
+		return
+	}
+
+	current := Access{
+		CPU:   e.CPU,
+		IC:    e.IC,
+		Word:  e.Word,
+		Write: e.Op == "WriteWord" || e.Op == "WriteHalfWord",
+		clock: vc[e.CPU],
+	}
+	for addr := e.Addr; addr < e.Addr+n; addr++ {
+		d.access(vc, addr, current)
+	}
+}
+
+// Acquire whatever was released to addr, then release everything to it.
+func (d *Detector) interchange(vc vectorClock, addr uint32) {
+	if l, ok := d.syncs[addr]; ok {
+		vc.join(l)
+	}
+	d.syncs[addr] = vc.copy()
+}
+
+// Check an access against the history of addr, then record it.
+func (d *Detector) access(vc vectorClock, addr uint32, current Access) {
+	sh, ok := d.shadows[addr]
+	if !ok {
+		sh = &shadow{reads: map[int]Access{}}
+		d.shadows[addr] = sh
+	}
+
+	if w := sh.write; w != nil && concurrent(vc, *w, current) {
+		d.report(addr, *w, current)
+	}
+	if !current.Write {
+		sh.reads[current.CPU] = current
+		return
+	}
+	for _, r := range sh.reads {
+		if concurrent(vc, r, current) {
+			d.report(addr, r, current)
+		}
+	}
+	sh.write = &current
+	sh.reads = map[int]Access{}
+}
+
+// Is the previous access a made by another CPU than current, and not
+// known to happen before the current state of vc?
+func concurrent(vc vectorClock, a, current Access) bool {
+	return a.CPU != current.CPU && a.clock > vc[a.CPU]
+}
+
+func (d *Detector) report(addr uint32, previous, current Access) {
+	key := [3]uint32{addr, previous.IC, current.IC}
+	if d.seen[key] {
+		return
+	}
+	d.seen[key] = true
+	r := Report{Addr: addr, Previous: previous, Current: current}
+	d.reports = append(d.reports, r)
+	log.WithFields(log.Fields{
+		"addr":     addr,
+		"previous": previous,
+		"current":  current,
+	}).Warn("data race")
+	if d.OnRace != nil {
+		d.OnRace(r)
+	}
+}
+
+// Return the races found so far.
+func (d *Detector) Reports() []Report {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	rv := make([]Report, len(d.reports))
+	copy(rv, d.reports)
+	return rv
+}
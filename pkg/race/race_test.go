@@ -0,0 +1,76 @@
+package race
+
+import (
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/shared"
+	"github.com/vatine/censor932/pkg/system"
+)
+
+// Run two CPUs in lockstep, with 16 half-words of shared memory at
+// address 16, and return the races found.
+func runPrograms(t *testing.T, programs [2][]uint32, steps uint64) []Report {
+	s := system.NewSystem(system.Lockstep, 0)
+	for _, p := range programs {
+		c := cpu.NewCPU()
+		c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 15}, cpu.NewDirectMemory(16))
+		for ix, w := range p {
+			c.StoreWord(uint32(2*ix), w)
+		}
+		s.AddCPU(c)
+	}
+	m := shared.NewSharedMemory(16)
+	d := NewDetector()
+	m.Observe(d)
+	if err := s.AddSharedMemory(m, cpu.MemoryRange{Low: 16, High: 31}); err != nil {
+		t.Fatalf("Unexpected error adding shared memory, %v", err)
+	}
+	defer s.Close()
+
+	s.CPUs[0].G[1] = 1
+	s.Run(steps)
+	return d.Reports()
+}
+
+func TestRace(t *testing.T) {
+	reports := runPrograms(t, [2][]uint32{
+		{0x50100010},                         // STW G1 -> 16
+		{0x00000000, 0x00000000, 0x5820000c}, // NOP; NOP; LW G2 <- 16
+	}, 3)
+
+	if len(reports) != 2 {
+		t.Fatalf("Saw %d races, expected 2 (one per half-word)", len(reports))
+	}
+	r := reports[0]
+	if r.Addr != 0 {
+		t.Errorf("Race on address 0x%05x, expected 0", r.Addr)
+	}
+	if r.Previous.CPU != 0 || !r.Previous.Write || r.Previous.IC != 0 || r.Previous.Word != 0x50100010 {
+		t.Errorf("Unexpected previous access, %v", r.Previous)
+	}
+	if r.Current.CPU != 1 || r.Current.Write || r.Current.IC != 4 || r.Current.Word != 0x5820000c {
+		t.Errorf("Unexpected current access, %v", r.Current)
+	}
+}
+
+func TestSynchronised(t *testing.T) {
+	reports := runPrograms(t, [2][]uint32{
+		{0x50100010, 0x5e300010},                         // STW G1 -> 16; IW G3 <-> 18
+		{0x00000000, 0x00000000, 0x5e30000e, 0x5820000a}, // NOP; NOP; IW G3 <-> 18; LW G2 <- 16
+	}, 4)
+
+	if len(reports) != 0 {
+		t.Errorf("Saw unexpected races, %v", reports)
+	}
+}
+
+func TestInterchangeIsNotARace(t *testing.T) {
+	d := NewDetector()
+	d.Observe(shared.Event{CPU: 0, Kind: cpu.Interchange, Op: "WriteWord", Addr: 2})
+	d.Observe(shared.Event{CPU: 1, Kind: cpu.Interchange, Op: "WriteWord", Addr: 2})
+
+	if len(d.Reports()) != 0 {
+		t.Errorf("Saw unexpected races, %v", d.Reports())
+	}
+}
@@ -0,0 +1,243 @@
+package shared
+
+// Memory consistency models for a SharedMemory.
+//
+// By default, a SharedMemory is sequentially consistent: every write
+// is visible to all requesters as soon as it has been made. Real
+// multi-port memory controllers may buffer writes, so a CPU can see
+// its own writes before the other CPUs do, and writes to different
+// addresses can become visible in a different order than they were
+// made. To let guest synchronisation code be tested against that,
+// a SharedMemory can be switched to a weaker model, in which data
+// writes from each requester go into a per-requester store buffer,
+// and are only written to memory after a delay.
+//
+// Observers are told about a buffered write when it is made, and
+// again when it is committed to memory (see Event).
+//
+// Delays are counted in accesses to the module, as that is the only
+// notion of time the module has. Requesters always see their own
+// buffered writes. An interchange (IW, IH) acts as a fence: the
+// requester's buffer is drained before the interchange is made.
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// How writes from a requester may be reordered.
+type Ordering int
+
+const (
+	// All writes are visible to everyone immediately.
+	SequentialConsistency Ordering = iota
+	// Writes are buffered, and drained to memory in the order they
+	// were made. Reads may pass buffered writes to other addresses.
+	TotalStoreOrder
+	// Writes are buffered, and writes to different addresses may
+	// drain to memory in any order.
+	PartialStoreOrder
+)
+
+// The consistency model of a SharedMemory.
+type Consistency struct {
+	Ordering Ordering
+	// Number of accesses to the module before a buffered write is
+	// drained to memory.
+	DrainDelay uint64
+	// Up to this many accesses are added, at random, to the delay
+	// of each write.
+	Jitter uint64
+	// Seed for the random jitter.
+	Seed int64
+}
+
+// A write waiting in a store buffer.
+type bufferedStore struct {
+	event Event
+	due   uint64
+}
+
+// Does the buffered write cover the half-word at addr?
+func (s bufferedStore) covers(addr uint32) bool {
+	if s.event.Op == "WriteWord" {
+		return s.event.Addr == addr || s.event.Addr+1 == addr
+	}
+	return s.event.Addr == addr
+}
+
+// Return the value the buffered write gives the half-word at addr.
+func (s bufferedStore) halfWord(addr uint32) uint16 {
+	if s.event.Op == "WriteWord" && s.event.Addr == addr {
+		return uint16(s.event.Value >> 16)
+	}
+	return uint16(s.event.Value)
+}
+
+// Change the value the buffered write gives the half-word at addr.
+func (s *bufferedStore) set(addr uint32, h uint16) {
+	switch {
+	case s.event.Op == "WriteWord" && s.event.Addr == addr:
+		s.event.Value = s.event.Value&0x0000ffff | uint32(h)<<16
+	case s.event.Op == "WriteWord":
+		s.event.Value = s.event.Value&0xffff0000 | uint32(h)
+	default:
+		s.event.Value = uint32(h)
+	}
+}
+
+// Do the two writes touch any half-word in common?
+func (s bufferedStore) overlaps(o bufferedStore) bool {
+	return o.covers(s.event.Addr) || (s.event.Op == "WriteWord" && o.covers(s.event.Addr+1))
+}
+
+type setConsistency struct {
+	model Consistency
+	ret   chan result
+}
+
+func (c setConsistency) execute(b *sharedMemoryBackend) {
+	b.flush()
+	b.model = c.model
+	b.rng = rand.New(rand.NewSource(c.model.Seed))
+	c.ret <- result{}
+}
+
+type flushBuffers struct {
+	ret chan result
+}
+
+func (c flushBuffers) execute(b *sharedMemoryBackend) {
+	b.flush()
+	c.ret <- result{}
+}
+
+// Change the consistency model of the shared memory. Any buffered
+// writes are drained first.
+func (s SharedMemory) SetConsistency(model Consistency) error {
+	c := make(chan result, 1)
+	_, err := s.do(setConsistency{model: model, ret: c}, c)
+	return err
+}
+
+// Drain all store buffers to memory.
+func (s SharedMemory) Flush() error {
+	c := make(chan result, 1)
+	_, err := s.do(flushBuffers{ret: c}, c)
+	return err
+}
+
+// Does a write from who go into a store buffer?
+func (b *sharedMemoryBackend) buffered(who cpu.Access) bool {
+	return b.model.Ordering != SequentialConsistency && who.Requester != Anonymous && who.Kind == cpu.DataWrite
+}
+
+// Move time forward for an access by who, draining any writes that
+// are due. An interchange first drains the requester's own buffer.
+// The access is also noted by the timing model, if any.
+func (b *sharedMemoryBackend) advance(who cpu.Access) {
+	b.tick++
+	if b.timing != nil {
+		b.timing.request(who.Requester)
+	}
+	if who.Kind == cpu.Interchange {
+		b.drainBuffer(who.Requester, true)
+	}
+	for _, id := range b.requesters() {
+		b.drainBuffer(id, false)
+	}
+}
+
+// Return the requesters with buffered writes, in a stable order.
+func (b *sharedMemoryBackend) requesters() []int {
+	rv := []int{}
+	for id := range b.buffers {
+		rv = append(rv, id)
+	}
+	sort.Ints(rv)
+	return rv
+}
+
+// Drain due writes (or all writes, if all is set) from the store
+// buffer of a requester.
+func (b *sharedMemoryBackend) drainBuffer(id int, all bool) {
+	buf := b.buffers[id]
+	for len(buf) > 0 {
+		pick := -1
+		switch {
+		case all || b.model.Ordering != PartialStoreOrder:
+			if all || buf[0].due <= b.tick {
+				pick = 0
+			}
+		default:
+			due := []int{}
+			for ix, s := range buf {
+				if s.due > b.tick {
+					continue
+				}
+				blocked := false
+				for _, earlier := range buf[:ix] {
+					if earlier.overlaps(s) {
+						blocked = true
+						break
+					}
+				}
+				if !blocked {
+					due = append(due, ix)
+				}
+			}
+			if len(due) > 0 {
+				pick = due[b.rng.Intn(len(due))]
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		s := buf[pick]
+		buf = append(buf[:pick], buf[pick+1:]...)
+		e := s.event
+		e.Commit = true
+		b.commit(e)
+	}
+	if len(buf) == 0 {
+		delete(b.buffers, id)
+	} else {
+		b.buffers[id] = buf
+	}
+}
+
+// Drain every store buffer.
+func (b *sharedMemoryBackend) flush() {
+	for _, id := range b.requesters() {
+		b.drainBuffer(id, true)
+	}
+}
+
+// Read a half-word as seen by who, that is, including its own
+// buffered writes.
+func (b *sharedMemoryBackend) load(who cpu.Access, addr uint32) uint16 {
+	buf := b.buffers[who.Requester]
+	for ix := len(buf) - 1; ix >= 0; ix-- {
+		if buf[ix].covers(addr) {
+			return buf[ix].halfWord(addr)
+		}
+	}
+	return b.memory[addr]
+}
+
+// Make a write, either directly or through the store buffer of the
+// requester.
+func (b *sharedMemoryBackend) store(who cpu.Access, e Event) {
+	if !b.buffered(who) {
+		b.commit(e)
+		return
+	}
+	delay := b.model.DrainDelay
+	if b.model.Jitter > 0 {
+		delay += uint64(b.rng.Int63n(int64(b.model.Jitter) + 1))
+	}
+	b.buffers[who.Requester] = append(b.buffers[who.Requester], bufferedStore{event: e, due: b.tick + delay})
+	b.notify(e)
+}
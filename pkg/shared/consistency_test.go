@@ -0,0 +1,205 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// The store-buffering litmus test: each requester writes one
+// location and then reads the other. Return what the two reads saw.
+func storeBuffering(s SharedMemory) (uint16, uint16) {
+	p0, p1 := s.Port(0), s.Port(1)
+	p0.WriteHalfWord(0, 1)
+	p1.WriteHalfWord(1, 1)
+	r0 := p0.FetchHalfWord(1)
+	r1 := p1.FetchHalfWord(0)
+	return r0, r1
+}
+
+func TestSequentialConsistency(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+
+	r0, r1 := storeBuffering(s)
+	if r0 != 1 || r1 != 1 {
+		t.Errorf("Saw %d and %d, expected 1 and 1", r0, r1)
+	}
+}
+
+func TestTotalStoreOrder(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+	s.SetConsistency(Consistency{Ordering: TotalStoreOrder, DrainDelay: 10})
+
+	r0, r1 := storeBuffering(s)
+	if r0 != 0 || r1 != 0 {
+		t.Errorf("Saw %d and %d, expected 0 and 0", r0, r1)
+	}
+
+	// A requester sees its own buffered writes.
+	if v := s.Port(0).FetchHalfWord(0); v != 1 {
+		t.Errorf("Requester 0 saw %d at 0, expected 1", v)
+	}
+
+	s.Flush()
+	if v := s.FetchHalfWord(1); v != 1 {
+		t.Errorf("Saw %d at 1 after Flush, expected 1", v)
+	}
+}
+
+func TestInterchangeFences(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+	s.SetConsistency(Consistency{Ordering: TotalStoreOrder, DrainDelay: 10})
+
+	p0 := s.Port(0)
+	p0.WriteHalfWord(0, 1)
+	p0.WriteHalfWordFor(cpu.Access{Kind: cpu.Interchange}, 2, 1)
+	if v := s.Port(1).FetchHalfWord(0); v != 1 {
+		t.Errorf("Saw %d at 0 after interchange, expected 1", v)
+	}
+}
+
+// Under partial store order, some seed should let a later write
+// become visible before an earlier one.
+func TestPartialStoreOrder(t *testing.T) {
+	reordered := false
+	for seed := int64(0); seed < 20 && !reordered; seed++ {
+		s := NewSharedMemory(4)
+		s.SetConsistency(Consistency{Ordering: PartialStoreOrder, DrainDelay: 1, Jitter: 8, Seed: seed})
+		p0, p1 := s.Port(0), s.Port(1)
+		p0.WriteHalfWord(0, 1)
+		p0.WriteHalfWord(1, 1)
+		for p1.FetchHalfWord(1) == 0 {
+		}
+		if p1.FetchHalfWord(0) == 0 {
+			reordered = true
+		}
+		s.Close()
+	}
+	if !reordered {
+		t.Errorf("Writes were never reordered")
+	}
+}
+
+// Buffered writes are seen by observers when they are made, and
+// again when they are committed.
+func TestObserveBuffered(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+	s.SetConsistency(Consistency{Ordering: TotalStoreOrder, DrainDelay: 10})
+	r := NewRecorder()
+	s.Observe(r)
+
+	s.Port(0).WriteHalfWord(0, 1)
+	expected := []Event{{CPU: 0, Kind: cpu.DataWrite, Op: "WriteHalfWord", Addr: 0, Value: 1}}
+	if !reflect.DeepEqual(r.Events(), expected) {
+		t.Errorf("Saw %+v when the write was made, expected %+v", r.Events(), expected)
+	}
+	s.Flush()
+	committed := expected[0]
+	committed.Commit = true
+	expected = append(expected, committed)
+	if !reflect.DeepEqual(r.Events(), expected) {
+		t.Errorf("Saw %+v after Flush, expected %+v", r.Events(), expected)
+	}
+}
+
+// A run under total store order replays, commits and all.
+func TestRecordReplayTSO(t *testing.T) {
+	model := Consistency{Ordering: TotalStoreOrder, DrainDelay: 3, Jitter: 4, Seed: 932}
+	s1 := NewSharedMemory(4)
+	defer s1.Close()
+	s1.SetConsistency(model)
+	r1 := NewRecorder()
+	s1.Observe(r1)
+	race(s1)
+	events := r1.Events()
+	commits := 0
+	for _, e := range events {
+		if e.Commit {
+			commits++
+		}
+	}
+	if commits == 0 || len(events)-commits != 200 {
+		t.Errorf("Saw %d accesses and %d commits, expected 200 accesses and some commits", len(events)-commits, commits)
+	}
+
+	for run := 0; run < 5; run++ {
+		s2 := NewSharedMemory(4)
+		s2.SetConsistency(model)
+		r2 := NewRecorder()
+		s2.Observe(r2)
+		s2.Replay(events)
+		race(s2)
+		if !reflect.DeepEqual(events, r2.Events()) {
+			t.Errorf("Run #%d, replayed events differ from the recorded ones", run)
+		}
+		s2.Close()
+	}
+}
+
+// A poke goes straight to memory, and changes any buffered write to
+// the same half-word, so that draining the buffer does not undo it.
+func TestPeekPoke(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+	s.SetConsistency(Consistency{Ordering: TotalStoreOrder, DrainDelay: 10})
+	r := NewRecorder()
+	s.Observe(r)
+	p := s.Port(0)
+
+	p.WriteWord(0, 0x11112222)
+	if h := p.PeekHalfWord(1); h != 0x2222 {
+		t.Errorf("Port 0 peeked 0x%04x, expected its buffered 0x2222", h)
+	}
+	if h := s.Port(1).PeekHalfWord(1); h != 0 {
+		t.Errorf("Port 1 peeked 0x%04x, expected 0", h)
+	}
+	p.PokeHalfWord(1, 0x3333)
+	p.PokeHalfWord(2, 0x4444)
+	if h := s.Port(1).PeekHalfWord(2); h != 0x4444 {
+		t.Errorf("Port 1 peeked 0x%04x, expected 0x4444", h)
+	}
+	if n := len(r.Events()); n != 1 {
+		t.Errorf("Observers saw %d events, expected only the write", n)
+	}
+	s.Flush()
+	if w, _ := s.TryFetchWord(0); w != 0x11113333 {
+		t.Errorf("Memory holds 0x%08x after draining, expected 0x11113333", w)
+	}
+}
+
+// Undoing a store puts the old value back without it being seen as a
+// write, and without the buffered store reaching memory later.
+func TestStepBackBuffered(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+	s.SetConsistency(Consistency{Ordering: TotalStoreOrder, DrainDelay: 10})
+	s.TryWriteHalfWord(1, 0x5555)
+	r := NewRecorder()
+	s.Observe(r)
+
+	c := cpu.NewCPU()
+	c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 15}, cpu.NewDirectMemory(16))
+	c.RegisterMemory(cpu.MemoryRange{Low: 16, High: 19}, s.Port(0))
+	c.StoreWord(0, 0x9810abcd) // LD G1, 0xabcd
+	c.StoreWord(2, 0x5010000e) // STW G1 -> 16
+	c.Journal = cpu.NewJournal(10)
+	c.Step()
+	c.Step()
+	c.StepBack()
+
+	if n := len(r.Events()); n != 1 {
+		t.Errorf("Observers saw %d events, expected only the write", n)
+	}
+	if w, _ := c.PeekWord(16); w != 0x00005555 {
+		t.Errorf("CPU sees 0x%08x after undoing, expected 0x00005555", w)
+	}
+	s.Flush()
+	if w, _ := s.TryFetchWord(0); w != 0x00005555 {
+		t.Errorf("Memory holds 0x%08x after draining, expected 0x00005555", w)
+	}
+}
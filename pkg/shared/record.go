@@ -0,0 +1,244 @@
+package shared
+
+// Recording and replaying the global order of accesses to a
+// SharedMemory.
+//
+// All accesses to a SharedMemory are executed, one at a time, by the
+// backend goroutine, so the order in which it executes them is the
+// order in which the CPUs sharing it "saw" each other. A Recorder
+// captures that order, and Replay forces a later run to execute the
+// accesses in the same order again, by holding back accesses from
+// any requester other than the one whose turn it is.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// A single completed access to a SharedMemory. For fetches, Value is
+// the value read, for writes (and interchanges) it is the value
+// written. IC and Word are the location and contents of the
+// instruction making the access, if known.
+//
+// A write that goes into a store buffer (see consistency.go) is seen
+// twice: when it is made, and again, with Commit set, when it reaches
+// memory and the other requesters can see it. The commit is not an
+// access of its own, so a replay does not wait for it.
+type Event struct {
+	CPU    int            `json:"cpu"`
+	Kind   cpu.AccessKind `json:"kind"`
+	Op     string         `json:"op"`
+	Addr   uint32         `json:"addr"`
+	Value  uint32         `json:"value"`
+	IC     uint32         `json:"ic"`
+	Word   uint32         `json:"word"`
+	Commit bool           `json:"commit,omitempty"`
+}
+
+// An Observer is told about every access to a SharedMemory, in the
+// order the accesses are executed. Observe is called from the backend
+// goroutine, so it must not itself access the SharedMemory.
+type Observer interface {
+	Observe(Event)
+}
+
+// A Recorder is an Observer keeping a log of all events.
+type Recorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Observe(e Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Return a copy of the events recorded so far.
+func (r *Recorder) Events() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rv := make([]Event, len(r.events))
+	copy(rv, r.events)
+	return rv
+}
+
+// Write the recorded events, one JSON object per line.
+func (r *Recorder) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range r.Events() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read events, as written by Recorder.Save.
+func LoadEvents(r io.Reader) ([]Event, error) {
+	var rv []Event
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, e)
+	}
+}
+
+// The state of an ongoing replay.
+type replay struct {
+	events  []Event
+	next    int
+	pending []access
+	expect  *Event
+}
+
+type addObserver struct {
+	observer Observer
+	ret      chan result
+}
+
+func (c addObserver) execute(b *sharedMemoryBackend) {
+	b.observers = append(b.observers, c.observer)
+	c.ret <- result{}
+}
+
+type startReplay struct {
+	events []Event
+	ret    chan result
+}
+
+func (c startReplay) execute(b *sharedMemoryBackend) {
+	b.replay = &replay{events: c.events}
+	c.ret <- result{}
+}
+
+type stopReplay struct {
+	ret chan result
+}
+
+func (c stopReplay) execute(b *sharedMemoryBackend) {
+	if b.replay != nil {
+		b.replay.events = nil
+		b.drain()
+	}
+	c.ret <- result{}
+}
+
+// Add an Observer, to be told about all subsequent accesses.
+func (s SharedMemory) Observe(o Observer) error {
+	c := make(chan result, 1)
+	_, err := s.do(addObserver{observer: o, ret: c}, c)
+	return err
+}
+
+// Force subsequent accesses to happen in the order given by
+// events. An access from a requester whose turn it is not is held
+// back until its turn comes. Once all events have been replayed,
+// accesses are executed in arrival order again.
+//
+// Replay only makes sense when the requesters run concurrently
+// (e.g. with system.Free scheduling); a single goroutine stepping
+// several CPUs will block on the first out-of-turn access. If a
+// requester never makes its expected access, StopReplay releases the
+// others.
+func (s SharedMemory) Replay(events []Event) error {
+	c := make(chan result, 1)
+	_, err := s.do(startReplay{events: events, ret: c}, c)
+	return err
+}
+
+// Abandon any ongoing replay, executing any held-back accesses.
+func (s SharedMemory) StopReplay() error {
+	c := make(chan result, 1)
+	_, err := s.do(stopReplay{ret: c}, c)
+	return err
+}
+
+// Execute an op, unless a replay says it has to wait its turn.
+// Accesses out of range are never recorded, so they have no turn, and
+// fail straight away.
+func (b *sharedMemoryBackend) dispatch(cmd op) {
+	a, ok := cmd.(access)
+	if !ok || b.replay == nil {
+		cmd.execute(b)
+		return
+	}
+	if addr, n := a.span(); b.check(addr, n) != nil {
+		cmd.execute(b)
+		return
+	}
+	b.replay.pending = append(b.replay.pending, a)
+	b.drain()
+}
+
+// Execute pending accesses for as long as the next one in the replay
+// has arrived. When the replay is exhausted, execute whatever is left
+// and go back to normal operation.
+func (b *sharedMemoryBackend) drain() {
+	for b.replay != nil {
+		r := b.replay
+		if r.next >= len(r.events) {
+			b.replay = nil
+			for _, a := range r.pending {
+				a.execute(b)
+			}
+			return
+		}
+
+		want := r.events[r.next]
+		if want.Commit {
+			// Made by the accesses around it.
+			r.next++
+			continue
+		}
+		found := -1
+		for ix, a := range r.pending {
+			if a.from() == want.CPU {
+				found = ix
+				break
+			}
+		}
+		if found < 0 {
+			return
+		}
+		a := r.pending[found]
+		r.pending = append(r.pending[:found], r.pending[found+1:]...)
+		r.next++
+		r.expect = &want
+		a.execute(b)
+		r.expect = nil
+	}
+}
+
+// Warn if an executed access is not the one the replay expected.
+func (b *sharedMemoryBackend) checkReplay(e Event) {
+	if b.replay == nil || b.replay.expect == nil || e.Commit {
+		return
+	}
+	want := b.replay.expect
+	if e.Op != want.Op || e.Addr != want.Addr {
+		log.WithFields(log.Fields{
+			"cpu":      e.CPU,
+			"op":       e.Op,
+			"addr":     e.Addr,
+			"expectOp": want.Op,
+			"expected": want.Addr,
+		}).Warn("replay diverged from recording")
+	}
+}
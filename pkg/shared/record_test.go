@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+// Have two requesters race writing to, and reading from, address 0.
+func race(s SharedMemory) {
+	raceWith(s, func(Port) {})
+}
+
+// The same, with something more done each time round.
+func raceWith(s SharedMemory, more func(Port)) {
+	var wg sync.WaitGroup
+	for id := 0; id < 2; id++ {
+		wg.Add(1)
+		go func(p Port) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				p.WriteHalfWord(0, uint16(p.Requester*100+n))
+				p.FetchHalfWord(0)
+				more(p)
+			}
+		}(s.Port(id))
+	}
+	wg.Wait()
+}
+
+func TestRecordReplay(t *testing.T) {
+	s1 := NewSharedMemory(4)
+	defer s1.Close()
+	r1 := NewRecorder()
+	s1.Observe(r1)
+	race(s1)
+
+	var buf bytes.Buffer
+	if err := r1.Save(&buf); err != nil {
+		t.Fatalf("Unexpected error saving recording, %v", err)
+	}
+	events, err := LoadEvents(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error loading recording, %v", err)
+	}
+	if !reflect.DeepEqual(events, r1.Events()) {
+		t.Fatalf("Loaded events differ from the saved ones")
+	}
+	if len(events) != 200 {
+		t.Errorf("Saw %d events, expected 200", len(events))
+	}
+
+	for run := 0; run < 5; run++ {
+		s2 := NewSharedMemory(4)
+		r2 := NewRecorder()
+		s2.Observe(r2)
+		s2.Replay(events)
+		race(s2)
+
+		if !reflect.DeepEqual(events, r2.Events()) {
+			t.Errorf("Run #%d, replayed events differ from the recorded ones", run)
+		}
+		if v1, v2 := s1.FetchHalfWord(0), s2.FetchHalfWord(0); v1 != v2 {
+			t.Errorf("Run #%d, final value 0x%04x, expected 0x%04x", run, v2, v1)
+		}
+		s2.Close()
+	}
+}
+
+// Accesses outside the memory are not recorded, and do not use up
+// the turn of anything that was.
+func TestReplayOutOfRange(t *testing.T) {
+	outside := func(p Port) {
+		a := cpu.Access{Requester: p.Requester, Kind: cpu.DataRead}
+		if _, err := p.memory.fetchHalfWord(a, 100); err == nil {
+			t.Errorf("Expected an error, reading outside the memory")
+		}
+	}
+	s1 := NewSharedMemory(4)
+	defer s1.Close()
+	r1 := NewRecorder()
+	s1.Observe(r1)
+	raceWith(s1, outside)
+	events := r1.Events()
+	if len(events) != 200 {
+		t.Errorf("Saw %d events, expected 200", len(events))
+	}
+
+	s2 := NewSharedMemory(4)
+	defer s2.Close()
+	r2 := NewRecorder()
+	s2.Observe(r2)
+	s2.Replay(events)
+	raceWith(s2, outside)
+	if !reflect.DeepEqual(events, r2.Events()) {
+		t.Errorf("Replayed events differ from the recorded ones")
+	}
+}
+
+func TestStopReplay(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+
+	// Requester 1 is expected first, but only requester 0 shows up.
+	s.Replay([]Event{{CPU: 1, Op: "WriteHalfWord", Addr: 0, Value: 1}})
+	done := make(chan uint16)
+	go func() {
+		done <- s.Port(0).FetchHalfWord(1)
+	}()
+	s.StopReplay()
+	<-done
+}
@@ -3,42 +3,143 @@ package shared
 // A memory backend designed to be attached to multiple CPUs a the same time.
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+
 	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+)
+
+var (
+	// Returned for any operation on a SharedMemory that has been closed.
+	ErrClosed = errors.New("shared memory closed")
+	// Returned (wrapped) for any access outside the shared memory.
+	ErrOutOfRange = errors.New("address out of range")
 )
 
 type op interface {
 	execute(*sharedMemoryBackend)
 }
 
+// An op that accesses memory on behalf of a specific requester.
+type access interface {
+	op
+	from() int
+	span() (addr, n uint32) // The half-words accessed
+}
+
+// The result of an operation, as passed back from the backend.
+type result struct {
+	value uint32
+	err   error
+}
+
 type SharedMemory struct {
-	cmd chan op
+	cmd     chan op
+	done    chan struct{}
+	stopped chan struct{}
+	once    *sync.Once
+	size    uint32
 }
 
 type sharedMemoryBackend struct {
-	memory []uint16
-	cmd    chan op
+	memory    []uint16
+	cmd       chan op
+	done      chan struct{}
+	stopped   chan struct{}
+	observers []Observer
+	replay    *replay
+	model     Consistency
+	buffers   map[int][]bufferedStore
+	tick      uint64
+	rng       *rand.Rand
+	timing    *timingState
 }
 
 type setHalfWord struct {
+	who   cpu.Access
 	addr  uint32
 	value uint16
-	ret   chan uint16
+	ret   chan result
 }
 
 type getHalfWord struct {
+	who  cpu.Access
 	addr uint32
-	ret  chan uint16
+	ret  chan result
+}
+
+// Debugger accesses, around the store buffers and observers.
+type peek struct {
+	requester int
+	addr      uint32
+	ret       chan result
+}
+
+type poke struct {
+	requester int
+	addr      uint32
+	value     uint16
+	ret       chan result
 }
 
 type setWord struct {
+	who   cpu.Access
 	addr  uint32
 	value uint32
-	ret   chan uint32
+	ret   chan result
 }
 
 type getWord struct {
+	who  cpu.Access
 	addr uint32
-	ret  chan uint32
+	ret  chan result
+}
+
+func (c setHalfWord) from() int { return c.who.Requester }
+func (c getHalfWord) from() int { return c.who.Requester }
+func (c setWord) from() int     { return c.who.Requester }
+func (c getWord) from() int     { return c.who.Requester }
+
+func (c setHalfWord) span() (uint32, uint32) { return c.addr, 1 }
+func (c getHalfWord) span() (uint32, uint32) { return c.addr, 1 }
+func (c setWord) span() (uint32, uint32)     { return c.addr, 2 }
+func (c getWord) span() (uint32, uint32)     { return c.addr, 2 }
+
+// Describe an access as an Event.
+func event(who cpu.Access, op string, addr, value uint32) Event {
+	return Event{CPU: who.Requester, Kind: who.Kind, IC: who.IC, Word: who.Word, Op: op, Addr: addr, Value: value}
+}
+
+// Write the value of a store event to memory, and tell the observers.
+func (b *sharedMemoryBackend) commit(e Event) {
+	if e.Op == "WriteWord" {
+		b.memory[e.Addr] = uint16((e.Value & 0xffff0000) >> 16)
+		b.memory[e.Addr+1] = uint16(e.Value & 0xffff)
+	} else {
+		b.memory[e.Addr] = uint16(e.Value)
+	}
+	b.notify(e)
+}
+
+// Pass a completed operation on to all observers.
+func (b *sharedMemoryBackend) notify(e Event) {
+	b.checkReplay(e)
+	for _, o := range b.observers {
+		o.Observe(e)
+	}
+}
+
+// Check that the n half-words starting at addr are all within the
+// backing store.
+func (b *sharedMemoryBackend) check(addr, n uint32) error {
+	size := uint32(len(b.memory))
+	if addr >= size || size-addr < n {
+		return fmt.Errorf("Address 0x%05x outside shared memory of size %d: %w", addr, size, ErrOutOfRange)
+	}
+	return nil
 }
 
 func (c getWord) execute(b *sharedMemoryBackend) {
@@ -47,10 +148,17 @@ func (c getWord) execute(b *sharedMemoryBackend) {
 		"op":   "get",
 	}
 	log.WithFields(fields).Debug("get value")
-	h0 := uint32(b.memory[c.addr])
-	h1 := uint32(b.memory[c.addr+1])
+	if err := b.check(c.addr, 2); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
+	b.advance(c.who)
+	h0 := uint32(b.load(c.who, c.addr))
+	h1 := uint32(b.load(c.who, c.addr+1))
 
-	c.ret <- ((h0 << 16) | h1)
+	rv := (h0 << 16) | h1
+	b.notify(event(c.who, "FetchWord", c.addr, rv))
+	c.ret <- result{value: rv}
 }
 
 func (c setWord) execute(b *sharedMemoryBackend) {
@@ -60,14 +168,17 @@ func (c setWord) execute(b *sharedMemoryBackend) {
 		"op":    "set",
 	}
 	log.WithFields(fields).Debug("set value")
-	h0 := uint32(b.memory[c.addr])
-	h1 := uint32(b.memory[c.addr+1])
+	if err := b.check(c.addr, 2); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
+	b.advance(c.who)
+	h0 := uint32(b.load(c.who, c.addr))
+	h1 := uint32(b.load(c.who, c.addr+1))
 
 	rv := (h0 << 16) | h1
-	b.memory[c.addr] = uint16((c.value & 0xffff0000) >> 16)
-	b.memory[c.addr+1] = uint16(c.value & 0xffff)
-
-	c.ret <- rv
+	b.store(c.who, event(c.who, "WriteWord", c.addr, c.value))
+	c.ret <- result{value: rv}
 }
 
 func (c getHalfWord) execute(b *sharedMemoryBackend) {
@@ -76,7 +187,14 @@ func (c getHalfWord) execute(b *sharedMemoryBackend) {
 		"op":   "getHalf",
 	}
 	log.WithFields(fields).Debug("get value")
-	c.ret <- b.memory[c.addr]
+	if err := b.check(c.addr, 1); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
+	b.advance(c.who)
+	rv := b.load(c.who, c.addr)
+	b.notify(event(c.who, "FetchHalfWord", c.addr, uint32(rv)))
+	c.ret <- result{value: uint32(rv)}
 }
 
 func (c setHalfWord) execute(b *sharedMemoryBackend) {
@@ -86,78 +204,298 @@ func (c setHalfWord) execute(b *sharedMemoryBackend) {
 		"op":    "setHalf",
 	}
 	log.WithFields(fields).Debug("set value")
-	rv := b.memory[c.addr]
+	if err := b.check(c.addr, 1); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
+	b.advance(c.who)
+	rv := b.load(c.who, c.addr)
+	b.store(c.who, event(c.who, "WriteHalfWord", c.addr, uint32(c.value)))
+	c.ret <- result{value: uint32(rv)}
+}
+
+func (c peek) execute(b *sharedMemoryBackend) {
+	if err := b.check(c.addr, 1); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
+	rv := b.load(cpu.Access{Requester: c.requester}, c.addr)
+	c.ret <- result{value: uint32(rv)}
+}
+
+// The buffered writes to the half-word are changed too, so that
+// draining them does not undo the poke.
+func (c poke) execute(b *sharedMemoryBackend) {
+	if err := b.check(c.addr, 1); err != nil {
+		c.ret <- result{err: err}
+		return
+	}
 	b.memory[c.addr] = c.value
-	c.ret <- rv
+	for _, buf := range b.buffers {
+		for ix := range buf {
+			if buf[ix].covers(c.addr) {
+				buf[ix].set(c.addr, c.value)
+			}
+		}
+	}
+	c.ret <- result{}
 }
 
 func (b *sharedMemoryBackend) run() {
-	for cmd := range b.cmd {
-		cmd.execute(b)
+	defer close(b.stopped)
+	for {
+		select {
+		case cmd := <-b.cmd:
+			b.dispatch(cmd)
+		case <-b.done:
+			return
+		}
 	}
 }
 
 func NewSharedMemory(size uint32) SharedMemory {
 	c := make(chan op)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 	store := make([]uint16, size)
-	backend := sharedMemoryBackend{cmd: c, memory: store}
+	backend := sharedMemoryBackend{cmd: c, memory: store, done: done, stopped: stopped, buffers: map[int][]bufferedStore{}}
 	go backend.run()
 
-	return SharedMemory{cmd: c}
+	return SharedMemory{cmd: c, done: done, stopped: stopped, once: &sync.Once{}, size: size}
+}
+
+// Return the size of the shared memory, in half-words.
+func (s SharedMemory) Size() uint32 {
+	return s.size
+}
+
+// Stop the backend goroutine and wait for it to exit. Any operation
+// after Close returns ErrClosed, as does any subsequent Close.
+func (s SharedMemory) Close() error {
+	err := ErrClosed
+	s.once.Do(func() {
+		close(s.done)
+		err = nil
+	})
+	<-s.stopped
+	return err
+}
+
+// Pass an operation to the backend and wait for the result.
+func (s SharedMemory) do(o op, ret chan result) (uint32, error) {
+	select {
+	case s.cmd <- o:
+	case <-s.done:
+		return 0, ErrClosed
+	}
+	r := <-ret
+	return r.value, r.err
+}
+
+// Retrieve a HalfWord, returning an error if the address is out of
+// range or the memory has been closed.
+func (s SharedMemory) TryFetchHalfWord(addr uint32) (uint16, error) {
+	return s.fetchHalfWord(cpu.Access{Requester: Anonymous, Kind: cpu.DataRead}, addr)
+}
+
+func (s SharedMemory) fetchHalfWord(who cpu.Access, addr uint32) (uint16, error) {
+	c := make(chan result, 1)
+	rv, err := s.do(getHalfWord{who: who, addr: addr, ret: c}, c)
+	return uint16(rv), err
+}
+
+// Retrieve a Word, returning an error if the address is out of range
+// or the memory has been closed.
+func (s SharedMemory) TryFetchWord(addr uint32) (uint32, error) {
+	return s.fetchWord(cpu.Access{Requester: Anonymous, Kind: cpu.DataRead}, addr)
+}
+
+func (s SharedMemory) fetchWord(who cpu.Access, addr uint32) (uint32, error) {
+	c := make(chan result, 1)
+	return s.do(getWord{who: who, addr: addr, ret: c}, c)
+}
+
+// Store a HalfWord, returning the previous value or an error if the
+// address is out of range or the memory has been closed.
+func (s SharedMemory) TryWriteHalfWord(addr uint32, data uint16) (uint16, error) {
+	return s.writeHalfWord(cpu.Access{Requester: Anonymous, Kind: cpu.DataWrite}, addr, data)
+}
+
+func (s SharedMemory) writeHalfWord(who cpu.Access, addr uint32, data uint16) (uint16, error) {
+	c := make(chan result, 1)
+	rv, err := s.do(setHalfWord{who: who, addr: addr, value: data, ret: c}, c)
+	return uint16(rv), err
+}
+
+// Store a Word, returning the previous value or an error if the
+// address is out of range or the memory has been closed.
+func (s SharedMemory) TryWriteWord(addr uint32, data uint32) (uint32, error) {
+	return s.writeWord(cpu.Access{Requester: Anonymous, Kind: cpu.DataWrite}, addr, data)
+}
+
+func (s SharedMemory) writeWord(who cpu.Access, addr uint32, data uint32) (uint32, error) {
+	c := make(chan result, 1)
+	return s.do(setWord{who: who, addr: addr, value: data, ret: c}, c)
 }
 
 func (s SharedMemory) FetchHalfWord(addr uint32) uint16 {
+	return s.Port(Anonymous).FetchHalfWord(addr)
+}
+
+func (s SharedMemory) PeekHalfWord(addr uint32) uint16 {
+	return s.Port(Anonymous).PeekHalfWord(addr)
+}
+
+func (s SharedMemory) PokeHalfWord(addr uint32, data uint16) {
+	s.Port(Anonymous).PokeHalfWord(addr, data)
+}
+
+func (s SharedMemory) FetchWord(addr uint32) uint32 {
+	return s.Port(Anonymous).FetchWord(addr)
+}
+
+func (s SharedMemory) WriteHalfWord(addr uint32, data uint16) uint16 {
+	return s.Port(Anonymous).WriteHalfWord(addr, data)
+}
+
+func (s SharedMemory) WriteWord(addr uint32, data uint32) uint32 {
+	return s.Port(Anonymous).WriteWord(addr, data)
+}
+
+// The TaggedMemoryBackend methods, attributing each access to the
+// requester in the passed-in Access.
+
+func (s SharedMemory) FetchHalfWordFor(a cpu.Access, addr uint32) uint16 {
+	return s.Port(a.Requester).FetchHalfWordFor(a, addr)
+}
+
+func (s SharedMemory) FetchWordFor(a cpu.Access, addr uint32) uint32 {
+	return s.Port(a.Requester).FetchWordFor(a, addr)
+}
+
+func (s SharedMemory) WriteHalfWordFor(a cpu.Access, addr uint32, data uint16) uint16 {
+	return s.Port(a.Requester).WriteHalfWordFor(a, addr, data)
+}
+
+func (s SharedMemory) WriteWordFor(a cpu.Access, addr uint32, data uint32) uint32 {
+	return s.Port(a.Requester).WriteWordFor(a, addr, data)
+}
+
+// The requester used for accesses made directly on a SharedMemory,
+// rather than through a Port.
+const Anonymous = -1
+
+// A Port is a connection to a SharedMemory on behalf of a specific
+// requester (usually a CPU), so that the backend can tell accesses
+// from different requesters apart, even when the CPU accessing it
+// does not identify itself.
+type Port struct {
+	memory    SharedMemory
+	Requester int
+}
+
+// Return a Port through which all accesses are attributed to the
+// given requester.
+func (s SharedMemory) Port(requester int) Port {
+	return Port{memory: s, Requester: requester}
+}
+
+func (p Port) FetchHalfWord(addr uint32) uint16 {
+	return p.FetchHalfWordFor(cpu.Access{Kind: cpu.DataRead}, addr)
+}
+
+func (p Port) FetchWord(addr uint32) uint32 {
+	return p.FetchWordFor(cpu.Access{Kind: cpu.DataRead}, addr)
+}
+
+func (p Port) WriteHalfWord(addr uint32, data uint16) uint16 {
+	return p.WriteHalfWordFor(cpu.Access{Kind: cpu.DataWrite}, addr, data)
+}
+
+func (p Port) WriteWord(addr uint32, data uint32) uint32 {
+	return p.WriteWordFor(cpu.Access{Kind: cpu.DataWrite}, addr, data)
+}
+
+// The DebugMemoryBackend methods. A peek sees what the requester
+// would, including its own buffered writes.
+
+func (p Port) PeekHalfWord(addr uint32) uint16 {
+	c := make(chan result, 1)
+	rv, err := p.memory.do(peek{requester: p.Requester, addr: addr, ret: c}, c)
+	if err != nil {
+		log.WithFields(log.Fields{"op": "PeekHalfWord", "addr": addr, "requester": p.Requester}).Error(err)
+	}
+	return uint16(rv)
+}
+
+func (p Port) PokeHalfWord(addr uint32, data uint16) {
+	c := make(chan result, 1)
+	_, err := p.memory.do(poke{requester: p.Requester, addr: addr, value: data, ret: c}, c)
+	if err != nil {
+		log.WithFields(log.Fields{"op": "PokeHalfWord", "addr": addr, "requester": p.Requester}).Error(err)
+	}
+}
+
+func (p Port) FetchHalfWordFor(a cpu.Access, addr uint32) uint16 {
+	a.Requester = p.Requester
 	fields := log.Fields{
-		"op":   "FetchHalfWord",
-		"addr": addr,
+		"op":        "FetchHalfWord",
+		"addr":      addr,
+		"requester": a.Requester,
+		"kind":      a.Kind,
 	}
 	log.WithFields(fields).Debug("thing")
-	c := make(chan uint16)
-	op := getHalfWord{addr: addr, ret: c}
-	s.cmd <- op
-	rv := <-c
-	close(c)
+	rv, err := p.memory.fetchHalfWord(a, addr)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+	}
 	return rv
 }
 
-func (s SharedMemory) FetchWord(addr uint32) uint32 {
+func (p Port) FetchWordFor(a cpu.Access, addr uint32) uint32 {
+	a.Requester = p.Requester
 	fields := log.Fields{
-		"op":   "FetchWord",
-		"addr": addr,
+		"op":        "FetchWord",
+		"addr":      addr,
+		"requester": a.Requester,
+		"kind":      a.Kind,
 	}
 	log.WithFields(fields).Debug("thing")
-	c := make(chan uint32)
-	op := getWord{addr: addr, ret: c}
-	s.cmd <- op
-	rv := <-c
-	close(c)
+	rv, err := p.memory.fetchWord(a, addr)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+	}
 	return rv
 }
 
-func (s SharedMemory) WriteHalfWord(addr uint32, data uint16) uint16 {
+func (p Port) WriteHalfWordFor(a cpu.Access, addr uint32, data uint16) uint16 {
+	a.Requester = p.Requester
 	fields := log.Fields{
-		"op":   "WriteHalfWord",
-		"addr": addr,
+		"op":        "WriteHalfWord",
+		"addr":      addr,
+		"requester": a.Requester,
+		"kind":      a.Kind,
 	}
 	log.WithFields(fields).Debug("thing")
-	c := make(chan uint16)
-	op := setHalfWord{addr: addr, value: data, ret: c}
-	s.cmd <- op
-	rv := <-c
-	close(c)
+	rv, err := p.memory.writeHalfWord(a, addr, data)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+	}
 	return rv
 }
 
-func (s SharedMemory) WriteWord(addr uint32, data uint32) uint32 {
-	c := make(chan uint32)
+func (p Port) WriteWordFor(a cpu.Access, addr uint32, data uint32) uint32 {
+	a.Requester = p.Requester
 	fields := log.Fields{
-		"op":   "c",
-		"addr": addr,
+		"op":        "WriteWord",
+		"addr":      addr,
+		"requester": a.Requester,
+		"kind":      a.Kind,
 	}
 	log.WithFields(fields).Debug("thing")
-	op := setWord{addr: addr, value: data, ret: c}
-	s.cmd <- op
-	rv := <-c
-	close(c)
+	rv, err := p.memory.writeWord(a, addr, data)
+	if err != nil {
+		log.WithFields(fields).Error(err)
+	}
 	return rv
 }
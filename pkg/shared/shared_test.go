@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/vatine/censor932/pkg/cpu"
@@ -8,6 +9,7 @@ import (
 
 func TestShared(t *testing.T) {
 	s := NewSharedMemory(16)
+	defer s.Close()
 
 	c1 := cpu.NewCPU()
 	c2 := cpu.NewCPU()
@@ -26,3 +28,54 @@ func TestShared(t *testing.T) {
 		t.Errorf("Expected 0x12345678, saw 0x%08x", v)
 	}
 }
+
+func TestSharedBounds(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+
+	if s.Size() != 4 {
+		t.Errorf("Expected size 4, saw %d", s.Size())
+	}
+
+	cases := []struct {
+		addr uint32
+		word bool
+		ok   bool
+	}{
+		{0, false, true},
+		{3, false, true},
+		{4, false, false},
+		{2, true, true},
+		{3, true, false},
+		{0xffffffff, true, false},
+	}
+
+	for ix, c := range cases {
+		var err error
+		if c.word {
+			_, err = s.TryWriteWord(c.addr, 0x12345678)
+		} else {
+			_, err = s.TryWriteHalfWord(c.addr, 0x1234)
+		}
+		switch {
+		case c.ok && err != nil:
+			t.Errorf("Case #%d, unexpected error %v", ix, err)
+		case !c.ok && !errors.Is(err, ErrOutOfRange):
+			t.Errorf("Case #%d, expected ErrOutOfRange, saw %v", ix, err)
+		}
+	}
+}
+
+func TestSharedClose(t *testing.T) {
+	s := NewSharedMemory(4)
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error from Close, %v", err)
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from second Close, saw %v", err)
+	}
+	if _, err := s.TryFetchWord(0); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, saw %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package shared
+
+// A timing model for a SharedMemory.
+//
+// The memory controllers of a Censor 932 installation arbitrate
+// between the CPUs connected to a module, so a CPU may have to wait
+// for its turn. The timing model divides time into memory cycles,
+// each ended by a call to Tick (the system package calls it once
+// per scheduling round). All accesses made during a cycle are
+// treated as simultaneous requests for the module's single port,
+// which serves them one at a time, in the order given by the
+// arbitration policy, each taking Latency cycles. Work that does not
+// fit into a cycle spills over into the next. The cycles a requester
+// waits, beyond the first, are its stall cycles, and are passed to
+// Timing.Stall.
+//
+// The timing model only affects statistics and stall accounting,
+// the accesses themselves are executed when they are made.
+
+import (
+	"sort"
+)
+
+// How a module picks which of several simultaneous requests to
+// serve first.
+type Arbitration int
+
+const (
+	// Requesters are served in the order of Timing.Priority, then by
+	// ascending ID.
+	FixedPriority Arbitration = iota
+	// Requesters take turns being served first.
+	RoundRobin
+)
+
+// The timing parameters of a SharedMemory.
+type Timing struct {
+	// Number of cycles the port is busy for each access.
+	Latency     uint64
+	Arbitration Arbitration
+	// Requester IDs, highest priority first, for FixedPriority.
+	Priority []int
+	// If set, called from the backend goroutine with the number of
+	// cycles a requester has stalled, at the end of each cycle.
+	Stall func(requester int, cycles uint64)
+}
+
+// Access statistics for one requester.
+type RequesterStatistics struct {
+	Accesses    uint64
+	Contended   uint64 // Accesses that had to wait for the port
+	StallCycles uint64
+}
+
+// Access statistics for a module.
+type Statistics struct {
+	Cycles      uint64
+	Accesses    uint64
+	BusyCycles  uint64
+	Contended   uint64
+	StallCycles uint64
+	Requesters  map[int]RequesterStatistics
+}
+
+// The timing state of a backend.
+type timingState struct {
+	timing  Timing
+	waiting []int  // Requesters of this cycle's accesses, in arrival order
+	backlog uint64 // Busy cycles carried over from earlier cycles
+	next    int    // The requester to favour next, for RoundRobin
+	stats   Statistics
+}
+
+type setTiming struct {
+	timing Timing
+	ret    chan result
+}
+
+func (c setTiming) execute(b *sharedMemoryBackend) {
+	b.timing = &timingState{timing: c.timing, stats: Statistics{Requesters: map[int]RequesterStatistics{}}}
+	c.ret <- result{}
+}
+
+type tick struct {
+	ret chan result
+}
+
+func (c tick) execute(b *sharedMemoryBackend) {
+	if b.timing != nil {
+		b.timing.endCycle()
+	}
+	c.ret <- result{}
+}
+
+type getStatistics struct {
+	ret   chan result
+	stats chan Statistics
+}
+
+func (c getStatistics) execute(b *sharedMemoryBackend) {
+	rv := Statistics{Requesters: map[int]RequesterStatistics{}}
+	if b.timing != nil {
+		rv = b.timing.stats
+		rv.Requesters = map[int]RequesterStatistics{}
+		for id, s := range b.timing.stats.Requesters {
+			rv.Requesters[id] = s
+		}
+	}
+	c.stats <- rv
+	c.ret <- result{}
+}
+
+// Enable the timing model, resetting all statistics.
+func (s SharedMemory) SetTiming(t Timing) error {
+	c := make(chan result, 1)
+	_, err := s.do(setTiming{timing: t, ret: c}, c)
+	return err
+}
+
+// End the current memory cycle.
+func (s SharedMemory) Tick() error {
+	c := make(chan result, 1)
+	_, err := s.do(tick{ret: c}, c)
+	return err
+}
+
+// Return the access statistics of the module. These are all zero
+// unless a timing model has been set.
+func (s SharedMemory) Statistics() (Statistics, error) {
+	c := make(chan result, 1)
+	stats := make(chan Statistics, 1)
+	if _, err := s.do(getStatistics{ret: c, stats: stats}, c); err != nil {
+		return Statistics{}, err
+	}
+	return <-stats, nil
+}
+
+// Note an access by requester in the current cycle.
+func (t *timingState) request(requester int) {
+	t.waiting = append(t.waiting, requester)
+}
+
+// Return the rank of a requester under FixedPriority; lower is served first.
+func (t *timingState) rank(requester int) int {
+	for ix, id := range t.timing.Priority {
+		if id == requester {
+			return ix
+		}
+	}
+	return len(t.timing.Priority)
+}
+
+// Return the requesters of this cycle in the order they are served.
+func (t *timingState) arbitrate() []int {
+	order := make([]int, len(t.waiting))
+	copy(order, t.waiting)
+
+	switch t.timing.Arbitration {
+	case RoundRobin:
+		// Requesters at or after t.next go first, in ID order, then
+		// the ones before it.
+		key := func(id int) int {
+			if id >= t.next {
+				return id - t.next
+			}
+			return id - t.next + 1<<30
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return key(order[i]) < key(order[j])
+		})
+		if len(order) > 0 {
+			t.next = order[0] + 1
+		}
+	default:
+		sort.SliceStable(order, func(i, j int) bool {
+			ri, rj := t.rank(order[i]), t.rank(order[j])
+			if ri != rj {
+				return ri < rj
+			}
+			return order[i] < order[j]
+		})
+	}
+	return order
+}
+
+// Serve this cycle's requests, account for the stalls and move on to
+// the next cycle.
+func (t *timingState) endCycle() {
+	stalls := map[int]uint64{}
+	now := t.backlog
+	for _, id := range t.arbitrate() {
+		stall := now
+		if t.timing.Latency > 1 {
+			stall += t.timing.Latency - 1
+		}
+		now += t.timing.Latency
+
+		rs := t.stats.Requesters[id]
+		rs.Accesses++
+		rs.StallCycles += stall
+		t.stats.Accesses++
+		t.stats.StallCycles += stall
+		t.stats.BusyCycles += t.timing.Latency
+		if now > t.timing.Latency {
+			rs.Contended++
+			t.stats.Contended++
+		}
+		t.stats.Requesters[id] = rs
+		stalls[id] += stall
+	}
+
+	t.backlog = 0
+	if now > 1 {
+		t.backlog = now - 1
+	}
+	t.waiting = t.waiting[:0]
+	t.stats.Cycles++
+
+	if t.timing.Stall != nil {
+		ids := []int{}
+		for id := range stalls {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			if stalls[id] > 0 {
+				t.timing.Stall(id, stalls[id])
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"testing"
+)
+
+func TestFixedPriority(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+
+	stalls := map[int]uint64{}
+	s.SetTiming(Timing{
+		Latency:     2,
+		Arbitration: FixedPriority,
+		Priority:    []int{1, 0},
+		Stall:       func(id int, cycles uint64) { stalls[id] += cycles },
+	})
+
+	s.Port(0).FetchHalfWord(0)
+	s.Port(1).FetchHalfWord(0)
+	s.Tick()
+
+	// Requester 1 goes first, and only waits for its own access.
+	if stalls[1] != 1 {
+		t.Errorf("Requester 1 stalled %d cycles, expected 1", stalls[1])
+	}
+	if stalls[0] != 3 {
+		t.Errorf("Requester 0 stalled %d cycles, expected 3", stalls[0])
+	}
+
+	stats, err := s.Statistics()
+	if err != nil {
+		t.Fatalf("Unexpected error, %v", err)
+	}
+	if stats.Accesses != 2 || stats.Contended != 1 || stats.BusyCycles != 4 || stats.StallCycles != 4 {
+		t.Errorf("Unexpected statistics, %+v", stats)
+	}
+	if rs := stats.Requesters[0]; rs.Accesses != 1 || rs.Contended != 1 {
+		t.Errorf("Unexpected statistics for requester 0, %+v", rs)
+	}
+
+	// The backlog of the previous cycle delays the next one.
+	s.Port(1).FetchHalfWord(0)
+	s.Tick()
+	if stalls[1] != 1+4 {
+		t.Errorf("Requester 1 stalled %d cycles, expected 5", stalls[1])
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s := NewSharedMemory(4)
+	defer s.Close()
+
+	first := []int{}
+	s.SetTiming(Timing{
+		Latency:     1,
+		Arbitration: RoundRobin,
+		Stall: func(id int, cycles uint64) {
+			// With a latency of 1, the requester served second
+			// is the only one stalling.
+			first = append(first, 1-id)
+		},
+	})
+
+	for n := 0; n < 4; n++ {
+		s.Port(0).FetchHalfWord(0)
+		s.Port(1).FetchHalfWord(0)
+		s.Tick()
+		// Let the backlog drain.
+		s.Tick()
+	}
+
+	expected := []int{0, 1, 0, 1}
+	if len(first) != len(expected) {
+		t.Fatalf("Saw %v, expected %v", first, expected)
+	}
+	for ix := range expected {
+		if first[ix] != expected[ix] {
+			t.Errorf("Cycle #%d, requester %d went first, expected %d", ix, first[ix], expected[ix])
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package system
+
+// Pacing the run loop against host wall time.
+//
+// By default a System runs as fast as the host allows. For
+// demonstrations, it can instead be throttled to approximately the
+// speed of the original hardware, given as a number of instructions
+// or cycles per second, per CPU. The run loop checks its progress
+// against the wall clock every so often, and sleeps whenever it is
+// ahead.
+
+import (
+	"time"
+)
+
+// What a pacing rate is counted in.
+type PaceUnit int
+
+const (
+	// Instructions executed by each CPU.
+	Instructions PaceUnit = iota
+	// Cycles of the virtual clock of each CPU.
+	Cycles
+)
+
+// How fast to run. A zero Rate means running freely.
+type Pacing struct {
+	Rate uint64 // Units per second
+	Unit PaceUnit
+}
+
+// The pacing state of a single run.
+type pacer struct {
+	rate     uint64
+	start    time.Time
+	base     uint64 // Progress when the run started
+	interval uint64 // How much progress to make between checks
+	checked  uint64 // Progress at the last check
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+func newPacer(rate, base uint64, now func() time.Time, sleep func(time.Duration)) *pacer {
+	interval := rate / 100
+	if interval == 0 {
+		interval = 1
+	}
+	return &pacer{
+		rate:     rate,
+		start:    now(),
+		base:     base,
+		interval: interval,
+		checked:  base,
+		now:      now,
+		sleep:    sleep,
+	}
+}
+
+// Sleep, if needed, so that the given progress is not made before
+// the wall clock says it should be.
+func (p *pacer) wait(progress uint64) {
+	if p == nil || p.rate == 0 || progress-p.checked < p.interval {
+		return
+	}
+	p.checked = progress
+	done := progress - p.base
+	target := p.start.Add(time.Duration(done/p.rate)*time.Second + time.Duration(done%p.rate)*time.Second/time.Duration(p.rate))
+	if d := target.Sub(p.now()); d > 0 {
+		p.sleep(d)
+	}
+}
+
+// Return a pacer for a run, or nil when running freely.
+func (s *System) pacer(base uint64) *pacer {
+	if s.Pacing.Rate == 0 {
+		return nil
+	}
+	now, sleep := s.now, s.sleep
+	if now == nil {
+		now = time.Now
+	}
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	return newPacer(s.Pacing.Rate, base, now, sleep)
+}
+
+// Return the progress of the system, in the pacing unit, given the
+// number of instructions executed per CPU. For cycles, the CPU
+// furthest ahead counts.
+func (s *System) progress(steps uint64) uint64 {
+	if s.Pacing.Unit != Cycles {
+		return steps
+	}
+	rv := uint64(0)
+	for _, c := range s.CPUs {
+		if c.Cycles > rv {
+			rv = c.Cycles
+		}
+	}
+	return rv
+}
@@ -0,0 +1,79 @@
+package system
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake wall clock, that only moves when slept on.
+type fakeClock struct {
+	lock  sync.Mutex
+	t     time.Time
+	slept time.Duration
+}
+
+func (f *fakeClock) now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) sleep(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.t = f.t.Add(d)
+	f.slept += d
+}
+
+// Make every CPU spin on a jump to itself, taking two cycles a step.
+func spin(s *System) {
+	for _, c := range s.CPUs {
+		c.StoreWord(0, 0x05f00000) // JC 15, 0
+		c.CC = 2
+	}
+}
+
+func TestPacingInstructions(t *testing.T) {
+	s := twoCPUs(t, Lockstep, 0)
+	defer s.Close()
+	clock := &fakeClock{}
+	s.now, s.sleep = clock.now, clock.sleep
+	spin(s)
+	s.Pacing = Pacing{Rate: 500, Unit: Instructions}
+
+	s.Run(1000)
+
+	if clock.slept != 2*time.Second {
+		t.Errorf("Slept %v, expected 2s", clock.slept)
+	}
+}
+
+func TestPacingCycles(t *testing.T) {
+	s := twoCPUs(t, Random, 1)
+	defer s.Close()
+	clock := &fakeClock{}
+	s.now, s.sleep = clock.now, clock.sleep
+	spin(s)
+	s.Pacing = Pacing{Rate: 1000, Unit: Cycles}
+
+	s.Run(500)
+
+	if clock.slept < 900*time.Millisecond || clock.slept > time.Second {
+		t.Errorf("Slept %v, expected about 1s", clock.slept)
+	}
+}
+
+func TestFreeRunning(t *testing.T) {
+	s := twoCPUs(t, Lockstep, 0)
+	defer s.Close()
+	clock := &fakeClock{}
+	s.now, s.sleep = clock.now, clock.sleep
+	spin(s)
+
+	s.Run(1000)
+
+	if clock.slept != 0 {
+		t.Errorf("Slept %v, expected no sleeping", clock.slept)
+	}
+}
@@ -0,0 +1,268 @@
+// The system package ties several CPUs and the memory modules they
+// share together, and runs them.
+//
+// A Censor 932 installation can have multiple CPUs, each with their
+// own local memory, connected to shared memory modules through
+// memory controllers. The System keeps track of the CPUs and the
+// shared modules, and steps the CPUs according to one of a few
+// scheduling policies, so that multiprocessor programs can be run
+// reproducibly.
+package system
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/shared"
+)
+
+// How the CPUs in a System are interleaved.
+type Scheduling int
+
+const (
+	// Step every CPU once per round, in the order they were added.
+	Lockstep Scheduling = iota
+	// Step one CPU at a time, picked by a pseudo-random generator
+	// seeded from System.Seed. The generator is kept from one run to
+	// the next, so a system run twice carries on the sequence rather
+	// than repeating it.
+	Random
+	// Run each CPU on its own goroutine, with no control over the
+	// interleaving. Memory cycles are only ended once all CPUs are
+	// done, so any timing model sees the whole run as one cycle; a
+	// shared module with a timing model needs Lockstep or Random.
+	Free
+)
+
+func (s Scheduling) String() string {
+	switch s {
+	case Lockstep:
+		return "lockstep"
+	case Random:
+		return "random"
+	case Free:
+		return "free"
+	}
+	return fmt.Sprintf("Scheduling(%d)", int(s))
+}
+
+// A collection of CPUs and the shared memory modules connecting them.
+type System struct {
+	CPUs       []*cpu.CPU
+	Modules    []shared.SharedMemory
+	Scheduling Scheduling
+	Seed       int64
+	Pacing     Pacing // Free running, unless set
+
+	rng   *rand.Rand          // For Random, made from Seed on first use
+	now   func() time.Time    // For tests, defaults to time.Now
+	sleep func(time.Duration) // For tests, defaults to time.Sleep
+}
+
+func NewSystem(scheduling Scheduling, seed int64) *System {
+	return &System{Scheduling: scheduling, Seed: seed}
+}
+
+// Add a CPU to the system, returning its index. The index also
+// becomes the CPU's ID.
+func (s *System) AddCPU(c *cpu.CPU) int {
+	c.ID = len(s.CPUs)
+	s.CPUs = append(s.CPUs, c)
+	return c.ID
+}
+
+// Add a shared memory module, registering it at the range r in the
+// address space of the listed CPUs (or all CPUs, if none are
+// listed). Each CPU is connected through its own Port, identified by
+// the CPU's index. Return an error if any of the registrations fail.
+func (s *System) AddSharedMemory(m shared.SharedMemory, r cpu.MemoryRange, cpus ...int) error {
+	if len(cpus) == 0 {
+		for ix := range s.CPUs {
+			cpus = append(cpus, ix)
+		}
+	}
+	for _, ix := range cpus {
+		if ix < 0 || ix >= len(s.CPUs) {
+			return fmt.Errorf("No CPU #%d in system", ix)
+		}
+		if err := s.CPUs[ix].RegisterMemory(r, m.Port(ix)); err != nil {
+			return err
+		}
+	}
+	s.Modules = append(s.Modules, m)
+	return nil
+}
+
+// Run every CPU in the system for the given number of steps.
+func (s *System) Run(steps uint64) {
+	s.RunUntil(steps, nil)
+}
+
+// Run every CPU in the system for up to the given number of steps.
+// If stop is not nil, it is called with each CPU after each of its
+// steps, and a CPU it returns true for is not stepped any further;
+// the run ends early once every CPU has stopped. Under Free
+// scheduling, stop is called from the goroutine of the CPU. Return
+// the most steps any CPU took.
+func (s *System) RunUntil(steps uint64, stop func(c *cpu.CPU) bool) uint64 {
+	fields := log.Fields{
+		"steps":      steps,
+		"scheduling": s.Scheduling,
+		"cpus":       len(s.CPUs),
+	}
+	log.WithFields(fields).Debug("System Run")
+
+	if stop == nil {
+		stop = func(*cpu.CPU) bool { return false }
+	}
+	switch s.Scheduling {
+	case Lockstep:
+		return s.runLockstep(steps, stop)
+	case Random:
+		return s.runRandom(steps, stop)
+	case Free:
+		return s.runFree(steps, stop)
+	}
+	log.WithFields(fields).Errorf("Unknown scheduling %v", s.Scheduling)
+	return 0
+}
+
+func (s *System) runLockstep(steps uint64, stop func(*cpu.CPU) bool) uint64 {
+	p := s.pacer(s.progress(0))
+	stopped := make([]bool, len(s.CPUs))
+	live := len(s.CPUs)
+	n := uint64(0)
+	for n < steps && live > 0 {
+		for ix, c := range s.CPUs {
+			if stopped[ix] {
+				continue
+			}
+			c.Step()
+			if stop(c) {
+				stopped[ix] = true
+				live--
+			}
+		}
+		n++
+		s.tick()
+		p.wait(s.progress(n))
+	}
+	return n
+}
+
+// End the memory cycle of every shared module.
+func (s *System) tick() {
+	for _, m := range s.Modules {
+		m.Tick()
+	}
+}
+
+// Pass stall cycles on to the CPU with the given index. Intended to
+// be used as shared.Timing.Stall for the modules in the system.
+func (s *System) Stall(requester int, cycles uint64) {
+	if requester >= 0 && requester < len(s.CPUs) {
+		s.CPUs[requester].Stall(cycles)
+	}
+}
+
+// Return the access statistics of each shared module.
+func (s *System) Statistics() ([]shared.Statistics, error) {
+	rv := []shared.Statistics{}
+	for _, m := range s.Modules {
+		st, err := m.Statistics()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, st)
+	}
+	return rv, nil
+}
+
+// Each step goes to one of the CPUs still running, picked at random.
+// A round, for the purpose of ending memory cycles, is as many steps
+// as there are CPUs.
+func (s *System) runRandom(steps uint64, stop func(*cpu.CPU) bool) uint64 {
+	if s.rng == nil {
+		s.rng = rand.New(rand.NewSource(s.Seed))
+	}
+	p := s.pacer(s.progress(0))
+	live := []int{}
+	if steps > 0 {
+		for ix := range s.CPUs {
+			live = append(live, ix)
+		}
+	}
+	taken := make([]uint64, len(s.CPUs))
+	most := uint64(0)
+	for n := uint64(1); len(live) > 0; n++ {
+		pick := s.rng.Intn(len(live))
+		ix := live[pick]
+		c := s.CPUs[ix]
+		c.Step()
+		taken[ix]++
+		if taken[ix] > most {
+			most = taken[ix]
+		}
+		if stop(c) || taken[ix] == steps {
+			live = append(live[:pick], live[pick+1:]...)
+		}
+		if n%uint64(len(s.CPUs)) == 0 {
+			s.tick()
+			p.wait(s.progress(n / uint64(len(s.CPUs))))
+		}
+	}
+	return most
+}
+
+// Ending a memory cycle stalls the CPUs that waited for it, so it is
+// only done once all the goroutines are finished.
+func (s *System) runFree(steps uint64, stop func(*cpu.CPU) bool) uint64 {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	most := uint64(0)
+	for _, c := range s.CPUs {
+		wg.Add(1)
+		go func(c *cpu.CPU) {
+			defer wg.Done()
+			progress := func(n uint64) uint64 {
+				if s.Pacing.Unit == Cycles {
+					return c.Cycles
+				}
+				return n
+			}
+			p := s.pacer(progress(0))
+			n := uint64(0)
+			for n < steps {
+				c.Step()
+				n++
+				p.wait(progress(n))
+				if stop(c) {
+					break
+				}
+			}
+			mu.Lock()
+			if n > most {
+				most = n
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	s.tick()
+	return most
+}
+
+// Close all shared memory modules in the system.
+func (s *System) Close() error {
+	var rv error
+	for _, m := range s.Modules {
+		if err := m.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
@@ -0,0 +1,154 @@
+package system
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/vatine/censor932/pkg/cpu"
+	"github.com/vatine/censor932/pkg/shared"
+)
+
+// Build a system with two CPUs, each with 16 half-words of local
+// memory, sharing 16 half-words at address 16.
+func twoCPUs(t *testing.T, scheduling Scheduling, seed int64) *System {
+	s := NewSystem(scheduling, seed)
+	for n := 0; n < 2; n++ {
+		c := cpu.NewCPU()
+		c.RegisterMemory(cpu.MemoryRange{Low: 0, High: 15}, cpu.NewDirectMemory(16))
+		s.AddCPU(c)
+	}
+	if err := s.AddSharedMemory(shared.NewSharedMemory(16), cpu.MemoryRange{Low: 16, High: 31}); err != nil {
+		t.Fatalf("Unexpected error adding shared memory, %v", err)
+	}
+	return s
+}
+
+func TestLockstep(t *testing.T) {
+	s := twoCPUs(t, Lockstep, 0)
+	defer s.Close()
+
+	// CPU 0: LD G1, 0x1234; STW G1 -> 16
+	s.CPUs[0].StoreWord(0, 0x98101234)
+	s.CPUs[0].StoreWord(2, 0x5010000e)
+	// CPU 1: NOP; LW G2 <- 16
+	s.CPUs[1].StoreWord(0, 0x00000000)
+	s.CPUs[1].StoreWord(2, 0x5820000e)
+
+	s.Run(2)
+
+	if s.CPUs[1].G[2] != 0x1234 {
+		t.Errorf("CPU 1 G[2] is 0x%08x, expected 0x00001234", s.CPUs[1].G[2])
+	}
+	for ix, c := range s.CPUs {
+		if c.IC != 4 {
+			t.Errorf("CPU %d IC is %d, expected 4", ix, c.IC)
+		}
+	}
+}
+
+// Return the order the CPUs of a system step in, over two runs.
+func randomOrder(t *testing.T, seed int64, steps uint64) ([]int, []int) {
+	s := twoCPUs(t, Random, seed)
+	defer s.Close()
+	orders := [][]int{}
+	for run := 0; run < 2; run++ {
+		order := []int{}
+		s.RunUntil(steps, func(c *cpu.CPU) bool {
+			order = append(order, c.ID)
+			return false
+		})
+		orders = append(orders, order)
+	}
+	return orders[0], orders[1]
+}
+
+func TestRandomOrder(t *testing.T) {
+	o1, o2 := randomOrder(t, 932, 10)
+	again1, again2 := randomOrder(t, 932, 10)
+	if !reflect.DeepEqual(o1, again1) || !reflect.DeepEqual(o2, again2) {
+		t.Errorf("Orders differ with the same seed, %v %v and %v %v", o1, o2, again1, again2)
+	}
+	if reflect.DeepEqual(o1, o2) {
+		t.Errorf("The second run repeats the first, %v", o1)
+	}
+
+	counts := make([]int, 2)
+	for _, ix := range o1 {
+		counts[ix]++
+	}
+	for ix, n := range counts {
+		if n != 10 {
+			t.Errorf("CPU %d stepped %d times, expected 10", ix, n)
+		}
+	}
+}
+
+// An unbounded run only goes on until the CPUs stop, without working
+// out anything for the steps it never takes.
+func TestRandomUnbounded(t *testing.T) {
+	s := twoCPUs(t, Random, 932)
+	defer s.Close()
+	n := s.RunUntil(math.MaxUint64, func(c *cpu.CPU) bool { return c.IC >= 12 })
+	if n != 6 {
+		t.Errorf("Most steps taken is %d, expected 6", n)
+	}
+	for ix, c := range s.CPUs {
+		if c.IC != 12 {
+			t.Errorf("CPU %d IC is %d, expected 12", ix, c.IC)
+		}
+	}
+}
+
+func TestFree(t *testing.T) {
+	s := twoCPUs(t, Free, 0)
+	defer s.Close()
+
+	s.Run(3)
+	for ix, c := range s.CPUs {
+		if c.IC != 6 {
+			t.Errorf("CPU %d IC is %d, expected 6", ix, c.IC)
+		}
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	for _, sch := range []Scheduling{Lockstep, Random, Free} {
+		s := twoCPUs(t, sch, 932)
+		// CPU 0 stops after 3 steps, CPU 1 after 5.
+		n := s.RunUntil(10, func(c *cpu.CPU) bool { return c.IC >= uint32(6+4*c.ID) })
+		if n != 5 {
+			t.Errorf("%v: most steps taken is %d, expected 5", sch, n)
+		}
+		for ix, c := range s.CPUs {
+			if c.IC != uint32(6+4*ix) {
+				t.Errorf("%v: CPU %d IC is %d, expected %d", sch, ix, c.IC, 6+4*ix)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestTiming(t *testing.T) {
+	s := twoCPUs(t, Lockstep, 0)
+	defer s.Close()
+	s.Modules[0].SetTiming(shared.Timing{Latency: 2, Stall: s.Stall})
+
+	// CPU 0: NOP; STW G1 -> 16
+	s.CPUs[0].StoreWord(2, 0x5010000e)
+	// CPU 1: NOP; LW G2 <- 16
+	s.CPUs[1].StoreWord(2, 0x5820000e)
+
+	s.Run(2)
+
+	if n := s.CPUs[0].Stalls(); n != 1 {
+		t.Errorf("CPU 0 stalled %d cycles, expected 1", n)
+	}
+	if n := s.CPUs[1].Stalls(); n != 3 {
+		t.Errorf("CPU 1 stalled %d cycles, expected 3", n)
+	}
+	stats, _ := s.Statistics()
+	if stats[0].Contended != 1 {
+		t.Errorf("Saw %d contended accesses, expected 1", stats[0].Contended)
+	}
+}